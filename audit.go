@@ -0,0 +1,88 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// AuditHook is called by the lock system after every script run, see
+// WithAuditHook. op is the name of the script, e.g. "create" or "unlock", and
+// args are its arguments with owner XML replaced by a placeholder. result is
+// "ok" if the script succeeded, the error code of a definitive failure, e.g.
+// "ERR_LOCKED" or "ERR_NO_SUCH_LOCK", or empty if the script could not run, in
+// which case err tells why.
+type AuditHook func(ctx context.Context, op string, args []interface{}, result string, err error)
+
+// WithContext returns a view of the lock system whose operations carry ctx,
+// sharing everything else with r, e.g. to pass the identity of the caller of a
+// request to the hook set with WithAuditHook. ctx also bounds how long the
+// scripts wait for a connection. The view is cheap to create per request.
+func (r *RedisLS) WithContext(ctx context.Context) *RedisLS {
+	if ctx == nil {
+		panic("webdavredisls: nil context")
+	}
+
+	view := *r
+	view.ctx = ctx
+	return &view
+}
+
+// context returns the context set with WithContext.
+func (r *RedisLS) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// audit calls the audit hook for a run of script. A panicking hook is logged
+// instead of failing the operation.
+func (r *RedisLS) audit(script *redis.Script, keysAndArgs []interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("webdavredisls: audit hook panicked: %v", p)
+		}
+	}()
+
+	r.auditHook(r.context(), r.scripts.name(script), auditArgs(keysAndArgs), auditResult(err), err)
+}
+
+// auditArgs returns a copy of the arguments of a script run with owner XML,
+// recognized by its leading "<", replaced by its length. Paths and tokens
+// never start with "<".
+func auditArgs(keysAndArgs []interface{}) []interface{} {
+	args := make([]interface{}, len(keysAndArgs))
+	for i, arg := range keysAndArgs {
+		if s, ok := arg.(string); ok && strings.HasPrefix(strings.TrimSpace(s), "<") {
+			arg = fmt.Sprintf("[owner XML, %d bytes]", len(s))
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// auditResult returns the result of a script run for the audit hook.
+func auditResult(err error) string {
+	if err == nil {
+		return replyOK
+	}
+	var lockedErr *LockedError
+	if errors.As(err, &lockedErr) {
+		return errLocked
+	}
+	for code, codeErr := range replyErrors {
+		if err == codeErr {
+			return code
+		}
+	}
+	return ""
+}
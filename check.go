@@ -0,0 +1,72 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrInconsistent is returned by Check when the lock state in Redis violates
+// one of the invariants maintained by the scripts. The returned error wraps it
+// with a description of the violation.
+var ErrInconsistent = errors.New("webdavredisls: inconsistent lock state")
+
+// Check collects expired locks and then verifies that the lock state in Redis
+// is consistent: every locked node has a token key pointing back to it,
+// refcounts equal the number of locked self-or-descendents, and exactly the
+// unheld finite locks are in the expiry zset with their expiry as the score.
+// It returns an error wrapping ErrInconsistent for the first violation found.
+//
+// The check runs as a single script that visits every key under the prefix, so
+// it blocks Redis for time proportional to the number of keys. It is meant to
+// be run periodically as a canary, not on every request.
+func (r *RedisLS) Check(now time.Time) error {
+	v, err := r.do(r.scripts.check, r.prefix, now.Unix())
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+
+	problem, err := redis.String(v, nil)
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", ErrInconsistent, problem)
+}
+
+// DanglingNodes collects expired locks and then returns the sorted names of
+// the nodes whose refcount differs from the number of locks at or below them,
+// e.g. to diagnose ancestor nodes that were not deleted after their last lock
+// was removed. Like Check it visits every key under the prefix.
+func (r *RedisLS) DanglingNodes(now time.Time) ([]string, error) {
+	names, err := redis.Strings(r.do(r.scripts.danglingNodes, r.prefix, now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// CompactExpirySet removes the names of missing nodes from the expiry zset
+// and then collects expired locks, e.g. to clean up after a failure left
+// entries behind that expiry collection would otherwise visit again and
+// again. It then deletes the unlocked nodes that have nothing below them and
+// takes their refcount off their ancestors, which collection leaves alone
+// because it would have to scan for descendants. It returns the number of
+// entries removed from the expiry zset. Like Check it visits every key under
+// the prefix.
+func (r *RedisLS) CompactExpirySet(now time.Time) (removed int, err error) {
+	return redis.Int(r.do(r.scripts.compactExpirySet, r.prefix, now.Unix()))
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrPoolTimeout is returned when no pooled connection could be obtained in
+// time, either because the pool is exhausted or because waiting for a
+// connection took longer than the timeout set with WithConnTimeout or the
+// deadline of the context. Callers may want to shed load, e.g. with a 503,
+// instead of retrying right away.
+var ErrPoolTimeout = errors.New("webdavredisls: timed out getting a connection")
+
+// ErrCommandTimeout is wrapped by the error returned when Redis did not reply
+// to a command within the timeout set with WithCommandTimeout, e.g. because
+// the connection is half-open. The command may or may not have been run.
+var ErrCommandTimeout = errors.New("webdavredisls: timed out waiting for a reply")
+
+// connProvider hands out the connections commands are run on. Every
+// connection returned by get is passed to release once it is no longer used.
+// Like redis.Pool.Get, get never fails: if no connection can be obtained it
+// returns a connection whose methods return the error.
+type connProvider interface {
+	get(ctx context.Context) redis.Conn
+	release(conn redis.Conn)
+}
+
+// conn gets a connection from r.conns, waiting at most as long as set with
+// WithConnTimeout. It must be passed to r.conns.release.
+func (r *RedisLS) conn(ctx context.Context) redis.Conn {
+	if r.connTimeout <= 0 {
+		return r.conns.get(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.connTimeout)
+	defer cancel()
+	return r.conns.get(ctx)
+}
+
+// poolConns gets connections from a redis.Pool and closes them to return them
+// to the pool.
+type poolConns struct {
+	pool *redis.Pool
+}
+
+func (p poolConns) get(ctx context.Context) redis.Conn {
+	conn, err := p.pool.GetContext(ctx)
+	if err != nil {
+		if err == redis.ErrPoolExhausted || errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %v", ErrPoolTimeout, err)
+		}
+		return errorConn{err}
+	}
+	return conn
+}
+
+func (p poolConns) release(conn redis.Conn) {
+	conn.Close()
+}
+
+// funcConns gets connections from the functions passed to
+// NewRedisLSWithConns.
+type funcConns struct {
+	getConn     func() (redis.Conn, error)
+	releaseConn func(redis.Conn)
+}
+
+func (f funcConns) get(ctx context.Context) redis.Conn {
+	conn, err := f.getConn()
+	if err != nil {
+		return errorConn{err}
+	}
+	return conn
+}
+
+func (f funcConns) release(conn redis.Conn) {
+	if _, ok := conn.(errorConn); ok {
+		return
+	}
+	f.releaseConn(conn)
+}
+
+// errorConn is the connection returned when no connection could be obtained.
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Close() error                                   { return c.err }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
+
+func (c errorConn) DoContext(context.Context, string, ...interface{}) (interface{}, error) {
+	return nil, c.err
+}
+
+func (c errorConn) ReceiveContext(context.Context) (interface{}, error) {
+	return nil, c.err
+}
+
+// doContext runs a command with redis.DoContext on connections that support
+// it. Other connections, e.g. those passed to NewRedisLSWithConns, run it with
+// Do once ctx has been checked, so callers must check ctx between commands.
+func doContext(ctx context.Context, conn redis.Conn, commandName string, args ...interface{}) (interface{}, error) {
+	if _, ok := conn.(redis.ConnWithContext); ok {
+		return redis.DoContext(conn, ctx, commandName, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return conn.Do(commandName, args...)
+}
+
+// timeoutConns wraps the connections of conns in timeoutConn, see
+// WithCommandTimeout.
+type timeoutConns struct {
+	conns   connProvider
+	timeout time.Duration
+}
+
+func (t timeoutConns) get(ctx context.Context) redis.Conn {
+	conn := t.conns.get(ctx)
+	if _, ok := conn.(errorConn); ok {
+		return conn
+	}
+	return timeoutConn{Conn: conn, timeout: t.timeout}
+}
+
+func (t timeoutConns) release(conn redis.Conn) {
+	if c, ok := conn.(timeoutConn); ok {
+		conn = c.Conn
+	}
+	t.conns.release(conn)
+}
+
+// timeoutConn waits at most timeout for each reply. Connections that don't
+// implement redis.ConnWithTimeout or redis.ConnWithContext are used as they
+// are.
+type timeoutConn struct {
+	redis.Conn
+	timeout time.Duration
+}
+
+func (c timeoutConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if _, ok := c.Conn.(redis.ConnWithTimeout); !ok {
+		return c.Conn.Do(commandName, args...)
+	}
+	reply, err := redis.DoWithTimeout(c.Conn, c.timeout, commandName, args...)
+	return reply, commandTimeoutError(err)
+}
+
+func (c timeoutConn) Receive() (interface{}, error) {
+	if _, ok := c.Conn.(redis.ConnWithTimeout); !ok {
+		return c.Conn.Receive()
+	}
+	reply, err := redis.ReceiveWithTimeout(c.Conn, c.timeout)
+	return reply, commandTimeoutError(err)
+}
+
+func (c timeoutConn) DoContext(ctx context.Context, commandName string, args ...interface{}) (interface{}, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	reply, err := doContext(timeoutCtx, c.Conn, commandName, args...)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return reply, fmt.Errorf("%w: %v", ErrCommandTimeout, err)
+	}
+	return reply, commandTimeoutError(err)
+}
+
+func (c timeoutConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	if _, ok := c.Conn.(redis.ConnWithContext); !ok {
+		return c.Receive()
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	reply, err := redis.ReceiveContext(c.Conn, timeoutCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return reply, fmt.Errorf("%w: %v", ErrCommandTimeout, err)
+	}
+	return reply, commandTimeoutError(err)
+}
+
+// commandTimeoutError wraps network timeouts in ErrCommandTimeout and returns
+// other errors unchanged.
+func commandTimeoutError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrCommandTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	webdav "github.com/koofr/go-webdav"
+)
+
+// ErrInfiniteLock is returned by SetExpiry for a lock with an infinite
+// duration, which has no expiry to move.
+var ErrInfiniteLock = errors.New("webdavredisls: lock has an infinite duration")
+
+// PeekExpiry returns the stored expiry of the lock identified by token, or the
+// zero time for an infinite lock. Unlike GetLock it also reports locks that
+// have expired but have not been collected yet. It returns
+// webdav.ErrNoSuchLock if there is no such lock. It is meant for admin
+// tooling and tests and never writes to Redis.
+func (r *RedisLS) PeekExpiry(token string) (time.Time, error) {
+	if token == "" {
+		return time.Time{}, webdav.ErrNoSuchLock
+	}
+	expirySec, err := redis.Int64(r.do(r.scripts.peekExpiry, r.prefix, r.storedToken(token)))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if expirySec == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(expirySec, 0), nil
+}
+
+// SetExpiry moves the expiry of the lock identified by token to at, truncated
+// to whole seconds, updating the node and the expiry zset atomically. It is an
+// escape hatch for admin tooling and tests, e.g. to make the collector pick up
+// a specific lock: it bypasses the duration semantics of Refresh, keeps the
+// stored duration, ignores WithExpiryRounding and WithExpiryJitter and doesn't
+// collect expired locks itself. A time in the past makes the lock collectable
+// by the next write. It returns webdav.ErrLocked for a held lock,
+// ErrInfiniteLock for an infinite lock and webdav.ErrNoSuchLock if there is no
+// such lock.
+func (r *RedisLS) SetExpiry(token string, at time.Time) error {
+	if token == "" {
+		return webdav.ErrNoSuchLock
+	}
+	expirySec := at.Unix()
+	if expirySec < 1 {
+		// 0 is the stored expiry of infinite locks.
+		expirySec = 1
+	}
+	_, err := r.do(r.scripts.setExpiry, r.prefix, r.storedToken(token), expirySec)
+	return err
+}
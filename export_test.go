@@ -0,0 +1,9 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+// DeleteByPrefix lets the tests of package webdavredisls_test clean up with
+// deleteByPrefix.
+var DeleteByPrefix = deleteByPrefix
@@ -0,0 +1,305 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	webdav "github.com/koofr/go-webdav"
+)
+
+// fallbackTokenPrefix marks the tokens of locks created in the fallback lock
+// system, so that they never collide with Redis tokens.
+const fallbackTokenPrefix = "fallback:"
+
+var _ webdav.LockSystem = (*FallbackLS)(nil)
+
+// FallbackLS is a webdav.LockSystem that uses a RedisLS and falls back to an
+// in-memory lock system while Redis is unavailable, so that locking degrades
+// instead of failing.
+//
+// When an operation fails because Redis can't be reached, FallbackLS switches
+// to fallback mode, reports the error to the handler passed to NewFallbackLS
+// and serves new locks from memory until Drain succeeds. Locks created in
+// fallback mode get tokens starting with "fallback:".
+//
+// The fallback is only consistent within a single process: while it is
+// active, locks held in Redis and locks held by other processes are not
+// checked, so two clients may lock the same resource. Locks created in
+// fallback mode are lost if the process exits before they are drained.
+type FallbackLS struct {
+	primary    *RedisLS
+	fallback   webdav.LockSystem
+	onFallback func(error)
+
+	mu     sync.Mutex
+	active bool
+	// locks are the fallback locks that have not been drained, by fallback
+	// token.
+	locks map[string]fallbackLock
+	// drained maps the fallback tokens of drained locks to their Redis
+	// tokens.
+	drained map[string]string
+}
+
+type fallbackLock struct {
+	details webdav.LockDetails
+	// expiry is the zero time for locks with an infinite duration.
+	expiry time.Time
+}
+
+// NewFallbackLS returns a FallbackLS for primary. onFallback, if not nil, is
+// called with the error whenever FallbackLS switches to fallback mode, e.g. to
+// log it and raise an alert.
+func NewFallbackLS(primary *RedisLS, onFallback func(error)) *FallbackLS {
+	return &FallbackLS{
+		primary:    primary,
+		fallback:   webdav.NewMemLS(),
+		onFallback: onFallback,
+		locks:      map[string]fallbackLock{},
+		drained:    map[string]string{},
+	}
+}
+
+// isUnavailable reports whether err means that Redis could not be reached,
+// as opposed to a definitive result or an error reply.
+func isUnavailable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrPoolExhausted) ||
+		errors.Is(err, ErrPoolTimeout)
+}
+
+// InFallback reports whether FallbackLS is in fallback mode.
+func (f *FallbackLS) InFallback() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// unavailable switches to fallback mode if err means that Redis could not be
+// reached and reports whether it did.
+func (f *FallbackLS) unavailable(err error) bool {
+	if !isUnavailable(err) {
+		return false
+	}
+
+	f.mu.Lock()
+	wasActive := f.active
+	f.active = true
+	f.mu.Unlock()
+
+	if !wasActive && f.onFallback != nil {
+		f.onFallback(err)
+	}
+	return true
+}
+
+// resolve returns the token to use for a token passed by a client and whether
+// it identifies a lock in the fallback lock system.
+func (f *FallbackLS) resolve(token string) (string, bool) {
+	if !strings.HasPrefix(token, fallbackTokenPrefix) {
+		return token, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if redisToken, ok := f.drained[token]; ok {
+		return redisToken, false
+	}
+	return strings.TrimPrefix(token, fallbackTokenPrefix), true
+}
+
+func fallbackExpiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
+
+func (f *FallbackLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	primaryConditions := make([]webdav.Condition, 0, len(conditions))
+	fallbackConditions := make([]webdav.Condition, 0, len(conditions))
+	for _, condition := range conditions {
+		token, isFallback := f.resolve(condition.Token)
+		condition.Token = token
+		if isFallback {
+			fallbackConditions = append(fallbackConditions, condition)
+		} else {
+			primaryConditions = append(primaryConditions, condition)
+		}
+	}
+
+	if len(fallbackConditions) == 0 {
+		release, err := f.primary.Confirm(now, name0, name1, primaryConditions...)
+		if !f.unavailable(err) {
+			return release, err
+		}
+	}
+
+	return f.fallback.Confirm(now, name0, name1, fallbackConditions...)
+}
+
+func (f *FallbackLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	if !f.InFallback() {
+		token, err := f.primary.Create(now, details)
+		if !f.unavailable(err) {
+			return token, err
+		}
+	}
+
+	token, err := f.fallback.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+	token = fallbackTokenPrefix + token
+
+	f.mu.Lock()
+	f.locks[token] = fallbackLock{
+		details: details,
+		expiry:  fallbackExpiry(now, details.Duration),
+	}
+	f.mu.Unlock()
+
+	return token, nil
+}
+
+func (f *FallbackLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	resolved, isFallback := f.resolve(token)
+	if !isFallback {
+		return f.primary.Refresh(now, resolved, duration)
+	}
+
+	details, err := f.fallback.Refresh(now, resolved, duration)
+	if err != nil {
+		return details, err
+	}
+
+	f.mu.Lock()
+	if lock, ok := f.locks[token]; ok {
+		lock.details.Duration = duration
+		lock.expiry = fallbackExpiry(now, duration)
+		f.locks[token] = lock
+	}
+	f.mu.Unlock()
+
+	return details, nil
+}
+
+func (f *FallbackLS) Unlock(now time.Time, token string) error {
+	resolved, isFallback := f.resolve(token)
+	if !isFallback {
+		err := f.primary.Unlock(now, resolved)
+		if err == nil || err == webdav.ErrNoSuchLock {
+			f.mu.Lock()
+			delete(f.drained, token)
+			f.mu.Unlock()
+		}
+		return err
+	}
+
+	if err := f.fallback.Unlock(now, resolved); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	delete(f.locks, token)
+	f.mu.Unlock()
+
+	return nil
+}
+
+// DrainError is returned by Drain when some fallback locks could not be
+// replayed into Redis. Those locks stay in the fallback lock system.
+type DrainError struct {
+	// Errors are the errors by fallback token.
+	Errors map[string]error
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("webdavredisls: %d fallback locks not drained", len(e.Errors))
+}
+
+// Drain replays the locks created in fallback mode into Redis with their
+// remaining duration, rounded up to whole seconds, and leaves fallback mode if
+// all of them could be replayed. Clients keep using their fallback tokens,
+// which are mapped to the new Redis tokens. Expired locks are dropped.
+//
+// Locks that are held by a Confirm call, or that conflict with a lock created
+// in Redis in the meantime, can't be replayed and are reported in a
+// *DrainError; they stay in memory until they are unlocked or a later Drain
+// succeeds. If Redis is still unavailable, Drain returns that error and stays
+// in fallback mode.
+func (f *FallbackLS) Drain(now time.Time) error {
+	f.mu.Lock()
+	tokens := make([]string, 0, len(f.locks))
+	locks := make([]fallbackLock, 0, len(f.locks))
+	for token, lock := range f.locks {
+		tokens = append(tokens, token)
+		locks = append(locks, lock)
+	}
+	f.mu.Unlock()
+
+	errs := map[string]error{}
+
+	for i, token := range tokens {
+		lock := locks[i]
+		memToken := strings.TrimPrefix(token, fallbackTokenPrefix)
+
+		if !lock.expiry.IsZero() && !now.Before(lock.expiry) {
+			f.fallback.Unlock(now, memToken)
+			f.mu.Lock()
+			delete(f.locks, token)
+			f.mu.Unlock()
+			continue
+		}
+
+		details := lock.details
+		if !lock.expiry.IsZero() {
+			details.Duration = (lock.expiry.Sub(now) + time.Second - 1).Truncate(time.Second)
+		}
+
+		redisToken, err := f.primary.Create(now, details)
+		if isUnavailable(err) {
+			return err
+		}
+		if err != nil {
+			errs[token] = err
+			continue
+		}
+
+		if err := f.fallback.Unlock(now, memToken); err != nil {
+			// The lock is held by a Confirm call in progress.
+			f.primary.Unlock(now, redisToken)
+			errs[token] = err
+			continue
+		}
+
+		f.mu.Lock()
+		delete(f.locks, token)
+		f.drained[token] = redisToken
+		f.mu.Unlock()
+	}
+
+	if len(errs) > 0 {
+		return &DrainError{Errors: errs}
+	}
+
+	f.mu.Lock()
+	f.active = false
+	f.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// flushBatchSize is the SCAN COUNT hint used by deleteByPrefix.
+const flushBatchSize = 1000
+
+// globEscaper escapes the glob special characters in a SCAN MATCH pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// Flush deletes all keys of the lock system, e.g. to tear down between tests
+// or benchmarks. It walks the keys with SCAN in batches instead of using KEYS,
+// so it does not block Redis, and checks ctx between batches. Only the keys
+// the lock system uses are matched, so keys of other lock systems whose prefix
+// starts with this one are left alone, and an empty prefix is refused.
+//
+// The fence counter of CreateFenced is kept, so that fences handed out after
+// the flush are still higher than the ones before. Locks created while Flush
+// runs may be partially deleted.
+func (r *RedisLS) Flush(ctx context.Context) error {
+	if r.prefix == "" {
+		return errors.New("webdavredisls: refusing to flush an empty prefix")
+	}
+
+	conn := r.conn(ctx)
+	defer r.conns.release(conn)
+
+	// The expiry shards are deleted even if the lock system is not sharded
+	// (anymore).
+	for _, keyPrefix := range []string{r.lua.namePrefix, r.lua.tokenPrefix, r.lua.idempotencyPrefix, r.lua.expiryShardPrefix} {
+		if err := deleteByPrefix(ctx, conn, r.prefix+keyPrefix); err != nil {
+			return err
+		}
+	}
+
+	fixed := redis.Args{}
+	for _, key := range []string{expiryZSetKey, nextTokenKey, heldCountKey, maintenanceKey, holdDeadlinesKey, holdCounterKey, releaseHistoryKey} {
+		fixed = fixed.Add(r.prefix + key)
+	}
+	_, err := doContext(ctx, conn, "DEL", fixed...)
+	return err
+}
+
+// deleteByPrefix deletes the keys that start with keyPrefix. It walks the keys
+// with SCAN and deletes each batch with UNLINK, so that neither the walk nor
+// freeing large values blocks Redis. It is the only place in the package that
+// deletes keys by pattern: it refuses an empty keyPrefix, which would match
+// every key of the database.
+func deleteByPrefix(ctx context.Context, conn redis.Conn, keyPrefix string) error {
+	if keyPrefix == "" {
+		return errors.New("webdavredisls: refusing to delete keys by an empty prefix")
+	}
+
+	pattern := globEscaper.Replace(keyPrefix) + "*"
+	cursor := "0"
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		values, err := redis.Values(doContext(ctx, conn, "SCAN", cursor, "MATCH", pattern, "COUNT", flushBatchSize))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+
+		args := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			if strings.HasPrefix(key, keyPrefix) {
+				args = append(args, key)
+			}
+		}
+		if len(args) > 0 {
+			if _, err := doContext(ctx, conn, "UNLINK", args...); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ReleaseReason is why a lock in the release history went away.
+type ReleaseReason string
+
+const (
+	// ReleaseUnlocked is a lock removed by Unlock or UnlockByPath.
+	ReleaseUnlocked ReleaseReason = "unlocked"
+	// ReleaseExpired is a lock collected after it expired.
+	ReleaseExpired ReleaseReason = "expired"
+	// ReleaseMoved is a lock moved away from Root by MoveLock.
+	ReleaseMoved ReleaseReason = "moved"
+)
+
+// ReleasedLock is an entry of the release history, see WithReleaseHistory.
+type ReleasedLock struct {
+	Root   string
+	Token  string
+	Reason ReleaseReason
+	// Time is when the lock was released, in whole seconds. For an expired
+	// lock it is when it was collected, which may be later than its expiry.
+	Time time.Time
+}
+
+// RecentlyReleased returns up to n of the most recently released locks, newest
+// first. It returns nothing without WithReleaseHistory. It never writes to
+// Redis.
+func (r *RedisLS) RecentlyReleased(n int) ([]ReleasedLock, error) {
+	if n <= 0 || r.lua.releaseHistorySize == 0 {
+		return nil, nil
+	}
+
+	conn := r.conn(r.context())
+	defer r.conns.release(conn)
+
+	entries, err := redis.Strings(conn.Do("LRANGE", r.prefix+releaseHistoryKey, 0, n-1))
+	if err != nil {
+		return nil, err
+	}
+
+	released := make([]ReleasedLock, 0, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "\t", 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("webdavredisls: invalid release history entry: %q", entry)
+		}
+		sec, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("webdavredisls: invalid release history entry: %q", entry)
+		}
+		released = append(released, ReleasedLock{
+			Root:   parts[3],
+			Token:  r.tokenURI(parts[2]),
+			Reason: ReleaseReason(parts[1]),
+			Time:   time.Unix(sec, 0),
+		})
+	}
+
+	return released, nil
+}
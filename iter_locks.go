@@ -0,0 +1,131 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// iterLocksBatchSize is the SCAN COUNT hint used by IterLocks.
+const iterLocksBatchSize = 100
+
+// IterLocks returns an iterator over all explicit locks that reads them in
+// batches, so that e.g. export tooling can process millions of locks with
+// bounded memory and stop early. With Go 1.23 or later seq can be used in a
+// range-over-func loop. Once the iteration is done, err returns the error
+// that stopped it, if any.
+//
+// The node keys are walked with SCAN in Go and every batch is read with a
+// script, so the locks are not ordered and the iteration is not a snapshot.
+// SCAN guarantees that a lock that exists during the whole iteration is
+// yielded, but it may be yielded more than once, and locks created or removed
+// during the iteration may or may not be yielded. With a context set with
+// WithContext the iteration stops with the context's error once it is done.
+// Like GetLock it never writes to Redis.
+func (r *RedisLS) IterLocks(now time.Time) (seq func(yield func(LockInfo) bool), err func() error) {
+	var iterErr error
+
+	seq = func(yield func(LockInfo) bool) {
+		iterErr = r.iterLocks(now, "", yield)
+	}
+
+	return seq, func() error { return iterErr }
+}
+
+// LocksMatching returns the explicit locks whose root starts with pathPrefix,
+// ordered by root, e.g. to show lock badges in a tree of the namespace. Unlike
+// ListLocksUnder the prefix is not a path: "/a/b" matches "/a/bc" too, while
+// "/a/b/" matches only the locks below "/a/b". The prefix is normalized like
+// a path, but not cleaned.
+//
+// The node keys are walked with SCAN MATCH like IterLocks. Redis still visits
+// every key under the lock system's prefix to match them, so it is meant for
+// admin use, not for the request path. Like GetLock it never writes to Redis.
+func (r *RedisLS) LocksMatching(now time.Time, pathPrefix string) ([]LockInfo, error) {
+	if r.pathNormalizer != nil {
+		pathPrefix = r.pathNormalizer(pathPrefix)
+	}
+	if r.caseFold {
+		pathPrefix = strings.ToLower(pathPrefix)
+	}
+
+	var locks []LockInfo
+	err := r.iterLocks(now, pathPrefix, func(lock LockInfo) bool {
+		locks = append(locks, lock)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// SCAN may return a key more than once.
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Details.Root < locks[j].Details.Root
+	})
+	unique := locks[:0]
+	for i, lock := range locks {
+		if i == 0 || lock.Details.Root != locks[i-1].Details.Root {
+			unique = append(unique, lock)
+		}
+	}
+
+	return unique, nil
+}
+
+// iterLocks yields the explicit locks whose root starts with pathPrefix.
+func (r *RedisLS) iterLocks(now time.Time, pathPrefix string, yield func(LockInfo) bool) error {
+	namePrefix := r.prefix + r.lua.namePrefix
+	pattern := globEscaper.Replace(namePrefix+pathPrefix) + "*"
+	cursor := "0"
+	ctx := r.context()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		conn := r.conn(ctx)
+		values, err := redis.Values(doContext(ctx, conn, "SCAN", cursor, "MATCH", pattern, "COUNT", iterLocksBatchSize))
+		r.conns.release(conn)
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+
+		args := redis.Args{}.Add(r.prefix, now.Unix())
+		for _, key := range keys {
+			if strings.HasPrefix(key, namePrefix) {
+				args = args.Add(strings.TrimPrefix(key, namePrefix))
+			}
+		}
+
+		if len(args) > 2 {
+			values, err := redis.Values(r.do(r.scripts.readLocks, args...))
+			if err != nil {
+				return err
+			}
+			locks, err := r.lockInfos(values)
+			if err != nil {
+				return err
+			}
+			for _, lock := range locks {
+				if !yield(lock) {
+					return nil
+				}
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -6,9 +6,14 @@
 package webdavredisls
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"path"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -16,11 +21,25 @@ import (
 )
 
 const (
-	namePrefix  string = "n:"
-	tokenPrefix string = "t:"
+	nameKeyType        string = "n"
+	tokenKeyType       string = "t"
+	idempotencyKeyType string = "i"
 
-	expiryZSetKey string = "e"
-	nextTokenKey  string = "nt"
+	defaultKeySeparator string = ":"
+
+	expiryZSetKey  string = "e"
+	nextTokenKey   string = "nt"
+	heldCountKey   string = "hc"
+	maintenanceKey string = "m"
+
+	holdDeadlinesKey string = "hx"
+	holdCounterKey   string = "hn"
+
+	releaseHistoryKey string = "rh"
+
+	// fenceCounterKey is the counter of CreateFenced. Flush keeps it, so that
+	// fences keep increasing.
+	fenceCounterKey string = "fc"
 
 	nameKey      string = "n"
 	rootKey      string = "r"
@@ -31,190 +50,1704 @@ const (
 	refCountKey  string = "c"
 	expiryKey    string = "e"
 	heldKey      string = "h"
+	heldSinceKey string = "s"
+	createdAtKey string = "a"
+
+	// metaKeyPrefix namespaces the fields set with CreateWithMeta so that
+	// they can't collide with the fields above.
+	metaKeyPrefix string = "m:"
+
+	// previousOwnerXMLKey is only used in the reply of the updateOwner script.
+	previousOwnerXMLKey string = "p"
 
 	trueValue  string = "t"
 	falseValue string = "f"
 
+	replyOK  = "ok"
+	replyErr = "err"
+
 	errLocked             = "ERR_LOCKED"
 	errNoSuchLock         = "ERR_NO_SUCH_LOCK"
 	errConfirmationFailed = "ERR_CONFIRMATION_FAILED"
+	errCorruptState       = "ERR_CORRUPT_STATE"
+	errMaintenance        = "ERR_MAINTENANCE"
+	errInvalidPath        = "ERR_INVALID_PATH"
+	errTokenExists        = "ERR_TOKEN_EXISTS"
+	errInvalidToken       = "ERR_INVALID_TOKEN"
+	errInfiniteLock       = "ERR_INFINITE_LOCK"
+	errDepthImmutable     = "ERR_DEPTH_IMMUTABLE"
 
 	infiniteTimeout time.Duration = -1
+
+	defaultIdempotencyWindow = time.Minute
+
+	createWaitMinBackoff = 10 * time.Millisecond
+	createWaitMaxBackoff = 500 * time.Millisecond
 )
 
+// ErrOwnerXMLTooLarge is returned when the owner XML exceeds the limit set
+// with WithMaxOwnerXMLBytes.
+var ErrOwnerXMLTooLarge = errors.New("webdavredisls: owner XML too large")
+
+// ErrRootLockForbidden is returned when an infinite-depth lock at "/" is
+// denied by the policy set with WithRootLockPolicy.
+var ErrRootLockForbidden = errors.New("webdavredisls: infinite-depth lock at root forbidden")
+
+// ErrZeroDuration is returned when a lock is requested with a duration of zero
+// seconds and WithRejectZeroDuration is set.
+var ErrZeroDuration = errors.New("webdavredisls: zero lock duration")
+
+// ErrDeadlinePassed is returned by CreateUntil and RefreshUntil for a deadline
+// that is not at least a second after now.
+var ErrDeadlinePassed = errors.New("webdavredisls: lock deadline has passed")
+
+// ErrDepthImmutable is returned by RefreshWithOpts when asked to change the
+// depth of a lock. A refresh can't change the scope of a lock.
+var ErrDepthImmutable = errors.New("webdavredisls: lock depth can't be changed by a refresh")
+
+// ErrRedisOutOfMemory is wrapped by the error returned when Redis rejects a
+// write because it reached maxmemory, e.g. to respond with 507 Insufficient
+// Storage instead of a generic server error.
+var ErrRedisOutOfMemory = errors.New("webdavredisls: redis out of memory")
+
+// ErrRedisReadOnly is wrapped by the error returned when Redis rejects a write
+// because it is a read-only replica (READONLY) or because it can't persist
+// snapshots (MISCONF).
+var ErrRedisReadOnly = errors.New("webdavredisls: redis rejects writes")
+
+// ErrInvalidPath is returned by the create script for a root that is not a
+// clean absolute path. Roots passed through the Go API are always cleaned, so
+// it only occurs for callers that run the scripts directly.
+var ErrInvalidPath = errors.New("webdavredisls: invalid lock path")
+
+// ErrPathTooDeep is returned when a lock is requested at a root with more path
+// segments than the limit set with WithScriptBudget.
+var ErrPathTooDeep = errors.New("webdavredisls: lock path too deep")
+
+// ErrCorruptState is returned when a script finds a node it relies on with
+// missing or invalid fields, instead of making a decision on bad data. Check
+// describes the problem in more detail.
+var ErrCorruptState = errors.New("webdavredisls: corrupt lock state")
+
+// DurationToSec returns the number of seconds stored in Redis for a lock
+// duration. This is the stable encoding of the "d" field of a lock node: whole
+// seconds, truncated, and -1 for an infinite duration. The "e" field holds the
+// expiry as Unix seconds, or 0 for an infinite lock. Tooling that reads Redis
+// directly or mirrors locks into another store should use these helpers to
+// translate the infinite marker.
+func DurationToSec(d time.Duration) int64 {
+	return durationToSec(d)
+}
+
+// SecToDuration returns the lock duration for a number of seconds stored in
+// Redis. Any negative number means an infinite duration. See DurationToSec.
+func SecToDuration(sec int64) time.Duration {
+	return secToDuration(sec)
+}
+
+// IsInfinite reports whether d is an infinite lock duration. Like
+// webdav.LockDetails.Duration, any negative duration is infinite.
+func IsInfinite(d time.Duration) bool {
+	return d < 0
+}
+
 func durationToSec(d time.Duration) int64 {
-	if d == infiniteTimeout {
+	if IsInfinite(d) {
 		return -1
 	}
 	return int64(d / time.Second)
 }
 
+func secToDuration(sec int64) time.Duration {
+	if sec < 0 {
+		return infiniteTimeout
+	}
+	return time.Duration(sec) * time.Second
+}
+
+var _ webdav.LockSystem = (*RedisLS)(nil)
+
+// RedisLS is a webdav.LockSystem that keeps its locks in Redis, so that they
+// are shared by every server using the same prefix.
+//
+// Like webdav.NewMemLS it only supports exclusive write locks: LockDetails
+// can't express shared locks, so every lock conflicts with any other lock
+// that covers the same resources. Confirm and Lookup only match conditions by
+// Token. Conditions with Not set or an ETag are treated as bare token matches
+// unless WithStrictConditions is used, in which case they fail; the handler
+// is expected to evaluate ETags itself.
+//
+// Every lock and every ancestor of a lock is a small hash. Redis stores such
+// hashes in its compact listpack encoding as long as no value is longer than
+// hash-max-listpack-value (64 bytes by default), so a node takes little more
+// memory than its packed fields would as a single string. Owner XML documents
+// are usually longer and turn the hashes of locked nodes into regular hash
+// tables; raising hash-max-listpack-value or using WithOwnerStore avoids that.
 type RedisLS struct {
-	pool   *redis.Pool
+	conns  connProvider
 	prefix string
+
+	expiryHandler     func(LockInfo)
+	maxOwnerXMLBytes  int
+	ownerValidator    func(string) error
+	retryAttempts     int
+	retryBackoff      time.Duration
+	idempotencyWindow time.Duration
+	keySeparator      string
+	expiryJitter      time.Duration
+	strictConditions  bool
+	inlineCollect     bool
+	pathNormalizer    func(string) string
+	caseFold          bool
+	ownerStore        OwnerStore
+	expiryShards      int
+	expiryRounding    time.Duration
+	conflictHandler   func(*LockedError)
+	connTimeout       time.Duration
+	commandTimeout    time.Duration
+	statsExporter     *statsExporter
+	minDuration       time.Duration
+	rejectZero        bool
+	rootLockPolicy    RootLockPolicy
+	alwaysEval        bool
+	noScripting       bool
+	txRelease         bool
+	heldConfirmRetry  time.Duration
+	scriptCacheCheck  time.Duration
+	debugAssertions   bool
+
+	creationTimestamps bool
+	collectLimit       int
+	maxPathDepth       int
+	releaseHistorySize int
+
+	namespaceSeparator string
+	tokenURIScheme     string
+	auditHook          AuditHook
+
+	// ctx is set on the views returned by WithContext.
+	ctx context.Context
+
+	// scriptCheck and scriptErrors are shared with the views returned by
+	// Scoped.
+	scriptCheck  *scriptCheckState
+	scriptErrors *scriptErrorCounts
+
+	lua     *luaConfig
+	scripts *scriptSet
+}
+
+// scriptCheckState is when the script cache was last checked, see
+// WithScriptCacheCheck, and the EnsureScripts call in progress.
+type scriptCheckState struct {
+	mu      sync.Mutex
+	last    time.Time
+	loading *scriptLoad
+}
+
+// scriptLoad is an EnsureScripts call in progress. done is closed once err is
+// set.
+type scriptLoad struct {
+	done chan struct{}
+	err  error
 }
 
 // NewRedisLS returns a new Redis LockSystem.
-func NewRedisLS(pool *redis.Pool, prefix string) *RedisLS {
+func NewRedisLS(pool *redis.Pool, prefix string, opts ...Option) *RedisLS {
+	return newRedisLS(poolConns{pool: pool}, prefix, opts...)
+}
+
+// NewRedisLSWithConns is like NewRedisLS, but for callers that don't use a
+// redis.Pool, e.g. because they keep a single long-lived connection. Every
+// command gets its connection from getConn and passes it to releaseConn when
+// done. Connections may be used for a single command at a time only, so a
+// shared connection has to be guarded by getConn and releaseConn.
+func NewRedisLSWithConns(getConn func() (redis.Conn, error), releaseConn func(redis.Conn), prefix string, opts ...Option) *RedisLS {
+	return newRedisLS(funcConns{getConn: getConn, releaseConn: releaseConn}, prefix, opts...)
+}
+
+func newRedisLS(conns connProvider, prefix string, opts ...Option) *RedisLS {
 	r := &RedisLS{
-		pool:   pool,
+		conns:  conns,
 		prefix: prefix,
+
+		idempotencyWindow: defaultIdempotencyWindow,
+		inlineCollect:     true,
+		expiryShards:      1,
+		keySeparator:      defaultKeySeparator,
+		scriptCheck:       &scriptCheckState{},
+		scriptErrors:      &scriptErrorCounts{},
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if err := validateKeySeparator(r.keySeparator); err != nil {
+		panic(err)
+	}
+
+	if r.expiryShards < 1 {
+		panic(fmt.Sprintf("webdavredisls: invalid number of expiry shards: %d", r.expiryShards))
+	}
+
+	if r.collectLimit < 0 || r.maxPathDepth < 0 {
+		panic(fmt.Sprintf("webdavredisls: invalid script budget: %d, %d", r.collectLimit, r.maxPathDepth))
+	}
+
+	if r.releaseHistorySize < 0 {
+		panic(fmt.Sprintf("webdavredisls: invalid release history size: %d", r.releaseHistorySize))
+	}
+
+	if r.commandTimeout > 0 {
+		r.conns = timeoutConns{conns: r.conns, timeout: r.commandTimeout}
+	}
+
+	if r.expiryRounding < 0 {
+		panic(fmt.Sprintf("webdavredisls: invalid expiry rounding: %s", r.expiryRounding))
+	}
+
+	r.lua = newLuaConfig(r.keySeparator, r.expiryShards, int64(r.expiryRounding/time.Second), r.debugAssertions, r.creationTimestamps, r.collectLimit, r.releaseHistorySize)
+	r.scripts = r.lua.scripts()
+
+	if err := r.validatePrefix(r.prefix); err != nil {
+		panic(err)
+	}
+
+	if r.statsExporter != nil {
+		if r.statsExporter.interval <= 0 {
+			panic(fmt.Sprintf("webdavredisls: invalid stats interval: %s", r.statsExporter.interval))
+		}
+		go r.statsExporter.run(r)
 	}
 
 	return r
 }
 
-func (r *RedisLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
-	conn := r.pool.Get()
-	defer conn.Close()
+// validateKeySeparator checks that with separator no two key types can be
+// confused, i.e. that no typed key prefix is a prefix of another key prefix
+// or of one of the fixed key names.
+func validateKeySeparator(separator string) error {
+	if separator == "" {
+		return errors.New("webdavredisls: empty key separator")
+	}
 
-	if name0 != "" {
-		name0 = slashClean(name0)
+	c := newLuaConfig(separator, 1, 0, false, false, 0, 0)
+	typed := []string{c.namePrefix, c.tokenPrefix, c.idempotencyPrefix, c.expiryShardPrefix}
+	fixed := []string{expiryZSetKey, nextTokenKey, heldCountKey, maintenanceKey, holdDeadlinesKey, holdCounterKey, releaseHistoryKey, fenceCounterKey}
+
+	for i, a := range typed {
+		for j, b := range typed {
+			if i != j && strings.HasPrefix(a, b) {
+				return fmt.Errorf("webdavredisls: key separator %q makes key prefixes %q and %q ambiguous", separator, a, b)
+			}
+		}
+		for _, b := range fixed {
+			if strings.HasPrefix(b, a) {
+				return fmt.Errorf("webdavredisls: key separator %q makes key prefix %q match key %q", separator, a, b)
+			}
+		}
 	}
-	if name1 != "" {
-		name1 = slashClean(name1)
+
+	return nil
+}
+
+// validatePrefix checks the invariant enforced with
+// WithNamespacePrefixSeparator: prefix ends with the separator and contains no
+// separator followed by a typed key prefix. Then no key under another valid
+// prefix starts with prefix followed by a typed key prefix, so the SCAN MATCH
+// patterns of different lock systems can't match each other's keys.
+func (r *RedisLS) validatePrefix(prefix string) error {
+	sep := r.namespaceSeparator
+	if sep == "" {
+		return nil
+	}
+	if !strings.HasSuffix(prefix, sep) {
+		return fmt.Errorf("webdavredisls: prefix %q does not end with the namespace separator %q", prefix, sep)
+	}
+	for _, keyPrefix := range []string{r.lua.namePrefix, r.lua.tokenPrefix, r.lua.idempotencyPrefix, r.lua.expiryShardPrefix} {
+		if strings.HasPrefix(prefix, keyPrefix) || strings.Contains(prefix, sep+keyPrefix) {
+			return fmt.Errorf("webdavredisls: prefix %q contains the key prefix %q after the namespace separator %q", prefix, keyPrefix, sep)
+		}
 	}
+	return nil
+}
 
-	conditionsLen := len(conditions)
+// Scoped returns a view of the lock system that stores its locks under prefix
+// instead, sharing the pool, options and compiled scripts, e.g. to serve many
+// tenants from a single pool. Views are as safe for concurrent use as the
+// RedisLS itself and independent of each other: locks under different
+// prefixes never conflict. An OwnerStore set with WithOwnerStore is shared by
+// all views, so the references it returns must be unique across prefixes.
+func (r *RedisLS) Scoped(prefix string) *RedisLS {
+	if err := r.validatePrefix(prefix); err != nil {
+		panic(err)
+	}
 
-	args := make([]interface{}, 5+conditionsLen)
-	args[0] = r.prefix
-	args[1] = now.Unix()
-	args[2] = name0
-	args[3] = name1
-	args[4] = conditionsLen
+	scoped := *r
+	scoped.prefix = prefix
+	return &scoped
+}
 
-	for i, condition := range conditions {
-		// TODO: support Condition.Not and Condition.ETag.
-		args[5+i] = condition.Token
+// replyErrors maps the error codes of {"err", code} script replies to errors.
+var replyErrors = map[string]error{
+	errLocked:             webdav.ErrLocked,
+	errNoSuchLock:         webdav.ErrNoSuchLock,
+	errConfirmationFailed: webdav.ErrConfirmationFailed,
+	errCorruptState:       ErrCorruptState,
+	errMaintenance:        ErrMaintenance,
+	errInvalidPath:        ErrInvalidPath,
+	errTokenExists:        ErrTokenExists,
+	errInvalidToken:       ErrInvalidToken,
+	errInfiniteLock:       ErrInfiniteLock,
+	errDepthImmutable:     ErrDepthImmutable,
+}
+
+// do runs a script on a connection from r.conns. Scripts reply with either
+// {"ok", value} or {"err", code}; the value is returned and the code is mapped
+// to an error using replyErrors. Scripts that collect expired nodes append the
+// collected locks as a third element, which are passed to the expiry handler
+// once the connection has been released.
+func (r *RedisLS) do(script *redis.Script, keysAndArgs ...interface{}) (reply interface{}, err error) {
+	if r.auditHook != nil {
+		defer func() { r.audit(script, keysAndArgs, err) }()
 	}
 
-	res, err := ConfirmScript.Do(conn, args...)
+	values, err := r.doRetry(script, keysAndArgs...)
 	if err != nil {
 		return nil, err
 	}
-	if reply, ok := res.([]byte); ok {
-		replyStr := string(reply)
-		if replyStr == errConfirmationFailed {
-			return nil, webdav.ErrConfirmationFailed
+	if len(values) < 2 {
+		return nil, fmt.Errorf("unexpected script reply length: %d", len(values))
+	}
+
+	if len(values) > 2 && (r.expiryHandler != nil || r.ownerStore != nil) {
+		collected, err := redis.Values(values[2], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range collected {
+			m, err := redis.StringMap(c, nil)
+			if err != nil {
+				return nil, err
+			}
+			info := lockInfoFromMap(m)
+			info.Token = r.tokenURI(info.Token)
+			ref := info.Details.OwnerXML
+			if r.expiryHandler != nil {
+				// On error the handler gets the owner reference instead.
+				r.resolveOwner(&info.Details)
+				r.expiryHandler(info)
+			}
+			r.deleteOwner(ref)
 		}
-		return nil, fmt.Errorf("confirm error: %s", replyStr)
 	}
 
-	conditionNames, err := redis.Strings(res, nil)
+	return parseReply(values[0], values[1])
+}
+
+// parseReply returns the value of an {"ok", value} reply or the error for the
+// code of an {"err", code} reply. The only error reply with more than a code
+// is ERR_LOCKED with the conflicting lock, which is returned as a LockedError.
+func parseReply(statusValue, value interface{}) (interface{}, error) {
+	status, err := redis.String(statusValue, nil)
 	if err != nil {
 		return nil, err
 	}
-	conditionName0 := conditionNames[0]
-	conditionName1 := conditionNames[1]
 
-	return func() {
-		if conditionName0 != "" || conditionName1 != "" {
-			conn := r.pool.Get()
-			defer conn.Close()
-
-			_, err = ReleaseScript.Do(
-				conn,
-				r.prefix,
-				conditionName0,
-				conditionName1,
-			)
-			if err != nil {
-				// TODO we should not just ignore the error
-				panic(err)
-			}
+	switch status {
+	case replyOK:
+		return value, nil
+	case replyErr:
+		if values, ok := value.([]interface{}); ok {
+			return nil, lockedError(values)
 		}
-	}, nil
+		code, err := redis.String(value, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err, ok := replyErrors[code]; ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("script error: %s", code)
+	default:
+		return nil, fmt.Errorf("unexpected script reply status: %s", status)
+	}
 }
 
-func (r *RedisLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
-	conn := r.pool.Get()
-	defer conn.Close()
+// doRetry runs a script, retrying connection-level errors on a fresh
+// connection as configured with WithRetry. Error replies from Redis are
+// returned immediately.
+func (r *RedisLS) doRetry(script *redis.Script, keysAndArgs ...interface{}) ([]interface{}, error) {
+	backoff := r.retryBackoff
 
-	tokenOrErr, err := redis.String(CreateScript.Do(
-		conn,
-		r.prefix,
-		now.Unix(),
-		slashClean(details.Root),
-		durationToSec(details.Duration),
-		details.ZeroDepth,
-		details.OwnerXML,
-	))
-	if err != nil {
-		return "", err
+	for attempt := 1; ; attempt++ {
+		conn := r.conn(r.context())
+		var values []interface{}
+		var err error
+		if r.noScripting || r.txRelease && script == r.scripts.release {
+			values, err = r.runTx(conn, script, keysAndArgs...)
+		} else {
+			values, err = redis.Values(r.runScript(conn, script, keysAndArgs...))
+		}
+		r.conns.release(conn)
+
+		if err == nil || !isConnError(err) || attempt >= r.retryAttempts {
+			return values, r.scriptError(script, err)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	if tokenOrErr == errLocked {
-		return "", webdav.ErrLocked
+}
+
+// runScript runs a script on conn with EVALSHA, falling back to EVAL if it's
+// not cached, or always with EVAL as configured with WithAlwaysEval.
+func (r *RedisLS) runScript(conn redis.Conn, script *redis.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	if r.alwaysEval {
+		if err := script.Send(conn, keysAndArgs...); err != nil {
+			return nil, err
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		return conn.Receive()
+	}
+
+	if r.scriptCacheCheck > 0 {
+		r.checkScriptCache(conn)
 	}
 
-	return tokenOrErr, nil
+	return script.Do(conn, keysAndArgs...)
 }
 
-func (r *RedisLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
-	conn := r.pool.Get()
-	defer conn.Close()
+// checkScriptCache loads the scripts missing from the script cache, at most
+// once per interval configured with WithScriptCacheCheck. Errors are ignored
+// because runScript falls back to EVAL anyway.
+func (r *RedisLS) checkScriptCache(conn redis.Conn) {
+	r.scriptCheck.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.scriptCheck.last) < r.scriptCacheCheck {
+		r.scriptCheck.mu.Unlock()
+		return
+	}
+	r.scriptCheck.last = now
+	r.scriptCheck.mu.Unlock()
 
-	res, err := RefreshScript.Do(
-		conn,
-		r.prefix,
-		now.Unix(),
-		token,
-		durationToSec(duration),
-	)
+	r.loadScripts(conn)
+}
+
+// EnsureScripts loads the scripts that are missing from the script cache of
+// the Redis server with SCRIPT LOAD, e.g. at startup or after the cache has
+// been flushed, so that the following calls don't each fall back to EVAL and
+// send the full script bodies. Concurrent calls, including those on views
+// returned by Scoped, which share the scripts, wait for a single load instead
+// of all loading the scripts. It needs the SCRIPT|EXISTS and SCRIPT|LOAD
+// commands and does nothing with WithAlwaysEval or WithNoScripting.
+func (r *RedisLS) EnsureScripts(ctx context.Context) error {
+	if r.alwaysEval || r.noScripting {
+		return nil
+	}
+
+	r.scriptCheck.mu.Lock()
+	if load := r.scriptCheck.loading; load != nil {
+		r.scriptCheck.mu.Unlock()
+		select {
+		case <-load.done:
+			return load.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	load := &scriptLoad{done: make(chan struct{})}
+	r.scriptCheck.loading = load
+	r.scriptCheck.mu.Unlock()
+
+	conn := r.conn(ctx)
+	load.err = r.loadScripts(conn)
+	r.conns.release(conn)
+
+	r.scriptCheck.mu.Lock()
+	r.scriptCheck.loading = nil
+	if load.err == nil {
+		r.scriptCheck.last = time.Now()
+	}
+	r.scriptCheck.mu.Unlock()
+	close(load.done)
+
+	return load.err
+}
+
+// loadScripts loads the scripts missing from the script cache.
+func (r *RedisLS) loadScripts(conn redis.Conn) error {
+	scripts := r.scripts.all()
+
+	args := make([]interface{}, len(scripts))
+	for i, script := range scripts {
+		args[i] = script.Hash()
+	}
+
+	exists, err := redis.Ints(conn.Do("SCRIPT", append([]interface{}{"EXISTS"}, args...)...))
 	if err != nil {
-		return webdav.LockDetails{}, err
+		return err
+	}
+	if len(exists) != len(scripts) {
+		return fmt.Errorf("unexpected SCRIPT EXISTS reply length: %d", len(exists))
+	}
+
+	for i, script := range scripts {
+		if exists[i] == 0 {
+			if err := script.Load(conn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isConnError reports whether err is a connection-level error, as opposed to
+// an error reply from Redis or a malformed reply. ErrPoolTimeout is not
+// retried, as waiting for the pool again would only add to the squeeze, and
+// neither is ErrCommandTimeout, as a stuck Redis should surface quickly.
+func isConnError(err error) bool {
+	if _, ok := err.(redis.Error); ok {
+		return false
+	}
+	if errors.Is(err, ErrPoolTimeout) || errors.Is(err, ErrCommandTimeout) {
+		return false
+	}
+	if err == redis.ErrNil {
+		return false
+	}
+	return true
+}
+
+// writeRejectedError wraps error replies of a Redis that rejects writes in
+// ErrRedisOutOfMemory or ErrRedisReadOnly and returns other errors unchanged.
+// Errors raised by a redis.call inside a script may be prefixed by the script
+// error, so the code is also matched after a "-".
+func writeRejectedError(redisErr redis.Error) error {
+	msg := string(redisErr)
+
+	hasCode := func(code string) bool {
+		return strings.HasPrefix(msg, code+" ") || strings.Contains(msg, "-"+code+" ")
 	}
-	if reply, ok := res.([]byte); ok {
-		replyStr := string(reply)
-		if replyStr == errLocked {
-			return webdav.LockDetails{}, webdav.ErrLocked
+
+	switch {
+	case hasCode("OOM"):
+		return fmt.Errorf("%w: %s", ErrRedisOutOfMemory, msg)
+	case hasCode("READONLY"), hasCode("MISCONF"):
+		return fmt.Errorf("%w: %s", ErrRedisReadOnly, msg)
+	}
+	return redisErr
+}
+
+// checkConditions rejects conditions that can't be evaluated when strict
+// conditions are enabled. Otherwise only the Token of each condition is used.
+func (r *RedisLS) checkConditions(conditions []webdav.Condition) error {
+	if !r.strictConditions {
+		return nil
+	}
+	for _, condition := range conditions {
+		if condition.Not || condition.ETag != "" {
+			return webdav.ErrConfirmationFailed
 		}
-		if replyStr == errNoSuchLock {
-			return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	return nil
+}
+
+// noConditionTokens reports whether conditions were given but none of them
+// has a token. Such conditions can't match any lock, and empty tokens must not
+// reach the scripts, where ancestor nodes have an empty token.
+func noConditionTokens(conditions []webdav.Condition) bool {
+	for _, condition := range conditions {
+		if condition.Token != "" {
+			return false
 		}
-		return webdav.LockDetails{}, fmt.Errorf("refresh error: %s", replyStr)
 	}
+	return len(conditions) > 0
+}
 
-	details, err := redis.StringMap(res, nil)
+// Confirm holds the locks that cover name0 and name1 and match one of the
+// conditions until the returned release function is called. A lock that is
+// already held by another Confirm call does not match, so by default a second
+// Confirm during the hold fails with webdav.ErrConfirmationFailed, just like
+// one with a wrong token, and webdav.Handler responds with 412 Precondition
+// Failed. With WithHeldConfirmRetry it waits for the hold to end instead.
+func (r *RedisLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	var heldNames []string
+	err := r.confirmRetrying(now, name0, name1, conditions, func(now time.Time) error {
+		args, err := r.confirmArgs(now, name0, name1, conditions)
+		if err != nil {
+			return err
+		}
+		heldNames, err = redis.Strings(r.do(r.scripts.confirm, args...))
+		return err
+	})
 	if err != nil {
-		return webdav.LockDetails{}, err
+		return nil, err
 	}
 
-	lockDetails := webdav.LockDetails{}
-	lockDetails.Root = details[rootKey]
-	lockDetailsDurationSec, _ := strconv.ParseInt(details[durationKey], 10, 64)
-	lockDetails.Duration = time.Duration(lockDetailsDurationSec) * time.Second
-	lockDetails.OwnerXML = details[ownerXMLKey]
-	lockDetails.ZeroDepth = details[zeroDepthKey] == trueValue
+	return r.releaser(heldNames), nil
+}
+
+// confirmRetrying calls confirm and, with WithHeldConfirmRetry, calls it
+// again while it fails with webdav.ErrConfirmationFailed because a lock that
+// matches the conditions is held. Like CreateWait, retries poll with a
+// doubling delay and the time passed to each retry is now advanced by the
+// time spent waiting.
+func (r *RedisLS) confirmRetrying(now time.Time, name0, name1 string, conditions []webdav.Condition, confirm func(now time.Time) error) error {
+	start := time.Now()
+	backoff := createWaitMinBackoff
+
+	for {
+		elapsed := time.Since(start)
+
+		err := confirm(now.Add(elapsed))
+		if err != webdav.ErrConfirmationFailed || r.heldConfirmRetry <= 0 {
+			return err
+		}
+
+		remaining := r.heldConfirmRetry - elapsed
+		if remaining <= 0 || !r.heldMatch(now.Add(elapsed), name0, name1, conditions) {
+			return err
+		}
+
+		delay := backoff
+		if delay > remaining {
+			delay = remaining
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.context().Done():
+			timer.Stop()
+			return r.context().Err()
+		case <-timer.C:
+		}
 
-	return lockDetails, nil
+		backoff *= 2
+		if backoff > createWaitMaxBackoff {
+			backoff = createWaitMaxBackoff
+		}
+	}
 }
 
-func (r *RedisLS) Unlock(now time.Time, token string) error {
-	conn := r.pool.Get()
-	defer conn.Close()
+// heldMatch reports whether one of the conditions identifies a held lock that
+// covers name0 or name1, i.e. whether Confirm failed only because of the hold.
+func (r *RedisLS) heldMatch(now time.Time, name0, name1 string, conditions []webdav.Condition) bool {
+	for _, condition := range conditions {
+		if condition.Token == "" {
+			continue
+		}
+		info, err := r.GetLock(now, condition.Token)
+		if err != nil || !info.Held {
+			continue
+		}
+		for _, name := range []string{name0, name1} {
+			if name != "" && lockCovers(info.Details.Root, info.Details.ZeroDepth, r.cleanPath(name)) {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	res, err := UnlockScript.Do(
-		conn,
-		r.prefix,
-		now.Unix(),
-		token,
-	)
+// ConfirmWithTimeout is like Confirm, but the held locks are also released by
+// SweepHolds once maxHold has passed, so that a release function that is
+// leaked, e.g. by a handler that panicked, can't keep them held forever. The
+// returned release function does nothing for holds that were already swept.
+//
+// This is a last resort, not a substitute for calling the release function:
+// an operation that runs longer than maxHold loses its locks while it is still
+// in progress. maxHold is rounded down to whole seconds and must be at least
+// a second.
+func (r *RedisLS) ConfirmWithTimeout(now time.Time, name0, name1 string, maxHold time.Duration, conditions ...webdav.Condition) (func(), error) {
+	maxHoldSec := durationToSec(maxHold)
+	if maxHoldSec <= 0 {
+		return nil, errors.New("webdavredisls: maxHold must be at least a second")
+	}
+
+	args, err := r.confirmArgs(now, name0, name1, conditions)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if reply, ok := res.([]byte); ok {
-		replyStr := string(reply)
-		if replyStr == errLocked {
-			return webdav.ErrLocked
-		}
-		if replyStr == errNoSuchLock {
-			return webdav.ErrNoSuchLock
+	args = append(args, maxHoldSec)
+
+	members, err := redis.Strings(r.do(r.scripts.confirmWithTimeout, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if len(members) > 0 {
+			releaseArgs := make([]interface{}, 1+len(members))
+			releaseArgs[0] = r.prefix
+			for i, member := range members {
+				releaseArgs[1+i] = member
+			}
+
+			_, err := r.do(r.scripts.releaseHolds, releaseArgs...)
+			if err != nil {
+				// TODO we should not just ignore the error
+				panic(err)
+			}
 		}
-		return fmt.Errorf("unlock error: %s", replyStr)
+	}, nil
+}
+
+// SweepHolds releases the locks held by ConfirmWithTimeout whose maxHold has
+// passed and returns how many holds it released. It should run periodically,
+// e.g. from a background goroutine, when ConfirmWithTimeout is used.
+func (r *RedisLS) SweepHolds(now time.Time) (int, error) {
+	return redis.Int(r.do(r.scripts.sweepHolds, r.prefix, now.Unix()))
+}
+
+// confirmArgs checks the arguments of Confirm and returns them as the
+// arguments of the confirm script.
+func (r *RedisLS) confirmArgs(now time.Time, name0, name1 string, conditions []webdav.Condition) ([]interface{}, error) {
+	if err := r.checkConditions(conditions); err != nil {
+		return nil, err
+	}
+	if noConditionTokens(conditions) && (name0 != "" || name1 != "") {
+		return nil, webdav.ErrConfirmationFailed
 	}
 
-	return nil
+	if name0 != "" {
+		name0 = r.cleanPath(name0)
+	}
+	if name1 != "" {
+		name1 = r.cleanPath(name1)
+	}
+
+	conditionsLen := len(conditions)
+
+	args := make([]interface{}, 5+conditionsLen)
+	args[0] = r.prefix
+	args[1] = now.Unix()
+	args[2] = name0
+	args[3] = name1
+	args[4] = conditionsLen
+
+	for i, condition := range conditions {
+		// TODO: support Condition.Not and Condition.ETag. Conditions without
+		// a token are sent as well, the script never matches them.
+		args[5+i] = r.storedToken(condition.Token)
+	}
+
+	return args, nil
+}
+
+// ConfirmRoots is like Confirm, but holds the explicit locks on roots directly
+// instead of looking up the locks that match a set of conditions. It is meant
+// for callers that created the locks themselves and know their roots, e.g. in
+// a MOVE that has just locked the source and the destination. Use Confirm for
+// clients that present If headers.
+//
+// Either all the locks are held or none is. It returns
+// webdav.ErrConfirmationFailed if a root has no explicit lock and
+// webdav.ErrLocked if one is already held.
+func (r *RedisLS) ConfirmRoots(now time.Time, roots []string) (func(), error) {
+	args := make([]interface{}, 2+len(roots))
+	args[0] = r.prefix
+	args[1] = now.Unix()
+	for i, root := range roots {
+		args[2+i] = r.cleanPath(root)
+	}
+
+	heldNames, err := redis.Strings(r.do(r.scripts.confirmRoots, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return r.releaser(heldNames), nil
+}
+
+// ConfirmManyPartial is like Confirm for any number of names, but instead of
+// failing as a whole it holds the locks of the names that match the conditions
+// and reports the names that don't in failed, e.g. for batch operations that
+// process whatever they could lock. A name fails if no lock matching one of
+// the conditions covers it or if that lock is already held. held and failed
+// keep the order of names.
+//
+// Unlike Confirm, which holds either all locks or none, it returns a nil error
+// when some or even all names failed. The caller decides whether to proceed
+// with the held names or to give up, and must call release in either case;
+// it releases just the locks that were held. Use Confirm where all names must
+// be locked together, e.g. for the source and the destination of a MOVE.
+func (r *RedisLS) ConfirmManyPartial(now time.Time, names []string, conditions ...webdav.Condition) (held, failed []string, release func(), err error) {
+	if err := r.checkConditions(conditions); err != nil {
+		return nil, nil, nil, err
+	}
+	if noConditionTokens(conditions) || len(conditions) == 0 {
+		return nil, append([]string{}, names...), func() {}, nil
+	}
+
+	args := make([]interface{}, 0, 3+len(names)+len(conditions))
+	args = append(args, r.prefix, now.Unix(), len(names))
+	for _, name := range names {
+		args = append(args, r.cleanPath(name))
+	}
+	for _, condition := range conditions {
+		args = append(args, r.storedToken(condition.Token))
+	}
+
+	values, err := redis.Values(r.do(r.scripts.confirmPartial, args...))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var heldNames, results []string
+	if _, err := redis.Scan(values, &heldNames, &results); err != nil {
+		return nil, nil, nil, err
+	}
+	if len(results) != len(names) {
+		return nil, nil, nil, fmt.Errorf("unexpected script reply length: %d", len(results))
+	}
+
+	for i, name := range names {
+		if results[i] == trueValue {
+			held = append(held, name)
+		} else {
+			failed = append(failed, name)
+		}
+	}
+
+	return held, failed, r.releaser(heldNames), nil
+}
+
+// releaser returns the release function for the nodes held by Confirm or
+// ConfirmRoots.
+func (r *RedisLS) releaser(heldNames []string) func() {
+	return func() {
+		if len(heldNames) > 0 {
+			releaseArgs := make([]interface{}, 1+len(heldNames))
+			releaseArgs[0] = r.prefix
+			for i, name := range heldNames {
+				releaseArgs[1+i] = name
+			}
+
+			_, err := r.do(r.scripts.release, releaseArgs...)
+			if err != nil {
+				// TODO we should not just ignore the error
+				panic(err)
+			}
+		}
+	}
+}
+
+// expiryJitterSec returns a random number of seconds in [0, expiryJitter] to
+// add to the expiry of the locks created or refreshed by one script run.
+func (r *RedisLS) expiryJitterSec() int64 {
+	maxSec := int64(r.expiryJitter / time.Second)
+	if maxSec <= 0 {
+		return 0
+	}
+	return rand.Int63n(maxSec + 1)
+}
+
+// lockDuration applies WithRejectZeroDuration and WithMinDuration to a
+// requested lock duration. Durations are stored in whole seconds, so anything
+// under a second counts as zero.
+func (r *RedisLS) lockDuration(d time.Duration) (time.Duration, error) {
+	if IsInfinite(d) {
+		return d, nil
+	}
+	if r.rejectZero && durationToSec(d) == 0 {
+		return 0, ErrZeroDuration
+	}
+	if d < r.minDuration {
+		return r.minDuration, nil
+	}
+	return d, nil
+}
+
+// checkOwnerXML validates ownerXML against the configured limits.
+func (r *RedisLS) checkOwnerXML(ownerXML string) error {
+	if r.maxOwnerXMLBytes > 0 && len(ownerXML) > r.maxOwnerXMLBytes {
+		return ErrOwnerXMLTooLarge
+	}
+	if r.ownerValidator != nil && ownerXML != "" {
+		if err := r.ownerValidator(ownerXML); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidOwner, err)
+		}
+	}
+	return nil
+}
+
+// checkPathDepth enforces the depth limit set with WithScriptBudget for a lock
+// at the clean path root.
+func (r *RedisLS) checkPathDepth(root string) error {
+	if r.maxPathDepth > 0 && strings.Count(root, "/") > r.maxPathDepth {
+		return ErrPathTooDeep
+	}
+	return nil
+}
+
+// checkRootLock enforces the policy set with WithRootLockPolicy and the depth
+// limit set with WithScriptBudget for a lock at the clean path root. explicit
+// is whether the lock is created with CreateRootLock.
+func (r *RedisLS) checkRootLock(root string, zeroDepth bool, explicit bool) error {
+	if err := r.checkPathDepth(root); err != nil {
+		return err
+	}
+	if root != "/" || zeroDepth {
+		return nil
+	}
+	switch r.rootLockPolicy {
+	case RootLockDenied:
+		return ErrRootLockForbidden
+	case RootLockExplicit:
+		if !explicit {
+			return ErrRootLockForbidden
+		}
+	}
+	return nil
+}
+
+func (r *RedisLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	token, _, err := r.create(now, details, false)
+	if errors.Is(err, webdav.ErrLocked) {
+		// webdav.Handler compares errors with ==.
+		return "", webdav.ErrLocked
+	}
+	return token, err
+}
+
+// CreateDetails is like Create, but also returns the lock details as they are
+// stored: with the root cleaned and the duration adjusted by
+// WithMinDuration and truncated to whole seconds. Use them to render the
+// lockdiscovery response instead of the requested details.
+func (r *RedisLS) CreateDetails(now time.Time, details webdav.LockDetails) (token string, stored webdav.LockDetails, err error) {
+	return r.create(now, details, false)
+}
+
+// CreateRootLock is like Create, but also creates infinite-depth locks at "/"
+// when they are limited to explicit requests with RootLockExplicit.
+func (r *RedisLS) CreateRootLock(now time.Time, details webdav.LockDetails) (string, error) {
+	token, _, err := r.create(now, details, true)
+	if errors.Is(err, webdav.ErrLocked) {
+		return "", webdav.ErrLocked
+	}
+	return token, err
+}
+
+func (r *RedisLS) create(now time.Time, details webdav.LockDetails, explicitRoot bool) (string, webdav.LockDetails, error) {
+	if err := r.checkOwnerXML(details.OwnerXML); err != nil {
+		return "", webdav.LockDetails{}, err
+	}
+	duration, err := r.lockDuration(details.Duration)
+	if err != nil {
+		return "", webdav.LockDetails{}, err
+	}
+	root := r.cleanPath(details.Root)
+	if err := r.checkRootLock(root, details.ZeroDepth, explicitRoot); err != nil {
+		return "", webdav.LockDetails{}, err
+	}
+
+	token, err := redis.String(r.do(
+		r.scripts.create,
+		r.prefix,
+		now.Unix(),
+		root,
+		durationToSec(duration),
+		details.ZeroDepth,
+		r.inlineOwnerXML(details.OwnerXML),
+		r.expiryJitterSec(),
+		r.inlineCollect,
+	))
+
+	token, err = r.finishCreate(now, token, details.OwnerXML, r.conflict(root, err))
+	if err != nil {
+		return "", webdav.LockDetails{}, err
+	}
+
+	return r.tokenURI(token), webdav.LockDetails{
+		Root:      root,
+		Duration:  secToDuration(durationToSec(duration)),
+		OwnerXML:  details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+	}, nil
+}
+
+// TryCreate is like Create, but reports a conflicting lock with granted set to
+// false and a nil error instead of webdav.ErrLocked, so that err is reserved
+// for genuine failures.
+func (r *RedisLS) TryCreate(now time.Time, details webdav.LockDetails) (token string, granted bool, err error) {
+	token, err = r.Create(now, details)
+	if err == webdav.ErrLocked {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// CreateWait is like Create, but if the lock conflicts with an existing lock it
+// retries until the conflicting lock is gone, ctx is done or maxWait has
+// elapsed, in which case it returns webdav.ErrLocked. Retries poll with a delay
+// that starts at createWaitMinBackoff and doubles up to createWaitMaxBackoff,
+// so a released lock is noticed up to that much later. The time passed to each
+// retry is now advanced by the time spent waiting.
+func (r *RedisLS) CreateWait(ctx context.Context, now time.Time, details webdav.LockDetails, maxWait time.Duration) (string, error) {
+	start := time.Now()
+	backoff := createWaitMinBackoff
+
+	for {
+		elapsed := time.Since(start)
+
+		token, err := r.Create(now.Add(elapsed), details)
+		if err != webdav.ErrLocked {
+			return token, err
+		}
+
+		remaining := maxWait - elapsed
+		if remaining <= 0 {
+			return "", webdav.ErrLocked
+		}
+
+		delay := backoff
+		if delay > remaining {
+			delay = remaining
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > createWaitMaxBackoff {
+			backoff = createWaitMaxBackoff
+		}
+	}
+}
+
+// CreateAll locks all of roots with the same duration, depth and owner,
+// waiting for conflicting locks like CreateWait, and returns the tokens in the
+// order of roots. It acquires the locks one by one in a canonical order, sorted
+// by cleaned path, so that two CreateAll calls for overlapping sets of roots
+// can't deadlock by each waiting for a lock the other one holds. Callers that
+// mix CreateAll with their own sequences of Create or CreateWait calls for the
+// same roots must acquire those in the same sorted order too.
+//
+// maxWait bounds the whole call. If a lock can't be acquired, the locks
+// acquired so far are unlocked in reverse order and the error is returned.
+// Roots that conflict with each other, e.g. "/a" and "/a/b" for
+// infinite-depth locks, fail with webdav.ErrLocked without waiting.
+func (r *RedisLS) CreateAll(ctx context.Context, now time.Time, roots []string, duration time.Duration, zeroDepth bool, ownerXML string, maxWait time.Duration) ([]string, error) {
+	order := make([]int, len(roots))
+	cleaned := make([]string, len(roots))
+	for i, root := range roots {
+		order[i] = i
+		cleaned[i] = r.cleanPath(root)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return cleaned[order[i]] < cleaned[order[j]]
+	})
+
+	for i, a := range order {
+		for _, b := range order[i+1:] {
+			if lockCovers(cleaned[a], zeroDepth, cleaned[b]) || lockCovers(cleaned[b], zeroDepth, cleaned[a]) {
+				return nil, webdav.ErrLocked
+			}
+		}
+	}
+
+	start := time.Now()
+	tokens := make([]string, len(roots))
+
+	for n, i := range order {
+		elapsed := time.Since(start)
+		token, err := r.CreateWait(ctx, now.Add(elapsed), webdav.LockDetails{
+			Root:      cleaned[i],
+			Duration:  duration,
+			OwnerXML:  ownerXML,
+			ZeroDepth: zeroDepth,
+		}, maxWait-elapsed)
+		if err != nil {
+			for k := n - 1; k >= 0; k-- {
+				r.Unlock(now.Add(time.Since(start)), tokens[order[k]])
+			}
+			return nil, err
+		}
+		tokens[i] = token
+	}
+
+	return tokens, nil
+}
+
+// CreateIdempotent is like Create, but if a previous call with the same
+// idempotency key created a lock that still exists, its token is returned
+// instead of webdav.ErrLocked. This makes it safe to retry a Create whose
+// reply was lost. Keys are remembered for the window set with
+// WithIdempotencyWindow.
+func (r *RedisLS) CreateIdempotent(now time.Time, key string, details webdav.LockDetails) (string, error) {
+	if err := r.checkOwnerXML(details.OwnerXML); err != nil {
+		return "", err
+	}
+	duration, err := r.lockDuration(details.Duration)
+	if err != nil {
+		return "", err
+	}
+	root := r.cleanPath(details.Root)
+	if err := r.checkRootLock(root, details.ZeroDepth, false); err != nil {
+		return "", err
+	}
+
+	token, err := redis.String(r.do(
+		r.scripts.createIdempotent,
+		r.prefix,
+		now.Unix(),
+		key,
+		durationToSec(r.idempotencyWindow),
+		root,
+		durationToSec(duration),
+		details.ZeroDepth,
+		r.inlineOwnerXML(details.OwnerXML),
+		r.expiryJitterSec(),
+	))
+
+	token, err = r.finishCreate(now, token, details.OwnerXML, r.conflict(root, err))
+	if err != nil {
+		return "", err
+	}
+	return r.tokenURI(token), nil
+}
+
+// CreateUntil is like Create, but the lock expires exactly at deadline,
+// truncated to whole seconds, instead of a duration after now, e.g. for
+// schedulers that compute absolute deadlines. The stored duration, which is
+// reported in LockDetails, is the time from now to deadline. As the expiry is
+// exact, WithMinDuration, WithExpiryJitter and WithExpiryRounding don't apply.
+// It returns ErrDeadlinePassed if deadline is not at least a second after
+// now.
+func (r *RedisLS) CreateUntil(now time.Time, root string, deadline time.Time, zeroDepth bool, ownerXML string) (string, error) {
+	durationSec := deadline.Unix() - now.Unix()
+	if durationSec <= 0 {
+		return "", ErrDeadlinePassed
+	}
+	if err := r.checkOwnerXML(ownerXML); err != nil {
+		return "", err
+	}
+	root = r.cleanPath(root)
+	if err := r.checkRootLock(root, zeroDepth, false); err != nil {
+		return "", err
+	}
+
+	token, err := redis.String(r.do(
+		r.scripts.create,
+		r.prefix,
+		now.Unix(),
+		root,
+		durationSec,
+		zeroDepth,
+		r.inlineOwnerXML(ownerXML),
+		0,
+		r.inlineCollect,
+		deadline.Unix(),
+	))
+
+	token, err = r.finishCreate(now, token, ownerXML, r.conflict(root, err))
+	if errors.Is(err, webdav.ErrLocked) {
+		// Like Create, for callers that compare errors with ==.
+		return "", webdav.ErrLocked
+	}
+	if err != nil {
+		return "", err
+	}
+	return r.tokenURI(token), nil
+}
+
+// CreateWithMeta creates a lock like Create, but instead of owner XML it
+// attaches meta to the lock, which GetLock returns in LockInfo.Meta. It is
+// meant for callers that use the lock system as a general-purpose lock rather
+// than for WebDAV.
+func (r *RedisLS) CreateWithMeta(now time.Time, root string, duration time.Duration, zeroDepth bool, meta map[string]string) (string, error) {
+	duration, err := r.lockDuration(duration)
+	if err != nil {
+		return "", err
+	}
+	root = r.cleanPath(root)
+	if err := r.checkRootLock(root, zeroDepth, false); err != nil {
+		return "", err
+	}
+
+	args := redis.Args{}.Add(
+		r.prefix,
+		now.Unix(),
+		root,
+		durationToSec(duration),
+		zeroDepth,
+		r.expiryJitterSec(),
+		r.inlineCollect,
+	)
+	for key, value := range meta {
+		args = args.Add(key, value)
+	}
+
+	token, err := redis.String(r.do(r.scripts.createWithMeta, args...))
+	if err != nil {
+		return "", r.conflict(root, err)
+	}
+	return r.tokenURI(token), nil
+}
+
+func (r *RedisLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	res, err := r.RefreshInfo(now, token, duration)
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return res.Details, nil
+}
+
+// RefreshResult is the result of RefreshInfo.
+type RefreshResult struct {
+	// Details are the lock metadata with the new duration.
+	Details webdav.LockDetails
+	// Expiry is when the refreshed lock expires, including any expiry
+	// jitter. It is the zero time for locks with an infinite duration.
+	Expiry time.Time
+}
+
+// RefreshInfo is like Refresh, but also returns the absolute expiry of the
+// refreshed lock, so that callers can compute the remaining time on their own
+// clock.
+func (r *RedisLS) RefreshInfo(now time.Time, token string, duration time.Duration) (RefreshResult, error) {
+	if token == "" {
+		return RefreshResult{}, webdav.ErrNoSuchLock
+	}
+	duration, err := r.lockDuration(duration)
+	if err != nil {
+		return RefreshResult{}, err
+	}
+
+	return r.refresh(r.prefix, now.Unix(), r.storedToken(token), durationToSec(duration), r.expiryJitterSec())
+}
+
+// RefreshUntil is like RefreshInfo, but the lock expires exactly at deadline,
+// truncated to whole seconds, like a lock created with CreateUntil. It returns
+// ErrDeadlinePassed if deadline is not at least a second after now.
+func (r *RedisLS) RefreshUntil(now time.Time, token string, deadline time.Time) (RefreshResult, error) {
+	if token == "" {
+		return RefreshResult{}, webdav.ErrNoSuchLock
+	}
+	durationSec := deadline.Unix() - now.Unix()
+	if durationSec <= 0 {
+		return RefreshResult{}, ErrDeadlinePassed
+	}
+
+	return r.refresh(r.prefix, now.Unix(), r.storedToken(token), durationSec, 0, deadline.Unix())
+}
+
+// RefreshOpts are the optional changes RefreshWithOpts makes along with the
+// refresh. Nil fields keep the stored values.
+type RefreshOpts struct {
+	// OwnerXML replaces the owner of the lock, for clients that resubmit the
+	// owner when refreshing.
+	OwnerXML *string
+	// ZeroDepth is the depth the client resubmitted. It must match the depth
+	// of the lock, otherwise the refresh fails with ErrDepthImmutable.
+	ZeroDepth *bool
+}
+
+// RefreshWithOpts is like RefreshInfo, but also applies opts atomically with
+// the refresh: either the lock is refreshed and its owner replaced, or neither
+// happens. Refresh keeps the owner, as a strict reading of RFC 4918 requires;
+// RefreshWithOpts is for compatibility with clients that expect otherwise.
+func (r *RedisLS) RefreshWithOpts(now time.Time, token string, duration time.Duration, opts RefreshOpts) (RefreshResult, error) {
+	if token == "" {
+		return RefreshResult{}, webdav.ErrNoSuchLock
+	}
+	duration, err := r.lockDuration(duration)
+	if err != nil {
+		return RefreshResult{}, err
+	}
+	token = r.storedToken(token)
+
+	// The empty argument is the deadline of RefreshUntil.
+	args := redis.Args{r.prefix, now.Unix(), token, durationToSec(duration), r.expiryJitterSec(), ""}
+
+	// ref is the owner reference put into the OwnerStore, if any.
+	ref := ""
+	if opts.OwnerXML != nil {
+		if err := r.checkOwnerXML(*opts.OwnerXML); err != nil {
+			return RefreshResult{}, err
+		}
+		stored := *opts.OwnerXML
+		if r.ownerStore != nil && stored != "" {
+			if ref, err = r.ownerStore.Put(token, stored); err != nil {
+				return RefreshResult{}, err
+			}
+			stored = ref
+		}
+		args = args.Add(true, stored)
+	} else {
+		args = args.Add(false, "")
+	}
+
+	if opts.ZeroDepth != nil {
+		args = args.Add(true, *opts.ZeroDepth)
+	} else {
+		args = args.Add(false, false)
+	}
+
+	details, err := redis.StringMap(r.do(r.scripts.refresh, args...))
+	if err != nil {
+		r.deleteOwner(ref)
+		return RefreshResult{}, err
+	}
+
+	if previous, ok := details[previousOwnerXMLKey]; ok && previous != ref {
+		r.deleteOwner(previous)
+	}
+
+	d := lockDetailsFromMap(details)
+	if opts.OwnerXML != nil {
+		d.OwnerXML = *opts.OwnerXML
+	} else if err := r.resolveOwner(&d); err != nil {
+		return RefreshResult{}, err
+	}
+
+	return RefreshResult{
+		Details: d,
+		Expiry:  expiryFromMap(details),
+	}, nil
+}
+
+// refresh runs the refresh script with args and returns its result.
+func (r *RedisLS) refresh(args ...interface{}) (RefreshResult, error) {
+	details, err := redis.StringMap(r.do(r.scripts.refresh, args...))
+	if err != nil {
+		return RefreshResult{}, err
+	}
+
+	d := lockDetailsFromMap(details)
+	if err := r.resolveOwner(&d); err != nil {
+		return RefreshResult{}, err
+	}
+
+	return RefreshResult{
+		Details: d,
+		Expiry:  expiryFromMap(details),
+	}, nil
+}
+
+// RefreshManyError is returned by RefreshMany when some of the locks could
+// not be refreshed. Errors maps each such token to webdav.ErrLocked or
+// webdav.ErrNoSuchLock.
+type RefreshManyError struct {
+	Errors map[string]error
+}
+
+func (e *RefreshManyError) Error() string {
+	return fmt.Sprintf("webdavredisls: failed to refresh %d locks", len(e.Errors))
+}
+
+// RefreshMany refreshes all the locks identified by tokens to duration in a
+// single script run and returns their updated details in the order of tokens.
+// Locks that are held or do not exist are skipped without failing the batch:
+// their details are left zero and a *RefreshManyError lists them.
+func (r *RedisLS) RefreshMany(now time.Time, tokens []string, duration time.Duration) ([]webdav.LockDetails, error) {
+	duration, err := r.lockDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+
+	tokensLen := len(tokens)
+
+	args := make([]interface{}, 5+tokensLen)
+	args[0] = r.prefix
+	args[1] = now.Unix()
+	args[2] = durationToSec(duration)
+	args[3] = r.expiryJitterSec()
+	args[4] = tokensLen
+
+	for i, token := range tokens {
+		args[5+i] = r.storedToken(token)
+	}
+
+	replies, err := redis.Values(r.do(r.scripts.refreshMany, args...))
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) != tokensLen {
+		return nil, fmt.Errorf("unexpected script reply length: %d", len(replies))
+	}
+
+	details := make([]webdav.LockDetails, tokensLen)
+	var errs map[string]error
+
+	for i, reply := range replies {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, fmt.Errorf("unexpected script reply length: %d", len(values))
+		}
+
+		m, err := redis.StringMap(parseReply(values[0], values[1]))
+		if err == webdav.ErrLocked || err == webdav.ErrNoSuchLock {
+			if errs == nil {
+				errs = map[string]error{}
+			}
+			errs[tokens[i]] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		details[i] = lockDetailsFromMap(m)
+		if err := r.resolveOwner(&details[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if errs != nil {
+		return details, &RefreshManyError{Errors: errs}
+	}
+
+	return details, nil
+}
+
+// UpdateOwner replaces the owner XML of the lock identified by token and
+// returns the updated details. It returns webdav.ErrLocked if the lock is held
+// and webdav.ErrNoSuchLock if there is no such lock.
+func (r *RedisLS) UpdateOwner(now time.Time, token string, ownerXML string) (webdav.LockDetails, error) {
+	if token == "" {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if err := r.checkOwnerXML(ownerXML); err != nil {
+		return webdav.LockDetails{}, err
+	}
+	token = r.storedToken(token)
+
+	if r.ownerStore != nil {
+		return r.storeOwner(now, token, ownerXML, false)
+	}
+
+	details, err := redis.StringMap(r.do(
+		r.scripts.updateOwner,
+		r.prefix,
+		now.Unix(),
+		token,
+		ownerXML,
+	))
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	return lockDetailsFromMap(details), nil
+}
+
+// StealOption modifies the behavior of Steal.
+type StealOption int
+
+const (
+	// StealNewToken makes Steal issue a new token for the lock. The old token
+	// stops working.
+	StealNewToken StealOption = iota + 1
+	// ForceSteal makes Steal take over a lock that is held by a Confirm call.
+	// The lock stays held until that call's release.
+	ForceSteal
+)
+
+// Steal transfers the lock identified by token to a new owner in a single
+// step, replacing its owner XML and duration while keeping the lock in place,
+// so there is no window in which another party could lock the resource. It
+// returns the lock's token, which is a new one if StealNewToken is given.
+//
+// Unlike Refresh, Steal changes the ownership of the lock. It returns
+// webdav.ErrLocked if the lock is held, unless ForceSteal is given, and
+// webdav.ErrNoSuchLock if there is no such lock.
+func (r *RedisLS) Steal(now time.Time, token string, newOwnerXML string, newDuration time.Duration, opts ...StealOption) (string, error) {
+	if token == "" {
+		return "", webdav.ErrNoSuchLock
+	}
+	if err := r.checkOwnerXML(newOwnerXML); err != nil {
+		return "", err
+	}
+	newDuration, err := r.lockDuration(newDuration)
+	if err != nil {
+		return "", err
+	}
+	token = r.storedToken(token)
+
+	newToken, force := false, false
+	for _, opt := range opts {
+		switch opt {
+		case StealNewToken:
+			newToken = true
+		case ForceSteal:
+			force = true
+		}
+	}
+
+	stolen, err := redis.String(r.do(
+		r.scripts.steal,
+		r.prefix,
+		now.Unix(),
+		token,
+		newOwnerXML,
+		durationToSec(newDuration),
+		newToken,
+		force,
+		r.expiryJitterSec(),
+		// With an OwnerStore the old owner is replaced by storeOwner, which
+		// deletes its document.
+		r.ownerStore != nil,
+	))
+	if err != nil {
+		return "", err
+	}
+
+	if r.ownerStore != nil {
+		if _, err := r.storeOwner(now, stolen, newOwnerXML, force); err != nil {
+			return "", err
+		}
+	}
+
+	return r.tokenURI(stolen), nil
+}
+
+// MoveLock moves the lock identified by token to newRoot, e.g. when the locked
+// resource is moved, keeping its token, duration, expiry and owner. It returns
+// webdav.ErrLocked if the lock is held or if it would conflict with another
+// lock at newRoot, in which case the lock stays where it was.
+func (r *RedisLS) MoveLock(now time.Time, token string, newRoot string) (webdav.LockDetails, error) {
+	if token == "" {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	newRoot = r.cleanPath(newRoot)
+	if err := r.checkPathDepth(newRoot); err != nil {
+		return webdav.LockDetails{}, err
+	}
+	if newRoot == "/" && r.rootLockPolicy != RootLockAllowed {
+		// The depth of a lock never changes, so it can be checked up front.
+		info, err := r.GetLock(now, token)
+		if err != nil {
+			return webdav.LockDetails{}, err
+		}
+		if err := r.checkRootLock(newRoot, info.Details.ZeroDepth, false); err != nil {
+			return webdav.LockDetails{}, err
+		}
+	}
+
+	m, err := redis.StringMap(r.do(
+		r.scripts.moveLock,
+		r.prefix,
+		now.Unix(),
+		r.storedToken(token),
+		newRoot,
+	))
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	info, err := r.lockInfo(m)
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	return info.Details, nil
+}
+
+// Unlock removes the lock identified by token. Like the other methods that
+// take a token, it returns webdav.ErrNoSuchLock for an empty token without
+// contacting Redis.
+func (r *RedisLS) Unlock(now time.Time, token string) error {
+	if token == "" {
+		return webdav.ErrNoSuchLock
+	}
+	return r.unlocked(r.do(
+		r.scripts.unlock,
+		r.prefix,
+		now.Unix(),
+		r.storedToken(token),
+	))
+}
+
+// ValidateToken reports whether Unlock would succeed for token at now without
+// changing anything: exists is false if Unlock would return
+// webdav.ErrNoSuchLock, including for a lock that has expired but has not
+// been collected yet, and held is true if it would return webdav.ErrLocked.
+// Like any pre-flight check, the answer may be stale by the time the client
+// acts on it.
+func (r *RedisLS) ValidateToken(now time.Time, token string) (exists bool, held bool, err error) {
+	if token == "" {
+		return false, false, nil
+	}
+	values, err := redis.Ints(r.do(r.scripts.validateToken, r.prefix, now.Unix(), r.storedToken(token)))
+	if err != nil {
+		return false, false, err
+	}
+	if len(values) != 2 {
+		return false, false, fmt.Errorf("unexpected script reply length: %d", len(values))
+	}
+	return values[0] == 1, values[1] == 1, nil
+}
+
+// UnlockResult is like Unlock, but reports a lock that does not exist, e.g.
+// because it has already expired or been removed, with removed set to false
+// and a nil error instead of webdav.ErrNoSuchLock, so that "unlock if present"
+// loops don't have to treat a missing lock as an error. err is reserved for
+// webdav.ErrLocked and genuine failures.
+func (r *RedisLS) UnlockResult(now time.Time, token string) (removed bool, err error) {
+	err = r.Unlock(now, token)
+	if err == webdav.ErrNoSuchLock {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UnlockByPath removes the explicit lock on root without knowing its token,
+// e.g. for administrative tooling when a client has lost the token. Like
+// Unlock it returns webdav.ErrLocked if the lock is held. It returns
+// webdav.ErrNoSuchLock if root has no explicit lock, even if it is covered by
+// an ancestor's infinite depth lock.
+func (r *RedisLS) UnlockByPath(now time.Time, root string) error {
+	return r.unlocked(r.do(
+		r.scripts.unlockByPath,
+		r.prefix,
+		now.Unix(),
+		r.cleanPath(root),
+	))
+}
+
+// unlocked handles the reply of the unlock scripts, which is the owner XML of
+// the removed lock.
+func (r *RedisLS) unlocked(reply interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+
+	ownerXML, err := redis.String(reply, nil)
+	if err != nil {
+		return err
+	}
+	r.deleteOwner(ownerXML)
+
+	return nil
+}
+
+// cleanPath canonicalizes a lock path: it applies the normalizer set with
+// WithPathNormalizer, lowercases it if WithCaseFold is set and then cleans the
+// result.
+func (r *RedisLS) cleanPath(name string) string {
+	if r.pathNormalizer != nil {
+		name = r.pathNormalizer(name)
+	}
+	if r.caseFold {
+		name = strings.ToLower(name)
+	}
+	return slashClean(name)
 }
 
 // slashClean is equivalent to but slightly more efficient than
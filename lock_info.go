@@ -0,0 +1,360 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	webdav "github.com/koofr/go-webdav"
+)
+
+// LockInfo describes an explicit lock as stored in Redis.
+type LockInfo struct {
+	// Token is the unique identifier for the lock.
+	Token string
+	// Details are the lock metadata.
+	Details webdav.LockDetails
+	// Held is whether the lock is actively held by a Confirm call that has
+	// not been released yet.
+	Held bool
+	// RefCount is the number of locks at or below the lock's root, including
+	// the lock itself. It is 0 for locks passed to the expiry handler.
+	RefCount int
+	// Expiry is when the lock expires, unless it is held. It is the zero
+	// time for locks with an infinite duration.
+	Expiry time.Time
+	// HeldSince is when the lock was held by the Confirm call that has not
+	// been released yet. It is the zero time if the lock is not held.
+	HeldSince time.Time
+	// CreatedAt is when the lock was created. Refreshing the lock does not
+	// change it. It is the zero time unless the lock was created with
+	// WithCreationTimestamps.
+	CreatedAt time.Time
+	// Meta is the metadata attached with CreateWithMeta. It is only set by
+	// GetLock.
+	Meta map[string]string
+}
+
+func lockDetailsFromMap(m map[string]string) webdav.LockDetails {
+	durationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+
+	return webdav.LockDetails{
+		Root:      m[rootKey],
+		Duration:  secToDuration(durationSec),
+		OwnerXML:  m[ownerXMLKey],
+		ZeroDepth: m[zeroDepthKey] == trueValue,
+	}
+}
+
+// expiryFromMap returns the absolute expiry of a lock reply, or the zero time
+// for an infinite lock.
+func expiryFromMap(m map[string]string) time.Time {
+	durationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+	expirySec, err := strconv.ParseInt(m[expiryKey], 10, 64)
+	if durationSec < 0 || err != nil {
+		return time.Time{}
+	}
+	return time.Unix(expirySec, 0)
+}
+
+func lockInfoFromMap(m map[string]string) LockInfo {
+	refCount, _ := strconv.Atoi(m[refCountKey])
+
+	info := LockInfo{
+		Token:    m[tokenKey],
+		Details:  lockDetailsFromMap(m),
+		Held:     m[heldKey] == trueValue,
+		RefCount: refCount,
+		Expiry:   expiryFromMap(m),
+	}
+
+	if heldSinceSec, err := strconv.ParseInt(m[heldSinceKey], 10, 64); err == nil && info.Held {
+		info.HeldSince = time.Unix(heldSinceSec, 0)
+	}
+
+	if createdAtSec, err := strconv.ParseInt(m[createdAtKey], 10, 64); err == nil {
+		info.CreatedAt = time.Unix(createdAtSec, 0)
+	}
+
+	for field, value := range m {
+		if strings.HasPrefix(field, metaKeyPrefix) {
+			if info.Meta == nil {
+				info.Meta = map[string]string{}
+			}
+			info.Meta[strings.TrimPrefix(field, metaKeyPrefix)] = value
+		}
+	}
+
+	return info
+}
+
+// lockInfo returns the LockInfo for a lock reply with the owner resolved.
+func (r *RedisLS) lockInfo(m map[string]string) (LockInfo, error) {
+	info := lockInfoFromMap(m)
+	info.Token = r.tokenURI(info.Token)
+	if err := r.resolveOwner(&info.Details); err != nil {
+		return LockInfo{}, err
+	}
+	return info, nil
+}
+
+// GetLock returns the lock identified by token. It is read-only: expired locks
+// that have not been collected yet are reported as webdav.ErrNoSuchLock
+// instead of being removed, so it can run against a replica.
+func (r *RedisLS) GetLock(now time.Time, token string) (LockInfo, error) {
+	if token == "" {
+		return LockInfo{}, webdav.ErrNoSuchLock
+	}
+	m, err := redis.StringMap(r.do(
+		r.scripts.getLock,
+		r.prefix,
+		now.Unix(),
+		r.storedToken(token),
+	))
+	if err != nil {
+		return LockInfo{}, err
+	}
+
+	return r.lockInfo(m)
+}
+
+// IsHeld reports whether the lock identified by token is held by a Confirm
+// call that has not been released yet. This distinguishes an operation in
+// progress from a lock that merely exists. It returns webdav.ErrNoSuchLock if
+// there is no such lock.
+func (r *RedisLS) IsHeld(now time.Time, token string) (bool, error) {
+	info, err := r.GetLock(now, token)
+	if err != nil {
+		return false, err
+	}
+	return info.Held, nil
+}
+
+// IsLocked reports whether name is covered by a lock, i.e. locked itself or
+// below an infinite-depth lock, regardless of who holds it. Locks on
+// descendants of name don't count. Unlike Lookup it matches no conditions and
+// stops at the first lock found on the way to the root. Like GetLock it never
+// writes to Redis.
+func (r *RedisLS) IsLocked(now time.Time, name string) (bool, error) {
+	return redis.Bool(r.do(
+		r.scripts.isLocked,
+		r.prefix,
+		now.Unix(),
+		r.cleanPath(name),
+	))
+}
+
+// RequiredTokens returns the tokens of the locks that cover name, nearest
+// first, i.e. the tokens one of which a client has to present in the If
+// header for Confirm to succeed, e.g. to tell it in a 423 response or when
+// debugging a webdav.ErrConfirmationFailed. Expired locks and locks held by
+// another Confirm call are left out, like Lookup does. It returns no tokens if
+// name is not locked. Like GetLock it never writes to Redis.
+func (r *RedisLS) RequiredTokens(now time.Time, name string) ([]string, error) {
+	tokens, err := redis.Strings(r.do(
+		r.scripts.requiredTokens,
+		r.prefix,
+		now.Unix(),
+		r.cleanPath(name),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for i, token := range tokens {
+		tokens[i] = r.tokenURI(token)
+	}
+	return tokens, nil
+}
+
+// Lookup returns the lock that covers name and matches at least one of the
+// conditions, following the same rules as Confirm but without holding the
+// lock. Like GetLock it never writes to Redis. It returns
+// webdav.ErrConfirmationFailed if no such lock exists.
+func (r *RedisLS) Lookup(now time.Time, name string, conditions ...webdav.Condition) (LockInfo, error) {
+	if err := r.checkConditions(conditions); err != nil {
+		return LockInfo{}, err
+	}
+	if noConditionTokens(conditions) {
+		return LockInfo{}, webdav.ErrConfirmationFailed
+	}
+
+	conditionsLen := len(conditions)
+
+	args := make([]interface{}, 4+conditionsLen)
+	args[0] = r.prefix
+	args[1] = now.Unix()
+	args[2] = r.cleanPath(name)
+	args[3] = conditionsLen
+
+	for i, condition := range conditions {
+		args[4+i] = r.storedToken(condition.Token)
+	}
+
+	m, err := redis.StringMap(r.do(r.scripts.lookup, args...))
+	if err != nil {
+		return LockInfo{}, err
+	}
+
+	return r.lockInfo(m)
+}
+
+// ListLocks returns all explicit locks, ordered by root. See ListLocksUnder.
+func (r *RedisLS) ListLocks(now time.Time) ([]LockInfo, error) {
+	return r.ListLocksUnder(now, "/", -1)
+}
+
+// ListLocksUnder returns the explicit locks at or below root that are at most
+// maxDepth path segments below it, ordered by root. A maxDepth of 0 returns
+// only the lock on root itself and a negative maxDepth means no limit.
+//
+// The filtering is done server-side, so only the matching locks are sent back,
+// but the underlying SCAN still walks the whole keyspace in a single script
+// call, which blocks Redis while it runs. Like GetLock it never writes to
+// Redis.
+func (r *RedisLS) ListLocksUnder(now time.Time, root string, maxDepth int) ([]LockInfo, error) {
+	values, err := redis.Values(r.do(
+		r.scripts.listLocks,
+		r.prefix,
+		now.Unix(),
+		r.cleanPath(root),
+		maxDepth,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := r.lockInfos(values)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Details.Root < locks[j].Details.Root
+	})
+
+	return locks, nil
+}
+
+// FilterLocks returns the explicit locks for which pred returns true, ordered
+// by root, e.g. to search by owner, duration, depth or held state without a
+// dedicated index. It enumerates the locks like ListLocks and applies pred in
+// Go, so it is an O(N) scan meant for admin tooling, not for the request path.
+// Like GetLock it never writes to Redis.
+func (r *RedisLS) FilterLocks(now time.Time, pred func(LockInfo) bool) ([]LockInfo, error) {
+	locks, err := r.ListLocks(now)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := locks[:0]
+	for _, lock := range locks {
+		if pred(lock) {
+			filtered = append(filtered, lock)
+		}
+	}
+
+	return filtered, nil
+}
+
+// StaleHeldLocks returns the locks that have been held by a Confirm call for
+// at least olderThan, ordered by root. Such locks usually mean that a release
+// function was leaked, and they can't be unlocked or expire until they are
+// released. Like FilterLocks it scans all locks and is meant for monitoring
+// and admin tooling. Locks held by a version that did not record when they
+// were held are not reported.
+func (r *RedisLS) StaleHeldLocks(now time.Time, olderThan time.Duration) ([]LockInfo, error) {
+	cutoff := now.Add(-olderThan)
+	return r.FilterLocks(now, func(info LockInfo) bool {
+		return info.Held && !info.HeldSince.IsZero() && !info.HeldSince.After(cutoff)
+	})
+}
+
+// ExpiringWithin returns the locks that expire after now and at most window
+// later, sorted by expiry, e.g. for a background refresher to renew them in
+// one round trip. Held locks can't expire and are not returned. Like GetLock
+// it is read-only, so it can run against a replica.
+func (r *RedisLS) ExpiringWithin(now time.Time, window time.Duration) ([]LockInfo, error) {
+	values, err := redis.Values(r.do(
+		r.scripts.expiringWithin,
+		r.prefix,
+		now.Unix(),
+		durationToSec(window),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := r.lockInfos(values)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		if !locks[i].Expiry.Equal(locks[j].Expiry) {
+			return locks[i].Expiry.Before(locks[j].Expiry)
+		}
+		return locks[i].Details.Root < locks[j].Details.Root
+	})
+
+	return locks, nil
+}
+
+// lockInfos returns the LockInfos for a list of lock replies.
+func (r *RedisLS) lockInfos(values []interface{}) ([]LockInfo, error) {
+	locks := make([]LockInfo, 0, len(values))
+
+	for _, v := range values {
+		m, err := redis.StringMap(v, nil)
+		if err != nil {
+			return nil, err
+		}
+		info, err := r.lockInfo(m)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, info)
+	}
+
+	return locks, nil
+}
+
+// ConflictingLock returns the lock that keeps a lock with the given depth from
+// being created at root, or nil if there is none, e.g. to show by whom and
+// until when a resource is locked before trying to lock it. The lock on root
+// itself takes precedence, then the locks below root if zeroDepth is false,
+// of which the one with the smallest root is returned, and then the nearest
+// infinite-depth lock on an ancestor. Like GetLock it is read-only: expired
+// locks that have not been collected yet are ignored, like Create ignores
+// them after collecting them.
+func (r *RedisLS) ConflictingLock(now time.Time, root string, zeroDepth bool) (*LockInfo, error) {
+	values, err := redis.Values(r.do(
+		r.scripts.conflictingLocks,
+		r.prefix,
+		now.Unix(),
+		r.cleanPath(root),
+		zeroDepth,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := r.lockInfos(values)
+	if err != nil {
+		return nil, err
+	}
+	if len(locks) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Details.Root < locks[j].Details.Root
+	})
+
+	return &locks[0], nil
+}
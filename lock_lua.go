@@ -1,16 +1,141 @@
 package webdavredisls
 
-import "github.com/gomodule/redigo/redis"
+import (
+	"strconv"
 
-func nameKeyMacro(nameVar string) string {
-	return `(prefix .. "` + namePrefix + `" .. ` + nameVar + `)`
+	"github.com/gomodule/redigo/redis"
+)
+
+// nextTokenMaxAttempts is the number of counter values next_token tries
+// before giving up. The steps between them double, so the last one is about
+// 2^40 above the first.
+const nextTokenMaxAttempts = 40
+
+// luaConfig holds the settings that are compiled into the Lua scripts.
+type luaConfig struct {
+	namePrefix        string
+	tokenPrefix       string
+	idempotencyPrefix string
+	expiryShardPrefix string
+	expiryShards      int
+	expiryRoundingSec int64
+	debugAssertions   bool
+	// creationTimestamps is whether create_token records when a lock was
+	// created, see WithCreationTimestamps.
+	creationTimestamps bool
+	// collectLimit is the maximum number of expiry zset entries
+	// collect_expired_nodes handles per call, or 0 for no limit, see
+	// WithScriptBudget.
+	collectLimit int
+	// releaseHistorySize is the number of released locks kept in the release
+	// history, or 0 to keep none, see WithReleaseHistory.
+	releaseHistorySize int
+}
+
+func newLuaConfig(separator string, expiryShards int, expiryRoundingSec int64, debugAssertions bool, creationTimestamps bool, collectLimit int, releaseHistorySize int) *luaConfig {
+	return &luaConfig{
+		namePrefix:        nameKeyType + separator,
+		tokenPrefix:       tokenKeyType + separator,
+		idempotencyPrefix: idempotencyKeyType + separator,
+		expiryShardPrefix: expiryZSetKey + separator,
+		expiryShards:      expiryShards,
+		expiryRoundingSec: expiryRoundingSec,
+		debugAssertions:   debugAssertions,
+
+		creationTimestamps: creationTimestamps,
+		collectLimit:       collectLimit,
+		releaseHistorySize: releaseHistorySize,
+	}
+}
+
+var defaultLuaConfig = newLuaConfig(defaultKeySeparator, 1, 0, false, false, 0, 0)
+
+// debugLuaConfig is defaultLuaConfig with debug assertions, see
+// WithDebugAssertions.
+var debugLuaConfig = newLuaConfig(defaultKeySeparator, 1, 0, true, false, 0, 0)
+
+func (c *luaConfig) nameKeyMacro(nameVar string) string {
+	return `(prefix .. "` + c.namePrefix + `" .. ` + nameVar + `)`
+}
+
+func (c *luaConfig) tokenKeyMacro(tokenVar string) string {
+	return `(prefix .. "` + c.tokenPrefix + `" .. ` + tokenVar + `)`
+}
+
+// assertMacro returns a statement that fails the script if condExpr is false,
+// naming the offending key or path subjectVar. Without debug assertions it is
+// empty.
+func (c *luaConfig) assertMacro(condExpr string, message string, subjectVar string) string {
+	if !c.debugAssertions {
+		return ""
+	}
+	return `if not (` + condExpr + `) then error("assertion failed: ` + message + `: " .. tostring(` + subjectVar + `)) end`
+}
+
+// expiryZSetKeyMacro returns the key of the expiry zset shard for a name. With
+// a single shard it is the unsharded key and expiryZSetFunc is not needed.
+func (c *luaConfig) expiryZSetKeyMacro(nameVar string) string {
+	if c.expiryShards <= 1 {
+		return `(prefix .. "` + expiryZSetKey + `")`
+	}
+	return `(prefix .. "` + c.expiryShardPrefix + `" .. expiry_shard(` + nameVar + `))`
+}
+
+// expiryZSetKeysMacro returns a table of the keys of all expiry zset shards.
+func (c *luaConfig) expiryZSetKeysMacro() string {
+	if c.expiryShards <= 1 {
+		return `{(prefix .. "` + expiryZSetKey + `")}`
+	}
+	return `expiry_zset_keys(prefix)`
+}
+
+func okReplyMacro(valueExpr string) string {
+	return `{"` + replyOK + `", ` + valueExpr + `}`
+}
+
+func errReplyMacro(code string) string {
+	return `{"` + replyErr + `", "` + code + `"}`
 }
 
-func tokenKeyMacro(tokenVar string) string {
-	return `(prefix .. "` + tokenPrefix + `" .. ` + tokenVar + `)`
+// lockedReplyMacro is the ERR_LOCKED reply of a create that conflicts with
+// the lock on holderRootVar, or with one of the locks below it if
+// holderTokenVar is nil. The code is followed by the holder in a nested table,
+// which parseReply turns into a LockedError.
+func lockedReplyMacro(holderRootVar, holderTokenVar string) string {
+	return `{"` + replyErr + `", {"` + errLocked + `", ` + holderRootVar + `, ` + holderTokenVar + ` or ""}}`
+}
+
+// expiryZSetFunc defines the functions used by the expiry zset macros when the
+// expiry zset is sharded, see WithExpiryShards. A name's shard is a hash of
+// the name modulo the number of shards.
+func (c *luaConfig) expiryZSetFunc() string {
+	if c.expiryShards <= 1 {
+		return ""
+	}
+
+	return `
+local expiry_shards = ` + strconv.Itoa(c.expiryShards) + `
+
+local expiry_shard = function(name)
+	local h = 0
+	for i = 1, string.len(name) do
+		h = (h * 31 + string.byte(name, i)) % 2147483647
+	end
+	return h % expiry_shards
+end
+
+local expiry_zset_keys = function(prefix)
+	local keys = {}
+	for shard = 0, expiry_shards - 1 do
+		table.insert(keys, prefix .. "` + c.expiryShardPrefix + `" .. shard)
+	end
+	return keys
+end
+`
 }
 
-var GetParentPathFunc = `
+func (c *luaConfig) getParentPathFunc() string {
+	return `
 local slash_byte = string.byte("/")
 
 local get_parent_path = function(path)
@@ -28,18 +153,77 @@ local get_parent_path = function(path)
 
 	return string.sub(path, 1, last_slash_idx - 1)
 end
+
+local is_clean_path = function(path)
+	if path == "/" then
+		return true
+	end
+	if string.byte(path, 1) ~= slash_byte or string.byte(path, -1) == slash_byte then
+		return false
+	end
+	local segments = path .. "/"
+	return not (string.find(segments, "//", 1, true) or string.find(segments, "/./", 1, true) or string.find(segments, "/../", 1, true))
+end
+`
+}
+
+// expiryFunc computes the expiry of a lock. expiry_jitter_sec is set by the
+// script entry point and spreads the expiries of locks created or refreshed in
+// the same second, see WithExpiryJitter. The jittered expiry is then rounded
+// up to a multiple of expiryRoundingSec, see WithExpiryRounding. Zero
+// durations are neither jittered nor rounded so that such locks still expire
+// immediately.
+func (c *luaConfig) expiryFunc() string {
+	expiry := `now_sec + duration_sec + expiry_jitter_sec`
+	if c.expiryRoundingSec > 1 {
+		rounding := strconv.FormatInt(c.expiryRoundingSec, 10)
+		expiry = `math.ceil((` + expiry + `) / ` + rounding + `) * ` + rounding
+	}
+
+	return `
+local expiry_jitter_sec = 0
+-- expiry_at_sec is the exact expiry passed by CreateUntil and RefreshUntil.
+local expiry_at_sec = nil
+
+local get_expiry = function(now_sec, duration_sec)
+	if expiry_at_sec then
+		return expiry_at_sec
+	end
+	if duration_sec > 0 then
+		return ` + expiry + `
+	end
+	return now_sec + duration_sec
+end
 `
+}
 
-var CreateTokenFunc = `
-local create_token = function(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml)
-	local token = tonumber(redis.call("INCR", prefix.."` + nextTokenKey + `"))
+func (c *luaConfig) createTokenFunc() string {
+	return `
+-- next_token takes the next token from the counter. If the counter was lost,
+-- e.g. evicted, it would hand out the tokens of existing locks again, so taken
+-- tokens are skipped, in growing steps so that a counter that restarted far
+-- below the live tokens catches up quickly.
+local next_token = function(prefix)
+	local step = 1
+	for _ = 1, ` + strconv.Itoa(nextTokenMaxAttempts) + ` do
+		local token = tonumber(redis.call("INCRBY", prefix.."` + nextTokenKey + `", step))
+		if redis.call("EXISTS", ` + c.tokenKeyMacro("token") + `) == 0 then
+			return token
+		end
+		step = step * 2
+	end
+	error("` + tokenCollisionMessage + `")
+end
 
+-- add_token adds the lock identified by token at root, with the given expiry,
+-- and the nodes of its ancestors.
+local add_token = function(prefix, token, root, duration_sec, expiry_sec, is_zero_depth, owner_xml)
 	local path = root
 
 	local is_first = true
 
 	while true do
-		local name_key = ` + nameKeyMacro("path") + `
+		local name_key = ` + c.nameKeyMacro("path") + `
 
 		local ref_count = tonumber(redis.call("HINCRBY", name_key, "` + refCountKey + `", 1))
 
@@ -55,13 +239,7 @@ local create_token = function(prefix, now_sec, root, duration_sec, is_zero_depth
 			table.insert(name_set_args, "` + falseValue + `")
 		end
 
-		local expiry_sec = 0
-
 		if is_first then
-			if duration_sec >= 0 then
-				expiry_sec = now_sec + duration_sec
-			end
-
 			local zero_depth_value = "` + trueValue + `"
 			if not is_zero_depth then
 				zero_depth_value = "` + falseValue + `"
@@ -80,16 +258,16 @@ local create_token = function(prefix, now_sec, root, duration_sec, is_zero_depth
 		end
 
 		if #name_set_args > 0 then
-			redis.call("HMSET", name_key, unpack(name_set_args))
+			redis.call("HSET", name_key, unpack(name_set_args))
 		end
 
 		if is_first then
-			local token_key = ` + tokenKeyMacro("token") + `
+			local token_key = ` + c.tokenKeyMacro("token") + `
 
 			redis.call("SET", token_key, path)
 
 			if duration_sec >= 0 then
-				local expiry_zset_key = prefix .. "` + expiryZSetKey + `"
+				local expiry_zset_key = ` + c.expiryZSetKeyMacro("path") + `
 				redis.call("ZADD", expiry_zset_key, expiry_sec, path)
 			end
 		end
@@ -100,37 +278,94 @@ local create_token = function(prefix, now_sec, root, duration_sec, is_zero_depth
 		path = get_parent_path(path)
 		is_first = false
 	end
+end
+
+local create_token = function(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml, token)
+	if not token then
+		token = next_token(prefix)
+	end
+
+	local expiry_sec = 0
+	if duration_sec >= 0 then
+		expiry_sec = get_expiry(now_sec, duration_sec)
+	end
+
+	add_token(prefix, token, root, duration_sec, expiry_sec, is_zero_depth, owner_xml)
+	` + c.recordCreatedAtMacro("root") + `
 
 	return tostring(token)
 end
 `
+}
 
-var CanCreateFunc = `
+// recordCreatedAtMacro returns a statement that records now_sec as the
+// creation time of the lock on the node at nameVar. Without creation
+// timestamps it is empty.
+func (c *luaConfig) recordCreatedAtMacro(nameVar string) string {
+	if !c.creationTimestamps {
+		return ""
+	}
+	return `redis.call("HSET", ` + c.nameKeyMacro(nameVar) + `, "` + createdAtKey + `", now_sec)`
+}
+
+// recordReleaseMacro returns a statement that pushes the lock with rootVar and
+// tokenVar onto the release history, released at now_sec for reason, and trims
+// the history to its size. Without a release history it is empty.
+func (c *luaConfig) recordReleaseMacro(rootVar string, tokenVar string, reason string) string {
+	if c.releaseHistorySize == 0 {
+		return ""
+	}
+	return `redis.call("LPUSH", prefix .. "` + releaseHistoryKey + `", now_sec .. "\t` + reason + `\t" .. ` + tokenVar + ` .. "\t" .. ` + rootVar + `)
+	redis.call("LTRIM", prefix .. "` + releaseHistoryKey + `", 0, ` + strconv.Itoa(c.releaseHistorySize-1) + `)`
+}
+
+// canCreateFunc defines can_create, which reports whether a lock can be
+// created at name and whether the nodes on its path are corrupt. If the lock
+// conflicts, it also returns the root and token of the conflicting lock, or
+// only name if the conflict is with a lock below it.
+//
+// Following RFC 4918 section 9.10, a zero-depth lock covers only its root, so
+// it conflicts with a lock on the same path and with an infinite-depth lock
+// on an ancestor, but not with any lock below it.
+func (c *luaConfig) canCreateFunc() string {
+	return `
 local can_create = function(prefix, name, is_zero_depth)
 	local path = name
 
 	local is_first = true
 
 	while true do
-		local name_key = ` + nameKeyMacro("path") + `
-		local root = redis.call("HGET", name_key, "` + rootKey + `")
+		local name_key = ` + c.nameKeyMacro("path") + `
+		local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + tokenKey + `", "` + zeroDepthKey + `", "` + refCountKey + `")
+		local root = res[1]
+		local token = res[2]
+		local zero_depth = res[3]
+
+		if root == false and res[4] ~= false then
+			-- The node exists but can't be told apart from a missing one.
+			return false, true
+		end
+
 		if root ~= false then
-			local token = redis.call("HGET", name_key, "` + tokenKey + `")
-			local node_is_zero_depth = redis.call("HGET", name_key, "` + zeroDepthKey + `") == "` + trueValue + `"
+			if not is_first and token ~= false and zero_depth ~= "` + trueValue + `" and zero_depth ~= "` + falseValue + `" then
+				-- The depth of an ancestor lock is unknown.
+				return false, true
+			end
+			local node_is_zero_depth = zero_depth == "` + trueValue + `"
 
 			if is_first then
 				if token ~= false then
 					-- The target node is already locked
-					return false
+					return false, false, path, token
 				end
 				if not is_zero_depth then
 					-- The requested lock depth is infinite, and the fact that node exists
 					-- (root ~= false) means that a descendent of the target node is locked.
-					return false
+					return false, false, path
 				end
 			elseif token ~= false and not node_is_zero_depth then
 				-- An ancestor of the target node is locked with infinite depth.
-				return false
+				return false, false, path, token
 			end
 		end
 
@@ -144,25 +379,35 @@ local can_create = function(prefix, name, is_zero_depth)
 	return true
 end
 `
+}
 
-var RemoveFunc = `
+func (c *luaConfig) removeFunc() string {
+	return `
 local remove = function(prefix, name, root, token, duration_sec)
-	local token_key = ` + tokenKeyMacro("token") + `
+	local token_key = ` + c.tokenKeyMacro("token") + `
+	` + c.assertMacro(`redis.call("GET", token_key) == name`, "token key does not point to the removed node", "token") + `
 	redis.call("DEL", token_key)
 
-	local name_key = ` + nameKeyMacro("name") + `
-	redis.call("HDEL", name_key, "` + tokenKey + `")
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local fields = {"` + tokenKey + `", "` + createdAtKey + `"}
+	for _, field in ipairs(redis.call("HKEYS", name_key)) do
+		if string.sub(field, 1, ` + strconv.Itoa(len(metaKeyPrefix)) + `) == "` + metaKeyPrefix + `" then
+			table.insert(fields, field)
+		end
+	end
+	redis.call("HDEL", name_key, unpack(fields))
 
 	if duration_sec >= 0 then
-		local expiry_zset_key = prefix .. "` + expiryZSetKey + `"
+		local expiry_zset_key = ` + c.expiryZSetKeyMacro("name") + `
 		redis.call("ZREM", expiry_zset_key, name)
 	end
 
 	local path = root
 
 	while true do
-		local path_name_key = ` + nameKeyMacro("path") + `
+		local path_name_key = ` + c.nameKeyMacro("path") + `
 		local ref_count = tonumber(redis.call("HINCRBY", path_name_key, "` + refCountKey + `", -1))
+		` + c.assertMacro("ref_count >= 0", "negative refcount", "path") + `
 
 		if ref_count == 0 then
 			redis.call("DEL", path_name_key)
@@ -175,88 +420,309 @@ local remove = function(prefix, name, root, token, duration_sec)
 	end
 end
 `
+}
+
+// reconcileFunc repairs the nodes on the path of a removed lock whose refcount
+// can't be right, e.g. after a script failed halfway through updating a path.
+// It only reads the nodes on the path, so it is cheap enough to run for every
+// collected lock. A node whose refcount is too high but still positive can
+// only be told apart by checking for descendants, which is left to
+// CompactExpirySet.
+func (c *luaConfig) reconcileFunc() string {
+	return `
+local reconcile = function(prefix, root)
+	local path = root
 
-var CollectExpiredNodesFunc = `
-local collect_expired_nodes = function(prefix, now_sec)
-	local expiry_zset_key = prefix .. "` + expiryZSetKey + `"
 	while true do
-		local names = redis.call("ZRANGEBYSCORE", expiry_zset_key, "-inf", now_sec, "LIMIT", 0, 100)
-		if next(names) == nil then
+		local path_name_key = ` + c.nameKeyMacro("path") + `
+		local res = redis.call("HMGET", path_name_key, "` + tokenKey + `", "` + refCountKey + `")
+		local ref_count = tonumber(res[2])
+
+		if res[1] then
+			if ref_count == nil or ref_count < 1 then
+				redis.call("HSET", path_name_key, "` + refCountKey + `", 1)
+			end
+		elseif ref_count ~= nil and ref_count <= 0 then
+			redis.call("DEL", path_name_key)
+		end
+
+		if path == "/" then
 			break
 		end
+		path = get_parent_path(path)
+	end
+end
+`
+}
 
-		for _, name in ipairs(names) do
-			local name_key = ` + nameKeyMacro("name") + `
-			local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + tokenKey + `", "` + durationKey + `")
-			local root = res[1]
-			local token = res[2]
-			local duration_sec = tonumber(res[3])
-			remove(prefix, name, root, token, duration_sec)
+// collectExpiredNodesFunc removes expired nodes and returns their details.
+// The details are also accumulated in collected_nodes so that scripts can
+// append them to their {status, value} reply using with_collected.
+// Expired entries of the expiry zset whose node is not locked are dropped
+// rather than failing the script. With a collect limit, at most that many
+// entries are handled, the oldest of every shard first, and the rest is left
+// to later calls.
+func (c *luaConfig) collectExpiredNodesFunc() string {
+	budget := -1
+	if c.collectLimit > 0 {
+		budget = c.collectLimit
+	}
+
+	return `
+local collected_nodes = {}
+
+local collect_expired_nodes = function(prefix, now_sec)
+	local collected = {}
+	-- budget is the number of entries left to handle, or -1 for no limit.
+	local budget = ` + strconv.Itoa(budget) + `
+	for _, expiry_zset_key in ipairs(` + c.expiryZSetKeysMacro() + `) do
+		while budget ~= 0 do
+			local count = 100
+			if budget > 0 and budget < count then
+				count = budget
+			end
+			local names = redis.call("ZRANGEBYSCORE", expiry_zset_key, "-inf", now_sec, "LIMIT", 0, count)
+			if next(names) == nil then
+				break
+			end
+			if budget > 0 then
+				budget = budget - #names
+			end
+
+			for _, name in ipairs(names) do
+				local name_key = ` + c.nameKeyMacro("name") + `
+				local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + tokenKey + `", "` + durationKey + `", "` + ownerXMLKey + `", "` + zeroDepthKey + `", "` + expiryKey + `")
+				local root = res[1]
+				local token = res[2]
+				local duration_sec = tonumber(res[3])
+				if not token then
+					-- The entry outlived its lock, e.g. because a script failed
+					-- halfway through. There is nothing to collect.
+					redis.call("ZREM", expiry_zset_key, name)
+				else
+					remove(prefix, name, root, token, duration_sec)
+					reconcile(prefix, root)
+					` + c.recordReleaseMacro("root", "token", string(ReleaseExpired)) + `
+
+					local node = {
+						"` + tokenKey + `", token,
+						"` + rootKey + `", root,
+						"` + durationKey + `", res[3],
+						"` + ownerXMLKey + `", res[4],
+						"` + zeroDepthKey + `", res[5],
+						"` + expiryKey + `", res[6],
+					}
+					table.insert(collected, node)
+					table.insert(collected_nodes, node)
+				end
+			end
 		end
 	end
+	return collected
+end
+
+local with_collected = function(reply)
+	return {reply[1], reply[2] or false, collected_nodes}
 end
 `
+}
 
-var HoldFunc = `
-local hold = function(prefix, name, duration_sec)
-	local name_key = ` + nameKeyMacro("name") + `
-	local held_str = redis.call("HGET", name_key, "` + heldKey + `")
-	if held_str == "` + trueValue + `" then
+// holdFunc defines hold, which marks a node as held and records since when,
+// if now_sec is given. The node must be locked: callers look it up in the same
+// script run, and hold fails instead of writing a half node with HSET if it is
+// gone.
+func (c *luaConfig) holdFunc() string {
+	return `
+local hold = function(prefix, name, duration_sec, now_sec)
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + heldKey + `", "` + tokenKey + `")
+	if not res[2] or res[2] == "" then
+		error("` + missingLockMessage + `: " .. name)
+	end
+	if res[1] == "` + trueValue + `" then
 		error("inconsistent held state")
 	end
 
-	redis.call("HSET", name_key, "` + heldKey + `", "` + trueValue + `")
+	if now_sec then
+		redis.call("HSET", name_key, "` + heldKey + `", "` + trueValue + `", "` + heldSinceKey + `", now_sec)
+	else
+		redis.call("HSET", name_key, "` + heldKey + `", "` + trueValue + `")
+	end
+	redis.call("INCR", prefix .. "` + heldCountKey + `")
 
 	if duration_sec >= 0 then
-		local expiry_zset_key = prefix .. "` + expiryZSetKey + `"
+		local expiry_zset_key = ` + c.expiryZSetKeyMacro("name") + `
+		` + c.assertMacro(`redis.call("ZSCORE", expiry_zset_key, name)`, "unheld finite lock missing from the expiry zset", "name") + `
 		redis.call("ZREM", expiry_zset_key, name)
 	end
 end
 `
+}
 
-var UnholdFunc = `
+func (c *luaConfig) unholdFunc() string {
+	return `
 local unhold = function(prefix, name, duration_sec, expiry_sec)
-	local name_key = ` + nameKeyMacro("name") + `
+	local name_key = ` + c.nameKeyMacro("name") + `
 	local held_str = redis.call("HGET", name_key, "` + heldKey + `")
 	if held_str ~= "` + trueValue + `" then
 		error("inconsistent held state")
 	end
 
 	redis.call("HSET", name_key, "` + heldKey + `", "` + falseValue + `")
+	redis.call("HDEL", name_key, "` + heldSinceKey + `")
+
+	local held_count = tonumber(redis.call("DECR", prefix .. "` + heldCountKey + `"))
+	` + c.assertMacro("held_count >= 0", "negative held count", "name") + `
+	if held_count <= 0 then
+		redis.call("DEL", prefix .. "` + heldCountKey + `")
+	end
 
 	if duration_sec >= 0 then
-		local expiry_zset_key = prefix .. "` + expiryZSetKey + `"
+		local expiry_zset_key = ` + c.expiryZSetKeyMacro("name") + `
+		` + c.assertMacro(`not redis.call("ZSCORE", expiry_zset_key, name)`, "held node in the expiry zset", "name") + `
 		redis.call("ZADD", expiry_zset_key, expiry_sec, name)
 	end
 end
 `
+}
 
-var CreateFunc = `
-local create = function(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml)
-	collect_expired_nodes(prefix, now_sec)
+func (c *luaConfig) createFunc() string {
+	return `
+-- token is the token of the lock if it is chosen by the caller, see
+-- CreateWithToken, or nil to take the next one from the counter.
+local create = function(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml, inline_collect, token)
+	-- The Go side cleans paths, but other callers could build keys that break
+	-- the ancestor walk.
+	if not is_clean_path(root) then
+		return ` + errReplyMacro(errInvalidPath) + `
+	end
+
+	if redis.call("EXISTS", prefix .. "` + maintenanceKey + `") == 1 then
+		return ` + errReplyMacro(errMaintenance) + `
+	end
+
+	if inline_collect then
+		collect_expired_nodes(prefix, now_sec)
+	end
+
+	if token then
+		local token_key = ` + c.tokenKeyMacro("token") + `
+		if not inline_collect and redis.call("EXISTS", token_key) == 1 then
+			-- The token may belong to an expired lock that has not been
+			-- collected yet.
+			collect_expired_nodes(prefix, now_sec)
+		end
+		if redis.call("EXISTS", token_key) == 1 then
+			return ` + errReplyMacro(errTokenExists) + `
+		end
+		if string.match(token, "^%d+$") and tonumber(token) > (tonumber(redis.call("GET", prefix .. "` + nextTokenKey + `")) or 0) then
+			-- The counter would hand out the same token later.
+			return ` + errReplyMacro(errInvalidToken) + `
+		end
+	end
+
+	local can, corrupt, holder_root, holder_token = can_create(prefix, root, is_zero_depth)
+	if not can and not corrupt and not inline_collect then
+		-- Expired nodes that have not been collected yet may be in the way.
+		if next(collect_expired_nodes(prefix, now_sec)) ~= nil then
+			can, corrupt, holder_root, holder_token = can_create(prefix, root, is_zero_depth)
+		end
+	end
+	if corrupt then
+		return ` + errReplyMacro(errCorruptState) + `
+	end
+	if not can then
+		return ` + lockedReplyMacro("holder_root", "holder_token") + `
+	end
+
+	token = create_token(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml, token)
+
+	return ` + okReplyMacro("token") + `
+end
+`
+}
+
+// createWithMetaFunc wraps create and stores meta, a flat list of keys and
+// values, in the lock's node hash under metaKeyPrefix. remove deletes the
+// fields again, as the node can outlive the lock.
+func (c *luaConfig) createWithMetaFunc() string {
+	return `
+local create_with_meta = function(prefix, now_sec, root, duration_sec, is_zero_depth, meta, inline_collect)
+	local reply = create(prefix, now_sec, root, duration_sec, is_zero_depth, "", inline_collect)
 
-	if not can_create(prefix, root, is_zero_depth) then
-		return "` + errLocked + `"
+	if reply[1] == "` + replyOK + `" and #meta > 0 then
+		local name_set_args = {}
+		for i = 1, #meta, 2 do
+			table.insert(name_set_args, "` + metaKeyPrefix + `" .. meta[i])
+			table.insert(name_set_args, meta[i + 1])
+		end
+		redis.call("HSET", ` + c.nameKeyMacro("root") + `, unpack(name_set_args))
 	end
 
-	local token = create_token(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml)
+	return reply
+end
+`
+}
+
+// createFencedFunc wraps create and takes the next number from the fence
+// counter for the created lock. Unlike the token counter, which next_token
+// restarts low after it was lost, the fence counter is only ever incremented.
+func (c *luaConfig) createFencedFunc() string {
+	return `
+local create_fenced = function(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml, inline_collect)
+	local reply = create(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml, inline_collect)
+
+	if reply[1] == "` + replyOK + `" then
+		local fence = redis.call("INCR", prefix .. "` + fenceCounterKey + `")
+		return ` + okReplyMacro("{reply[2], fence}") + `
+	end
 
-	return token
+	return reply
 end
 `
+}
 
-var RefreshFunc = `
-local refresh = function(prefix, now_sec, token, new_duration_sec)
+// createIdempotentFunc wraps create so that a retried request with the same
+// idempotency key gets the original token back instead of ERR_LOCKED, for as
+// long as the idempotency key and the lock both exist.
+func (c *luaConfig) createIdempotentFunc() string {
+	return `
+local create_idempotent = function(prefix, now_sec, idempotency_key, window_sec, root, duration_sec, is_zero_depth, owner_xml)
 	collect_expired_nodes(prefix, now_sec)
 
-	local token_key = ` + tokenKeyMacro("token") + `
+	local idempotency_key_key = prefix .. "` + c.idempotencyPrefix + `" .. idempotency_key
+
+	local token = redis.call("GET", idempotency_key_key)
+	if token and redis.call("EXISTS", ` + c.tokenKeyMacro("token") + `) == 1 then
+		return ` + okReplyMacro("token") + `
+	end
+
+	local reply = create(prefix, now_sec, root, duration_sec, is_zero_depth, owner_xml, true)
+	if reply[1] == "` + replyOK + `" then
+		redis.call("SET", idempotency_key_key, reply[2], "EX", window_sec)
+	end
+
+	return reply
+end
+`
+}
+
+func (c *luaConfig) refreshFunc() string {
+	return `
+-- refresh_owner_xml and refresh_zero_depth are the owner and depth passed by
+-- RefreshWithOpts, or nil to keep the stored ones.
+local refresh_owner_xml = nil
+local refresh_zero_depth = nil
+
+local refresh_token = function(prefix, now_sec, token, new_duration_sec)
+	local token_key = ` + c.tokenKeyMacro("token") + `
 
 	local name = redis.call("GET", token_key)
 	if not name then
-		return "` + errNoSuchLock + `"
+		return ` + errReplyMacro(errNoSuchLock) + `
 	end
 
-	local name_key = ` + nameKeyMacro("name") + `
+	local name_key = ` + c.nameKeyMacro("name") + `
 	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + ownerXMLKey + `", "` + zeroDepthKey + `", "` + heldKey + `")
 	local root = res[1]
 	local old_duration_sec = tonumber(res[2])
@@ -265,10 +731,14 @@ local refresh = function(prefix, now_sec, token, new_duration_sec)
 	local held = res[5] == "` + trueValue + `"
 
 	if held then
-		return "` + errLocked + `"
+		return ` + errReplyMacro(errLocked) + `
+	end
+
+	if refresh_zero_depth ~= nil and refresh_zero_depth ~= (zero_depth == "` + trueValue + `") then
+		return ` + errReplyMacro(errDepthImmutable) + `
 	end
 
-	local expiry_zset_key = prefix .. "` + expiryZSetKey + `"
+	local expiry_zset_key = ` + c.expiryZSetKeyMacro("name") + `
 
 	if old_duration_sec >= 0 then
 		redis.call("ZREM", expiry_zset_key, name)
@@ -277,226 +747,1980 @@ local refresh = function(prefix, now_sec, token, new_duration_sec)
 	local new_expiry_sec = 0
 
 	if new_duration_sec >= 0 then
-		new_expiry_sec = now_sec + new_duration_sec
+		new_expiry_sec = get_expiry(now_sec, new_duration_sec)
 
 		redis.call("ZADD", expiry_zset_key, new_expiry_sec, name)
 	end
 
-	redis.call("HMSET", name_key, "` + durationKey + `", new_duration_sec, "` + expiryKey + `", new_expiry_sec)
+	redis.call("HSET", name_key, "` + durationKey + `", new_duration_sec, "` + expiryKey + `", new_expiry_sec)
+
+	local previous_owner_xml = owner_xml
+	if refresh_owner_xml then
+		owner_xml = refresh_owner_xml
+		redis.call("HSET", name_key, "` + ownerXMLKey + `", owner_xml)
+	end
 
-	return {
+	local details = {
 		"` + rootKey + `", root,
 		"` + durationKey + `", tostring(new_duration_sec),
 		"` + ownerXMLKey + `", owner_xml,
 		"` + zeroDepthKey + `", zero_depth,
+		"` + expiryKey + `", tostring(new_expiry_sec),
 	}
+	if refresh_owner_xml then
+		table.insert(details, "` + previousOwnerXMLKey + `")
+		table.insert(details, previous_owner_xml or "")
+	end
+
+	return ` + okReplyMacro("details") + `
+end
+
+local refresh = function(prefix, now_sec, token, new_duration_sec)
+	collect_expired_nodes(prefix, now_sec)
+
+	return refresh_token(prefix, now_sec, token, new_duration_sec)
 end
 `
+}
 
-var UnlockFunc = `
-local unlock = function(prefix, now_sec, token)
+// refreshManyFunc refreshes each of the tokens and replies with a
+// {status, value} reply per token, so that one held or missing lock does not
+// fail the whole batch. Expired nodes are collected once.
+func (c *luaConfig) refreshManyFunc() string {
+	return `
+local refresh_many = function(prefix, now_sec, tokens, new_duration_sec)
+	collect_expired_nodes(prefix, now_sec)
+
+	local replies = {}
+	for _, token in ipairs(tokens) do
+		table.insert(replies, refresh_token(prefix, now_sec, token, new_duration_sec))
+	end
+
+	return ` + okReplyMacro("replies") + `
+end
+`
+}
+
+func (c *luaConfig) updateOwnerFunc() string {
+	return `
+local update_owner = function(prefix, now_sec, token, owner_xml, force)
 	collect_expired_nodes(prefix, now_sec)
 
-	local token_key = ` + tokenKeyMacro("token") + `
+	local token_key = ` + c.tokenKeyMacro("token") + `
 
 	local name = redis.call("GET", token_key)
 	if not name then
-		return "` + errNoSuchLock + `"
+		return ` + errReplyMacro(errNoSuchLock) + `
 	end
 
-	local name_key = ` + nameKeyMacro("name") + `
-	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + heldKey + `")
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + zeroDepthKey + `", "` + heldKey + `", "` + ownerXMLKey + `")
 	local root = res[1]
-	local duration_sec = tonumber(res[2])
-	local held = res[3] == "` + trueValue + `"
+	local duration_sec = res[2]
+	local zero_depth = res[3]
+	local held = res[4] == "` + trueValue + `"
+	local previous_owner_xml = res[5] or ""
 
-	if held then
-		return "` + errLocked + `"
+	if held and not force then
+		return ` + errReplyMacro(errLocked) + `
 	end
 
-	remove(prefix, name, root, token, duration_sec)
+	redis.call("HSET", name_key, "` + ownerXMLKey + `", owner_xml)
+
+	local details = {
+		"` + rootKey + `", root,
+		"` + durationKey + `", duration_sec,
+		"` + ownerXMLKey + `", owner_xml,
+		"` + zeroDepthKey + `", zero_depth,
+		"` + previousOwnerXMLKey + `", previous_owner_xml,
+	}
+
+	return ` + okReplyMacro("details") + `
 end
 `
+}
 
-// LookupFunc returns the node n that locks the named resource, provided that n
-// matches at least one of the given conditions and that lock isn't held by
-// another party. Otherwise, it returns nil.
-//
-// n may be a parent of the named resource, if n is an infinite depth lock.
-var LookupFunc = `
-local lookup_token = function(prefix, lookup_name, token)
-	local token_key = ` + tokenKeyMacro("token") + `
+// stealFunc transfers the lock identified by token to a new owner, keeping
+// its node and refcounts. With new_token set the lock gets a new token and
+// the old one stops working. Held locks are only stolen with force set; they
+// stay held and are put back in the expiry zset by the pending release. With
+// keep_owner set the owner is left unchanged.
+func (c *luaConfig) stealFunc() string {
+	return `
+local steal = function(prefix, now_sec, token, owner_xml, duration_sec, new_token, force, keep_owner)
+	collect_expired_nodes(prefix, now_sec)
+
+	local token_key = ` + c.tokenKeyMacro("token") + `
 
 	local name = redis.call("GET", token_key)
 	if not name then
-		return nil
+		return ` + errReplyMacro(errNoSuchLock) + `
 	end
 
-	local name_key = ` + nameKeyMacro("name") + `
-	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + zeroDepthKey + `", "` + heldKey + `")
-	local root = res[1]
-	local duration_sec = tonumber(res[2])
-	local is_zero_depth = res[3] == "` + trueValue + `"
-	local held = res[4] == "` + trueValue + `"
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + durationKey + `", "` + heldKey + `")
+	local old_duration_sec = tonumber(res[1])
+	local held = res[2] == "` + trueValue + `"
 
-	if held then
-		return nil
+	if held and not force then
+		return ` + errReplyMacro(errLocked) + `
 	end
 
-	if lookup_name == root then
-		return {root, duration_sec}
+	local expiry_sec = 0
+	if duration_sec >= 0 then
+		expiry_sec = get_expiry(now_sec, duration_sec)
 	end
 
-	if is_zero_depth then
-		return nil
-	end
+	if not held then
+		local expiry_zset_key = ` + c.expiryZSetKeyMacro("name") + `
 
-	local root_slash = root .. "/"
-	-- has_prefix(lookup_name, root+"/")
-	if root == "/" or (#lookup_name >= #root_slash and string.sub(lookup_name, 1, #root_slash) == root_slash) then
-		return {root, duration_sec}
+		if old_duration_sec >= 0 then
+			redis.call("ZREM", expiry_zset_key, name)
+		end
+		if duration_sec >= 0 then
+			redis.call("ZADD", expiry_zset_key, expiry_sec, name)
+		end
 	end
 
-	return nil
-end
+	if new_token then
+		redis.call("DEL", token_key)
+		token = tostring(next_token(prefix))
+		redis.call("SET", ` + c.tokenKeyMacro("token") + `, name)
+	end
 
-local lookup = function(prefix, lookup_name, condition_tokens)
-	for _, token in ipairs(condition_tokens) do
-		local res = lookup_token(prefix, lookup_name, token)
-		if res ~= nil then
-			return res
-		end
+	redis.call("HSET", name_key, "` + tokenKey + `", token, "` + durationKey + `", duration_sec, "` + expiryKey + `", expiry_sec)
+	if not keep_owner then
+		redis.call("HSET", name_key, "` + ownerXMLKey + `", owner_xml)
 	end
 
-	return nil
+	return ` + okReplyMacro("token") + `
 end
 `
+}
+
+// moveLockFunc moves the lock identified by token to new_root, keeping its
+// token, duration, expiry, owner, metadata and creation time. The lock is
+// removed before can_create checks new_root, so that it can't conflict with
+// itself, and is added back at its old root if new_root conflicts.
+func (c *luaConfig) moveLockFunc() string {
+	return `
+local move_lock = function(prefix, now_sec, token, new_root)
+	if not is_clean_path(new_root) then
+		return ` + errReplyMacro(errInvalidPath) + `
+	end
 
-var ConfirmFunc = `
-local confirm = function(prefix, now_sec, name0, name1, condition_tokens)
 	collect_expired_nodes(prefix, now_sec)
 
-	local n0 = nil
-	local n1 = nil
+	local token_key = ` + c.tokenKeyMacro("token") + `
 
-	if name0 ~= nil then
-		n0 = lookup(prefix, name0, condition_tokens)
-		if n0 == nil then
-			return "` + errConfirmationFailed + `"
-		end
+	local name = redis.call("GET", token_key)
+	if not name then
+		return ` + errReplyMacro(errNoSuchLock) + `
 	end
-	if name1 ~= nil then
-		n1 = lookup(prefix, name1, condition_tokens)
-		if n1 == nil then
-			return "` + errConfirmationFailed + `"
+
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + ownerXMLKey + `", "` + zeroDepthKey + `", "` + expiryKey + `", "` + heldKey + `")
+	local root = res[1]
+	local duration_sec = tonumber(res[2])
+	local owner_xml = res[3] or ""
+	local is_zero_depth = res[4] == "` + trueValue + `"
+	local expiry_sec = tonumber(res[5])
+	local held = res[6] == "` + trueValue + `"
+
+	if held then
+		return ` + errReplyMacro(errLocked) + `
+	end
+
+	local meta = {}
+	local name_values = redis.call("HGETALL", name_key)
+	for i = 1, #name_values, 2 do
+		if string.sub(name_values[i], 1, ` + strconv.Itoa(len(metaKeyPrefix)) + `) == "` + metaKeyPrefix + `" or name_values[i] == "` + createdAtKey + `" then
+			table.insert(meta, name_values[i])
+			table.insert(meta, name_values[i + 1])
 		end
 	end
 
-	-- Don't hold the same node twice.
-	if n0 ~= nil and n1 ~= nil and n0[1] == n1[1] then
-		n1 = nil
+	remove(prefix, name, root, token, duration_sec)
+
+	local can, corrupt = can_create(prefix, new_root, is_zero_depth)
+	local target = new_root
+	if not can then
+		target = root
 	end
 
-	local res = {"", ""}
+	add_token(prefix, token, target, duration_sec, expiry_sec, is_zero_depth, owner_xml)
+	if #meta > 0 then
+		redis.call("HSET", ` + c.nameKeyMacro("target") + `, unpack(meta))
+	end
 
-	if n0 ~= nil then
-		hold(prefix, n0[1], n0[2])
-		res[1] = n0[1]
+	if corrupt then
+		return ` + errReplyMacro(errCorruptState) + `
 	end
-	if n1 ~= nil then
-		hold(prefix, n1[1], n1[2])
-		res[2] = n1[1]
+	if not can then
+		return ` + errReplyMacro(errLocked) + `
 	end
 
-	return res
+	` + c.recordReleaseMacro("root", "token", string(ReleaseMoved)) + `
+
+	return ` + okReplyMacro("lock_reply(read_lock(prefix, now_sec, token))") + `
 end
 `
+}
 
-var ReleaseFunc = `
-local release = function(prefix, name0, name1)
-	if name0 ~= nil then
-		local name0_key = ` + nameKeyMacro("name0") + `
-		local res0 = redis.call("HMGET", name0_key, "` + durationKey + `", "` + expiryKey + `")
-		local duration_sec0 = tonumber(res0[1])
-		local expiry_sec0 = tonumber(res0[2])
+func (c *luaConfig) unlockFunc() string {
+	return `
+local unlock = function(prefix, now_sec, token)
+	collect_expired_nodes(prefix, now_sec)
+
+	local token_key = ` + c.tokenKeyMacro("token") + `
+
+	local name = redis.call("GET", token_key)
+	if not name then
+		return ` + errReplyMacro(errNoSuchLock) + `
+	end
+
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + heldKey + `", "` + ownerXMLKey + `")
+	local root = res[1]
+	local duration_sec = tonumber(res[2])
+	local held = res[3] == "` + trueValue + `"
+	local owner_xml = res[4] or ""
+
+	if held then
+		return ` + errReplyMacro(errLocked) + `
+	end
+
+	remove(prefix, name, root, token, duration_sec)
+	` + c.recordReleaseMacro("root", "token", string(ReleaseUnlocked)) + `
+
+	return ` + okReplyMacro("owner_xml") + `
+end
+`
+}
+
+// unlockByPathFunc unlocks the explicit lock on root. A root that is only
+// covered by an ancestor lock has no token field and is ERR_NO_SUCH_LOCK.
+func (c *luaConfig) unlockByPathFunc() string {
+	return `
+local unlock_by_path = function(prefix, now_sec, root)
+	collect_expired_nodes(prefix, now_sec)
+
+	local name_key = ` + c.nameKeyMacro("root") + `
+
+	local token = redis.call("HGET", name_key, "` + tokenKey + `")
+	if not token then
+		return ` + errReplyMacro(errNoSuchLock) + `
+	end
+
+	return unlock(prefix, now_sec, token)
+end
+`
+}
+
+// lookupFunc returns the node n that locks the named resource, provided that n
+// matches at least one of the given conditions and that lock isn't held by
+// another party. Otherwise, it returns nil.
+//
+// n may be a parent of the named resource, if n is an infinite depth lock.
+func (c *luaConfig) lookupFunc() string {
+	return `
+local lock_covers = function(root, is_zero_depth, lookup_name)
+	if lookup_name == root then
+		return true
+	end
+
+	if is_zero_depth then
+		return false
+	end
+
+	-- Both paths are clean, so only "/" ends with a slash and root .. "/"
+	-- matches path.Clean's idea of a parent.
+	local root_slash = root .. "/"
+	-- has_prefix(lookup_name, root+"/")
+	return root == "/" or (#lookup_name >= #root_slash and string.sub(lookup_name, 1, #root_slash) == root_slash)
+end
+
+local lookup_token = function(prefix, lookup_name, token)
+	local token_key = ` + c.tokenKeyMacro("token") + `
+
+	local name = redis.call("GET", token_key)
+	if not name then
+		return nil
+	end
+
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + zeroDepthKey + `", "` + heldKey + `")
+	local root = res[1]
+	local duration_sec = tonumber(res[2])
+	local is_zero_depth = res[3] == "` + trueValue + `"
+	local held = res[4] == "` + trueValue + `"
+
+	if held then
+		return nil
+	end
+
+	if lock_covers(root, is_zero_depth, lookup_name) then
+		return {root, duration_sec}
+	end
+
+	return nil
+end
+
+local lookup = function(prefix, lookup_name, condition_tokens)
+	for _, token in ipairs(condition_tokens) do
+		local res = lookup_token(prefix, lookup_name, token)
+		if res ~= nil then
+			return res
+		end
+	end
+
+	return nil
+end
+`
+}
+
+// readLockFunc returns the explicit lock identified by token, or nil if there
+// is no such lock. It never writes: a lock whose expiry has passed is treated
+// as absent even if collect_expired_nodes has not removed it yet, so it can
+// run on a replica.
+func (c *luaConfig) readLockFunc() string {
+	return `
+local read_lock = function(prefix, now_sec, token)
+	local token_key = ` + c.tokenKeyMacro("token") + `
+
+	local name = redis.call("GET", token_key)
+	if not name then
+		return nil
+	end
+
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + rootKey + `", "` + durationKey + `", "` + ownerXMLKey + `", "` + zeroDepthKey + `", "` + expiryKey + `", "` + heldKey + `", "` + refCountKey + `", "` + heldSinceKey + `", "` + createdAtKey + `")
+	if not res[1] then
+		return nil
+	end
+
+	local lock = {
+		token = token,
+		root = res[1],
+		duration_sec = tonumber(res[2]),
+		owner_xml = res[3] or "",
+		is_zero_depth = res[4] == "` + trueValue + `",
+		expiry_sec = tonumber(res[5]),
+		held = res[6] == "` + trueValue + `",
+		ref_count = tonumber(res[7]) or 0,
+		held_since_sec = res[8],
+		created_sec = res[9],
+	}
+
+	-- Held nodes are not in the expiry zset, so they can't expire.
+	if not lock.held and lock.duration_sec >= 0 and lock.expiry_sec <= now_sec then
+		return nil
+	end
+
+	return lock
+end
+
+local lock_reply = function(lock)
+	local zero_depth_value = "` + falseValue + `"
+	if lock.is_zero_depth then
+		zero_depth_value = "` + trueValue + `"
+	end
+
+	local held_value = "` + falseValue + `"
+	if lock.held then
+		held_value = "` + trueValue + `"
+	end
+
+	local reply = {
+		"` + tokenKey + `", lock.token,
+		"` + rootKey + `", lock.root,
+		"` + durationKey + `", tostring(lock.duration_sec),
+		"` + ownerXMLKey + `", lock.owner_xml,
+		"` + zeroDepthKey + `", zero_depth_value,
+		"` + expiryKey + `", tostring(lock.expiry_sec),
+		"` + heldKey + `", held_value,
+		"` + refCountKey + `", tostring(lock.ref_count),
+	}
+
+	if lock.held and lock.held_since_sec then
+		table.insert(reply, "` + heldSinceKey + `")
+		table.insert(reply, lock.held_since_sec)
+	end
+
+	if lock.created_sec then
+		table.insert(reply, "` + createdAtKey + `")
+		table.insert(reply, lock.created_sec)
+	end
+
+	return reply
+end
+`
+}
+
+func (c *luaConfig) getLockFunc() string {
+	return `
+local get_lock = function(prefix, now_sec, token)
+	local lock = read_lock(prefix, now_sec, token)
+	if lock == nil then
+		return ` + errReplyMacro(errNoSuchLock) + `
+	end
+
+	local reply = lock_reply(lock)
+
+	-- Only GetLock returns the fields set with CreateWithMeta, so that listing
+	-- locks doesn't need to read every node hash in full.
+	local name_values = redis.call("HGETALL", ` + c.nameKeyMacro("lock.root") + `)
+	for i = 1, #name_values, 2 do
+		if string.sub(name_values[i], 1, ` + strconv.Itoa(len(metaKeyPrefix)) + `) == "` + metaKeyPrefix + `" then
+			table.insert(reply, name_values[i])
+			table.insert(reply, name_values[i + 1])
+		end
+	end
+
+	return ` + okReplyMacro("reply") + `
+end
+`
+}
+
+// isLockedFunc reports whether name is covered by an unexpired lock on
+// itself or an infinite-depth lock on an ancestor, stopping at the first one.
+// Like read_lock it never writes.
+func (c *luaConfig) isLockedFunc() string {
+	return `
+local is_locked = function(prefix, now_sec, name)
+	local path = name
+
+	while true do
+		local token = redis.call("HGET", ` + c.nameKeyMacro("path") + `, "` + tokenKey + `")
+		if token then
+			local lock = read_lock(prefix, now_sec, token)
+			if lock ~= nil and lock_covers(lock.root, lock.is_zero_depth, name) then
+				return ` + okReplyMacro("1") + `
+			end
+		end
 
-		unhold(prefix, name0, duration_sec0, expiry_sec0)
+		if path == "/" then
+			break
+		end
+		path = get_parent_path(path)
+	end
+
+	return ` + okReplyMacro("0") + `
+end
+`
+}
+
+// requiredTokensFunc returns the tokens of the unexpired, unheld locks that
+// cover name, nearest first: the tokens one of which Lookup needs as a
+// condition. Like read_lock it never writes.
+func (c *luaConfig) requiredTokensFunc() string {
+	return `
+local required_tokens = function(prefix, now_sec, name)
+	local tokens = {}
+	local path = name
+
+	while true do
+		local token = redis.call("HGET", ` + c.nameKeyMacro("path") + `, "` + tokenKey + `")
+		if token then
+			local lock = read_lock(prefix, now_sec, token)
+			if lock ~= nil and not lock.held and lock_covers(lock.root, lock.is_zero_depth, name) then
+				table.insert(tokens, token)
+			end
+		end
+
+		if path == "/" then
+			break
+		end
+		path = get_parent_path(path)
+	end
+
+	return ` + okReplyMacro("tokens") + `
+end
+`
+}
+
+// conflictingLocksFunc returns the unexpired locks that keep a lock from
+// being created at name, in the order can_create checks them: the lock on name
+// itself, the locks below name if the requested lock has infinite depth, or
+// the nearest infinite-depth lock on an ancestor. Only the descendants can be
+// more than one lock. Like read_lock it never writes.
+func (c *luaConfig) conflictingLocksFunc() string {
+	return `
+local conflicting_locks = function(prefix, now_sec, name, is_zero_depth)
+	if not is_clean_path(name) then
+		return ` + errReplyMacro(errInvalidPath) + `
+	end
+
+	local path = name
+
+	while true do
+		local token = redis.call("HGET", ` + c.nameKeyMacro("path") + `, "` + tokenKey + `")
+		if token then
+			local lock = read_lock(prefix, now_sec, token)
+			if lock ~= nil and (path == name or not lock.is_zero_depth) then
+				return ` + okReplyMacro("{lock_reply(lock)}") + `
+			end
+		end
+
+		if path == name and not is_zero_depth then
+			local locks = list_locks(prefix, now_sec, name, -1)[2]
+			if next(locks) ~= nil then
+				return ` + okReplyMacro("locks") + `
+			end
+		end
+
+		if path == "/" then
+			break
+		end
+		path = get_parent_path(path)
+	end
+
+	return ` + okReplyMacro("{}") + `
+end
+`
+}
+
+// readOnlyLookupFunc is the non-mutating counterpart of lookupFunc. Expired
+// locks are filtered out by read_lock instead of being collected.
+func (c *luaConfig) readOnlyLookupFunc() string {
+	return `
+local lookup_read_only = function(prefix, now_sec, lookup_name, condition_tokens)
+	for _, token in ipairs(condition_tokens) do
+		local lock = read_lock(prefix, now_sec, token)
+		if lock ~= nil and not lock.held and lock_covers(lock.root, lock.is_zero_depth, lookup_name) then
+			return ` + okReplyMacro("lock_reply(lock)") + `
+		end
+	end
+
+	return ` + errReplyMacro(errConfirmationFailed) + `
+end
+`
+}
+
+// globEscapeFunc escapes the glob special characters in a SCAN MATCH pattern.
+func (c *luaConfig) globEscapeFunc() string {
+	return `
+local glob_escape = function(s)
+	return (string.gsub(s, "[%*%?%[%]\\]", "\\%0"))
+end
+`
+}
+
+// listLocksFunc returns the explicit locks at or below root that are at most
+// max_depth path segments below it (a negative max_depth means no limit). It
+// is read-only. The whole SCAN runs inside one script call, so it blocks Redis
+// for a time proportional to the size of the keyspace.
+func (c *luaConfig) listLocksFunc() string {
+	return `
+local path_depth = function(root, name)
+	if name == root then
+		return 0
+	end
+
+	local root_slash = root .. "/"
+	if root ~= "/" and string.sub(name, 1, #root_slash) ~= root_slash then
+		return nil
 	end
 
+	local depth = 0
+	local path = name
+	while path ~= root do
+		path = get_parent_path(path)
+		depth = depth + 1
+	end
+
+	return depth
+end
+
+local list_locks = function(prefix, now_sec, root, max_depth)
+	local name_key_prefix_len = #` + c.nameKeyMacro(`""`) + `
+	local pattern = glob_escape(` + c.nameKeyMacro("root") + `) .. "*"
+
+	local locks = {}
+	local seen = {}
+	local cursor = "0"
+
+	repeat
+		local res = redis.call("SCAN", cursor, "MATCH", pattern, "COUNT", 100)
+		cursor = res[1]
+
+		for _, name_key in ipairs(res[2]) do
+			local name = string.sub(name_key, name_key_prefix_len + 1)
+			local depth = path_depth(root, name)
+
+			if not seen[name] and depth ~= nil and (max_depth < 0 or depth <= max_depth) then
+				seen[name] = true
+
+				local token = redis.call("HGET", name_key, "` + tokenKey + `")
+				if token then
+					local lock = read_lock(prefix, now_sec, token)
+					if lock ~= nil then
+						table.insert(locks, lock_reply(lock))
+					end
+				end
+			end
+		end
+	until cursor == "0"
+
+	return ` + okReplyMacro("locks") + `
+end
+`
+}
+
+// readLocksFunc reads the explicit locks on names, skipping names without
+// one. It is used by IterLocks, which finds the names with a SCAN in Go.
+func (c *luaConfig) readLocksFunc() string {
+	return `
+local read_locks = function(prefix, now_sec, names)
+	local locks = {}
+
+	for _, name in ipairs(names) do
+		local token = redis.call("HGET", ` + c.nameKeyMacro("name") + `, "` + tokenKey + `")
+		if token then
+			local lock = read_lock(prefix, now_sec, token)
+			if lock ~= nil then
+				table.insert(locks, lock_reply(lock))
+			end
+		end
+	end
+
+	return ` + okReplyMacro("locks") + `
+end
+`
+}
+
+// expiringWithinFunc reads the locks expiring after now_sec and at most
+// window_sec later from the expiry zset. Held locks are not in the zset.
+func (c *luaConfig) expiringWithinFunc() string {
+	return `
+local expiring_within = function(prefix, now_sec, window_sec)
+	local locks = {}
+
+	for _, expiry_zset_key in ipairs(` + c.expiryZSetKeysMacro() + `) do
+		local names = redis.call("ZRANGEBYSCORE", expiry_zset_key, "(" .. now_sec, now_sec + window_sec)
+
+		for _, name in ipairs(names) do
+			local name_key = ` + c.nameKeyMacro("name") + `
+			local token = redis.call("HGET", name_key, "` + tokenKey + `")
+			if token then
+				local lock = read_lock(prefix, now_sec, token)
+				if lock ~= nil then
+					table.insert(locks, lock_reply(lock))
+				end
+			end
+		end
+	end
+
+	return ` + okReplyMacro("locks") + `
+end
+`
+}
+
+func (c *luaConfig) confirmFunc() string {
+	return `
+local confirm = function(prefix, now_sec, name0, name1, condition_tokens)
+	collect_expired_nodes(prefix, now_sec)
+
+	local n0 = nil
+	local n1 = nil
+
+	if name0 ~= nil then
+		n0 = lookup(prefix, name0, condition_tokens)
+		if n0 == nil then
+			return ` + errReplyMacro(errConfirmationFailed) + `
+		end
+	end
 	if name1 ~= nil then
-		local name1_key = ` + nameKeyMacro("name1") + `
-		local res1 = redis.call("HMGET", name1_key, "` + durationKey + `", "` + expiryKey + `")
-		local duration_sec1 = tonumber(res1[1])
-		local expiry_sec1 = tonumber(res1[2])
+		n1 = lookup(prefix, name1, condition_tokens)
+		if n1 == nil then
+			return ` + errReplyMacro(errConfirmationFailed) + `
+		end
+	end
+
+	-- Don't hold the same node twice. The nodes are held in the same script
+	-- run as they are looked up, so they can't expire or be removed in
+	-- between.
+	if n0 ~= nil and n1 ~= nil and n0[1] == n1[1] then
+		n1 = nil
+	end
+
+	local res = {}
+
+	if n0 ~= nil then
+		hold(prefix, n0[1], n0[2], now_sec)
+		table.insert(res, n0[1])
+	end
+	if n1 ~= nil then
+		hold(prefix, n1[1], n1[2], now_sec)
+		table.insert(res, n1[1])
+	end
+
+	return ` + okReplyMacro("res") + `
+end
+`
+}
+
+// confirmRootsFunc holds the explicit locks on roots without matching
+// condition tokens, for callers that created the locks themselves. Either all
+// of them are held or none is.
+func (c *luaConfig) confirmRootsFunc() string {
+	return `
+local confirm_roots = function(prefix, now_sec, roots)
+	collect_expired_nodes(prefix, now_sec)
+
+	local nodes = {}
+	local seen = {}
+
+	for _, root in ipairs(roots) do
+		if not seen[root] then
+			seen[root] = true
+
+			local name_key = ` + c.nameKeyMacro("root") + `
+			local res = redis.call("HMGET", name_key, "` + tokenKey + `", "` + durationKey + `", "` + heldKey + `")
+			if not res[1] or res[1] == "" then
+				return ` + errReplyMacro(errConfirmationFailed) + `
+			end
+			if res[3] == "` + trueValue + `" then
+				return ` + errReplyMacro(errLocked) + `
+			end
+
+			table.insert(nodes, {root, tonumber(res[2])})
+		end
+	end
 
-		unhold(prefix, name1, duration_sec1, expiry_sec1)
+	local res = {}
+	for _, n in ipairs(nodes) do
+		hold(prefix, n[1], n[2], now_sec)
+		table.insert(res, n[1])
 	end
+
+	return ` + okReplyMacro("res") + `
 end
 `
+}
 
-var CreateScript = redis.NewScript(0,
-	GetParentPathFunc+
-		RemoveFunc+
-		CollectExpiredNodesFunc+
-		CanCreateFunc+
-		CreateTokenFunc+
-		CreateFunc+
-		`return create(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", ARGV[6])`,
-)
+// confirmPartialFunc looks up and holds the lock of every name on its own,
+// like confirm does for one name, and replies with the held nodes and with
+// "t" or "f" per name. Names whose lookup fails don't fail the others.
+func (c *luaConfig) confirmPartialFunc() string {
+	return `
+local confirm_partial = function(prefix, now_sec, names, condition_tokens)
+	collect_expired_nodes(prefix, now_sec)
 
-var RefreshScript = redis.NewScript(0,
-	GetParentPathFunc+
-		RemoveFunc+
-		CollectExpiredNodesFunc+
-		RefreshFunc+
-		`return refresh(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]))`,
-)
+	-- Look up all names before holding any node, as lookup skips held nodes
+	-- and several names may be covered by the same lock.
+	local nodes = {}
+	for i, name in ipairs(names) do
+		nodes[i] = lookup(prefix, name, condition_tokens) or false
+	end
 
-var UnlockScript = redis.NewScript(0,
-	GetParentPathFunc+
-		RemoveFunc+
-		CollectExpiredNodesFunc+
-		UnlockFunc+
-		`return unlock(ARGV[1], tonumber(ARGV[2]), ARGV[3])`,
-)
+	local held_nodes = {}
+	local held = {}
+	local results = {}
+
+	for i, n in ipairs(nodes) do
+		if n then
+			if not held[n[1]] then
+				hold(prefix, n[1], n[2], now_sec)
+				held[n[1]] = true
+				table.insert(held_nodes, n[1])
+			end
+			results[i] = "` + trueValue + `"
+		else
+			results[i] = "` + falseValue + `"
+		end
+	end
+
+	return ` + okReplyMacro("{held_nodes, results}") + `
+end
+`
+}
+
+func (c *luaConfig) releaseFunc() string {
+	return `
+-- release unholds the named nodes. Empty and repeated names are skipped, so
+-- callers can pass the held roots of Confirm as they are.
+local release = function(prefix, names)
+	local released = {}
+
+	for _, name in ipairs(names) do
+		if name ~= "" and not released[name] then
+			released[name] = true
+
+			local name_key = ` + c.nameKeyMacro("name") + `
+			local res = redis.call("HMGET", name_key, "` + durationKey + `", "` + expiryKey + `")
+			local duration_sec = tonumber(res[1])
+			local expiry_sec = tonumber(res[2])
+
+			unhold(prefix, name, duration_sec, expiry_sec)
+		end
+	end
+
+	return ` + okReplyMacro("true") + `
+end
+`
+}
+
+// confirmWithTimeoutFunc wraps confirm so that the held nodes are also
+// registered in the hold deadlines zset, from which sweep_holds releases them
+// once max_hold_sec has passed. Every hold gets a member of the form id .. name
+// with a fresh id, so that a late release of a swept hold can't release a
+// later hold of the same node.
+func (c *luaConfig) confirmWithTimeoutFunc() string {
+	return `
+local confirm_with_timeout = function(prefix, now_sec, name0, name1, condition_tokens, max_hold_sec)
+	local reply = confirm(prefix, now_sec, name0, name1, condition_tokens)
+	if reply[1] ~= "` + replyOK + `" then
+		return reply
+	end
+
+	local members = {}
+	for _, name in ipairs(reply[2]) do
+		local id = redis.call("INCR", prefix .. "` + holdCounterKey + `")
+		local member = id .. name
+		redis.call("ZADD", prefix .. "` + holdDeadlinesKey + `", now_sec + max_hold_sec, member)
+		table.insert(members, member)
+	end
+
+	return ` + okReplyMacro("members") + `
+end
+`
+}
+
+// releaseHoldsFunc releases the holds registered by confirm_with_timeout.
+// release_holds skips the holds that have already been released, and
+// sweep_holds releases the holds whose deadline has passed.
+func (c *luaConfig) releaseHoldsFunc() string {
+	return `
+local release_holds = function(prefix, members)
+	local names = {}
+	for _, member in ipairs(members) do
+		if redis.call("ZREM", prefix .. "` + holdDeadlinesKey + `", member) == 1 then
+			table.insert(names, string.match(member, "^%d+(/.*)$"))
+		end
+	end
+
+	release(prefix, names)
+
+	return ` + okReplyMacro("#names") + `
+end
+
+local sweep_holds = function(prefix, now_sec)
+	local members = redis.call("ZRANGEBYSCORE", prefix .. "` + holdDeadlinesKey + `", "-inf", now_sec)
+	return release_holds(prefix, members)
+end
+`
+}
+
+// statsFunc reads aggregate counters without scanning the keyspace. The root
+// node's refCount is the number of locks.
+func (c *luaConfig) statsFunc() string {
+	return `
+local stats = function(prefix, now_sec, soon_sec)
+	local root = "/"
+	local root_key = ` + c.nameKeyMacro("root") + `
+
+	local locks = tonumber(redis.call("HGET", root_key, "` + refCountKey + `")) or 0
+	local held = tonumber(redis.call("GET", prefix .. "` + heldCountKey + `")) or 0
+
+	local collectable = 0
+	local expiring_soon = 0
+	for _, expiry_zset_key in ipairs(` + c.expiryZSetKeysMacro() + `) do
+		collectable = collectable + redis.call("ZCOUNT", expiry_zset_key, "-inf", now_sec)
+		expiring_soon = expiring_soon + redis.call("ZCOUNT", expiry_zset_key, "(" .. now_sec, soon_sec)
+	end
+	local next_token = tonumber(redis.call("GET", prefix .. "` + nextTokenKey + `")) or 0
+
+	return ` + okReplyMacro("{locks, held, expiring_soon, collectable, next_token}") + `
+end
+`
+}
+
+// snapshotFunc gathers the stats, the limit locks expiring soonest, and from
+// a scan of at most scan_budget name keys, up to limit held locks and the
+// limit oldest locks by creation time. The last element of the reply tells
+// whether the scan was cut short.
+func (c *luaConfig) snapshotFunc() string {
+	return `
+local snapshot = function(prefix, now_sec, soon_sec, limit, scan_budget)
+	local counters = stats(prefix, now_sec, soon_sec)[2]
+
+	local expiring = {}
+	for _, expiry_zset_key in ipairs(` + c.expiryZSetKeysMacro() + `) do
+		local res = redis.call("ZRANGEBYSCORE", expiry_zset_key, "(" .. now_sec, "+inf", "WITHSCORES", "LIMIT", 0, limit)
+		for i = 1, #res, 2 do
+			table.insert(expiring, {res[i], tonumber(res[i + 1])})
+		end
+	end
+	table.sort(expiring, function(a, b)
+		if a[2] ~= b[2] then
+			return a[2] < b[2]
+		end
+		return a[1] < b[1]
+	end)
+
+	local soonest = {}
+	for _, e in ipairs(expiring) do
+		if #soonest >= limit then
+			break
+		end
+		local name = e[1]
+		local token = redis.call("HGET", ` + c.nameKeyMacro("name") + `, "` + tokenKey + `")
+		local lock = token and read_lock(prefix, now_sec, token)
+		if lock then
+			table.insert(soonest, lock_reply(lock))
+		end
+	end
+
+	local pattern = glob_escape(` + c.nameKeyMacro(`""`) + `) .. "*"
+	local held = {}
+	local created = {}
+	local seen = {}
+	local scanned = 0
+	local cursor = "0"
+
+	repeat
+		local res = redis.call("SCAN", cursor, "MATCH", pattern, "COUNT", 100)
+		cursor = res[1]
+
+		for _, name_key in ipairs(res[2]) do
+			scanned = scanned + 1
+			local fields = redis.call("HMGET", name_key, "` + tokenKey + `", "` + heldKey + `", "` + createdAtKey + `")
+			local token = fields[1]
+			if token and not seen[token] then
+				seen[token] = true
+				if fields[2] == "` + trueValue + `" and #held < limit then
+					local lock = read_lock(prefix, now_sec, token)
+					if lock then
+						table.insert(held, lock_reply(lock))
+					end
+				end
+				local created_sec = tonumber(fields[3])
+				if created_sec then
+					table.insert(created, {token, created_sec})
+				end
+			end
+		end
+	until cursor == "0" or scanned >= scan_budget
+
+	table.sort(created, function(a, b)
+		if a[2] ~= b[2] then
+			return a[2] < b[2]
+		end
+		return a[1] < b[1]
+	end)
+
+	local oldest = {}
+	for _, e in ipairs(created) do
+		if #oldest >= limit then
+			break
+		end
+		local lock = read_lock(prefix, now_sec, e[1])
+		if lock then
+			table.insert(oldest, lock_reply(lock))
+		end
+	end
+
+	local truncated = 0
+	if cursor ~= "0" then
+		truncated = 1
+	end
+
+	return ` + okReplyMacro("{counters, soonest, held, oldest, truncated}") + `
+end
+`
+}
+
+// countLocksUnderFunc reads the refCount of the node at name, which is the
+// number of locks at or below it.
+func (c *luaConfig) countLocksUnderFunc() string {
+	return `
+local count_locks_under = function(prefix, name)
+	local count = tonumber(redis.call("HGET", ` + c.nameKeyMacro("name") + `, "` + refCountKey + `")) or 0
+	return ` + okReplyMacro("count") + `
+end
+`
+}
+
+// validateTokenFunc reports whether the lock identified by token exists and
+// whether it is held, as unlock would see it, but without collecting expired
+// nodes or writing anything: a lock that has expired but has not been
+// collected yet does not exist.
+func (c *luaConfig) validateTokenFunc() string {
+	return `
+local validate_token = function(prefix, now_sec, token)
+	local name = redis.call("GET", ` + c.tokenKeyMacro("token") + `)
+	if not name then
+		return ` + okReplyMacro("{0, 0}") + `
+	end
+
+	local res = redis.call("HMGET", ` + c.nameKeyMacro("name") + `, "` + tokenKey + `", "` + durationKey + `", "` + expiryKey + `", "` + heldKey + `")
+	local duration_sec = tonumber(res[2])
+	local expiry_sec = tonumber(res[3])
+	if res[1] ~= token or not duration_sec then
+		return ` + okReplyMacro("{0, 0}") + `
+	end
+	if duration_sec >= 0 and expiry_sec and expiry_sec <= now_sec then
+		return ` + okReplyMacro("{0, 0}") + `
+	end
+
+	if res[4] == "` + trueValue + `" then
+		return ` + okReplyMacro("{1, 1}") + `
+	end
+	return ` + okReplyMacro("{1, 0}") + `
+end
+`
+}
+
+// expiryAdminFunc defines peek_expiry and set_expiry, which read and write
+// the expiry of a lock directly for tooling. Neither collects expired nodes,
+// so that a lock moved into the past stays until the next collection.
+func (c *luaConfig) expiryAdminFunc() string {
+	return `
+local peek_expiry = function(prefix, token)
+	local name = redis.call("GET", ` + c.tokenKeyMacro("token") + `)
+	if not name then
+		return ` + errReplyMacro(errNoSuchLock) + `
+	end
+
+	local res = redis.call("HMGET", ` + c.nameKeyMacro("name") + `, "` + durationKey + `", "` + expiryKey + `")
+	local duration_sec = tonumber(res[1])
+	local expiry_sec = tonumber(res[2])
+	if not duration_sec or not expiry_sec then
+		return ` + errReplyMacro(errCorruptState) + `
+	end
+	if duration_sec < 0 then
+		expiry_sec = 0
+	end
+
+	return ` + okReplyMacro("expiry_sec") + `
+end
+
+local set_expiry = function(prefix, token, expiry_sec)
+	local name = redis.call("GET", ` + c.tokenKeyMacro("token") + `)
+	if not name then
+		return ` + errReplyMacro(errNoSuchLock) + `
+	end
+
+	local name_key = ` + c.nameKeyMacro("name") + `
+	local res = redis.call("HMGET", name_key, "` + durationKey + `", "` + heldKey + `")
+	local duration_sec = tonumber(res[1])
+	if not duration_sec then
+		return ` + errReplyMacro(errCorruptState) + `
+	end
+	if res[2] == "` + trueValue + `" then
+		return ` + errReplyMacro(errLocked) + `
+	end
+	if duration_sec < 0 then
+		return ` + errReplyMacro(errInfiniteLock) + `
+	end
+
+	-- The shard depends only on the name, so ZADD moves the entry.
+	redis.call("ZADD", ` + c.expiryZSetKeyMacro("name") + `, expiry_sec, name)
+	redis.call("HSET", name_key, "` + expiryKey + `", expiry_sec)
+
+	return ` + okReplyMacro("1") + `
+end
+`
+}
+
+// scanNodesFunc defines scan_nodes, which returns the sets of the names and
+// tokens of all nodes under prefix, and count_locked, which returns the number
+// of locked self-or-descendents of every locked path.
+func (c *luaConfig) scanNodesFunc() string {
+	return `
+local scan_nodes = function(prefix)
+	local name_key_prefix = ` + c.nameKeyMacro(`""`) + `
+	local token_key_prefix = ` + c.tokenKeyMacro(`""`) + `
+
+	-- Only the typed keys are scanned, so that the keys under a longer prefix
+	-- of another lock system can't match.
+	local scan_keys = function(key_prefix)
+		local set = {}
+		local cursor = "0"
+
+		repeat
+			local res = redis.call("SCAN", cursor, "MATCH", glob_escape(key_prefix) .. "*", "COUNT", 100)
+			cursor = res[1]
+
+			for _, key in ipairs(res[2]) do
+				set[string.sub(key, #key_prefix + 1)] = true
+			end
+		until cursor == "0"
+
+		return set
+	end
+
+	return scan_keys(name_key_prefix), scan_keys(token_key_prefix)
+end
+
+local count_locked = function(prefix, names)
+	local locked_counts = {}
+
+	for name in pairs(names) do
+		local name_key = ` + c.nameKeyMacro("name") + `
+		if redis.call("HGET", name_key, "` + tokenKey + `") then
+			local path = name
+			while true do
+				locked_counts[path] = (locked_counts[path] or 0) + 1
+				if path == "/" then
+					break
+				end
+				path = get_parent_path(path)
+			end
+		end
+	end
+
+	return locked_counts
+end
+`
+}
+
+// compactExpirySetFunc removes the names of missing nodes from the expiry
+// zset, collects expired nodes and then deletes the unlocked nodes that have
+// no descendants, taking their refcount off their ancestors. It replies with
+// the number of names removed from the expiry zset.
+func (c *luaConfig) compactExpirySetFunc() string {
+	return `
+local compact_expiry_set = function(prefix, now_sec)
+	local removed = 0
+	for _, expiry_zset_key in ipairs(` + c.expiryZSetKeysMacro() + `) do
+		local cursor = "0"
+		repeat
+			local res = redis.call("ZSCAN", expiry_zset_key, cursor, "COUNT", 100)
+			cursor = res[1]
+
+			for i = 1, #res[2], 2 do
+				local name = res[2][i]
+				if redis.call("EXISTS", ` + c.nameKeyMacro("name") + `) == 0 then
+					removed = removed + redis.call("ZREM", expiry_zset_key, name)
+				end
+			end
+		until cursor == "0"
+	end
+
+	collect_expired_nodes(prefix, now_sec)
+
+	local names = scan_nodes(prefix)
+
+	-- has_descendants[name] is whether there is a node below name.
+	local has_descendants = {}
+	for name in pairs(names) do
+		local path = name
+		while path ~= "/" do
+			path = get_parent_path(path)
+			has_descendants[path] = true
+		end
+	end
+
+	for name in pairs(names) do
+		local name_key = ` + c.nameKeyMacro("name") + `
+		local res = redis.call("HMGET", name_key, "` + tokenKey + `", "` + refCountKey + `")
+		if not res[1] and not has_descendants[name] and redis.call("EXISTS", name_key) == 1 then
+			-- Nothing is locked at or below the node, so its whole refcount
+			-- is excess that its ancestors carry as well.
+			redis.call("DEL", name_key)
+
+			local ref_count = tonumber(res[2]) or 0
+			local ancestor = name
+			while ref_count ~= 0 and ancestor ~= "/" do
+				ancestor = get_parent_path(ancestor)
+				local ancestor_name_key = ` + c.nameKeyMacro("ancestor") + `
+				if redis.call("EXISTS", ancestor_name_key) == 1 then
+					local ancestor_ref_count = tonumber(redis.call("HINCRBY", ancestor_name_key, "` + refCountKey + `", -ref_count))
+					if ancestor_ref_count <= 0 and not redis.call("HGET", ancestor_name_key, "` + tokenKey + `") then
+						redis.call("DEL", ancestor_name_key)
+					end
+				end
+			end
+		end
+	end
+
+	return ` + okReplyMacro("removed") + `
+end
+`
+}
+
+// danglingNodesFunc collects expired nodes and then returns the names of the
+// nodes whose refCount differs from their number of locked
+// self-or-descendents.
+func (c *luaConfig) danglingNodesFunc() string {
+	return `
+local dangling_nodes = function(prefix, now_sec)
+	collect_expired_nodes(prefix, now_sec)
+
+	local names = scan_nodes(prefix)
+	local locked_counts = count_locked(prefix, names)
+
+	local dangling = {}
+	for name in pairs(names) do
+		local name_key = ` + c.nameKeyMacro("name") + `
+		local ref_count = tonumber(redis.call("HGET", name_key, "` + refCountKey + `")) or 0
+		if ref_count ~= (locked_counts[name] or 0) then
+			table.insert(dangling, name)
+		end
+	end
+
+	return ` + okReplyMacro("dangling") + `
+end
+`
+}
+
+// deepestLockFunc finds the unexpired lock whose root has the most path
+// segments. It never writes.
+func (c *luaConfig) deepestLockFunc() string {
+	return `
+local deepest_lock = function(prefix, now_sec)
+	local names = scan_nodes(prefix)
+
+	local deepest = ""
+	local deepest_depth = -1
+
+	for name in pairs(names) do
+		local depth = 0
+		if name ~= "/" then
+			local _, slashes = string.gsub(name, "/", "")
+			depth = slashes
+		end
+
+		if depth > deepest_depth or (depth == deepest_depth and name < deepest) then
+			local name_key = ` + c.nameKeyMacro("name") + `
+			local token = redis.call("HGET", name_key, "` + tokenKey + `")
+			if token and read_lock(prefix, now_sec, token) ~= nil then
+				deepest = name
+				deepest_depth = depth
+			end
+		end
+	end
+
+	return ` + okReplyMacro("{deepest, deepest_depth}") + `
+end
+`
+}
+
+// checkFunc collects expired nodes and then verifies the invariants maintained
+// by the other scripts. It replies with a description of the first violation
+// found, or false. It visits every key under prefix with SCAN and ZSCAN.
+func (c *luaConfig) checkFunc() string {
+	return `
+local find_inconsistency = function(prefix)
+	local names, tokens = scan_nodes(prefix)
+
+	if next(names) ~= nil and not names["/"] then
+		return string.format("non-empty lock state does not contain the root %q", "/")
+	end
+
+	-- locked_counts[name] is the number of locked self-or-descendents of name.
+	local locked_counts = {}
+	local ref_counts = {}
+	local held_count = 0
+
+	for name in pairs(names) do
+		local name_key = ` + c.nameKeyMacro("name") + `
+		local res = redis.call("HMGET", name_key, "` + nameKey + `", "` + tokenKey + `", "` + refCountKey + `", "` + heldKey + `", "` + durationKey + `", "` + expiryKey + `", "` + rootKey + `", "` + zeroDepthKey + `")
+		local node_name = res[1]
+		local token = res[2]
+		local ref_count = tonumber(res[3])
+		local held = res[4] == "` + trueValue + `"
+		local duration_sec = tonumber(res[5])
+		local expiry_sec = tonumber(res[6])
+		local root = res[7]
+		local zero_depth = res[8]
+
+		if node_name ~= name then
+			return string.format("node name %q != key name %q", tostring(node_name), name)
+		end
+		if not is_clean_path(name) then
+			return string.format("node name %q is not clean", name)
+		end
+		if root ~= name then
+			return string.format("node root %q != key name %q", tostring(root), name)
+		end
+		if ref_count == nil or ref_count <= 0 then
+			return string.format("non-positive refCount for node at name %q", name)
+		end
+		ref_counts[name] = ref_count
+
+		if held then
+			held_count = held_count + 1
+		end
+
+		local expiry_score = redis.call("ZSCORE", ` + c.expiryZSetKeyMacro("name") + `, name)
+
+		if token then
+			if not tokens[token] then
+				return string.format("node at name %q has token %q but no token key", name, token)
+			end
+			if duration_sec == nil or expiry_sec == nil then
+				return string.format("node at name %q has token %q but no duration or expiry", name, token)
+			end
+			if zero_depth ~= "` + trueValue + `" and zero_depth ~= "` + falseValue + `" then
+				return string.format("node at name %q has invalid zero depth %q", name, tostring(zero_depth))
+			end
+
+			if held or duration_sec < 0 then
+				if expiry_score then
+					return string.format("node at name %q is held or infinite but in the expiry zset", name)
+				end
+			elseif tonumber(expiry_score) ~= expiry_sec then
+				return string.format("node at name %q has expiry %s but expiry zset score %s", name, tostring(expiry_sec), tostring(expiry_score))
+			end
+
+			local path = name
+			while true do
+				locked_counts[path] = (locked_counts[path] or 0) + 1
+				if path == "/" then
+					break
+				end
+				path = get_parent_path(path)
+			end
+		else
+			if held then
+				return string.format("node at name %q is held but has no token", name)
+			end
+			if expiry_score then
+				return string.format("node at name %q has no token but is in the expiry zset", name)
+			end
+		end
+	end
+
+	local stored_held_count = tonumber(redis.call("GET", prefix .. "` + heldCountKey + `")) or 0
+	if stored_held_count ~= held_count then
+		return string.format("held count %d differs from the number of held nodes %d", stored_held_count, held_count)
+	end
+
+	for name, locked_count in pairs(locked_counts) do
+		if ref_counts[name] == nil then
+			return string.format("no node at name %q with %d locked self-or-descendents", name, locked_count)
+		end
+	end
+	for name, ref_count in pairs(ref_counts) do
+		local locked_count = locked_counts[name] or 0
+		if ref_count ~= locked_count then
+			return string.format("node at name %q has refCount %d but %d locked self-or-descendents", name, ref_count, locked_count)
+		end
+	end
+
+	for token in pairs(tokens) do
+		local token_key = ` + c.tokenKeyMacro("token") + `
+		local name = redis.call("GET", token_key)
+		if not name or not names[name] then
+			return string.format("token %q refers to missing node at name %q", token, tostring(name))
+		end
+
+		local name_key = ` + c.nameKeyMacro("name") + `
+		local node_token = redis.call("HGET", name_key, "` + tokenKey + `")
+		if node_token ~= token then
+			return string.format("token %q refers to node at name %q with token %q", token, name, tostring(node_token))
+		end
+	end
+
+	for _, expiry_zset_key in ipairs(` + c.expiryZSetKeysMacro() + `) do
+		local cursor = "0"
+		repeat
+			local res = redis.call("ZSCAN", expiry_zset_key, cursor, "COUNT", 100)
+			cursor = res[1]
+
+			for i = 1, #res[2], 2 do
+				local name = res[2][i]
+				if not names[name] then
+					return string.format("node at name %q in the expiry zset but missing", name)
+				end
+				if ` + c.expiryZSetKeyMacro("name") + ` ~= expiry_zset_key then
+					return string.format("node at name %q in the wrong expiry zset shard %q", name, expiry_zset_key)
+				end
+			end
+		until cursor == "0"
+	end
+
+	return nil
+end
+
+local check = function(prefix, now_sec)
+	collect_expired_nodes(prefix, now_sec)
+
+	return ` + okReplyMacro("find_inconsistency(prefix) or false") + `
+end
+`
+}
+
+// scriptSet holds the scripts compiled with a luaConfig.
+type scriptSet struct {
+	create             *redis.Script
+	createIdempotent   *redis.Script
+	refresh            *redis.Script
+	refreshMany        *redis.Script
+	updateOwner        *redis.Script
+	steal              *redis.Script
+	unlock             *redis.Script
+	unlockByPath       *redis.Script
+	confirm            *redis.Script
+	release            *redis.Script
+	getLock            *redis.Script
+	lookup             *redis.Script
+	listLocks          *redis.Script
+	check              *redis.Script
+	stats              *redis.Script
+	danglingNodes      *redis.Script
+	expiringWithin     *redis.Script
+	deepestLock        *redis.Script
+	confirmRoots       *redis.Script
+	confirmWithTimeout *redis.Script
+	releaseHolds       *redis.Script
+	sweepHolds         *redis.Script
+	createWithMeta     *redis.Script
+	moveLock           *redis.Script
+	readLocks          *redis.Script
+	createWithToken    *redis.Script
+	isLocked           *redis.Script
+	compactExpirySet   *redis.Script
+	conflictingLocks   *redis.Script
+	countLocksUnder    *redis.Script
+	peekExpiry         *redis.Script
+	setExpiry          *redis.Script
+	confirmPartial     *redis.Script
+	snapshot           *redis.Script
+	validateToken      *redis.Script
+	requiredTokens     *redis.Script
+	createFenced       *redis.Script
+}
+
+// all returns all scripts of the set.
+func (s *scriptSet) all() []*redis.Script {
+	return []*redis.Script{
+		s.create,
+		s.createIdempotent,
+		s.refresh,
+		s.refreshMany,
+		s.updateOwner,
+		s.steal,
+		s.unlock,
+		s.unlockByPath,
+		s.confirm,
+		s.release,
+		s.getLock,
+		s.lookup,
+		s.listLocks,
+		s.check,
+		s.stats,
+		s.danglingNodes,
+		s.expiringWithin,
+		s.deepestLock,
+		s.confirmRoots,
+		s.confirmWithTimeout,
+		s.releaseHolds,
+		s.sweepHolds,
+		s.createWithMeta,
+		s.moveLock,
+		s.readLocks,
+		s.createWithToken,
+		s.isLocked,
+		s.compactExpirySet,
+		s.conflictingLocks,
+		s.countLocksUnder,
+		s.peekExpiry,
+		s.setExpiry,
+		s.confirmPartial,
+		s.snapshot,
+		s.validateToken,
+		s.requiredTokens,
+		s.createFenced,
+	}
+}
+
+func (c *luaConfig) scripts() *scriptSet {
+	return &scriptSet{
+		create: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.canCreateFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.createFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[7]) or 0
+				expiry_at_sec = tonumber(ARGV[9])
+				return with_collected(create(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", ARGV[6], ARGV[8] ~= "0"))`,
+		),
+		createIdempotent: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.canCreateFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.createFunc()+
+				c.createIdempotentFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[9]) or 0
+				return with_collected(create_idempotent(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5], tonumber(ARGV[6]), ARGV[7] == "1", ARGV[8]))`,
+		),
+		refresh: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.expiryFunc()+
+				c.refreshFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[5]) or 0
+				expiry_at_sec = tonumber(ARGV[6])
+				if ARGV[7] == "1" then
+					refresh_owner_xml = ARGV[8]
+				end
+				if ARGV[9] == "1" then
+					refresh_zero_depth = ARGV[10] == "1"
+				end
+				return with_collected(refresh(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4])))`,
+		),
+		refreshMany: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.expiryFunc()+
+				c.refreshFunc()+
+				c.refreshManyFunc()+
+				`
+				expiry_jitter_sec = tonumber(ARGV[4])
+				local tokens_count = tonumber(ARGV[5])
+				local tokens = {unpack(ARGV, 6, 5 + tokens_count)}
+				return with_collected(refresh_many(ARGV[1], tonumber(ARGV[2]), tokens, tonumber(ARGV[3])))
+				`,
+		),
+		updateOwner: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.updateOwnerFunc()+
+				`return with_collected(update_owner(ARGV[1], tonumber(ARGV[2]), ARGV[3], ARGV[4], ARGV[5] == "1"))`,
+		),
+		steal: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.stealFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[8]) or 0
+				return with_collected(steal(ARGV[1], tonumber(ARGV[2]), ARGV[3], ARGV[4], tonumber(ARGV[5]), ARGV[6] == "1", ARGV[7] == "1", ARGV[9] == "1"))`,
+		),
+		unlock: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.unlockFunc()+
+				`return with_collected(unlock(ARGV[1], tonumber(ARGV[2]), ARGV[3]))`,
+		),
+		unlockByPath: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.unlockFunc()+
+				c.unlockByPathFunc()+
+				`return with_collected(unlock_by_path(ARGV[1], tonumber(ARGV[2]), ARGV[3]))`,
+		),
+		confirm: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.holdFunc()+
+				c.lookupFunc()+
+				c.confirmFunc()+
+				`
+				local condition_tokens_count = tonumber(ARGV[5])
+				local condition_tokens = {unpack(ARGV, 6, 6 + condition_tokens_count)}
+				local name0 = ARGV[3]
+				if name0 == "" then
+					name0 = nil
+				end
+				local name1 = ARGV[4]
+				if name1 == "" then
+					name1 = nil
+				end
+				return with_collected(confirm(ARGV[1], tonumber(ARGV[2]), name0, name1, condition_tokens))
+				`,
+		),
+		release: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.unholdFunc()+
+				c.releaseFunc()+
+				`return release(ARGV[1], {unpack(ARGV, 2)})`,
+		),
+		getLock: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.readLockFunc()+
+				c.getLockFunc()+
+				`return get_lock(ARGV[1], tonumber(ARGV[2]), ARGV[3])`,
+		),
+		lookup: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.lookupFunc()+
+				c.readLockFunc()+
+				c.readOnlyLookupFunc()+
+				`
+				local condition_tokens_count = tonumber(ARGV[4])
+				local condition_tokens = {unpack(ARGV, 5, 5 + condition_tokens_count)}
+				return lookup_read_only(ARGV[1], tonumber(ARGV[2]), ARGV[3], condition_tokens)
+				`,
+		),
+		listLocks: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.globEscapeFunc()+
+				c.readLockFunc()+
+				c.listLocksFunc()+
+				`return list_locks(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]))`,
+		),
+		check: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.globEscapeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.scanNodesFunc()+
+				c.checkFunc()+
+				`return with_collected(check(ARGV[1], tonumber(ARGV[2])))`,
+		),
+		danglingNodes: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.globEscapeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.scanNodesFunc()+
+				c.danglingNodesFunc()+
+				`return with_collected(dangling_nodes(ARGV[1], tonumber(ARGV[2])))`,
+		),
+		stats: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.statsFunc()+
+				`return stats(ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]))`,
+		),
+		expiringWithin: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.readLockFunc()+
+				c.expiringWithinFunc()+
+				`return expiring_within(ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]))`,
+		),
+		deepestLock: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.globEscapeFunc()+
+				c.scanNodesFunc()+
+				c.readLockFunc()+
+				c.deepestLockFunc()+
+				`return deepest_lock(ARGV[1], tonumber(ARGV[2]))`,
+		),
+		confirmRoots: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.holdFunc()+
+				c.confirmRootsFunc()+
+				`return with_collected(confirm_roots(ARGV[1], tonumber(ARGV[2]), {unpack(ARGV, 3)}))`,
+		),
+		confirmWithTimeout: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.holdFunc()+
+				c.lookupFunc()+
+				c.confirmFunc()+
+				c.confirmWithTimeoutFunc()+
+				`
+				local condition_tokens_count = tonumber(ARGV[5])
+				local condition_tokens = {unpack(ARGV, 6, 5 + condition_tokens_count)}
+				local name0 = ARGV[3]
+				if name0 == "" then
+					name0 = nil
+				end
+				local name1 = ARGV[4]
+				if name1 == "" then
+					name1 = nil
+				end
+				local max_hold_sec = tonumber(ARGV[6 + condition_tokens_count])
+				return with_collected(confirm_with_timeout(ARGV[1], tonumber(ARGV[2]), name0, name1, condition_tokens, max_hold_sec))
+				`,
+		),
+		releaseHolds: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.unholdFunc()+
+				c.releaseFunc()+
+				c.releaseHoldsFunc()+
+				`return release_holds(ARGV[1], {unpack(ARGV, 2)})`,
+		),
+		sweepHolds: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.unholdFunc()+
+				c.releaseFunc()+
+				c.releaseHoldsFunc()+
+				`return sweep_holds(ARGV[1], tonumber(ARGV[2]))`,
+		),
+		createWithMeta: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.canCreateFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.createFunc()+
+				c.createWithMetaFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[6]) or 0
+				local meta = {unpack(ARGV, 8)}
+				return with_collected(create_with_meta(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", meta, ARGV[7] ~= "0"))`,
+		),
+		moveLock: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.canCreateFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.readLockFunc()+
+				c.moveLockFunc()+
+				`return with_collected(move_lock(ARGV[1], tonumber(ARGV[2]), ARGV[3], ARGV[4]))`,
+		),
+		readLocks: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.readLockFunc()+
+				c.readLocksFunc()+
+				`return read_locks(ARGV[1], tonumber(ARGV[2]), {unpack(ARGV, 3)})`,
+		),
+		createWithToken: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.canCreateFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.createFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[7]) or 0
+				return with_collected(create(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", ARGV[6], ARGV[8] ~= "0", ARGV[9]))`,
+		),
+		isLocked: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.lookupFunc()+
+				c.readLockFunc()+
+				c.isLockedFunc()+
+				`return is_locked(ARGV[1], tonumber(ARGV[2]), ARGV[3])`,
+		),
+		compactExpirySet: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.globEscapeFunc()+
+				c.scanNodesFunc()+
+				c.compactExpirySetFunc()+
+				`return with_collected(compact_expiry_set(ARGV[1], tonumber(ARGV[2])))`,
+		),
+		conflictingLocks: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.globEscapeFunc()+
+				c.readLockFunc()+
+				c.listLocksFunc()+
+				c.conflictingLocksFunc()+
+				`return conflicting_locks(ARGV[1], tonumber(ARGV[2]), ARGV[3], ARGV[4] == "1")`,
+		),
+		countLocksUnder: redis.NewScript(0,
+			c.countLocksUnderFunc()+
+				`return count_locks_under(ARGV[1], ARGV[2])`,
+		),
+		peekExpiry: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.expiryAdminFunc()+
+				`return peek_expiry(ARGV[1], ARGV[2])`,
+		),
+		setExpiry: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.expiryAdminFunc()+
+				`return set_expiry(ARGV[1], ARGV[2], tonumber(ARGV[3]))`,
+		),
+		confirmPartial: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.holdFunc()+
+				c.lookupFunc()+
+				c.confirmPartialFunc()+
+				`
+				local names_count = tonumber(ARGV[3])
+				local names = {unpack(ARGV, 4, 3 + names_count)}
+				local condition_tokens = {unpack(ARGV, 4 + names_count)}
+				return with_collected(confirm_partial(ARGV[1], tonumber(ARGV[2]), names, condition_tokens))
+				`,
+		),
+		snapshot: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.globEscapeFunc()+
+				c.readLockFunc()+
+				c.statsFunc()+
+				c.snapshotFunc()+
+				`return snapshot(ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4]), tonumber(ARGV[5]))`,
+		),
+		validateToken: redis.NewScript(0,
+			c.validateTokenFunc()+
+				`return validate_token(ARGV[1], tonumber(ARGV[2]), ARGV[3])`,
+		),
+		requiredTokens: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.lookupFunc()+
+				c.readLockFunc()+
+				c.requiredTokensFunc()+
+				`return required_tokens(ARGV[1], tonumber(ARGV[2]), ARGV[3])`,
+		),
+		createFenced: redis.NewScript(0,
+			c.expiryZSetFunc()+
+				c.getParentPathFunc()+
+				c.removeFunc()+
+				c.reconcileFunc()+
+				c.collectExpiredNodesFunc()+
+				c.canCreateFunc()+
+				c.expiryFunc()+
+				c.createTokenFunc()+
+				c.createFunc()+
+				c.createFencedFunc()+
+				`expiry_jitter_sec = tonumber(ARGV[7]) or 0
+				return with_collected(create_fenced(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", ARGV[6], ARGV[8] ~= "0"))`,
+		),
+	}
+}
 
-var ConfirmScript = redis.NewScript(0,
-	GetParentPathFunc+
-		RemoveFunc+
-		CollectExpiredNodesFunc+
-		HoldFunc+
-		LookupFunc+
-		ConfirmFunc+
-		`
-		local condition_tokens_count = tonumber(ARGV[5])
-		local condition_tokens = {unpack(ARGV, 6, 6 + condition_tokens_count)}
-		local name0 = ARGV[3]
-		if name0 == "" then
-			name0 = nil
-		end
-		local name1 = ARGV[4]
-		if name1 == "" then
-			name1 = nil
-		end
-		return confirm(ARGV[1], tonumber(ARGV[2]), name0, name1, condition_tokens)
-		`,
+// Lua functions compiled with the default configuration. A RedisLS compiles
+// its own functions, see luaConfig.
+var (
+	GetParentPathFunc       = defaultLuaConfig.getParentPathFunc()
+	ExpiryFunc              = defaultLuaConfig.expiryFunc()
+	ExpiryZSetFunc          = defaultLuaConfig.expiryZSetFunc()
+	CreateTokenFunc         = defaultLuaConfig.createTokenFunc()
+	CanCreateFunc           = defaultLuaConfig.canCreateFunc()
+	RemoveFunc              = defaultLuaConfig.removeFunc()
+	ReconcileFunc           = defaultLuaConfig.reconcileFunc()
+	CollectExpiredNodesFunc = defaultLuaConfig.collectExpiredNodesFunc()
+	HoldFunc                = defaultLuaConfig.holdFunc()
+	UnholdFunc              = defaultLuaConfig.unholdFunc()
+
+	CreateFunc             = defaultLuaConfig.createFunc()
+	CreateIdempotentFunc   = defaultLuaConfig.createIdempotentFunc()
+	RefreshFunc            = defaultLuaConfig.refreshFunc()
+	RefreshManyFunc        = defaultLuaConfig.refreshManyFunc()
+	UpdateOwnerFunc        = defaultLuaConfig.updateOwnerFunc()
+	StealFunc              = defaultLuaConfig.stealFunc()
+	UnlockFunc             = defaultLuaConfig.unlockFunc()
+	UnlockByPathFunc       = defaultLuaConfig.unlockByPathFunc()
+	LookupFunc             = defaultLuaConfig.lookupFunc()
+	ReadLockFunc           = defaultLuaConfig.readLockFunc()
+	GetLockFunc            = defaultLuaConfig.getLockFunc()
+	ReadOnlyLookupFunc     = defaultLuaConfig.readOnlyLookupFunc()
+	GlobEscapeFunc         = defaultLuaConfig.globEscapeFunc()
+	ListLocksFunc          = defaultLuaConfig.listLocksFunc()
+	ConfirmFunc            = defaultLuaConfig.confirmFunc()
+	ReleaseFunc            = defaultLuaConfig.releaseFunc()
+	ScanNodesFunc          = defaultLuaConfig.scanNodesFunc()
+	CheckFunc              = defaultLuaConfig.checkFunc()
+	DanglingNodesFunc      = defaultLuaConfig.danglingNodesFunc()
+	StatsFunc              = defaultLuaConfig.statsFunc()
+	ExpiringWithinFunc     = defaultLuaConfig.expiringWithinFunc()
+	DeepestLockFunc        = defaultLuaConfig.deepestLockFunc()
+	ConfirmRootsFunc       = defaultLuaConfig.confirmRootsFunc()
+	ConfirmWithTimeoutFunc = defaultLuaConfig.confirmWithTimeoutFunc()
+	ReleaseHoldsFunc       = defaultLuaConfig.releaseHoldsFunc()
+	CreateWithMetaFunc     = defaultLuaConfig.createWithMetaFunc()
+	MoveLockFunc           = defaultLuaConfig.moveLockFunc()
+	ReadLocksFunc          = defaultLuaConfig.readLocksFunc()
+	IsLockedFunc           = defaultLuaConfig.isLockedFunc()
+	CompactExpirySetFunc   = defaultLuaConfig.compactExpirySetFunc()
+	ConflictingLocksFunc   = defaultLuaConfig.conflictingLocksFunc()
+	CountLocksUnderFunc    = defaultLuaConfig.countLocksUnderFunc()
+	ExpiryAdminFunc        = defaultLuaConfig.expiryAdminFunc()
+	ConfirmPartialFunc     = defaultLuaConfig.confirmPartialFunc()
+	SnapshotFunc           = defaultLuaConfig.snapshotFunc()
+	ValidateTokenFunc      = defaultLuaConfig.validateTokenFunc()
+	RequiredTokensFunc     = defaultLuaConfig.requiredTokensFunc()
+	CreateFencedFunc       = defaultLuaConfig.createFencedFunc()
+
+	// Variants with debug assertions, see WithDebugAssertions.
+	DebugRemoveFunc = debugLuaConfig.removeFunc()
+	DebugHoldFunc   = debugLuaConfig.holdFunc()
+	DebugUnholdFunc = debugLuaConfig.unholdFunc()
 )
 
-var ReleaseScript = redis.NewScript(0,
-	GetParentPathFunc+
-		RemoveFunc+
-		CollectExpiredNodesFunc+
-		UnholdFunc+
-		ReleaseFunc+
-		`
-		local name0 = ARGV[2]
-		if name0 == "" then
-			name0 = nil
-		end
-		local name1 = ARGV[3]
-		if name1 == "" then
-			name1 = nil
-		end
-		return release(ARGV[1], name0, name1)
-		`,
+var defaultScripts = defaultLuaConfig.scripts()
+
+// Scripts compiled with the default configuration.
+var (
+	CreateScript             = defaultScripts.create
+	CreateIdempotentScript   = defaultScripts.createIdempotent
+	RefreshScript            = defaultScripts.refresh
+	RefreshManyScript        = defaultScripts.refreshMany
+	UpdateOwnerScript        = defaultScripts.updateOwner
+	StealScript              = defaultScripts.steal
+	UnlockScript             = defaultScripts.unlock
+	UnlockByPathScript       = defaultScripts.unlockByPath
+	ConfirmScript            = defaultScripts.confirm
+	ReleaseScript            = defaultScripts.release
+	GetLockScript            = defaultScripts.getLock
+	LookupScript             = defaultScripts.lookup
+	ListLocksScript          = defaultScripts.listLocks
+	CheckScript              = defaultScripts.check
+	DanglingNodesScript      = defaultScripts.danglingNodes
+	StatsScript              = defaultScripts.stats
+	ExpiringWithinScript     = defaultScripts.expiringWithin
+	DeepestLockScript        = defaultScripts.deepestLock
+	ConfirmRootsScript       = defaultScripts.confirmRoots
+	ConfirmWithTimeoutScript = defaultScripts.confirmWithTimeout
+	ReleaseHoldsScript       = defaultScripts.releaseHolds
+	SweepHoldsScript         = defaultScripts.sweepHolds
+	CreateWithMetaScript     = defaultScripts.createWithMeta
+	MoveLockScript           = defaultScripts.moveLock
+	ReadLocksScript          = defaultScripts.readLocks
+	CreateWithTokenScript    = defaultScripts.createWithToken
+	IsLockedScript           = defaultScripts.isLocked
+	CompactExpirySetScript   = defaultScripts.compactExpirySet
+	ConflictingLocksScript   = defaultScripts.conflictingLocks
+	CountLocksUnderScript    = defaultScripts.countLocksUnder
+	PeekExpiryScript         = defaultScripts.peekExpiry
+	SetExpiryScript          = defaultScripts.setExpiry
+	ConfirmPartialScript     = defaultScripts.confirmPartial
+	SnapshotScript           = defaultScripts.snapshot
+	ValidateTokenScript      = defaultScripts.validateToken
+	RequiredTokensScript     = defaultScripts.requiredTokens
+	CreateFencedScript       = defaultScripts.createFenced
 )
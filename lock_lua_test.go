@@ -1,6 +1,8 @@
 package webdavredisls_test
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"time"
 
@@ -20,8 +22,14 @@ var _ = Describe("LockLua", func() {
 			`return get_parent_path(ARGV[1])`,
 	)
 
+	isCleanPathScript := redis.NewScript(0,
+		GetParentPathFunc+
+			`return tostring(is_clean_path(ARGV[1]))`,
+	)
+
 	createTokenScript := redis.NewScript(0,
 		GetParentPathFunc+
+			ExpiryFunc+
 			CreateTokenFunc+
 			`return create_token(ARGV[1], tonumber(ARGV[2]), ARGV[3], tonumber(ARGV[4]), ARGV[5] == "1", ARGV[6])`,
 	)
@@ -41,13 +49,14 @@ var _ = Describe("LockLua", func() {
 	collectExpiredNodesScript := redis.NewScript(0,
 		GetParentPathFunc+
 			RemoveFunc+
+			ReconcileFunc+
 			CollectExpiredNodesFunc+
 			`return collect_expired_nodes(ARGV[1], tonumber(ARGV[2]))`,
 	)
 
 	holdScript := redis.NewScript(0,
 		HoldFunc+
-			`return hold(ARGV[1], ARGV[2], tonumber(ARGV[3]))`,
+			`return hold(ARGV[1], ARGV[2], tonumber(ARGV[3]), tonumber(ARGV[4]))`,
 	)
 
 	unholdScript := redis.NewScript(0,
@@ -68,6 +77,30 @@ var _ = Describe("LockLua", func() {
 			`,
 	)
 
+	// okReply returns the value of an {"ok", value} script reply.
+	okReply := func(res interface{}, err error) (interface{}, error) {
+		values, err := redis.Values(res, err)
+		if err != nil {
+			return nil, err
+		}
+		if status, _ := redis.String(values[0], nil); status != "ok" {
+			return nil, fmt.Errorf("unexpected script reply: %q", values)
+		}
+		return values[1], nil
+	}
+
+	// errReply returns the error code of an {"err", code} script reply.
+	errReply := func(res interface{}, err error) (interface{}, error) {
+		values, err := redis.Values(res, err)
+		if err != nil {
+			return nil, err
+		}
+		if status, _ := redis.String(values[0], nil); status != "err" {
+			return nil, fmt.Errorf("unexpected script reply: %q", values)
+		}
+		return values[1], nil
+	}
+
 	BeforeEach(func() {
 		server := os.Getenv("REDIS_SERVER")
 		if server == "" {
@@ -95,13 +128,7 @@ var _ = Describe("LockLua", func() {
 
 		conn = pool.Get()
 
-		keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
-		Expect(err).NotTo(HaveOccurred())
-
-		for _, key := range keys {
-			_, err = conn.Do("DEL", key)
-			Expect(err).NotTo(HaveOccurred())
-		}
+		Expect(DeleteByPrefix(context.Background(), conn, prefix)).To(Succeed())
 	})
 
 	AfterEach(func() {
@@ -122,6 +149,25 @@ var _ = Describe("LockLua", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(parentPath).To(Equal("/path"))
 		})
+
+		It("should check that a path is clean", func() {
+			for path, clean := range map[string]string{
+				"/":          "true",
+				"/a":         "true",
+				"/a/b c/..d": "true",
+				"":           "false",
+				"a/b":        "false",
+				"/a/":        "false",
+				"/a//b":      "false",
+				"/a/./b":     "false",
+				"/a/..":      "false",
+				"/..":        "false",
+			} {
+				res, err := redis.String(isCleanPathScript.Do(conn, path))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res).To(Equal(clean), path)
+			}
+		})
 	})
 
 	Describe("CreateTokenFunc", func() {
@@ -941,6 +987,7 @@ var _ = Describe("LockLua", func() {
 				prefix,
 				root,
 				durationSec,
+				nowSec,
 			)
 			Expect(err).NotTo(HaveOccurred())
 
@@ -948,6 +995,7 @@ var _ = Describe("LockLua", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(keys).To(ConsistOf(
 				prefix+"nt",
+				prefix+"hc",
 				prefix+"n:/p1/p2",
 				prefix+"n:/p1",
 				prefix+"n:/",
@@ -960,6 +1008,7 @@ var _ = Describe("LockLua", func() {
 				"n": "/p1/p2",     // name
 				"r": "/p1/p2",     // root
 				"h": "t",          // held
+				"s": "1556895905", // heldSince
 				"t": "1",          // token
 				"d": "300",        // duration
 				"o": "<owner />",  // ownerXML
@@ -1018,6 +1067,7 @@ var _ = Describe("LockLua", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(keys).To(ConsistOf(
 				prefix+"nt",
+				prefix+"hc",
 				prefix+"n:/p1/p2",
 				prefix+"n:/p1",
 				prefix+"n:/",
@@ -1093,6 +1143,25 @@ var _ = Describe("LockLua", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("inconsistent held state"))
 		})
+
+		It("should fail to hold a node that no longer exists", func() {
+			nowSec := 1556895905
+			root := "/p1/p2"
+			durationSec := 300
+
+			_, err := holdScript.Do(
+				conn,
+				prefix,
+				root,
+				durationSec,
+				nowSec,
+			)
+			Expect(err).To(MatchError(ContainSubstring("holding a missing lock: /p1/p2")))
+
+			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+		})
 	})
 
 	Describe("UnholdFunc", func() {
@@ -1120,6 +1189,7 @@ var _ = Describe("LockLua", func() {
 				prefix,
 				root,
 				durationSec,
+				nowSec,
 			)
 			Expect(err).NotTo(HaveOccurred())
 
@@ -1300,7 +1370,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			token, err := redis.String(CreateScript.Do(
+			token, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1308,7 +1378,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			res, err := redis.Strings(lookupScript.Do(
@@ -1343,7 +1413,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			token, err := redis.String(CreateScript.Do(
+			token, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1351,7 +1421,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			_, err = holdScript.Do(
@@ -1380,7 +1450,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := false
 			ownerXML := "<owner />"
 
-			token, err := redis.String(CreateScript.Do(
+			token, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1388,7 +1458,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			res, err := redis.Strings(lookupScript.Do(
@@ -1409,7 +1479,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := false
 			ownerXML := "<owner />"
 
-			token, err := redis.String(CreateScript.Do(
+			token, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1417,7 +1487,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			res, err := redis.Strings(lookupScript.Do(
@@ -1438,7 +1508,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			token, err := redis.String(CreateScript.Do(
+			token, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1446,7 +1516,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			res, err := lookupScript.Do(
@@ -1461,6 +1531,98 @@ var _ = Describe("LockLua", func() {
 		})
 	})
 
+	Describe("ReadOnlyLookupFunc", func() {
+		It("should find a node", func() {
+			nowSec := 1556895905
+			root := "/p1/p2"
+			durationSec := 300
+			isZeroDepth := false
+			ownerXML := "<owner />"
+
+			token, err := redis.String(okReply(CreateScript.Do(
+				conn,
+				prefix,
+				nowSec,
+				root,
+				durationSec,
+				isZeroDepth,
+				ownerXML,
+			)))
+			Expect(err).NotTo(HaveOccurred())
+
+			m, err := redis.StringMap(okReply(LookupScript.Do(
+				conn,
+				prefix,
+				nowSec+1,
+				"/p1/p2/p3",
+				2,
+				"9999",
+				token,
+			)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(m).To(Equal(map[string]string{
+				"t": token,        // token
+				"r": "/p1/p2",     // root
+				"d": "300",        // duration
+				"o": "<owner />",  // ownerXML
+				"z": "f",          // isZeroDepth
+				"e": "1556896205", // expiry
+				"h": "f",          // held
+				"c": "1",          // refCount
+			}))
+		})
+
+		It("should not find an expired node without removing it", func() {
+			nowSec := 1556895905
+			root := "/p1/p2"
+			durationSec := 300
+			isZeroDepth := true
+			ownerXML := "<owner />"
+
+			token, err := redis.String(okReply(CreateScript.Do(
+				conn,
+				prefix,
+				nowSec,
+				root,
+				durationSec,
+				isZeroDepth,
+				ownerXML,
+			)))
+			Expect(err).NotTo(HaveOccurred())
+
+			res, err := redis.String(errReply(LookupScript.Do(
+				conn,
+				prefix,
+				nowSec+durationSec,
+				root,
+				1,
+				token,
+			)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal("ERR_CONFIRMATION_FAILED"))
+
+			res, err = redis.String(errReply(GetLockScript.Do(
+				conn,
+				prefix,
+				nowSec+durationSec,
+				token,
+			)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal("ERR_NO_SUCH_LOCK"))
+
+			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(ConsistOf(
+				prefix+"nt",
+				prefix+"n:/p1/p2",
+				prefix+"n:/p1",
+				prefix+"n:/",
+				prefix+"t:"+token,
+				prefix+"e",
+			))
+		})
+	})
+
 	Describe("Create", func() {
 		It("should create a token", func() {
 			nowSec := 1556895905
@@ -1469,7 +1631,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1477,11 +1639,29 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 		})
 
+		It("should not create a token for an unclean root", func() {
+			res, err := redis.String(errReply(CreateScript.Do(
+				conn,
+				prefix,
+				1556895905,
+				"/p1//p2",
+				300,
+				true,
+				"<owner />",
+			)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal("ERR_INVALID_PATH"))
+
+			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(BeEmpty())
+		})
+
 		It("should not create a token if it already exists", func() {
 			nowSec := 1556895905
 			root := "/p1/p2"
@@ -1489,7 +1669,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1497,11 +1677,11 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 
-			tokenOrErr, err = redis.String(CreateScript.Do(
+			lockedErr, err := redis.Strings(errReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1509,9 +1689,9 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(tokenOrErr).To(Equal("ERR_LOCKED"))
+			Expect(lockedErr).To(Equal([]string{"ERR_LOCKED", root, "1"}))
 		})
 
 		It("should collect expired nodes", func() {
@@ -1521,7 +1701,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth1 := true
 			ownerXML1 := "<owner />"
 
-			tokenOrErr1, err := redis.String(CreateScript.Do(
+			tokenOrErr1, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec1,
@@ -1529,7 +1709,7 @@ var _ = Describe("LockLua", func() {
 				durationSec1,
 				isZeroDepth1,
 				ownerXML1,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr1).To(Equal("1"))
 
@@ -1539,7 +1719,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth2 := true
 			ownerXML2 := "<owner />"
 
-			tokenOrErr2, err := redis.String(CreateScript.Do(
+			tokenOrErr2, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec2,
@@ -1547,7 +1727,7 @@ var _ = Describe("LockLua", func() {
 				durationSec2,
 				isZeroDepth2,
 				ownerXML2,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr2).To(Equal("2"))
 
@@ -1565,7 +1745,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1573,7 +1753,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
@@ -1581,19 +1761,20 @@ var _ = Describe("LockLua", func() {
 			nowSec = 1556895907
 			newDurationSec := 600
 
-			details, err := redis.StringMap(RefreshScript.Do(
+			details, err := redis.StringMap(okReply(RefreshScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
 				newDurationSec,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(details).To(Equal(map[string]string{
-				"r": "/p1/p2",    // root
-				"d": "600",       // duration
-				"o": "<owner />", // owner
-				"z": "t",         // isZeroDepth
+				"r": "/p1/p2",     // root
+				"d": "600",        // duration
+				"e": "1556896507", // expiry
+				"o": "<owner />",  // owner
+				"z": "t",          // isZeroDepth
 			}))
 
 			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
@@ -1657,7 +1838,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1665,7 +1846,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
@@ -1673,19 +1854,20 @@ var _ = Describe("LockLua", func() {
 			nowSec = 1556895907
 			newDurationSec := 300
 
-			details, err := redis.StringMap(RefreshScript.Do(
+			details, err := redis.StringMap(okReply(RefreshScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
 				newDurationSec,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(details).To(Equal(map[string]string{
-				"r": "/p1/p2",    // root
-				"d": "300",       // duration
-				"o": "<owner />", // owner
-				"z": "t",         // isZeroDepth
+				"r": "/p1/p2",     // root
+				"d": "300",        // duration
+				"e": "1556896207", // expiry
+				"o": "<owner />",  // owner
+				"z": "t",          // isZeroDepth
 			}))
 
 			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
@@ -1745,7 +1927,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1753,7 +1935,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
@@ -1761,19 +1943,20 @@ var _ = Describe("LockLua", func() {
 			nowSec = 1556895907
 			newDurationSec := 300
 
-			details, err := redis.StringMap(RefreshScript.Do(
+			details, err := redis.StringMap(okReply(RefreshScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
 				newDurationSec,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(details).To(Equal(map[string]string{
-				"r": "/p1/p2",    // root
-				"d": "300",       // duration
-				"o": "<owner />", // owner
-				"z": "t",         // isZeroDepth
+				"r": "/p1/p2",     // root
+				"d": "300",        // duration
+				"e": "1556896207", // expiry
+				"o": "<owner />",  // owner
+				"z": "t",          // isZeroDepth
 			}))
 
 			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
@@ -1833,7 +2016,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1841,7 +2024,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
@@ -1849,17 +2032,18 @@ var _ = Describe("LockLua", func() {
 			nowSec = 1556895907
 			newDurationSec := -1
 
-			details, err := redis.StringMap(RefreshScript.Do(
+			details, err := redis.StringMap(okReply(RefreshScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
 				newDurationSec,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(details).To(Equal(map[string]string{
 				"r": "/p1/p2",    // root
 				"d": "-1",        // duration
+				"e": "0",         // expiry
 				"o": "<owner />", // owner
 				"z": "t",         // isZeroDepth
 			}))
@@ -1912,13 +2096,13 @@ var _ = Describe("LockLua", func() {
 			token := 1
 			newDurationSec := -1
 
-			webdavErr, err := redis.String(RefreshScript.Do(
+			webdavErr, err := redis.String(errReply(RefreshScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
 				newDurationSec,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(webdavErr).To(Equal("ERR_NO_SUCH_LOCK"))
 		})
@@ -1930,7 +2114,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1938,7 +2122,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
@@ -1954,13 +2138,13 @@ var _ = Describe("LockLua", func() {
 			nowSec = 1556895907
 			newDurationSec := 600
 
-			webdavErr, err := redis.String(RefreshScript.Do(
+			webdavErr, err := redis.String(errReply(RefreshScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
 				newDurationSec,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(webdavErr).To(Equal("ERR_LOCKED"))
 		})
@@ -1974,7 +2158,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -1982,19 +2166,19 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
 
 			nowSec = 1556895907
 
-			_, err = UnlockScript.Do(
+			_, err = okReply(UnlockScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
-			)
+			))
 			Expect(err).NotTo(HaveOccurred())
 
 			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
@@ -2008,12 +2192,12 @@ var _ = Describe("LockLua", func() {
 			nowSec := 1556895907
 			token := 1
 
-			webdavErr, err := redis.String(UnlockScript.Do(
+			webdavErr, err := redis.String(errReply(UnlockScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(webdavErr).To(Equal("ERR_NO_SUCH_LOCK"))
 		})
@@ -2025,7 +2209,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			tokenOrErr, err := redis.String(CreateScript.Do(
+			tokenOrErr, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -2033,7 +2217,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(tokenOrErr).To(Equal("1"))
 			token := tokenOrErr
@@ -2046,12 +2230,12 @@ var _ = Describe("LockLua", func() {
 			)
 			Expect(err).NotTo(HaveOccurred())
 
-			webdavErr, err := redis.String(UnlockScript.Do(
+			webdavErr, err := redis.String(errReply(UnlockScript.Do(
 				conn,
 				prefix,
 				nowSec,
 				token,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(webdavErr).To(Equal("ERR_LOCKED"))
 		})
@@ -2065,7 +2249,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth1 := true
 			ownerXML1 := "<owner />"
 
-			token1, err := redis.String(CreateScript.Do(
+			token1, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec1,
@@ -2073,7 +2257,7 @@ var _ = Describe("LockLua", func() {
 				durationSec1,
 				isZeroDepth1,
 				ownerXML1,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			nowSec2 := 1556895905
@@ -2082,7 +2266,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth2 := true
 			ownerXML2 := "<owner />"
 
-			token2, err := redis.String(CreateScript.Do(
+			token2, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec2,
@@ -2090,10 +2274,10 @@ var _ = Describe("LockLua", func() {
 				durationSec2,
 				isZeroDepth2,
 				ownerXML2,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
-			res, err := redis.Strings(ConfirmScript.Do(
+			res, err := redis.Strings(okReply(ConfirmScript.Do(
 				conn,
 				prefix,
 				nowSec2,
@@ -2102,7 +2286,7 @@ var _ = Describe("LockLua", func() {
 				2,
 				token2,
 				token1,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(res).To(Equal([]string{"/p1/p2", "/p4"}))
 		})
@@ -2114,7 +2298,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			token, err := redis.String(CreateScript.Do(
+			token, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -2122,10 +2306,10 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
-			res, err := redis.Strings(ConfirmScript.Do(
+			res, err := redis.Strings(okReply(ConfirmScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -2133,9 +2317,40 @@ var _ = Describe("LockLua", func() {
 				"",
 				1,
 				token,
-			))
+			)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal([]string{"/p1/p2"}))
+		})
+
+		It("should hold a node shared by both names once", func() {
+			nowSec := 1556895905
+			root := "/p1"
+			durationSec := 300
+			isZeroDepth := false
+			ownerXML := "<owner />"
+
+			token, err := redis.String(okReply(CreateScript.Do(
+				conn,
+				prefix,
+				nowSec,
+				root,
+				durationSec,
+				isZeroDepth,
+				ownerXML,
+			)))
 			Expect(err).NotTo(HaveOccurred())
-			Expect(res).To(Equal([]string{"/p1/p2", ""}))
+
+			res, err := redis.Strings(okReply(ConfirmScript.Do(
+				conn,
+				prefix,
+				nowSec,
+				"/p1/p2",
+				"/p1/p3",
+				1,
+				token,
+			)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal([]string{"/p1"}))
 		})
 
 		It("should fail for non-existent token", func() {
@@ -2145,7 +2360,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			_, err := redis.String(CreateScript.Do(
+			_, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -2153,10 +2368,10 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
-			res, err := redis.String(ConfirmScript.Do(
+			res, err := redis.String(errReply(ConfirmScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -2164,7 +2379,7 @@ var _ = Describe("LockLua", func() {
 				"",
 				1,
 				"9999",
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(res).To(Equal("ERR_CONFIRMATION_FAILED"))
 		})
@@ -2178,7 +2393,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth1 := true
 			ownerXML1 := "<owner />"
 
-			_, err := redis.String(CreateScript.Do(
+			_, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec1,
@@ -2186,7 +2401,7 @@ var _ = Describe("LockLua", func() {
 				durationSec1,
 				isZeroDepth1,
 				ownerXML1,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			nowSec2 := 1556895905
@@ -2195,7 +2410,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth2 := true
 			ownerXML2 := "<owner />"
 
-			_, err = redis.String(CreateScript.Do(
+			_, err = redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec2,
@@ -2203,7 +2418,7 @@ var _ = Describe("LockLua", func() {
 				durationSec2,
 				isZeroDepth2,
 				ownerXML2,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			_, err = holdScript.Do(
@@ -2222,15 +2437,71 @@ var _ = Describe("LockLua", func() {
 			)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, err = ReleaseScript.Do(
+			_, err = okReply(ReleaseScript.Do(
 				conn,
 				prefix,
 				root1,
 				root2,
-			)
+			))
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("should release any number of nodes", func() {
+			nowSec := 1556895905
+			durationSec := 300
+			roots := []string{"/p1", "/p2", "/p3"}
+
+			for i, root := range roots {
+				_, err := redis.String(okReply(CreateScript.Do(
+					conn,
+					prefix,
+					nowSec+i,
+					root,
+					durationSec,
+					true,
+					"<owner />",
+				)))
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = holdScript.Do(
+					conn,
+					prefix,
+					root,
+					durationSec,
+				)
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			n, err := redis.Int(conn.Do("ZCARD", prefix+"e"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(0))
+
+			_, err = okReply(ReleaseScript.Do(
+				conn,
+				prefix,
+				"/p1",
+				"",
+				"/p2",
+				"/p3",
+				"/p1",
+			))
+			Expect(err).NotTo(HaveOccurred())
+
+			for i, root := range roots {
+				score, err := redis.Int(conn.Do("ZSCORE", prefix+"e", root))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(score).To(Equal(nowSec + i + durationSec))
+
+				held, err := redis.String(conn.Do("HGET", prefix+"n:"+root, "h"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(held).To(Equal("f"))
+			}
+
+			exists, err := redis.Int(conn.Do("EXISTS", prefix+"hc"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(Equal(0))
+		})
+
 		It("should release a single node", func() {
 			nowSec := 1556895905
 			root := "/p1/p2"
@@ -2238,7 +2509,7 @@ var _ = Describe("LockLua", func() {
 			isZeroDepth := true
 			ownerXML := "<owner />"
 
-			_, err := redis.String(CreateScript.Do(
+			_, err := redis.String(okReply(CreateScript.Do(
 				conn,
 				prefix,
 				nowSec,
@@ -2246,7 +2517,7 @@ var _ = Describe("LockLua", func() {
 				durationSec,
 				isZeroDepth,
 				ownerXML,
-			))
+			)))
 			Expect(err).NotTo(HaveOccurred())
 
 			_, err = holdScript.Do(
@@ -2257,13 +2528,92 @@ var _ = Describe("LockLua", func() {
 			)
 			Expect(err).NotTo(HaveOccurred())
 
-			_, err = ReleaseScript.Do(
+			_, err = okReply(ReleaseScript.Do(
 				conn,
 				prefix,
 				root,
 				nil,
-			)
+			))
 			Expect(err).NotTo(HaveOccurred())
 		})
 	})
+
+	Describe("Debug assertions", func() {
+		debugRemoveScript := redis.NewScript(0,
+			GetParentPathFunc+
+				DebugRemoveFunc+
+				`return remove(ARGV[1], ARGV[2], ARGV[3], ARGV[4], tonumber(ARGV[5]))`,
+		)
+
+		debugHoldScript := redis.NewScript(0,
+			DebugHoldFunc+
+				`return hold(ARGV[1], ARGV[2], tonumber(ARGV[3]), tonumber(ARGV[4]))`,
+		)
+
+		debugUnholdScript := redis.NewScript(0,
+			DebugUnholdFunc+
+				`return unhold(ARGV[1], ARGV[2], tonumber(ARGV[3]), tonumber(ARGV[4]))`,
+		)
+
+		nowSec := 1556895905
+		root := "/p1/p2"
+		durationSec := 300
+
+		createToken := func() string {
+			token, err := redis.String(createTokenScript.Do(conn, prefix, nowSec, root, durationSec, true, ""))
+			Expect(err).NotTo(HaveOccurred())
+			return token
+		}
+
+		It("should hold, unhold and remove a consistent node", func() {
+			token := createToken()
+
+			_, err := debugHoldScript.Do(conn, prefix, root, durationSec, nowSec)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = debugUnholdScript.Do(conn, prefix, root, durationSec, nowSec+durationSec)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = debugRemoveScript.Do(conn, prefix, root, root, token, durationSec)
+			Expect(err).NotTo(HaveOccurred())
+
+			keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(keys).To(ConsistOf(prefix + "nt"))
+		})
+
+		It("should fail to remove a node its token key does not point to", func() {
+			createToken()
+
+			_, err := debugRemoveScript.Do(conn, prefix, root, root, "2", durationSec)
+			Expect(err).To(MatchError(ContainSubstring("assertion failed: token key does not point to the removed node: 2")))
+		})
+
+		It("should fail when a refcount goes negative", func() {
+			token := createToken()
+
+			_, err := conn.Do("HSET", prefix+"n:/p1", "c", 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = debugRemoveScript.Do(conn, prefix, root, root, token, durationSec)
+			Expect(err).To(MatchError(ContainSubstring("assertion failed: negative refcount: /p1")))
+		})
+
+		It("should fail to hold a node that is not locked", func() {
+			_, err := debugHoldScript.Do(conn, prefix, root, durationSec, nowSec)
+			Expect(err).To(MatchError(ContainSubstring("holding a missing lock: /p1/p2")))
+		})
+
+		It("should fail to unhold a node that is in the expiry zset", func() {
+			createToken()
+
+			_, err := conn.Do("HSET", prefix+"n:"+root, "h", "t")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = conn.Do("SET", prefix+"hc", 1)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = debugUnholdScript.Do(conn, prefix, root, durationSec, nowSec+durationSec)
+			Expect(err).To(MatchError(ContainSubstring("assertion failed: held node in the expiry zset: /p1/p2")))
+		})
+	})
 })
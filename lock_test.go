@@ -5,14 +5,24 @@
 package webdavredisls
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -38,17 +48,17 @@ type RedisLSNode struct {
 
 func (r *RedisLS) redisLog(msg string) {
 	// for debugging in redis-cli with MONITOR
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	conn.Do("PING", "******** RedisLS log: "+msg)
 	conn.Close()
 }
 
 func (r *RedisLS) byNameKey(name string) string {
-	return r.prefix + namePrefix + name
+	return r.prefix + r.lua.namePrefix + name
 }
 
 func (r *RedisLS) byTokenKey(name string) string {
-	return r.prefix + tokenPrefix + name
+	return r.prefix + r.lua.tokenPrefix + name
 }
 
 func (r *RedisLS) getByName(conn redis.Conn, name string) (*RedisLSNode, error) {
@@ -105,7 +115,7 @@ func (r *RedisLS) getByToken(conn redis.Conn, token string) (*RedisLSNode, error
 }
 
 func getByName(r *RedisLS, name string) *RedisLSNode {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	n, err := r.getByName(conn, name)
@@ -117,7 +127,7 @@ func getByName(r *RedisLS, name string) *RedisLSNode {
 }
 
 func byNameAll(r *RedisLS) map[string]*RedisLSNode {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	keys, err := redis.Strings(conn.Do("KEYS", r.byNameKey("*")))
@@ -141,7 +151,7 @@ func byNameAll(r *RedisLS) map[string]*RedisLSNode {
 }
 
 func byNameLen(r *RedisLS) int {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	keys, err := redis.Strings(conn.Do("KEYS", r.byNameKey("*")))
@@ -153,7 +163,7 @@ func byNameLen(r *RedisLS) int {
 }
 
 func getByToken(r *RedisLS, token string) *RedisLSNode {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	n, err := r.getByToken(conn, token)
@@ -165,7 +175,7 @@ func getByToken(r *RedisLS, token string) *RedisLSNode {
 }
 
 func byTokenAll(r *RedisLS) map[string]*RedisLSNode {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	keys, err := redis.Strings(conn.Do("KEYS", r.byTokenKey("*")))
@@ -190,7 +200,7 @@ func byTokenAll(r *RedisLS) map[string]*RedisLSNode {
 }
 
 func byTokenLen(r *RedisLS) int {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	keys, err := redis.Strings(conn.Do("KEYS", r.byTokenKey("*")))
@@ -201,8 +211,10 @@ func byTokenLen(r *RedisLS) int {
 	return len(keys)
 }
 
+// byExpiryAll returns the nodes in the expiry zset. Unlike the scripts it
+// treats an entry without a node as a bug and panics.
 func byExpiryAll(r *RedisLS) []*RedisLSNode {
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	names, err := redis.Strings(conn.Do("ZRANGEBYSCORE", r.prefix+expiryZSetKey, "-inf", "+inf"))
@@ -261,7 +273,7 @@ func lockTestZeroDepth(name string) bool {
 	panic(fmt.Sprintf("lock name %q did not end with 'i' or 'z'", name))
 }
 
-func NewTestRedisLS() *RedisLS {
+func NewTestRedisLS(opts ...Option) *RedisLS {
 	server := os.Getenv("REDIS_SERVER")
 	if server == "" {
 		server = "localhost:6379"
@@ -286,143 +298,4756 @@ func NewTestRedisLS() *RedisLS {
 		},
 	}
 
-	prefix := "webdavredislstest:"
+	r := NewRedisLS(pool, "webdavredislstest:", opts...)
+
+	if err := r.Flush(context.Background()); err != nil {
+		panic(err)
+	}
+
+	return r
+}
+
+// testPool returns the pool of a RedisLS created by NewTestRedisLS.
+func testPool(r *RedisLS) *redis.Pool {
+	return r.conns.(poolConns).pool
+}
+
+func TestRedisLSConfirm(t *testing.T) {
+	testRedisLSConfirm(t)
+}
+
+func TestRedisLSConfirmTransactionalRelease(t *testing.T) {
+	testRedisLSConfirm(t, WithTransactionalRelease())
+}
+
+func testRedisLSConfirm(t *testing.T, opts ...Option) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(opts...)
+	alice, err := r.Create(now, webdav.LockDetails{
+		Root:      "/alice",
+		Duration:  infiniteTimeout,
+		ZeroDepth: false,
+	})
+	tweedle, err := r.Create(now, webdav.LockDetails{
+		Root:      "/tweedle",
+		Duration:  infiniteTimeout,
+		ZeroDepth: false,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Create: inconsistent state: %v", err)
+	}
+
+	// Test a mismatch between name and condition.
+	_, err = r.Confirm(now, "/tweedle/dee", "", webdav.Condition{Token: alice})
+	if err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm (mismatch): got %v, want webdav.ErrConfirmationFailed", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Confirm (mismatch): inconsistent state: %v", err)
+	}
+
+	// Test two names (that fall under the same lock) in the one Confirm call.
+	release, err := r.Confirm(now, "/tweedle/dee", "/tweedle/dum", webdav.Condition{Token: tweedle})
+	if err != nil {
+		t.Fatalf("Confirm (twins): %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Confirm (twins): inconsistent state: %v", err)
+	}
+	release()
+	if err := r.consistent(); err != nil {
+		t.Fatalf("release (twins): inconsistent state: %v", err)
+	}
+
+	// Test the same two names in overlapping Confirm / release calls.
+	releaseDee, err := r.Confirm(now, "/tweedle/dee", "", webdav.Condition{Token: tweedle})
+	if err != nil {
+		t.Fatalf("Confirm (sequence #0): %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Confirm (sequence #0): inconsistent state: %v", err)
+	}
+
+	_, err = r.Confirm(now, "/tweedle/dum", "", webdav.Condition{Token: tweedle})
+	if err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm (sequence #1): got %v, want webdav.ErrConfirmationFailed", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Confirm (sequence #1): inconsistent state: %v", err)
+	}
+
+	releaseDee()
+	if err := r.consistent(); err != nil {
+		t.Fatalf("release (sequence #2): inconsistent state: %v", err)
+	}
+
+	releaseDum, err := r.Confirm(now, "/tweedle/dum", "", webdav.Condition{Token: tweedle})
+	if err != nil {
+		t.Fatalf("Confirm (sequence #3): %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Confirm (sequence #3): inconsistent state: %v", err)
+	}
+
+	// Test that you can't unlock a held lock.
+	err = r.Unlock(now, tweedle)
+	if err != webdav.ErrLocked {
+		t.Fatalf("Unlock (sequence #4): got %v, want ErrLocked", err)
+	}
+
+	releaseDum()
+	if err := r.consistent(); err != nil {
+		t.Fatalf("release (sequence #5): inconsistent state: %v", err)
+	}
+
+	err = r.Unlock(now, tweedle)
+	if err != nil {
+		t.Fatalf("Unlock (sequence #6): %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Unlock (sequence #6): inconsistent state: %v", err)
+	}
+}
+
+// memLSAdapter provides the internal memLS methods used by the upstream memLS
+// tests on top of the public RedisLS API, so that they can be ported with few
+// changes.
+type memLSAdapter struct {
+	t   *testing.T
+	r   *RedisLS
+	now time.Time
+}
+
+// canCreate reports whether a lock can be created at name by creating it and
+// unlocking it again.
+func (m memLSAdapter) canCreate(name string, zeroDepth bool) bool {
+	token, granted, err := m.r.TryCreate(m.now, webdav.LockDetails{
+		Root:      name,
+		Duration:  infiniteTimeout,
+		ZeroDepth: zeroDepth,
+	})
+	if err != nil {
+		m.t.Fatalf("TryCreate %q: %v", name, err)
+	}
+	if granted {
+		if err := m.r.Unlock(m.now, token); err != nil {
+			m.t.Fatalf("Unlock %q: %v", name, err)
+		}
+	}
+	return granted
+}
+
+// lookup returns the token of the lock that the conditions match for name, or
+// "" if there is none.
+func (m memLSAdapter) lookup(name string, conditions ...webdav.Condition) string {
+	info, err := m.r.Lookup(m.now, name, conditions...)
+	if err == webdav.ErrConfirmationFailed {
+		return ""
+	}
+	if err != nil {
+		m.t.Fatalf("Lookup %q: %v", name, err)
+	}
+	return info.Token
+}
+
+func TestRedisLSCanCreate(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	m := memLSAdapter{t: t, r: r, now: now}
+
+	for _, name := range lockTestNames {
+		_, err := r.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  infiniteTimeout,
+			ZeroDepth: lockTestZeroDepth(name),
+		})
+		if err != nil {
+			t.Fatalf("creating lock for %q: %v", name, err)
+		}
+	}
+
+	wantCanCreate := func(name string, zeroDepth bool) bool {
+		for _, n := range lockTestNames {
+			switch {
+			case n == name:
+				// An existing lock has the same name as the proposed lock.
+				return false
+			case strings.HasPrefix(n, name):
+				// An existing lock would be a child of the proposed lock,
+				// which conflicts if the proposed lock has infinite depth.
+				if !zeroDepth {
+					return false
+				}
+			case strings.HasPrefix(name, n):
+				// An existing lock would be an ancestor of the proposed lock,
+				// which conflicts if the ancestor has infinite depth.
+				if n[len(n)-1] == 'i' {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	var check func(int, string)
+	check = func(recursion int, name string) {
+		for _, zeroDepth := range []bool{false, true} {
+			got := m.canCreate(name, zeroDepth)
+			want := wantCanCreate(name, zeroDepth)
+			if got != want {
+				t.Errorf("canCreate name=%q zeroDepth=%t: got %t, want %t", name, zeroDepth, got, want)
+			}
+		}
+		if recursion == 6 {
+			return
+		}
+		if name != "/" {
+			name += "/"
+		}
+		for _, c := range "_iz" {
+			check(recursion+1, name+string(c))
+		}
+	}
+	check(0, "/")
+
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSLookup(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	m := memLSAdapter{t: t, r: r, now: now}
+
+	first, err := r.ReserveTokens(1)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+	badToken := strconv.FormatInt(first, 10)
+	t.Logf("badToken=%q", badToken)
+
+	tokens := map[string]string{}
+	for _, name := range lockTestNames {
+		token, err := r.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  infiniteTimeout,
+			ZeroDepth: lockTestZeroDepth(name),
+		})
+		if err != nil {
+			t.Fatalf("creating lock for %q: %v", name, err)
+		}
+		t.Logf("%-15q -> token=%q", name, token)
+		tokens[name] = token
+	}
+
+	baseNames := append([]string{"/a", "/b/c"}, lockTestNames...)
+	for _, baseName := range baseNames {
+		for _, suffix := range []string{"", "/0", "/1/2/3"} {
+			name := baseName + suffix
+
+			goodToken := ""
+			base := tokens[baseName]
+			if base != "" && (suffix == "" || !lockTestZeroDepth(baseName)) {
+				goodToken = base
+			}
+
+			for _, token := range []string{badToken, goodToken} {
+				if token == "" {
+					continue
+				}
+
+				got := m.lookup(name, webdav.Condition{Token: token})
+				want := base
+				if token == badToken {
+					want = ""
+				}
+				if got != want {
+					t.Errorf("name=%-20qtoken=%q (bad=%t): got %q, want %q",
+						name, token, token == badToken, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRedisLSConflictingLock(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	m := memLSAdapter{t: t, r: r, now: now}
+
+	tokens := map[string]string{}
+	for _, name := range lockTestNames {
+		token, err := r.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  infiniteTimeout,
+			ZeroDepth: lockTestZeroDepth(name),
+		})
+		if err != nil {
+			t.Fatalf("creating lock for %q: %v", name, err)
+		}
+		tokens[name] = token
+	}
+
+	// ConflictingLock agrees with Create.
+	var check func(int, string)
+	check = func(recursion int, name string) {
+		for _, zeroDepth := range []bool{false, true} {
+			lock, err := r.ConflictingLock(now, name, zeroDepth)
+			if err != nil {
+				t.Fatalf("ConflictingLock name=%q zeroDepth=%t: %v", name, zeroDepth, err)
+			}
+			if want := m.canCreate(name, zeroDepth); (lock == nil) != want {
+				t.Errorf("ConflictingLock name=%q zeroDepth=%t: got %v, want nil %t", name, zeroDepth, lock, want)
+			}
+		}
+		if recursion == 4 {
+			return
+		}
+		if name != "/" {
+			name += "/"
+		}
+		for _, c := range "_iz" {
+			check(recursion+1, name+string(c))
+		}
+	}
+	check(0, "/")
+
+	testCases := []struct {
+		name      string
+		zeroDepth bool
+		want      string
+	}{
+		// The lock on the name itself.
+		{"/_/z", false, "/_/z"},
+		// The smallest root below the name.
+		{"/_", false, "/_/_/_/_/z"},
+		{"/_/z/_", false, "/_/z/_/i"},
+		// The nearest infinite-depth ancestor.
+		{"/i/x", true, "/i"},
+		{"/_/_/i/x/y", false, "/_/_/i"},
+		{"/z/x", true, ""},
+	}
+
+	for _, tc := range testCases {
+		lock, err := r.ConflictingLock(now, tc.name, tc.zeroDepth)
+		if err != nil {
+			t.Fatalf("ConflictingLock %q: %v", tc.name, err)
+		}
+		got := ""
+		if lock != nil {
+			got = lock.Details.Root
+			if lock.Token != tokens[got] {
+				t.Fatalf("ConflictingLock %q: got token %q, want %q", tc.name, lock.Token, tokens[got])
+			}
+		}
+		if got != tc.want {
+			t.Fatalf("ConflictingLock %q zeroDepth=%t: got %q, want %q", tc.name, tc.zeroDepth, got, tc.want)
+		}
+	}
+
+	// Expired locks don't conflict.
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/x", Duration: time.Second}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if lock, err := r.ConflictingLock(now, "/x", false); err != nil || lock == nil {
+		t.Fatalf("ConflictingLock: got %v, %v, want the lock on /x", lock, err)
+	}
+	if lock, err := r.ConflictingLock(now.Add(time.Second), "/x", false); err != nil || lock != nil {
+		t.Fatalf("ConflictingLock after expiry: got %v, %v, want nil", lock, err)
+	}
+}
+
+func TestRedisLSNonCanonicalRoot(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/foo/./bar//",
+		Duration: 1 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Create: inconsistent state: %v", err)
+	}
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Unlock: inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSNonCanonicalConfirm(t *testing.T) {
+	tests := []struct {
+		root      string
+		zeroDepth bool
+		name      string
+		match     bool
+	}{
+		{"/foo/./bar//", false, "/foo/bar", true},
+		{"/foo/./bar//", false, "foo//bar/", true},
+		{"/foo/./bar//", false, "/foo/baz/../bar/qux/.", true},
+		{"/foo/./bar//", false, "//foo/bar//qux//", true},
+		{"/foo/./bar//", false, "/foo/bar/../barx", false},
+		{"/foo/./bar//", false, "/foo/bar/..", false},
+		{"foo/bar/", true, "/foo/./bar/", true},
+		{"foo/bar/", true, "/foo/bar//qux", false},
+		{"//.", false, "/foo/../bar/", true},
+		{"/./", true, "//", true},
+		{"/./", true, "/foo/..//bar/..", true},
+		{"/./", true, "/foo", false},
+	}
+
+	for _, opts := range [][]Option{nil, {WithNoScripting()}, {WithTransactionalRelease()}} {
+		for _, test := range tests {
+			now := time.Unix(0, 0)
+			r := NewTestRedisLS(opts...)
+
+			token, err := r.Create(now, webdav.LockDetails{Root: test.root, Duration: time.Minute, ZeroDepth: test.zeroDepth})
+			if err != nil {
+				t.Fatalf("Create %q: %v", test.root, err)
+			}
+
+			if !r.noScripting {
+				_, err = r.Lookup(now, test.name, webdav.Condition{Token: token})
+				if test.match && err != nil || !test.match && err != webdav.ErrConfirmationFailed {
+					t.Errorf("%+v: Lookup: got %v, want match %v", test, err, test.match)
+				}
+			}
+
+			release, err := r.Confirm(now, test.name, "", webdav.Condition{Token: token})
+			if test.match && err != nil || !test.match && err != webdav.ErrConfirmationFailed {
+				t.Errorf("%+v: Confirm: got %v, want match %v", test, err, test.match)
+			}
+			if err == nil {
+				release()
+			}
+
+			if err := r.Unlock(now, token); err != nil {
+				t.Fatalf("Unlock: %v", err)
+			}
+		}
+	}
+}
+
+func TestRedisLSListLocksUnder(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for _, name := range []string{"/a", "/a/b/c", "/a/b/c/d", "/ab", "/x/y"} {
+		_, err := r.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  infiniteTimeout,
+			ZeroDepth: true,
+		})
+		if err != nil {
+			t.Fatalf("Create %q: %v", name, err)
+		}
+	}
+	_, err := r.Create(now, webdav.LockDetails{
+		Root:      "/a/expired",
+		Duration:  1 * time.Second,
+		ZeroDepth: true,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	testCases := []struct {
+		root     string
+		maxDepth int
+		want     []string
+	}{
+		{"/", -1, []string{"/a", "/a/b/c", "/a/b/c/d", "/ab", "/x/y"}},
+		{"/a", -1, []string{"/a", "/a/b/c", "/a/b/c/d"}},
+		{"/a", 0, []string{"/a"}},
+		{"/a", 1, []string{"/a"}},
+		{"/a", 2, []string{"/a", "/a/b/c"}},
+		{"/a/b", 1, []string{"/a/b/c"}},
+		{"/x", -1, []string{"/x/y"}},
+		{"/nope", -1, []string{}},
+	}
+
+	for _, tc := range testCases {
+		locks, err := r.ListLocksUnder(now.Add(time.Second), tc.root, tc.maxDepth)
+		if err != nil {
+			t.Fatalf("ListLocksUnder(%q, %d): %v", tc.root, tc.maxDepth, err)
+		}
+		got := []string{}
+		for _, lock := range locks {
+			got = append(got, lock.Details.Root)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("ListLocksUnder(%q, %d):\ngot  %q\nwant %q", tc.root, tc.maxDepth, got, tc.want)
+		}
+	}
+}
+
+func TestRedisLSExpiryHandler(t *testing.T) {
+	var expired []LockInfo
+	r := NewTestRedisLS(WithExpiryHandler(func(info LockInfo) {
+		expired = append(expired, info)
+	}))
+
+	now := time.Unix(0, 0)
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:      "/a",
+		Duration:  5 * time.Second,
+		OwnerXML:  "<owner />",
+		ZeroDepth: true,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if len(expired) != 0 {
+		t.Fatalf("Create: got %d expired locks, want 0", len(expired))
+	}
+
+	now = now.Add(5 * time.Second)
+	if _, err := r.Create(now, webdav.LockDetails{
+		Root:     "/b",
+		Duration: infiniteTimeout,
+	}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	want := []LockInfo{{
+		Token: token,
+		Details: webdav.LockDetails{
+			Root:      "/a",
+			Duration:  5 * time.Second,
+			OwnerXML:  "<owner />",
+			ZeroDepth: true,
+		},
+		Expiry: now,
+	}}
+	if !reflect.DeepEqual(expired, want) {
+		t.Fatalf("expired:\ngot  %v\nwant %v", expired, want)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSUpdateOwner(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithMaxOwnerXMLBytes(32))
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+		OwnerXML: "<owner>alice</owner>",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	got, err := r.UpdateOwner(now, token, "<owner>bob</owner>")
+	if err != nil {
+		t.Fatalf("UpdateOwner: %v", err)
+	}
+	want := webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+		OwnerXML: "<owner>bob</owner>",
+	}
+	if got != want {
+		t.Fatalf("UpdateOwner:\ngot  %v\nwant %v", got, want)
+	}
+	if n := getByToken(r, token); n.details.OwnerXML != want.OwnerXML {
+		t.Fatalf("UpdateOwner: stored owner %q, want %q", n.details.OwnerXML, want.OwnerXML)
+	}
+
+	if _, err := r.UpdateOwner(now, token, "<owner>"+strings.Repeat("x", 32)+"</owner>"); err != ErrOwnerXMLTooLarge {
+		t.Fatalf("UpdateOwner (too large): got %v, want ErrOwnerXMLTooLarge", err)
+	}
+	if _, err := r.UpdateOwner(now, "9999", "<owner />"); err != webdav.ErrNoSuchLock {
+		t.Fatalf("UpdateOwner (no such lock): got %v, want webdav.ErrNoSuchLock", err)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if _, err := r.UpdateOwner(now, token, "<owner />"); err != webdav.ErrLocked {
+		t.Fatalf("UpdateOwner (held): got %v, want webdav.ErrLocked", err)
+	}
+	release()
+
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSIsHeld(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if held, err := r.IsHeld(now, token); err != nil || held {
+		t.Fatalf("IsHeld: got %v, %v, want false, nil", held, err)
+	}
+
+	release, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if held, err := r.IsHeld(now, token); err != nil || !held {
+		t.Fatalf("IsHeld (confirmed): got %v, %v, want true, nil", held, err)
+	}
+	locks, err := r.ListLocks(now)
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if len(locks) != 1 || !locks[0].Held {
+		t.Fatalf("ListLocks (confirmed): got %v, want one held lock", locks)
+	}
+
+	release()
+	if held, err := r.IsHeld(now, token); err != nil || held {
+		t.Fatalf("IsHeld (released): got %v, %v, want false, nil", held, err)
+	}
+
+	if _, err := r.IsHeld(now, "9999"); err != webdav.ErrNoSuchLock {
+		t.Fatalf("IsHeld (no such lock): got %v, want webdav.ErrNoSuchLock", err)
+	}
+}
+
+func TestRedisLSRetry(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithRetry(3, time.Millisecond))
+
+	dial := testPool(r).Dial
+	failures := 0
+	r.conns = poolConns{pool: &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			if failures > 0 {
+				failures--
+				return nil, errors.New("dial failed")
+			}
+			return dial()
+		},
+	}}
+
+	failures = 2
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	failures = 3
+	if err := r.Unlock(now, token); err == nil || err.Error() != "dial failed" {
+		t.Fatalf("Unlock: got %v, want dial failed", err)
+	}
+
+	// Definitive results are not retried.
+	failures = 0
+	if _, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+	}); err != webdav.ErrLocked {
+		t.Fatalf("Create: got %v, want webdav.ErrLocked", err)
+	}
+
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSCreateIdempotent(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	details := webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+	}
+
+	token, err := r.CreateIdempotent(now, "req1", details)
+	if err != nil {
+		t.Fatalf("CreateIdempotent: %v", err)
+	}
+
+	retried, err := r.CreateIdempotent(now, "req1", details)
+	if err != nil {
+		t.Fatalf("CreateIdempotent (retry): %v", err)
+	}
+	if retried != token {
+		t.Fatalf("CreateIdempotent (retry): got token %q, want %q", retried, token)
+	}
+
+	if _, err := r.CreateIdempotent(now, "req2", details); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("CreateIdempotent (other key): got %v, want webdav.ErrLocked", err)
+	}
+
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	// The key no longer maps to an existing lock, so a new one is created.
+	recreated, err := r.CreateIdempotent(now, "req1", details)
+	if err != nil {
+		t.Fatalf("CreateIdempotent (after unlock): %v", err)
+	}
+	if recreated == token {
+		t.Fatalf("CreateIdempotent (after unlock): got the unlocked token %q", token)
+	}
+
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSKeySeparator(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithKeySeparator("/"))
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a/b",
+		Duration: 1 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Create: inconsistent state: %v", err)
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	for _, key := range []string{"n//a/b", "n//a", "n//", "t/" + token, "e", "nt"} {
+		exists, err := redis.Bool(conn.Do("EXISTS", r.prefix+key))
+		if err != nil {
+			t.Fatalf("EXISTS %q: %v", key, err)
+		}
+		if !exists {
+			t.Fatalf("key %q does not exist", key)
+		}
+	}
+
+	locks, err := r.ListLocks(now)
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Token != token {
+		t.Fatalf("ListLocks: got %v, want the lock with token %q", locks, token)
+	}
+
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Unlock: inconsistent state: %v", err)
+	}
+}
+
+func TestValidateKeySeparator(t *testing.T) {
+	testCases := []struct {
+		separator string
+		valid     bool
+	}{
+		{":", true},
+		{"/", true},
+		{"::", true},
+		{"", false},
+		// "n" + "t" is the token counter key.
+		{"t", false},
+	}
+
+	for _, tc := range testCases {
+		err := validateKeySeparator(tc.separator)
+		if (err == nil) != tc.valid {
+			t.Fatalf("validateKeySeparator(%q): got %v, want valid=%v", tc.separator, err, tc.valid)
+		}
+	}
+}
+
+func TestRedisLSSteal(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: 10 * time.Second,
+		OwnerXML: "<owner>worker1</owner>",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	stolen, err := r.Steal(now, token, "<owner>worker2</owner>", infiniteTimeout)
+	if err != nil {
+		t.Fatalf("Steal: %v", err)
+	}
+	if stolen != token {
+		t.Fatalf("Steal: got token %q, want %q", stolen, token)
+	}
+	n := getByToken(r, token)
+	if n.details.OwnerXML != "<owner>worker2</owner>" || n.details.Duration != time.Duration(-1) {
+		t.Fatalf("Steal: got details %v", n.details)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Steal: inconsistent state: %v", err)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if _, err := r.Steal(now, token, "<owner>worker3</owner>", 10*time.Second); err != webdav.ErrLocked {
+		t.Fatalf("Steal (held): got %v, want webdav.ErrLocked", err)
+	}
+	stolen, err = r.Steal(now, token, "<owner>worker3</owner>", 10*time.Second, StealNewToken, ForceSteal)
+	if err != nil {
+		t.Fatalf("Steal (forced): %v", err)
+	}
+	if stolen == token {
+		t.Fatalf("Steal (forced): got the old token %q", token)
+	}
+	release()
+
+	if err := r.Unlock(now, token); err != webdav.ErrNoSuchLock {
+		t.Fatalf("Unlock (old token): got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Steal (forced): inconsistent state: %v", err)
+	}
+
+	// The stolen lock expires according to its new duration.
+	if err := r.Unlock(now.Add(10*time.Second), stolen); err != webdav.ErrNoSuchLock {
+		t.Fatalf("Unlock (expired): got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Unlock (expired): inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSCheck(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check (empty): %v", err)
+	}
+
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a/b",
+		Duration: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{
+		Root:     "/c",
+		Duration: infiniteTimeout,
+	}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	release, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check (held): %v", err)
+	}
+	release()
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check (released): %v", err)
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	if _, err := conn.Do("HINCRBY", r.byNameKey("/a"), refCountKey, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(now); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Check (bad refCount): got %v, want ErrInconsistent", err)
+	}
+	if _, err := conn.Do("HINCRBY", r.byNameKey("/a"), refCountKey, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Do("ZREM", r.prefix+expiryZSetKey, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(now); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Check (missing expiry): got %v, want ErrInconsistent", err)
+	}
+	if _, err := conn.Do("ZADD", r.prefix+expiryZSetKey, 10, "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Do("DEL", r.byTokenKey(token)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(now); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Check (missing token key): got %v, want ErrInconsistent", err)
+	}
+}
+
+func TestRedisLSUnlockByPath(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := r.UnlockByPath(now, "/a/b"); err != webdav.ErrNoSuchLock {
+		t.Fatalf("UnlockByPath (descendent): got %v, want webdav.ErrNoSuchLock", err)
+	}
+
+	release, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if err := r.UnlockByPath(now, "/a"); err != webdav.ErrLocked {
+		t.Fatalf("UnlockByPath (held): got %v, want webdav.ErrLocked", err)
+	}
+	release()
+
+	if err := r.UnlockByPath(now, "a/"); err != nil {
+		t.Fatalf("UnlockByPath: %v", err)
+	}
+	if n := getByToken(r, token); n != nil {
+		t.Fatalf("UnlockByPath: lock still exists: %v", n)
+	}
+	if err := r.UnlockByPath(now, "/a"); err != webdav.ErrNoSuchLock {
+		t.Fatalf("UnlockByPath (unlocked): got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("UnlockByPath: inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSRefreshMany(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	tokenA, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	tokenB, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	tokenC, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	release, err := r.Confirm(now, "/b", "", webdav.Condition{Token: tokenB})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	defer release()
+
+	got, err := r.RefreshMany(now, []string{tokenA, tokenB, "nosuchtoken", tokenC}, 20*time.Second)
+	manyErr, ok := err.(*RefreshManyError)
+	if !ok {
+		t.Fatalf("RefreshMany: got %v, want *RefreshManyError", err)
+	}
+	wantErrs := map[string]error{
+		tokenB:        webdav.ErrLocked,
+		"nosuchtoken": webdav.ErrNoSuchLock,
+	}
+	if !reflect.DeepEqual(manyErr.Errors, wantErrs) {
+		t.Fatalf("RefreshMany: got errors %v, want %v", manyErr.Errors, wantErrs)
+	}
+	want := []webdav.LockDetails{
+		{Root: "/a", Duration: 20 * time.Second},
+		{},
+		{},
+		{Root: "/c", Duration: 20 * time.Second},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("RefreshMany:\ngot  %v\nwant %v", got, want)
+	}
+	if n := getByToken(r, tokenC); !n.expiry.Equal(now.Add(20 * time.Second)) {
+		t.Fatalf("RefreshMany: got expiry %v, want %v", n.expiry, now.Add(20*time.Second))
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("RefreshMany: inconsistent state: %v", err)
+	}
+
+	if got, err := r.RefreshMany(now, nil, 20*time.Second); err != nil || len(got) != 0 {
+		t.Fatalf("RefreshMany (empty): got %v, %v", got, err)
+	}
+}
+
+func TestRedisLSExpiryJitter(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithExpiryJitter(5 * time.Second))
+
+	expiries := map[time.Time]bool{}
+	for i := 0; i < 20; i++ {
+		token, err := r.Create(now, webdav.LockDetails{
+			Root:     "/" + string(rune('a'+i)),
+			Duration: 10 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		expiry := getByToken(r, token).expiry
+		if expiry.Before(now.Add(10*time.Second)) || expiry.After(now.Add(15*time.Second)) {
+			t.Fatalf("Create: got expiry %v, want within [10s, 15s]", expiry.Sub(now))
+		}
+		expiries[expiry] = true
+	}
+	if len(expiries) < 2 {
+		t.Fatalf("Create: all locks got the same expiry")
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Create: inconsistent state: %v", err)
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	// Zero-duration locks are not jittered.
+	token, err := r.Create(now, webdav.LockDetails{Root: "/zero", Duration: 0})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := r.Unlock(now, token); err != webdav.ErrNoSuchLock {
+		t.Fatalf("Unlock (zero duration): got %v, want webdav.ErrNoSuchLock", err)
+	}
+}
+
+func TestRedisLSStrictConditions(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithStrictConditions())
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: infiniteTimeout,
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+
+	for _, condition := range []webdav.Condition{
+		{Not: true, Token: token},
+		{Token: token, ETag: `"etag"`},
+	} {
+		if _, err := r.Confirm(now, "/a", "", condition); err != webdav.ErrConfirmationFailed {
+			t.Fatalf("Confirm %+v: got %v, want webdav.ErrConfirmationFailed", condition, err)
+		}
+		if _, err := r.Lookup(now, "/a", condition); err != webdav.ErrConfirmationFailed {
+			t.Fatalf("Lookup %+v: got %v, want webdav.ErrConfirmationFailed", condition, err)
+		}
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Confirm: inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSStats(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	stats, err := r.Stats(now)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats != (LockStats{}) {
+		t.Fatalf("Stats (empty): got %+v", stats)
+	}
+
+	for _, d := range []struct {
+		root     string
+		duration time.Duration
+	}{
+		{"/a", 10 * time.Second},
+		{"/b", 30 * time.Second},
+		{"/c", 2 * time.Minute},
+		{"/d", infiniteTimeout},
+	} {
+		if _, err := r.Create(now, webdav.LockDetails{Root: d.root, Duration: d.duration}); err != nil {
+			t.Fatalf("Create %q: %v", d.root, err)
+		}
+	}
+	tokenD := getByName(r, "/d").token
+
+	release, err := r.Confirm(now, "/d", "", webdav.Condition{Token: tokenD})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+
+	stats, err = r.Stats(now.Add(20 * time.Second))
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	want := LockStats{
+		Locks:        4,
+		Held:         1,
+		ExpiringSoon: 1,
+		Collectable:  1,
+		TokenCounter: 4,
+	}
+	if stats != want {
+		t.Fatalf("Stats:\ngot  %+v\nwant %+v", stats, want)
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check (held): %v", err)
+	}
+
+	release()
+	stats, err = r.Stats(now)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Held != 0 {
+		t.Fatalf("Stats (released): got %d held, want 0", stats.Held)
+	}
+}
+
+func TestRedisLSInlineCollect(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithInlineCollect(false))
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: 10 * time.Second}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// Without a conflict, the expired lock is left in place.
+	now = now.Add(10 * time.Second)
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if byTokenLen(r) != 2 {
+		t.Fatalf("Create: got %d locks, want 2", byTokenLen(r))
+	}
+
+	// An expired lock in the way is collected before giving up.
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create (over expired): %v", err)
+	}
+	if byTokenLen(r) != 2 {
+		t.Fatalf("Create (over expired): got %d locks, want 2", byTokenLen(r))
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: infiniteTimeout}); err != webdav.ErrLocked {
+		t.Fatalf("Create (conflict): got %v, want webdav.ErrLocked", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("Create: inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSPathNormalizer(t *testing.T) {
+	now := time.Unix(0, 0)
+	composed := "/caf\u00e9"
+	decomposed := "/cafe\u0301"
+
+	r := NewTestRedisLS()
+	if _, err := r.Create(now, webdav.LockDetails{Root: composed, Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: decomposed, Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create (without normalizer): %v", err)
+	}
+
+	r = NewTestRedisLS(WithPathNormalizer(NormalizeNFC))
+	token, err := r.Create(now, webdav.LockDetails{Root: decomposed, Duration: infiniteTimeout})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: composed, Duration: infiniteTimeout}); err != webdav.ErrLocked {
+		t.Fatalf("Create (composed): got %v, want webdav.ErrLocked", err)
+	}
+	if n := getByToken(r, token); n.details.Root != composed {
+		t.Fatalf("Create: got root %q, want %q", n.details.Root, composed)
+	}
+
+	release, err := r.Confirm(now, composed+"/x", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm (composed): %v", err)
+	}
+	release()
+	if _, err := r.Lookup(now, decomposed, webdav.Condition{Token: token}); err != nil {
+		t.Fatalf("Lookup (decomposed): %v", err)
+	}
+}
+
+func TestRedisLSCaseFold(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithCaseFold())
+	token, err := r.Create(now, webdav.LockDetails{Root: "/Foo/Bar", Duration: infiniteTimeout})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/foo/bar", Duration: infiniteTimeout}); err != webdav.ErrLocked {
+		t.Fatalf("Create (folded): got %v, want webdav.ErrLocked", err)
+	}
+	if n := getByToken(r, token); n.details.Root != "/foo/bar" {
+		t.Fatalf("Create: got root %q, want %q", n.details.Root, "/foo/bar")
+	}
+
+	release, err := r.Confirm(now, "/FOO/bar/Baz", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+	if _, err := r.Lookup(now, "/foo/BAR", webdav.Condition{Token: token}); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if err := r.UnlockByPath(now, "/fOO/bAR"); err != nil {
+		t.Fatalf("UnlockByPath: %v", err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("UnlockByPath: inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSTryCreate(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithMaxOwnerXMLBytes(8))
+	token, granted, err := r.TryCreate(now, webdav.LockDetails{Root: "/a", Duration: infiniteTimeout})
+	if err != nil || !granted || token == "" {
+		t.Fatalf("TryCreate: got %q, %t, %v", token, granted, err)
+	}
+
+	token, granted, err = r.TryCreate(now, webdav.LockDetails{Root: "/a/b", Duration: infiniteTimeout})
+	if err != nil || granted || token != "" {
+		t.Fatalf("TryCreate (locked): got %q, %t, %v", token, granted, err)
+	}
+
+	_, granted, err = r.TryCreate(now, webdav.LockDetails{Root: "/c", OwnerXML: "<owner>alice</owner>"})
+	if err != ErrOwnerXMLTooLarge || granted {
+		t.Fatalf("TryCreate (too large): got %t, %v", granted, err)
+	}
+}
+
+func TestRedisLSUnlockResult(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if removed, err := r.UnlockResult(now, token); err != webdav.ErrLocked || removed {
+		t.Fatalf("UnlockResult (held): got %t, %v, want false, webdav.ErrLocked", removed, err)
+	}
+	release()
+
+	if removed, err := r.UnlockResult(now, token); err != nil || !removed {
+		t.Fatalf("UnlockResult: got %t, %v, want true, nil", removed, err)
+	}
+	if removed, err := r.UnlockResult(now, token); err != nil || removed {
+		t.Fatalf("UnlockResult (removed): got %t, %v, want false, nil", removed, err)
+	}
+}
+
+type memOwnerStore struct {
+	docs    map[string]string
+	next    int
+	failPut bool
+}
+
+func (s *memOwnerStore) Put(token, ownerXML string) (string, error) {
+	if s.failPut {
+		return "", errors.New("put failed")
+	}
+	s.next++
+	ref := "ref" + strconv.Itoa(s.next)
+	s.docs[ref] = ownerXML
+	return ref, nil
+}
+
+func (s *memOwnerStore) Get(ref string) (string, error) {
+	ownerXML, ok := s.docs[ref]
+	if !ok {
+		return "", errors.New("no such document")
+	}
+	return ownerXML, nil
+}
+
+func (s *memOwnerStore) Delete(ref string) error {
+	delete(s.docs, ref)
+	return nil
+}
+
+func TestRedisLSOwnerStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := &memOwnerStore{docs: map[string]string{}}
+	r := NewTestRedisLS(WithOwnerStore(store))
+
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: 10 * time.Second,
+		OwnerXML: "<owner>alice</owner>",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if n := getByToken(r, token); n.details.OwnerXML != "ref1" {
+		t.Fatalf("Create: stored owner %q, want %q", n.details.OwnerXML, "ref1")
+	}
+	info, err := r.GetLock(now, token)
+	if err != nil || info.Details.OwnerXML != "<owner>alice</owner>" {
+		t.Fatalf("GetLock: got %v, %v", info, err)
+	}
+	details, err := r.Refresh(now, token, 20*time.Second)
+	if err != nil || details.OwnerXML != "<owner>alice</owner>" {
+		t.Fatalf("Refresh: got %v, %v", details, err)
+	}
+
+	if _, err := r.UpdateOwner(now, token, "<owner>bob</owner>"); err != nil {
+		t.Fatalf("UpdateOwner: %v", err)
+	}
+	if want := map[string]string{"ref2": "<owner>bob</owner>"}; !reflect.DeepEqual(store.docs, want) {
+		t.Fatalf("UpdateOwner: got documents %v, want %v", store.docs, want)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if _, err := r.Steal(now, token, "<owner>carol</owner>", 10*time.Second, ForceSteal); err != nil {
+		t.Fatalf("Steal: %v", err)
+	}
+	release()
+	if want := map[string]string{"ref3": "<owner>carol</owner>"}; !reflect.DeepEqual(store.docs, want) {
+		t.Fatalf("Steal: got documents %v, want %v", store.docs, want)
+	}
+
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if len(store.docs) != 0 {
+		t.Fatalf("Unlock: got documents %v, want none", store.docs)
+	}
+
+	// Collected locks have their documents deleted too.
+	if _, err := r.Create(now, webdav.LockDetails{
+		Root:     "/b",
+		Duration: 10 * time.Second,
+		OwnerXML: "<owner>dave</owner>",
+	}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now.Add(10*time.Second), webdav.LockDetails{Root: "/c"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if len(store.docs) != 0 {
+		t.Fatalf("Create (collecting): got documents %v, want none", store.docs)
+	}
+
+	store.failPut = true
+	if _, err := r.Create(now, webdav.LockDetails{
+		Root:     "/d",
+		Duration: 10 * time.Second,
+		OwnerXML: "<owner>erin</owner>",
+	}); err == nil {
+		t.Fatalf("Create (failed Put): got nil error")
+	}
+	if n := getByName(r, "/d"); n != nil {
+		t.Fatalf("Create (failed Put): lock still exists: %v", n)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSExpiryShards(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithExpiryShards(4))
+
+	tokens := map[string]string{}
+	for _, root := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		token, err := r.Create(now, webdav.LockDetails{Root: root, Duration: 10 * time.Second})
+		if err != nil {
+			t.Fatalf("Create %q: %v", root, err)
+		}
+		tokens[root] = token
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("KEYS", r.prefix+expiryZSetKey+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) < 2 {
+		t.Fatalf("Create: got expiry keys %q, want several shards", keys)
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, r.prefix+expiryZSetKey+defaultKeySeparator) {
+			t.Fatalf("Create: got unsharded expiry key %q", key)
+		}
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: tokens["/a"]})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check (held): %v", err)
+	}
+	release()
+	if _, err := r.Refresh(now, tokens["/b"], 20*time.Second); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	stats, err := r.Stats(now.Add(10 * time.Second))
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Collectable != 5 || stats.ExpiringSoon != 1 {
+		t.Fatalf("Stats: got %+v, want 5 collectable and 1 expiring soon", stats)
+	}
+
+	// Expired locks are collected from all shards.
+	if err := r.Check(now.Add(10 * time.Second)); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if byTokenLen(r) != 1 {
+		t.Fatalf("Check: got %d locks after collection, want 1", byTokenLen(r))
+	}
+}
+
+func TestRedisLSCorruptState(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", r.byNameKey("/a"), zeroDepthKey, "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: infiniteTimeout}); err != ErrCorruptState {
+		t.Fatalf("Create (invalid zero depth): got %v, want ErrCorruptState", err)
+	}
+	if err := r.Check(now); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Check (invalid zero depth): got %v, want ErrInconsistent", err)
+	}
+	if _, err := conn.Do("HSET", r.byNameKey("/a"), zeroDepthKey, falseValue); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Do("HDEL", r.byNameKey("/"), rootKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: infiniteTimeout}); err != ErrCorruptState {
+		t.Fatalf("Create (missing root): got %v, want ErrCorruptState", err)
+	}
+}
+
+func TestRedisLSFlush(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	for i := 0; i < 20; i++ {
+		if _, err := r.Create(now, webdav.LockDetails{
+			Root:     "/" + string(rune('a'+i)),
+			Duration: 10 * time.Second,
+		}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	// Keys outside of the prefix are left alone, even if they look similar.
+	if _, err := conn.Do("SET", "webdavredislstest*other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Do("DEL", "webdavredislstest*other")
+
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	keys, err := redis.Strings(conn.Do("KEYS", "webdavredislstest*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"webdavredislstest*other"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("Flush: got keys %q, want %q", keys, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Flush(ctx); err != context.Canceled {
+		t.Fatalf("Flush (canceled): got %v, want context.Canceled", err)
+	}
+
+	if err := NewRedisLS(testPool(r), "").Flush(context.Background()); err == nil {
+		t.Fatalf("Flush (empty prefix): got nil error")
+	}
+
+	// Connections without context support are flushed with Do, and failing
+	// to get a connection is reported as such.
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	plain := NewRedisLSWithConns(func() (redis.Conn, error) {
+		return denyConn{testPool(r).Get(), nil}, nil
+	}, func(conn redis.Conn) {
+		conn.Close()
+	}, r.prefix)
+	if err := plain.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush (no context support): %v", err)
+	}
+	if n := getByName(r, "/a"); n != nil {
+		t.Fatalf("Flush (no context support): got %+v, want no lock", n)
+	}
+	dialErr := errors.New("dial failed")
+	failing := NewRedisLSWithConns(func() (redis.Conn, error) {
+		return nil, dialErr
+	}, func(conn redis.Conn) {}, r.prefix)
+	if err := failing.Flush(context.Background()); err != dialErr {
+		t.Fatalf("Flush (no connection): got %v, want %v", err, dialErr)
+	}
+}
+
+func TestDeleteByPrefix(t *testing.T) {
+	r := NewTestRedisLS()
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	for _, key := range []string{"webdavredislstest:x:1", "webdavredislstest:x:2", "webdavredislstest:y"} {
+		if _, err := conn.Do("SET", key, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer conn.Do("DEL", "webdavredislstest:y")
+
+	if err := deleteByPrefix(context.Background(), conn, ""); err == nil {
+		t.Fatalf("deleteByPrefix (empty prefix): got nil error")
+	}
+	if err := deleteByPrefix(context.Background(), conn, "webdavredislstest:x:"); err != nil {
+		t.Fatalf("deleteByPrefix: %v", err)
+	}
+	keys, err := redis.Strings(conn.Do("KEYS", "webdavredislstest:*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"webdavredislstest:y"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("deleteByPrefix: got keys %q, want %q", keys, want)
+	}
+}
+
+func TestRedisLSDanglingNodes(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: infiniteTimeout, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	info, err := r.GetLock(now, token)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if info.RefCount != 2 {
+		t.Fatalf("GetLock: got RefCount %d, want 2", info.RefCount)
+	}
+
+	dangling, err := r.DanglingNodes(now)
+	if err != nil || len(dangling) != 0 {
+		t.Fatalf("DanglingNodes: got %q, %v", dangling, err)
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", r.byNameKey("/c"), nameKey, "/c", rootKey, "/c", refCountKey, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("HINCRBY", r.byNameKey("/"), refCountKey, 1); err != nil {
+		t.Fatal(err)
+	}
+	dangling, err = r.DanglingNodes(now)
+	if err != nil {
+		t.Fatalf("DanglingNodes: %v", err)
+	}
+	if want := []string{"/", "/c"}; !reflect.DeepEqual(dangling, want) {
+		t.Fatalf("DanglingNodes: got %q, want %q", dangling, want)
+	}
+}
+
+func TestRedisLSZeroDuration(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	r := NewTestRedisLS(WithMinDuration(5 * time.Second))
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: 0})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if n := getByToken(r, token); n == nil || !n.expiry.Equal(now.Add(5*time.Second)) {
+		t.Fatalf("Create: got %v, want a 5s lock", n)
+	}
+	details, err := r.Refresh(now, token, 0)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if details.Duration != 5*time.Second {
+		t.Fatalf("Refresh: got duration %v, want 5s", details.Duration)
+	}
+	if details, err := r.Refresh(now, token, infiniteTimeout); err != nil || details.Duration != infiniteTimeout {
+		t.Fatalf("Refresh (infinite): got %v, %v", details, err)
+	}
+
+	r = NewTestRedisLS(WithRejectZeroDuration(), WithMinDuration(5*time.Second))
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: 500 * time.Millisecond}); err != ErrZeroDuration {
+		t.Fatalf("Create: got %v, want ErrZeroDuration", err)
+	}
+	token, err = r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Second})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Refresh(now, token, 0); err != ErrZeroDuration {
+		t.Fatalf("Refresh: got %v, want ErrZeroDuration", err)
+	}
+	if n := getByToken(r, token); !n.expiry.Equal(now.Add(5 * time.Second)) {
+		t.Fatalf("Create: got expiry %v, want %v", n.expiry, now.Add(5*time.Second))
+	}
+}
+
+func TestRedisLSScriptCache(t *testing.T) {
+	now := time.Now()
+
+	for _, opt := range []Option{WithAlwaysEval(), WithScriptCacheCheck(time.Nanosecond)} {
+		r := NewTestRedisLS(opt)
+
+		conn := r.conns.get(context.Background())
+		_, err := conn.Do("SCRIPT", "FLUSH")
+		conn.Close()
+		if err != nil {
+			t.Fatalf("SCRIPT FLUSH: %v", err)
+		}
+
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if _, err := r.Refresh(now, token, time.Minute); err != nil {
+			t.Fatalf("Refresh: %v", err)
+		}
+		if err := r.Unlock(now, token); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+
+		if r.alwaysEval {
+			continue
+		}
+
+		scripts := r.scripts.all()
+		args := []interface{}{"EXISTS"}
+		for _, script := range scripts {
+			args = append(args, script.Hash())
+		}
+		conn = r.conns.get(context.Background())
+		exists, err := redis.Ints(conn.Do("SCRIPT", args...))
+		conn.Close()
+		if err != nil {
+			t.Fatalf("SCRIPT EXISTS: %v", err)
+		}
+		for i, e := range exists {
+			if e != 1 {
+				t.Errorf("script %d not loaded by the cache check", i)
+			}
+		}
+	}
+}
+
+func TestRedisLSCreateWait(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS()
+
+	details := webdav.LockDetails{Root: "/a", Duration: time.Minute}
+
+	token, err := r.Create(now, details)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if _, err := r.CreateWait(context.Background(), now, details, 50*time.Millisecond); err != webdav.ErrLocked {
+		t.Fatalf("CreateWait (timeout): got %v, want webdav.ErrLocked", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.CreateWait(ctx, now, details, time.Minute); err != context.Canceled {
+		t.Fatalf("CreateWait (canceled): got %v, want context.Canceled", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := r.Unlock(now, token); err != nil {
+			t.Errorf("Unlock: %v", err)
+		}
+	}()
+
+	token, err = r.CreateWait(context.Background(), now, details, 5*time.Second)
+	if err != nil {
+		t.Fatalf("CreateWait: %v", err)
+	}
+	if n := getByToken(r, token); n == nil || n.details.Root != "/a" {
+		t.Fatalf("CreateWait: got %v, want a lock on /a", n)
+	}
+}
+
+func TestRedisLSCreateAll(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS()
+	ctx := context.Background()
+
+	tokens, err := r.CreateAll(ctx, now, []string{"/c", "/a/", "/b"}, time.Minute, false, "<owner>alice</owner>", time.Second)
+	if err != nil {
+		t.Fatalf("CreateAll: %v", err)
+	}
+	for i, root := range []string{"/c", "/a", "/b"} {
+		if n := getByToken(r, tokens[i]); n == nil || n.details.Root != root || n.details.OwnerXML != "<owner>alice</owner>" {
+			t.Fatalf("CreateAll: got %v for token %d, want a lock on %s", n, i, root)
+		}
+	}
+
+	// A conflict on the last root releases the others.
+	if _, err := r.CreateAll(ctx, now, []string{"/d", "/e", "/c"}, time.Minute, false, "", 50*time.Millisecond); err != webdav.ErrLocked {
+		t.Fatalf("CreateAll: got %v, want %v", err, webdav.ErrLocked)
+	}
+	for _, root := range []string{"/d", "/e"} {
+		if _, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute}); err != nil {
+			t.Fatalf("Create %s: %v", root, err)
+		}
+	}
+
+	// Roots that conflict with each other fail without waiting.
+	start := time.Now()
+	if _, err := r.CreateAll(ctx, now, []string{"/f", "/f/g"}, time.Minute, false, "", time.Minute); err != webdav.ErrLocked {
+		t.Fatalf("CreateAll: got %v, want %v", err, webdav.ErrLocked)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("CreateAll: waited %v", elapsed)
+	}
+	if _, err := r.CreateAll(ctx, now, []string{"/f", "/f/g"}, time.Minute, true, "", time.Minute); err != nil {
+		t.Fatalf("CreateAll (zero depth): %v", err)
+	}
+}
+
+func TestRedisLSCreateAllOrder(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS()
+
+	// Without the canonical order each call could take its first root and
+	// wait for the other one's until maxWait.
+	errs := make(chan error, 2)
+	for _, roots := range [][]string{{"/a", "/b"}, {"/b", "/a"}} {
+		go func(roots []string) {
+			for i := 0; i < 5; i++ {
+				tokens, err := r.CreateAll(context.Background(), now, roots, time.Minute, false, "", 5*time.Second)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, token := range tokens {
+					if err := r.Unlock(now, token); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+			errs <- nil
+		}(roots)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("CreateAll: %v", err)
+		}
+	}
+}
+
+func TestRedisLSLockExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewTestRedisLS()
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	info, err := r.GetLock(now, token)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if want := now.Add(time.Minute); !info.Expiry.Equal(want) {
+		t.Fatalf("GetLock: got expiry %v, want %v", info.Expiry, want)
+	}
+
+	now = now.Add(10 * time.Second)
+	res, err := r.RefreshInfo(now, token, 2*time.Minute)
+	if err != nil {
+		t.Fatalf("RefreshInfo: %v", err)
+	}
+	if want := now.Add(2 * time.Minute); !res.Expiry.Equal(want) {
+		t.Fatalf("RefreshInfo: got expiry %v, want %v", res.Expiry, want)
+	}
+	if res.Details.Duration != 2*time.Minute {
+		t.Fatalf("RefreshInfo: got duration %v, want 2m", res.Details.Duration)
+	}
+
+	res, err = r.RefreshInfo(now, token, infiniteTimeout)
+	if err != nil {
+		t.Fatalf("RefreshInfo: %v", err)
+	}
+	if !res.Expiry.IsZero() {
+		t.Fatalf("RefreshInfo: got expiry %v for an infinite lock, want zero", res.Expiry)
+	}
+	locks, err := r.ListLocks(now)
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if len(locks) != 1 || !locks[0].Expiry.IsZero() {
+		t.Fatalf("ListLocks: got %v, want one lock with a zero expiry", locks)
+	}
+}
+
+func TestRedisLSRootLockPolicy(t *testing.T) {
+	now := time.Now()
+
+	r := NewTestRedisLS(WithRootLockPolicy(RootLockDenied))
+
+	for _, root := range []string{"/", "", "/a/.."} {
+		if _, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute}); err != ErrRootLockForbidden {
+			t.Fatalf("Create %q: got %v, want ErrRootLockForbidden", root, err)
+		}
+	}
+	if _, err := r.CreateIdempotent(now, "k", webdav.LockDetails{Root: "/", Duration: time.Minute}); err != ErrRootLockForbidden {
+		t.Fatalf("CreateIdempotent: got %v, want ErrRootLockForbidden", err)
+	}
+	if _, err := r.CreateRootLock(now, webdav.LockDetails{Root: "/", Duration: time.Minute}); err != ErrRootLockForbidden {
+		t.Fatalf("CreateRootLock: got %v, want ErrRootLockForbidden", err)
+	}
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/", Duration: time.Minute, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create zero-depth: %v", err)
+	}
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create /a: %v", err)
+	}
+
+	r = NewTestRedisLS(WithRootLockPolicy(RootLockExplicit))
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/", Duration: time.Minute}); err != ErrRootLockForbidden {
+		t.Fatalf("Create: got %v, want ErrRootLockForbidden", err)
+	}
+	if _, err := r.CreateRootLock(now, webdav.LockDetails{Root: "/", Duration: time.Minute}); err != nil {
+		t.Fatalf("CreateRootLock: %v", err)
+	}
+	if _, err := r.CreateRootLock(now, webdav.LockDetails{Root: "/", Duration: time.Minute}); err != webdav.ErrLocked {
+		t.Fatalf("CreateRootLock: got %v, want webdav.ErrLocked", err)
+	}
+}
+
+func TestRedisLSMaintenance(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS()
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := r.SetMaintenance(true); err != nil {
+		t.Fatalf("SetMaintenance: %v", err)
+	}
+	if on, err := r.InMaintenance(); err != nil || !on {
+		t.Fatalf("InMaintenance: got %v, %v, want true", on, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.WithContext(ctx).SetMaintenance(false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SetMaintenance: got %v, want %v", err, context.Canceled)
+	}
+	if _, err := r.WithContext(ctx).InMaintenance(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("InMaintenance: got %v, want %v", err, context.Canceled)
+	}
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != ErrMaintenance {
+		t.Fatalf("Create: got %v, want ErrMaintenance", err)
+	}
+	if _, err := r.CreateIdempotent(now, "k", webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != ErrMaintenance {
+		t.Fatalf("CreateIdempotent: got %v, want ErrMaintenance", err)
+	}
+
+	if _, err := r.Refresh(now, token, 2*time.Minute); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if n := byNameLen(r); n != 0 {
+		t.Fatalf("after Unlock: got %d nodes, want 0", n)
+	}
+
+	if err := r.SetMaintenance(false); err != nil {
+		t.Fatalf("SetMaintenance: %v", err)
+	}
+	if on, err := r.InMaintenance(); err != nil || on {
+		t.Fatalf("InMaintenance: got %v, %v, want false", on, err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+}
+
+func TestRedisLSExpiringWithin(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewTestRedisLS(WithExpiryShards(2))
+
+	durations := map[string]time.Duration{
+		"/a": 30 * time.Second,
+		"/b": 10 * time.Second,
+		"/c": 2 * time.Minute,
+		"/d": infiniteTimeout,
+		"/e": 20 * time.Second,
+	}
+	for root, duration := range durations {
+		if _, err := r.Create(now, webdav.LockDetails{Root: root, Duration: duration}); err != nil {
+			t.Fatalf("Create %s: %v", root, err)
+		}
+	}
+
+	_, err := r.Confirm(now, "/e", "", webdav.Condition{Token: getByName(r, "/e").token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+
+	locks, err := r.ExpiringWithin(now, time.Minute)
+	if err != nil {
+		t.Fatalf("ExpiringWithin: %v", err)
+	}
+	var roots []string
+	for _, info := range locks {
+		roots = append(roots, info.Details.Root)
+	}
+	if want := []string{"/b", "/a"}; !reflect.DeepEqual(roots, want) {
+		t.Fatalf("ExpiringWithin: got %v, want %v", roots, want)
+	}
+
+	locks, err = r.ExpiringWithin(now.Add(10*time.Second), time.Minute)
+	if err != nil {
+		t.Fatalf("ExpiringWithin: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Details.Root != "/a" {
+		t.Fatalf("ExpiringWithin (later): got %v, want /a", locks)
+	}
+}
+
+func TestRedisLSScoped(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS()
+
+	a := r.Scoped(r.prefix + "a:")
+	b := r.Scoped(r.prefix + "b:")
+	for _, s := range []*RedisLS{a, b} {
+		if err := s.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	details := webdav.LockDetails{Root: "/x", Duration: time.Minute}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 2)
+	errs := make([]error, 2)
+	for i, s := range []*RedisLS{a, b} {
+		wg.Add(1)
+		go func(i int, s *RedisLS) {
+			defer wg.Done()
+			tokens[i], errs[i] = s.Create(now, details)
+		}(i, s)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Create %d: %v", i, err)
+		}
+	}
+
+	if _, err := a.Create(now, details); err != webdav.ErrLocked {
+		t.Fatalf("Create again: got %v, want webdav.ErrLocked", err)
+	}
+	if n := byNameLen(r); n != 0 {
+		t.Fatalf("unscoped: got %d nodes, want 0", n)
+	}
+
+	if err := a.Unlock(now, tokens[0]); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := b.GetLock(now, tokens[1]); err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if r.prefix != "webdavredislstest:" {
+		t.Fatalf("Scoped changed the prefix of the original to %q", r.prefix)
+	}
+
+	for _, s := range []*RedisLS{a, b} {
+		if err := s.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+}
+
+func TestRedisLSDeepestLock(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS()
+
+	if path, depth, err := r.DeepestLock(now); err != nil || path != "" || depth != -1 {
+		t.Fatalf("DeepestLock (empty): got %q, %d, %v, want \"\", -1", path, depth, err)
+	}
+
+	for _, l := range []struct {
+		root     string
+		duration time.Duration
+	}{
+		{"/", time.Minute},
+		{"/a/b", time.Minute},
+		{"/c/d", time.Minute},
+		{"/e/f/g", time.Second},
+	} {
+		if _, err := r.Create(now, webdav.LockDetails{Root: l.root, Duration: l.duration, ZeroDepth: true}); err != nil {
+			t.Fatalf("Create %s: %v", l.root, err)
+		}
+	}
+
+	if path, depth, err := r.DeepestLock(now); err != nil || path != "/e/f/g" || depth != 3 {
+		t.Fatalf("DeepestLock: got %q, %d, %v, want /e/f/g, 3", path, depth, err)
+	}
+	// The expired lock is skipped but not collected.
+	if path, depth, err := r.DeepestLock(now.Add(time.Second)); err != nil || path != "/a/b" || depth != 2 {
+		t.Fatalf("DeepestLock (expired): got %q, %d, %v, want /a/b, 2", path, depth, err)
+	}
+	if getByName(r, "/e/f/g") == nil {
+		t.Fatalf("DeepestLock collected an expired lock")
+	}
+}
+
+func TestRedisLSReconcile(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Second}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/c", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	// Inflate the refcounts on the path of /a/b, as if a script had failed
+	// while removing a lock below it.
+	for _, name := range []string{"/a/b", "/a", "/"} {
+		if _, err := conn.Do("HINCRBY", r.byNameKey(name), refCountKey, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Deflate the refcount of /d, so that removing /d/e leaves it negative.
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/d/e", Duration: time.Second}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := conn.Do("HINCRBY", r.byNameKey("/d"), refCountKey, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/f", Duration: infiniteTimeout}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if n := getByName(r, "/d"); n != nil {
+		t.Fatalf("got node /d %v, want it removed", n)
+	}
+	// Collection doesn't look for descendants, so the unlocked /a/b is left
+	// for CompactExpirySet.
+	dangling, err := r.DanglingNodes(now)
+	if want := []string{"/", "/a", "/a/b"}; err != nil || !reflect.DeepEqual(dangling, want) {
+		t.Fatalf("DanglingNodes: got %q, %v, want %q", dangling, err, want)
+	}
+
+	if _, err := r.CompactExpirySet(now); err != nil {
+		t.Fatalf("CompactExpirySet: %v", err)
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if n := getByName(r, "/a/b"); n != nil {
+		t.Fatalf("got node /a/b %v, want it removed", n)
+	}
+}
+
+func TestRedisLSNoScriptingConflicts(t *testing.T) {
+	now := time.Now()
+	r := NewTestRedisLS(WithNoScripting())
+
+	if _, err := r.GetLock(now, "1"); err != ErrScriptingDisabled {
+		t.Fatalf("GetLock: got %v, want ErrScriptingDisabled", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			root := "/a"
+			if i%2 == 1 {
+				root = "/a/b"
+			}
+			_, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute})
+			if err == webdav.ErrLocked || err == ErrTxConflict {
+				return
+			}
+			if err != nil {
+				t.Errorf("Create: %v", err)
+				return
+			}
+			mu.Lock()
+			granted++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if granted != 1 {
+		t.Fatalf("Create: got %d conflicting locks granted, want 1", granted)
+	}
+	if err := NewRedisLS(testPool(r), r.prefix).Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+}
+
+func TestRedisLSFallback(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	dial := testPool(r).Dial
+	down := false
+	r.conns = poolConns{pool: &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			if down {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			}
+			return dial()
+		},
+	}}
+
+	fallbacks := 0
+	f := NewFallbackLS(r, func(err error) {
+		fallbacks++
+	})
+
+	redisToken, err := f.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if f.InFallback() {
+		t.Fatalf("InFallback: got true, want false")
+	}
+
+	down = true
+	token, err := f.Create(now, webdav.LockDetails{Root: "/b", Duration: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !strings.HasPrefix(token, fallbackTokenPrefix) {
+		t.Fatalf("Create: got token %q, want a fallback token", token)
+	}
+	if _, err := f.Create(now, webdav.LockDetails{Root: "/b/c", Duration: time.Minute}); err != webdav.ErrLocked {
+		t.Fatalf("Create: got %v, want webdav.ErrLocked", err)
+	}
+	if !f.InFallback() || fallbacks != 1 {
+		t.Fatalf("got InFallback %t with %d fallbacks, want true with 1", f.InFallback(), fallbacks)
+	}
+
+	if _, err := f.Refresh(now, token, 20*time.Second); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	release, err := f.Confirm(now, "/b/c", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+
+	if err := f.Drain(now); !isUnavailable(err) {
+		t.Fatalf("Drain: got %v, want an unavailable error", err)
+	}
+
+	down = false
+	now = now.Add(5 * time.Second)
+	if err := f.Drain(now); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if f.InFallback() {
+		t.Fatalf("InFallback: got true, want false")
+	}
+
+	n := getByName(r, "/b")
+	if n == nil {
+		t.Fatalf("getByName: /b not drained")
+	}
+	if want := now.Add(15 * time.Second); !n.expiry.Equal(want) {
+		t.Fatalf("expiry: got %v, want %v", n.expiry, want)
+	}
+
+	release, err = f.Confirm(now, "/b/c", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+
+	if err := f.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := f.Unlock(now, redisToken); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if got := byNameLen(r); got != 0 {
+		t.Fatalf("byNameLen: got %d, want 0", got)
+	}
+}
+
+func TestRedisLSCreateDetails(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithMinDuration(10*time.Second), WithCaseFold())
+
+	token, stored, err := r.CreateDetails(now, webdav.LockDetails{
+		Root:     "/A/../B/",
+		Duration: 2500 * time.Millisecond,
+		OwnerXML: "<owner/>",
+	})
+	if err != nil {
+		t.Fatalf("CreateDetails: %v", err)
+	}
+
+	want := webdav.LockDetails{
+		Root:     "/b",
+		Duration: 10 * time.Second,
+		OwnerXML: "<owner/>",
+	}
+	if stored != want {
+		t.Fatalf("CreateDetails: got %#v, want %#v", stored, want)
+	}
+
+	refreshed, err := r.Refresh(now, token, 10*time.Second)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if refreshed != stored {
+		t.Fatalf("Refresh: got %#v, want %#v", refreshed, stored)
+	}
+
+	if _, _, err := r.CreateDetails(now, webdav.LockDetails{Root: "/b", Duration: time.Minute}); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("CreateDetails: got %v, want webdav.ErrLocked", err)
+	}
+}
+
+func TestRedisLSEmptyToken(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// An empty token must be rejected before contacting Redis, where "/a"
+	// is a node with an empty token.
+	r.conns = poolConns{pool: &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, errors.New("dial failed")
+		},
+	}}
+
+	if err := r.Unlock(now, ""); err != webdav.ErrNoSuchLock {
+		t.Errorf("Unlock: got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if _, err := r.Refresh(now, "", time.Minute); err != webdav.ErrNoSuchLock {
+		t.Errorf("Refresh: got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if _, err := r.UpdateOwner(now, "", "<owner/>"); err != webdav.ErrNoSuchLock {
+		t.Errorf("UpdateOwner: got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if _, err := r.Steal(now, "", "<owner/>", time.Minute); err != webdav.ErrNoSuchLock {
+		t.Errorf("Steal: got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if _, err := r.GetLock(now, ""); err != webdav.ErrNoSuchLock {
+		t.Errorf("GetLock: got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if _, err := r.Confirm(now, "/a", "", webdav.Condition{Token: ""}, webdav.Condition{ETag: `"x"`}); err != webdav.ErrConfirmationFailed {
+		t.Errorf("Confirm: got %v, want webdav.ErrConfirmationFailed", err)
+	}
+	if _, err := r.Lookup(now, "/a", webdav.Condition{Token: ""}); err != webdav.ErrConfirmationFailed {
+		t.Errorf("Lookup: got %v, want webdav.ErrConfirmationFailed", err)
+	}
+}
+
+func TestRedisLSFilterLocks(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for _, details := range []webdav.LockDetails{
+		{Root: "/a", Duration: time.Minute, OwnerXML: "<owner>alice</owner>", ZeroDepth: true},
+		{Root: "/a/b", Duration: time.Hour, OwnerXML: "<owner>bob</owner>"},
+		{Root: "/c", Duration: infiniteTimeout, OwnerXML: "<owner>alice</owner>"},
+	} {
+		if _, err := r.Create(now, details); err != nil {
+			t.Fatalf("Create %q: %v", details.Root, err)
+		}
+	}
+
+	testCases := []struct {
+		name string
+		pred func(LockInfo) bool
+		want []string
+	}{
+		{"owner", func(l LockInfo) bool { return strings.Contains(l.Details.OwnerXML, "alice") }, []string{"/a", "/c"}},
+		{"duration", func(l LockInfo) bool { return l.Details.Duration >= time.Hour }, []string{"/a/b"}},
+		{"none", func(l LockInfo) bool { return false }, []string{}},
+	}
+
+	for _, tc := range testCases {
+		locks, err := r.FilterLocks(now, tc.pred)
+		if err != nil {
+			t.Fatalf("FilterLocks %s: %v", tc.name, err)
+		}
+		got := []string{}
+		for _, lock := range locks {
+			got = append(got, lock.Details.Root)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("FilterLocks %s:\ngot  %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRedisLSOwnerValidator(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithOwnerValidator(WellFormedOwnerXML))
+
+	for _, ownerXML := range []string{"", "<owner />", "<D:href>mailto:a@example.com</D:href>", "alice"} {
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: ownerXML})
+		if err != nil {
+			t.Fatalf("Create %q: %v", ownerXML, err)
+		}
+		if err := r.Unlock(now, token); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+	}
+
+	for _, ownerXML := range []string{"<owner>", "<a></b>", "</a>", "<a x=>"} {
+		_, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: ownerXML})
+		if !errors.Is(err, ErrInvalidOwner) {
+			t.Fatalf("Create %q: got %v, want ErrInvalidOwner", ownerXML, err)
+		}
+	}
+	if n := byNameLen(r); n != 0 {
+		t.Fatalf("byNameLen: got %d, want 0", n)
+	}
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: "<owner />"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.UpdateOwner(now, token, "<owner>"); !errors.Is(err, ErrInvalidOwner) {
+		t.Fatalf("UpdateOwner: got %v, want ErrInvalidOwner", err)
+	}
+	if _, err := r.Steal(now, token, "<owner>", time.Minute); !errors.Is(err, ErrInvalidOwner) {
+		t.Fatalf("Steal: got %v, want ErrInvalidOwner", err)
+	}
+	if n := getByToken(r, token); n == nil || n.details.OwnerXML != "<owner />" {
+		t.Fatalf("getByToken: got %+v, want the owner unchanged", n)
+	}
+}
+
+func TestRedisLSReserveTokens(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	if n, err := r.TokenCounter(); err != nil || n != 0 {
+		t.Fatalf("TokenCounter: got %d, %v, want 0", n, err)
+	}
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if n, err := r.TokenCounter(); err != nil || strconv.FormatInt(n, 10) != token {
+		t.Fatalf("TokenCounter: got %d, %v, want %s", n, err, token)
+	}
+
+	first, err := r.ReserveTokens(10)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+	if want := int64(2); first != want {
+		t.Fatalf("ReserveTokens: got %d, want %d", first, want)
+	}
+	if _, err := r.ReserveTokens(0); err == nil {
+		t.Fatalf("ReserveTokens(0): got nil, want an error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.WithContext(ctx).TokenCounter(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("TokenCounter: got %v, want %v", err, context.Canceled)
+	}
+	if _, err := r.WithContext(ctx).ReserveTokens(1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("ReserveTokens: got %v, want %v", err, context.Canceled)
+	}
+
+	token, err = r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if token != "12" {
+		t.Fatalf("Create: got token %s, want 12", token)
+	}
+}
+
+// errorReplyConn is a redis.Conn that answers every command with an error
+// reply.
+type errorReplyConn struct {
+	reply string
+}
+
+func (c *errorReplyConn) Close() error { return nil }
+func (c *errorReplyConn) Err() error   { return nil }
+func (c *errorReplyConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, redis.Error(c.reply)
+}
+func (c *errorReplyConn) Send(commandName string, args ...interface{}) error { return nil }
+func (c *errorReplyConn) Flush() error                                       { return nil }
+func (c *errorReplyConn) Receive() (interface{}, error)                      { return nil, redis.Error(c.reply) }
+
+func TestRedisLSWriteRejected(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	testCases := []struct {
+		reply string
+		want  error
+	}{
+		{"OOM command not allowed when used memory > 'maxmemory'.", ErrRedisOutOfMemory},
+		{"ERR Error running script (call to f_1): @user_script:10: -OOM command not allowed when used memory > 'maxmemory'.", ErrRedisOutOfMemory},
+		{"READONLY You can't write against a read only replica.", ErrRedisReadOnly},
+		{"MISCONF Redis is configured to save RDB snapshots, but it's currently unable to persist to disk.", ErrRedisReadOnly},
+		{"ERR unknown command", nil},
+	}
+
+	for _, tc := range testCases {
+		for _, opts := range [][]Option{nil, {WithAlwaysEval()}} {
+			reply := tc.reply
+			r := NewRedisLS(&redis.Pool{
+				Dial: func() (redis.Conn, error) {
+					return &errorReplyConn{reply: reply}, nil
+				},
+			}, "webdavredislstest:", append(opts, WithRetry(3, time.Millisecond))...)
+
+			_, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+			if tc.want == nil {
+				if err == nil || errors.Is(err, ErrRedisOutOfMemory) || errors.Is(err, ErrRedisReadOnly) {
+					t.Fatalf("Create %q: got %v, want the reply unchanged", tc.reply, err)
+				}
+				continue
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("Create %q: got %v, want %v", tc.reply, err, tc.want)
+			}
+			if !strings.Contains(err.Error(), tc.reply) {
+				t.Fatalf("Create %q: got %v, want the reply in the message", tc.reply, err)
+			}
+		}
+	}
+}
+
+func TestDurationToSec(t *testing.T) {
+	testCases := []struct {
+		d        time.Duration
+		sec      int64
+		back     time.Duration
+		infinite bool
+	}{
+		{infiniteTimeout, -1, infiniteTimeout, true},
+		{-time.Hour, -1, infiniteTimeout, true},
+		{0, 0, 0, false},
+		{1500 * time.Millisecond, 1, time.Second, false},
+		{time.Hour, 3600, time.Hour, false},
+	}
+
+	for _, tc := range testCases {
+		if got := DurationToSec(tc.d); got != tc.sec {
+			t.Errorf("DurationToSec(%v): got %d, want %d", tc.d, got, tc.sec)
+		}
+		if got := SecToDuration(tc.sec); got != tc.back {
+			t.Errorf("SecToDuration(%d): got %v, want %v", tc.sec, got, tc.back)
+		}
+		if got := IsInfinite(tc.d); got != tc.infinite {
+			t.Errorf("IsInfinite(%v): got %t, want %t", tc.d, got, tc.infinite)
+		}
+	}
+}
+
+func TestRedisLSConfirmRoots(t *testing.T) {
+	testRedisLSConfirmRoots(t)
+}
+
+func TestRedisLSConfirmRootsTransactionalRelease(t *testing.T) {
+	testRedisLSConfirmRoots(t, WithTransactionalRelease())
+}
+
+func testRedisLSConfirmRoots(t *testing.T, opts ...Option) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(opts...)
+
+	for _, details := range []webdav.LockDetails{
+		{Root: "/src", Duration: time.Minute},
+		{Root: "/dst", Duration: infiniteTimeout, ZeroDepth: true},
+		{Root: "/old", Duration: time.Second},
+	} {
+		if _, err := r.Create(now, details); err != nil {
+			t.Fatalf("Create %q: %v", details.Root, err)
+		}
+	}
+
+	release, err := r.ConfirmRoots(now, []string{"/src/", "/dst", "/dst"})
+	if err != nil {
+		t.Fatalf("ConfirmRoots: %v", err)
+	}
+	for _, name := range []string{"/src", "/dst"} {
+		if n := getByName(r, name); n == nil || !n.held {
+			t.Fatalf("getByName %q: got %+v, want held", name, n)
+		}
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+
+	if _, err := r.ConfirmRoots(now, []string{"/src"}); err != webdav.ErrLocked {
+		t.Fatalf("ConfirmRoots: got %v, want webdav.ErrLocked", err)
+	}
+	release()
+
+	// Ancestors without an explicit lock and expired locks can't be held,
+	// and nothing is held if any root fails.
+	for _, roots := range [][]string{{"/src", "/"}, {"/src", "/nope"}, {"/src", "/old"}} {
+		if _, err := r.ConfirmRoots(now.Add(time.Second), roots); err != webdav.ErrConfirmationFailed {
+			t.Fatalf("ConfirmRoots %q: got %v, want webdav.ErrConfirmationFailed", roots, err)
+		}
+		if n := getByName(r, "/src"); n == nil || n.held {
+			t.Fatalf("getByName /src: got %+v, want not held", n)
+		}
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+}
+
+func TestRedisLSScriptErrors(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// With WithTransactionalRelease the release runs without scripts, but
+	// fails the same way.
+	noEval := NewRedisLSWithConns(func() (redis.Conn, error) {
+		return denyConn{testPool(r).Get(), map[string]bool{"EVAL": true, "EVALSHA": true}}, nil
+	}, func(conn redis.Conn) {
+		conn.Close()
+	}, r.prefix, WithTransactionalRelease())
+
+	// Releasing a node that is not held violates the held state invariant.
+	for _, ls := range []*RedisLS{r, noEval} {
+		_, err := ls.do(ls.scripts.release, ls.prefix, "/a")
+		if !errors.Is(err, ErrInconsistentHeldState) {
+			t.Fatalf("release: got %v, want ErrInconsistentHeldState", err)
+		}
+		var scriptErr *ScriptError
+		if !errors.As(err, &scriptErr) || scriptErr.Script != "release" {
+			t.Fatalf("release: got %#v, want a *ScriptError for release", err)
+		}
+	}
+
+	// Definitive results are not script errors.
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != webdav.ErrLocked {
+		t.Fatalf("Create: got %v, want webdav.ErrLocked", err)
+	}
+
+	want := map[string]uint64{"release": 1}
+	if got := r.Scoped("other:").ScriptErrors(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ScriptErrors: got %v, want %v", got, want)
+	}
+}
+
+func TestRedisLSHeldConfirmRetry(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	for _, maxWait := range []time.Duration{0, 5 * time.Second} {
+		r := NewTestRedisLS(WithHeldConfirmRetry(maxWait))
+
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		release, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+		if err != nil {
+			t.Fatalf("Confirm: %v", err)
+		}
+
+		// A condition that matches no lock fails without waiting for the
+		// hold.
+		start := time.Now()
+		if _, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: "missing"}); err != webdav.ErrConfirmationFailed {
+			t.Fatalf("Confirm (wait %v, wrong token): got %v, want %v", maxWait, err, webdav.ErrConfirmationFailed)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Confirm (wait %v, wrong token): took %v", maxWait, elapsed)
+		}
+
+		if maxWait == 0 {
+			// By default a Confirm during the hold fails like a wrong token.
+			if _, err := r.Confirm(now, "/a/c", "", webdav.Condition{Token: token}); err != webdav.ErrConfirmationFailed {
+				t.Fatalf("Confirm (held): got %v, want %v", err, webdav.ErrConfirmationFailed)
+			}
+			release()
+			continue
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			release()
+		}()
+		second, err := r.Confirm(now, "/a/c", "", webdav.Condition{Token: token})
+		if err != nil {
+			t.Fatalf("Confirm (held): %v", err)
+		}
+		if time.Since(start) < 50*time.Millisecond {
+			t.Fatalf("Confirm (held): did not wait for the release")
+		}
+
+		// A hold that outlasts maxWait still fails, and so does a canceled
+		// context.
+		short := NewRedisLS(testPool(r), r.prefix, WithHeldConfirmRetry(50*time.Millisecond))
+		if _, err := short.Confirm(now, "/a", "", webdav.Condition{Token: token}); err != webdav.ErrConfirmationFailed {
+			t.Fatalf("Confirm (timeout): got %v, want %v", err, webdav.ErrConfirmationFailed)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := r.WithContext(ctx).Confirm(now, "/a", "", webdav.Condition{Token: token}); err != context.Canceled {
+			t.Fatalf("Confirm (canceled): got %v, want context.Canceled", err)
+		}
+		second()
+
+		if err := r.consistent(); err != nil {
+			t.Fatalf("inconsistent state: %v", err)
+		}
+	}
+}
+
+func TestRedisLSConfirmWithTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if _, err := r.ConfirmWithTimeout(now, "/a", "", 0, webdav.Condition{Token: token}); err == nil {
+		t.Fatalf("ConfirmWithTimeout: got nil, want an error for a zero maxHold")
+	}
+
+	leaked, err := r.ConfirmWithTimeout(now, "/a", "/a/b", 5*time.Second, webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("ConfirmWithTimeout: %v", err)
+	}
+	if err := r.Unlock(now, token); err != webdav.ErrLocked {
+		t.Fatalf("Unlock: got %v, want webdav.ErrLocked", err)
+	}
+
+	if n, err := r.SweepHolds(now.Add(4 * time.Second)); err != nil || n != 0 {
+		t.Fatalf("SweepHolds: got %d, %v, want 0", n, err)
+	}
+	if n, err := r.SweepHolds(now.Add(5 * time.Second)); err != nil || n != 1 {
+		t.Fatalf("SweepHolds: got %d, %v, want 1", n, err)
+	}
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+
+	// The node is held again, so the leaked release must not release it.
+	release, err := r.ConfirmWithTimeout(now, "/a", "", time.Minute, webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("ConfirmWithTimeout: %v", err)
+	}
+	leaked()
+	if n := getByName(r, "/a"); n == nil || !n.held {
+		t.Fatalf("getByName: got %+v, want held", n)
+	}
+
+	release()
+	if err := r.consistent(); err != nil {
+		t.Fatalf("inconsistent state: %v", err)
+	}
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+}
+
+func TestRedisLSIterLocks(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for i := 0; i < 250; i++ {
+		if _, err := r.Create(now, webdav.LockDetails{Root: "/l/" + strconv.Itoa(i), Duration: time.Minute}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/expired", Duration: time.Second}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	now = now.Add(time.Second)
+
+	want, err := r.ListLocks(now)
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+
+	seq, iterErr := r.IterLocks(now)
+	seen := map[string]LockInfo{}
+	seq(func(info LockInfo) bool {
+		seen[info.Token] = info
+		return true
+	})
+	if err := iterErr(); err != nil {
+		t.Fatalf("IterLocks: %v", err)
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("IterLocks: got %d locks, want %d", len(seen), len(want))
+	}
+	for _, info := range want {
+		if !reflect.DeepEqual(seen[info.Token], info) {
+			t.Fatalf("IterLocks: got %+v, want %+v", seen[info.Token], info)
+		}
+	}
+
+	n := 0
+	seq(func(info LockInfo) bool {
+		n++
+		return n < 10
+	})
+	if err := iterErr(); err != nil || n != 10 {
+		t.Fatalf("IterLocks (stopped): got %d locks, %v, want 10, nil", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	seq, iterErr = r.WithContext(ctx).IterLocks(now)
+	n = 0
+	seq(func(info LockInfo) bool {
+		n++
+		cancel()
+		return true
+	})
+	if err := iterErr(); !errors.Is(err, context.Canceled) || n >= len(want) {
+		t.Fatalf("IterLocks (canceled): got %d locks, %v, want fewer than %d, %v", n, err, len(want), context.Canceled)
+	}
+
+	dialErr := errors.New("dial failed")
+	r = NewRedisLSWithConns(func() (redis.Conn, error) {
+		return nil, dialErr
+	}, func(redis.Conn) {}, "webdavredislstest:")
+	seq, iterErr = r.IterLocks(now)
+	seq(func(info LockInfo) bool {
+		t.Fatalf("IterLocks: yielded %+v without a connection", info)
+		return false
+	})
+	if err := iterErr(); err != dialErr {
+		t.Fatalf("IterLocks: got %v, want %v", err, dialErr)
+	}
+}
+
+func TestRedisLSStaleHeldLocks(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	tokenA, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	tokenB, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	releaseA, err := r.Confirm(now, "/a", "", webdav.Condition{Token: tokenA})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	releaseB, err := r.Confirm(now.Add(30*time.Second), "/b", "", webdav.Condition{Token: tokenB})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+
+	locks, err := r.StaleHeldLocks(now.Add(40*time.Second), 20*time.Second)
+	if err != nil {
+		t.Fatalf("StaleHeldLocks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Token != tokenA || !locks[0].HeldSince.Equal(now) {
+		t.Fatalf("StaleHeldLocks: got %+v, want /a held since %v", locks, now)
+	}
+
+	releaseA()
+	releaseB()
+
+	info, err := r.GetLock(now, tokenA)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if !info.HeldSince.IsZero() {
+		t.Fatalf("GetLock: got HeldSince %v, want zero", info.HeldSince)
+	}
+	locks, err = r.StaleHeldLocks(now.Add(time.Hour), 0)
+	if err != nil || len(locks) != 0 {
+		t.Fatalf("StaleHeldLocks: got %+v, %v, want none", locks, err)
+	}
+}
+
+func TestRedisLSCreateWithMeta(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	meta := map[string]string{"service": "indexer", "host": "worker-1"}
+	token, err := r.CreateWithMeta(now, "/a", time.Minute, true, meta)
+	if err != nil {
+		t.Fatalf("CreateWithMeta: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	info, err := r.GetLock(now, token)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if !reflect.DeepEqual(info.Meta, meta) || info.Details.OwnerXML != "" || !info.Details.ZeroDepth {
+		t.Fatalf("GetLock: got %+v, want meta %v", info, meta)
+	}
+
+	if _, err := r.CreateWithMeta(now, "/a", time.Minute, true, nil); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("CreateWithMeta: got %v, want webdav.ErrLocked", err)
+	}
+
+	// The node of /a outlives the lock because /a/b is still locked, so its
+	// metadata must not leak into the next lock on /a.
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	token, err = r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: "<owner/>", ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	info, err = r.GetLock(now, token)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if info.Meta != nil || info.Details.OwnerXML != "<owner/>" {
+		t.Fatalf("GetLock: got %+v, want no meta", info)
+	}
+}
+
+func TestRedisLSWithConns(t *testing.T) {
+	now := time.Unix(0, 0)
+	pool := testPool(NewTestRedisLS())
+
+	// A single shared connection, guarded by getConn and releaseConn.
+	shared := pool.Get()
+	defer shared.Close()
+	var mu sync.Mutex
+	gets, releases := 0, 0
+	getConn := func() (redis.Conn, error) {
+		mu.Lock()
+		gets++
+		return shared, nil
+	}
+	releaseConn := func(conn redis.Conn) {
+		releases++
+		mu.Unlock()
+	}
+
+	r := NewRedisLSWithConns(getConn, releaseConn, "webdavredislstest:")
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if gets == 0 || gets != releases {
+		t.Fatalf("got %d gets and %d releases, want the same non-zero number", gets, releases)
+	}
+
+	dialErr := errors.New("dial failed")
+	r = NewRedisLSWithConns(func() (redis.Conn, error) {
+		return nil, dialErr
+	}, func(conn redis.Conn) {
+		t.Fatalf("releaseConn called with a connection getConn didn't return")
+	}, "webdavredislstest:")
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != dialErr {
+		t.Fatalf("Create: got %v, want %v", err, dialErr)
+	}
+}
+
+func TestRedisLSMoveLock(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithRootLockPolicy(RootLockDenied))
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute, OwnerXML: "<owner/>"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	other, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	details, err := r.MoveLock(now.Add(10*time.Second), token, "/d/e/")
+	if err != nil {
+		t.Fatalf("MoveLock: %v", err)
+	}
+	want := webdav.LockDetails{Root: "/d/e", Duration: time.Minute, OwnerXML: "<owner/>"}
+	if details != want {
+		t.Fatalf("MoveLock: got %+v, want %+v", details, want)
+	}
+	info, err := r.GetLock(now, token)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if info.Details != want || !info.Expiry.Equal(now.Add(time.Minute)) {
+		t.Fatalf("GetLock: got %+v, want %+v expiring at %v", info, want, now.Add(time.Minute))
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create (old root): %v", err)
+	}
+
+	if _, err := r.MoveLock(now, token, "/c/f"); err != webdav.ErrLocked {
+		t.Fatalf("MoveLock (conflict): got %v, want webdav.ErrLocked", err)
+	}
+	if _, err := r.MoveLock(now, token, "/"); err != ErrRootLockForbidden {
+		t.Fatalf("MoveLock (root): got %v, want ErrRootLockForbidden", err)
+	}
+	if info, err := r.GetLock(now, token); err != nil || info.Details.Root != "/d/e" {
+		t.Fatalf("GetLock: got %+v, %v, want the lock at /d/e", info, err)
+	}
+
+	release, err := r.Confirm(now, "/c", "", webdav.Condition{Token: other})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if _, err := r.MoveLock(now, other, "/g"); err != webdav.ErrLocked {
+		t.Fatalf("MoveLock (held): got %v, want webdav.ErrLocked", err)
+	}
+	release()
+
+	if _, err := r.MoveLock(now, "9999", "/g"); err != webdav.ErrNoSuchLock {
+		t.Fatalf("MoveLock (no such lock): got %v, want webdav.ErrNoSuchLock", err)
+	}
+
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+}
+
+func TestRedisLSExpiryRounding(t *testing.T) {
+	now := time.Unix(3, 0)
+
+	r := NewTestRedisLS(WithExpiryRounding(10 * time.Second))
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	info, err := r.GetLock(now, token)
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if want := time.Unix(70, 0); !info.Expiry.Equal(want) {
+		t.Fatalf("GetLock: got expiry %v, want %v", info.Expiry, want)
+	}
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: 0}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create (zero duration not rounded): %v", err)
+	}
+
+	r = NewTestRedisLS(WithNoScripting(), WithExpiryRounding(10*time.Second))
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create (no scripting): %v", err)
+	}
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+	expirySec, err := redis.Int64(conn.Do("HGET", r.prefix+"n:/a", expiryKey))
+	if err != nil || expirySec != 70 {
+		t.Fatalf("expiry (no scripting): got %d, %v, want 70", expirySec, err)
+	}
+}
+
+func TestRedisLSLockedError(t *testing.T) {
+	now := time.Unix(0, 0)
+	var conflicts []LockedError
+	r := NewTestRedisLS(WithConflictHandler(func(err *LockedError) {
+		conflicts = append(conflicts, *err)
+	}))
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/c/d", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	for _, tc := range []struct {
+		root      string
+		zeroDepth bool
+		want      LockedError
+	}{
+		{"/a", true, LockedError{Root: "/a", HolderRoot: "/a", HolderToken: token}},
+		{"/a/b", true, LockedError{Root: "/a/b", HolderRoot: "/a", HolderToken: token}},
+		{"/c", false, LockedError{Root: "/c", HolderRoot: "/c"}},
+	} {
+		_, _, err := r.CreateDetails(now, webdav.LockDetails{Root: tc.root, Duration: time.Minute, ZeroDepth: tc.zeroDepth})
+		var lockedErr *LockedError
+		if !errors.As(err, &lockedErr) || *lockedErr != tc.want || !errors.Is(err, webdav.ErrLocked) {
+			t.Fatalf("CreateDetails %q: got %v, want %+v", tc.root, err, tc.want)
+		}
+	}
+
+	// Create returns the bare webdav.ErrLocked for webdav.Handler, but the
+	// conflict is still reported to the handler.
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute}); err != webdav.ErrLocked {
+		t.Fatalf("Create: got %v, want webdav.ErrLocked", err)
+	}
+	if len(conflicts) != 4 || conflicts[3].Root != "/a/b" || conflicts[3].HolderToken != token {
+		t.Fatalf("conflicts: got %+v, want 4 ending with /a/b blocked by %s", conflicts, token)
+	}
+	if got, want := conflicts[3].Error(), "webdav: locked: /a/b is blocked by the lock on /a (token "+token+")"; got != want {
+		t.Fatalf("Error: got %q, want %q", got, want)
+	}
+}
+
+func TestRedisLSConnTimeout(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithConnTimeout(20*time.Millisecond), WithRetry(3, time.Millisecond))
+	dial := testPool(r).Dial
+
+	for _, wait := range []bool{true, false} {
+		pool := &redis.Pool{
+			MaxActive: 1,
+			Wait:      wait,
+			Dial:      dial,
+		}
+		r.conns = poolConns{pool: pool}
+
+		// Exhaust the pool.
+		conn := pool.Get()
+
+		start := time.Now()
+		if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); !errors.Is(err, ErrPoolTimeout) {
+			t.Fatalf("Create (wait %t): got %v, want ErrPoolTimeout", wait, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Create (wait %t): took %v", wait, elapsed)
+		}
+
+		conn.Close()
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create (wait %t): %v", wait, err)
+		}
+		if err := r.Unlock(now, token); err != nil {
+			t.Fatalf("Unlock (wait %t): %v", wait, err)
+		}
+		pool.Close()
+	}
+}
+
+func TestRedisLSCommandTimeout(t *testing.T) {
+	// The server accepts connections and reads commands, but never replies.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", l.Addr().String())
+		},
+	}
+	defer pool.Close()
+	r := NewRedisLS(pool, "timeout:", WithCommandTimeout(50*time.Millisecond), WithRetry(3, time.Millisecond))
+
+	start := time.Now()
+	if _, err := r.Create(time.Unix(0, 0), webdav.LockDetails{Root: "/a", Duration: time.Minute}); !errors.Is(err, ErrCommandTimeout) {
+		t.Fatalf("Create: got %v, want ErrCommandTimeout", err)
+	}
+	if err := r.Flush(context.Background()); !errors.Is(err, ErrCommandTimeout) {
+		t.Fatalf("Flush: got %v, want ErrCommandTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("took %v", elapsed)
+	}
+
+	// Commands that are answered in time are not affected.
+	r = NewTestRedisLS(WithCommandTimeout(time.Second))
+	token, err := r.Create(time.Unix(0, 0), webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := r.Unlock(time.Unix(0, 0), token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+}
+
+func TestRedisLSCreateFenced(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(1000, 0)
+		r := NewTestRedisLS(append(opts, WithTokenURIScheme("urn:uuid"))...)
+		// other is another instance sharing the prefix.
+		other := NewRedisLS(testPool(r), r.prefix, opts...)
+
+		conn := r.conns.get(context.Background())
+		defer conn.Close()
+
+		last := int64(0)
+		for i, ls := range []*RedisLS{r, other, r, other, r} {
+			if i == 2 {
+				// Losing the token counter makes next_token restart low, but
+				// not the fences.
+				if _, err := conn.Do("DEL", r.prefix+nextTokenKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if i == 4 {
+				if err := r.Flush(context.Background()); err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+
+			token, fence, err := ls.CreateFenced(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+			if err != nil {
+				t.Fatalf("CreateFenced %d: %v", i, err)
+			}
+			if fence <= last {
+				t.Fatalf("CreateFenced %d: got fence %d, want more than %d", i, fence, last)
+			}
+			last = fence
+			if err := ls.Unlock(now, token); err != nil {
+				t.Fatalf("Unlock %d: %v", i, err)
+			}
+		}
+
+		if _, _, err := r.CreateFenced(now, webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != nil {
+			t.Fatalf("CreateFenced: %v", err)
+		}
+		if _, fence, err := r.CreateFenced(now, webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != webdav.ErrLocked || fence != 0 {
+			t.Fatalf("CreateFenced: got %d, %v, want 0, %v", fence, err, webdav.ErrLocked)
+		}
+	}
+}
+
+func TestRedisLSCreateWithToken(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	details := webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: "<owner/>"}
+	if err := r.CreateWithToken(now, "job-42", details); err != nil {
+		t.Fatalf("CreateWithToken: %v", err)
+	}
+	info, err := r.GetLock(now, "job-42")
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if info.Details != details {
+		t.Fatalf("GetLock: got %+v, want %+v", info.Details, details)
+	}
+
+	if err := r.CreateWithToken(now, "job-42", webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != ErrTokenExists {
+		t.Fatalf("CreateWithToken (token exists): got %v, want ErrTokenExists", err)
+	}
+	if err := r.CreateWithToken(now, "job-43", webdav.LockDetails{Root: "/a/b", Duration: time.Minute}); !errors.Is(err, webdav.ErrLocked) {
+		t.Fatalf("CreateWithToken (locked): got %v, want webdav.ErrLocked", err)
+	}
+
+	for _, token := range []string{"", "a:b", "ERR_LOCKED", "a b", "<a>", "1"} {
+		if err := r.CreateWithToken(now, token, webdav.LockDetails{Root: "/c", Duration: time.Minute}); err != ErrInvalidToken {
+			t.Fatalf("CreateWithToken %q: got %v, want ErrInvalidToken", token, err)
+		}
+	}
+
+	// Reserved numbers can't be handed out by Create.
+	first, err := r.ReserveTokens(1)
+	if err != nil {
+		t.Fatalf("ReserveTokens: %v", err)
+	}
+	reserved := strconv.FormatInt(first, 10)
+	if err := r.CreateWithToken(now, reserved, webdav.LockDetails{Root: "/c", Duration: time.Minute}); err != nil {
+		t.Fatalf("CreateWithToken %q: %v", reserved, err)
+	}
+
+	// The token of an expired lock can be reused.
+	if err := r.CreateWithToken(now, "job-44", webdav.LockDetails{Root: "/d", Duration: time.Second}); err != nil {
+		t.Fatalf("CreateWithToken: %v", err)
+	}
+	if err := r.CreateWithToken(now.Add(time.Second), "job-44", webdav.LockDetails{Root: "/e", Duration: time.Minute}); err != nil {
+		t.Fatalf("CreateWithToken (expired): %v", err)
+	}
+
+	if err := r.Unlock(now, "job-42"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := r.Check(now.Add(time.Second)); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+}
+
+func TestRedisLSStatsInterval(t *testing.T) {
+	now := time.Now()
+	statsc := make(chan LockStats, 100)
+	r := NewTestRedisLS(WithStatsInterval(5*time.Millisecond, func(stats LockStats) {
+		statsc <- stats
+	}))
+
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		var stats LockStats
+		select {
+		case stats = <-statsc:
+		case <-timeout:
+			t.Fatalf("no stats with the lock exported")
+		}
+		if stats.Locks == 1 {
+			break
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close (again): %v", err)
+	}
+	for len(statsc) > 0 {
+		<-statsc
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(statsc) != 0 {
+		t.Fatalf("stats exported after Close")
+	}
+}
+
+func TestRedisLSIsLocked(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for _, details := range []webdav.LockDetails{
+		{Root: "/a", Duration: time.Minute},
+		{Root: "/b", Duration: time.Minute, ZeroDepth: true},
+		{Root: "/c/d", Duration: time.Second},
+	} {
+		if _, err := r.Create(now, details); err != nil {
+			t.Fatalf("Create %q: %v", details.Root, err)
+		}
+	}
+	now = now.Add(time.Second)
+
+	for name, want := range map[string]bool{
+		"/":      false,
+		"/a":     true,
+		"/a/x/y": true,
+		"/ab":    false,
+		"/b":     true,
+		"/b/x":   false,
+		"/c":     false,
+		"/c/d":   false,
+	} {
+		locked, err := r.IsLocked(now, name)
+		if err != nil || locked != want {
+			t.Fatalf("IsLocked %q: got %t, %v, want %t", name, locked, err, want)
+		}
+	}
+}
+
+// sourceCommands returns the sorted set of Redis commands issued in the
+// non-test files matching pattern other than skip, found with re.
+func sourceCommands(t *testing.T, pattern string, re *regexp.Regexp, skip ...string) []string {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") || file == "permissions.go" || containsString(skip, file) {
+			continue
+		}
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range re.FindAllStringSubmatch(string(src), -1) {
+			seen[m[1]] = true
+		}
+	}
+	var commands []string
+	for command := range seen {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+func TestRequiredCommands(t *testing.T) {
+	lua := sourceCommands(t, "lock_lua.go", regexp.MustCompile(`redis\.call\("([A-Z]+)"`))
+	if !reflect.DeepEqual(lua, luaCommands) {
+		t.Fatalf("luaCommands: got %v, want %v", luaCommands, lua)
+	}
+
+	goRe := regexp.MustCompile(`(?:Do|DoContext|doContext|Send|queue)\((?:conn, ctx, |ctx, conn, )?"([A-Z]+)"`)
+	tx := sourceCommands(t, "noscript.go", goRe)
+	if !reflect.DeepEqual(tx, txCommands) {
+		t.Fatalf("txCommands: got %v, want %v", txCommands, tx)
+	}
+	var other []string
+	for _, command := range sourceCommands(t, "*.go", goRe, "noscript.go") {
+		// SCRIPT is only used by the script cache check.
+		if command != "SCRIPT" {
+			other = append(other, command)
+		}
+	}
+	if want := sortedStrings(append(append([]string{}, goCommands...), releaseHistoryCommands...)); !reflect.DeepEqual(other, want) {
+		t.Fatalf("goCommands and releaseHistoryCommands: got %v, want %v", want, other)
+	}
+
+	r := NewTestRedisLS()
+	got := r.RequiredCommands()
+	if !containsString(got, "EVALSHA") || !containsString(got, "ZSCAN") || containsString(got, "MULTI") || containsString(got, "SCRIPT|LOAD") {
+		t.Fatalf("RequiredCommands: got %v", got)
+	}
+	if !sort.StringsAreSorted(got) {
+		t.Fatalf("RequiredCommands: got %v, want it sorted", got)
+	}
+
+	r = NewTestRedisLS(WithNoScripting())
+	got = r.RequiredCommands()
+	if containsString(got, "EVALSHA") || containsString(got, "ZSCAN") || !containsString(got, "MULTI") || !containsString(got, "INCRBY") {
+		t.Fatalf("RequiredCommands WithNoScripting: got %v", got)
+	}
+	if containsString(got, "LRANGE") {
+		t.Fatalf("RequiredCommands: got %v, want no LRANGE without WithReleaseHistory", got)
+	}
+
+	r = NewTestRedisLS(WithReleaseHistory(10))
+	if got = r.RequiredCommands(); !containsString(got, "LRANGE") {
+		t.Fatalf("RequiredCommands WithReleaseHistory: got %v", got)
+	}
+}
+
+func sortedStrings(values []string) []string {
+	sort.Strings(values)
+	return values
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// denyConn is a redis.Conn that answers the commands in deny with a NOPERM
+// error reply and passes the others on.
+type denyConn struct {
+	redis.Conn
+	deny map[string]bool
+}
+
+func (c denyConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if len(args) > 0 {
+		if sub, ok := args[0].(string); ok && c.deny[commandName+"|"+sub] {
+			return nil, redis.Error("NOPERM this user has no permissions to run the '" + strings.ToLower(commandName+"|"+sub) + "' command")
+		}
+	}
+	if c.deny[commandName] {
+		return nil, redis.Error("NOPERM this user has no permissions to run the '" + strings.ToLower(commandName) + "' command")
+	}
+	return c.Conn.Do(commandName, args...)
+}
+
+// arityConn is a redis.Conn that records the commands Redis rejected for
+// their number of arguments.
+type arityConn struct {
+	redis.Conn
+	rejected *[]string
+}
+
+func (c arityConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	if redisErr, ok := err.(redis.Error); ok && strings.Contains(string(redisErr), "wrong number of arguments") {
+		*c.rejected = append(*c.rejected, commandName)
+	}
+	return reply, err
+}
+
+func TestRedisLSCheckPermissions(t *testing.T) {
+	r := NewTestRedisLS()
+	pool := testPool(r)
+
+	if err := r.CheckPermissions(context.Background()); err != nil {
+		t.Fatalf("CheckPermissions: %v", err)
+	}
+
+	// Redis checks the number of arguments before the ACL, so a probe with
+	// the wrong number would never be denied.
+	var rejected []string
+	all := NewRedisLSWithConns(func() (redis.Conn, error) {
+		return arityConn{Conn: pool.Get(), rejected: &rejected}, nil
+	}, func(conn redis.Conn) {
+		conn.Close()
+	}, r.prefix, WithScriptCacheCheck(time.Minute), WithReleaseHistory(10), WithTransactionalRelease())
+	if err := all.CheckPermissions(context.Background()); err != nil {
+		t.Fatalf("CheckPermissions: %v", err)
+	}
+	if len(rejected) != 0 {
+		t.Fatalf("CheckPermissions: probes of %v have the wrong number of arguments", rejected)
+	}
+
+	conn := pool.Get()
+	exists, err := redis.Bool(conn.Do("EXISTS", r.prefix+"permissions-probe"))
+	conn.Close()
+	if err != nil || exists {
+		t.Fatalf("probe key: got %t, %v, want it removed", exists, err)
+	}
+
+	deny := map[string]bool{"ZSCAN": true, "SCRIPT|LOAD": true, "HINCRBY": true, "LPUSH": true}
+	r = NewRedisLSWithConns(func() (redis.Conn, error) {
+		return denyConn{Conn: pool.Get(), deny: deny}, nil
+	}, func(conn redis.Conn) {
+		conn.Close()
+	}, r.prefix, WithScriptCacheCheck(time.Minute))
+
+	err = r.CheckPermissions(context.Background())
+	if !errors.Is(err, ErrCommandsDenied) {
+		t.Fatalf("CheckPermissions: got %v, want ErrCommandsDenied", err)
+	}
+	if want := "webdavredisls: redis commands denied: HINCRBY, LPUSH, SCRIPT|LOAD, ZSCAN"; err.Error() != want {
+		t.Fatalf("CheckPermissions: got %q, want %q", err, want)
+	}
+}
+
+func TestRedisLSCompactExpirySet(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for _, root := range []string{"/a", "/b"} {
+		if _, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute}); err != nil {
+			t.Fatalf("Create %q: %v", root, err)
+		}
+	}
+
+	removed, err := r.CompactExpirySet(now)
+	if err != nil || removed != 0 {
+		t.Fatalf("CompactExpirySet: got %d, %v, want 0", removed, err)
+	}
+
+	conn := r.conns.get(context.Background())
+	defer conn.Close()
+
+	// Entries left behind by a remove that did not get to ZREM.
+	if _, err := conn.Do("ZADD", r.prefix+expiryZSetKey, 30, "/c", 3600, "/d/e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(now); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("Check: got %v, want ErrInconsistent", err)
+	}
+
+	removed, err = r.CompactExpirySet(now)
+	if err != nil || removed != 2 {
+		t.Fatalf("CompactExpirySet: got %d, %v, want 2", removed, err)
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if n := len(byExpiryAll(r)); n != 2 {
+		t.Fatalf("byExpiryAll: got %d nodes, want 2", n)
+	}
+
+	// Expired locks are collected after compacting.
+	removed, err = r.CompactExpirySet(now.Add(time.Minute))
+	if err != nil || removed != 0 {
+		t.Fatalf("CompactExpirySet: got %d, %v, want 0", removed, err)
+	}
+	if n := len(byExpiryAll(r)); n != 0 {
+		t.Fatalf("byExpiryAll: got %d nodes, want 0", n)
+	}
+}
+
+func TestRedisLSOrphanedExpiryEntry(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(0, 0)
+		r := NewTestRedisLS(opts...)
+
+		if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Second}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		conn := r.conns.get(context.Background())
+		// Entries without a node and on a node that is not locked.
+		_, err := conn.Do("ZADD", r.prefix+expiryZSetKey, 1, "/c", 1, "/a")
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(time.Second)
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := r.Check(now); err != nil && !errors.Is(err, ErrScriptingDisabled) {
+			t.Fatalf("Check: %v", err)
+		}
+		if nodes := byExpiryAll(r); len(nodes) != 1 || nodes[0].name != "/a" {
+			t.Fatalf("byExpiryAll: got %v, want /a", nodes)
+		}
+		if err := r.Unlock(now, token); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+	}
+}
+
+func TestRedisLSDebugAssertions(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithDebugAssertions())
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	release, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+	if err := r.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	token, err = r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	conn := r.conns.get(context.Background())
+	_, err = conn.Do("HSET", r.byNameKey("/a"), refCountKey, 0)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Unlock(now, token)
+	if err == nil || !strings.Contains(err.Error(), "assertion failed: negative refcount: /a") {
+		t.Fatalf("Unlock: got %v, want a failed assertion", err)
+	}
+}
+
+func TestRedisLSLocksMatching(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for _, details := range []webdav.LockDetails{
+		{Root: "/a", Duration: time.Minute, ZeroDepth: true},
+		{Root: "/ab", Duration: time.Minute},
+		{Root: "/a/b/c", Duration: time.Minute},
+		{Root: "/a*x", Duration: time.Minute},
+		{Root: "/a/d", Duration: time.Second},
+		{Root: "/b", Duration: time.Minute},
+	} {
+		if _, err := r.Create(now, details); err != nil {
+			t.Fatalf("Create %q: %v", details.Root, err)
+		}
+	}
+	now = now.Add(time.Second)
+
+	for pathPrefix, want := range map[string][]string{
+		"/":    {"/a", "/a*x", "/a/b/c", "/ab", "/b"},
+		"/a":   {"/a", "/a*x", "/a/b/c", "/ab"},
+		"/a/":  {"/a/b/c"},
+		"/a/b": {"/a/b/c"},
+		"/a*":  {"/a*x"},
+		"/c":   nil,
+	} {
+		locks, err := r.LocksMatching(now, pathPrefix)
+		if err != nil {
+			t.Fatalf("LocksMatching %q: %v", pathPrefix, err)
+		}
+		var roots []string
+		for _, lock := range locks {
+			roots = append(roots, lock.Details.Root)
+		}
+		if !reflect.DeepEqual(roots, want) {
+			t.Fatalf("LocksMatching %q: got %q, want %q", pathPrefix, roots, want)
+		}
+	}
+}
+
+func TestRedisLSCreationTimestamps(t *testing.T) {
+	for _, opts := range [][]Option{{WithCreationTimestamps()}, {WithCreationTimestamps(), WithNoScripting()}} {
+		created := time.Unix(10, 0)
+		r := NewTestRedisLS(opts...)
+
+		token, err := r.Create(created, webdav.LockDetails{Root: "/a/b", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		now := created.Add(50 * time.Second)
+		if _, err := r.Refresh(now, token, time.Minute); err != nil {
+			t.Fatalf("Refresh: %v", err)
+		}
+
+		info, err := r.GetLock(now, token)
+		if err != nil {
+			if errors.Is(err, ErrScriptingDisabled) {
+				continue
+			}
+			t.Fatalf("GetLock: %v", err)
+		}
+		if !info.CreatedAt.Equal(created) {
+			t.Fatalf("GetLock: got CreatedAt %v, want %v", info.CreatedAt, created)
+		}
+
+		locks, err := r.ListLocks(now)
+		if err != nil || len(locks) != 1 || !locks[0].CreatedAt.Equal(created) {
+			t.Fatalf("ListLocks: got %v, %v, want CreatedAt %v", locks, err, created)
+		}
+
+		if _, err := r.MoveLock(now, token, "/c"); err != nil {
+			t.Fatalf("MoveLock: %v", err)
+		}
+		info, err = r.GetLock(now, token)
+		if err != nil || !info.CreatedAt.Equal(created) {
+			t.Fatalf("GetLock after MoveLock: got %v, %v, want CreatedAt %v", info.CreatedAt, err, created)
+		}
+	}
+
+	now := time.Unix(10, 0)
+	r := NewTestRedisLS()
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	info, err := r.GetLock(now, token)
+	if err != nil || !info.CreatedAt.IsZero() {
+		t.Fatalf("GetLock: got CreatedAt %v, %v, want the zero time", info.CreatedAt, err)
+	}
+}
+
+func TestRedisLSScriptBudget(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(0, 0)
+		collected := 0
+		r := NewTestRedisLS(append(opts,
+			WithScriptBudget(2, 2),
+			WithExpiryHandler(func(LockInfo) { collected++ }),
+		)...)
+
+		var token string
+		for i := 0; i < 5; i++ {
+			root := fmt.Sprintf("/a/%d", i)
+			tok, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Second})
+			if err != nil {
+				t.Fatalf("Create %q: %v", root, err)
+			}
+			if i == 0 {
+				token = tok
+			}
+		}
+		if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b/c", Duration: time.Second}); err != ErrPathTooDeep {
+			t.Fatalf("Create: got %v, want ErrPathTooDeep", err)
+		}
+		if _, err := r.MoveLock(now, token, "/a/b/c"); err != ErrPathTooDeep {
+			t.Fatalf("MoveLock: got %v, want ErrPathTooDeep", err)
+		}
+		if n := getByToken(r, token); n == nil || n.name != "/a/0" {
+			t.Fatalf("getByToken: got %v, want the lock at /a/0", n)
+		}
+
+		now = now.Add(time.Second)
+		for i, want := range []int{2, 4, 5} {
+			root := fmt.Sprintf("/b/%d", i)
+			if _, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute}); err != nil {
+				t.Fatalf("Create %q: %v", root, err)
+			}
+			if collected != want {
+				t.Fatalf("collected %d locks, want %d", collected, want)
+			}
+		}
+	}
+}
+
+func TestRedisLSScriptBusy(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	for _, reply := range []string{
+		"BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSCRIPT.",
+		"ERR Error running script (call to f_1): @user_script:1: Script killed by user with SCRIPT KILL...",
+	} {
+		r := NewRedisLS(&redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return &errorReplyConn{reply: reply}, nil
+			},
+		}, "webdavredislstest:", WithAlwaysEval())
+
+		_, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if !errors.Is(err, ErrScriptBusy) {
+			t.Fatalf("Create %q: got %v, want ErrScriptBusy", reply, err)
+		}
+	}
+}
+
+func TestRedisLSPrefixCollision(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	app := r.Scoped(r.prefix + "app")
+	app2 := r.Scoped(r.prefix + "app2")
+	for _, s := range []*RedisLS{app, app2} {
+		if err := s.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	for _, s := range []*RedisLS{app, app2} {
+		root := "/" + strings.TrimPrefix(s.prefix, r.prefix)
+		if _, err := s.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute}); err != nil {
+			t.Fatalf("Create %q: %v", root, err)
+		}
+	}
+
+	for _, s := range []*RedisLS{app, app2} {
+		want := []string{"/" + strings.TrimPrefix(s.prefix, r.prefix)}
+		roots := func(locks []LockInfo) []string {
+			var roots []string
+			for _, lock := range locks {
+				roots = append(roots, lock.Details.Root)
+			}
+			return roots
+		}
+
+		locks, err := s.ListLocks(now)
+		if err != nil || !reflect.DeepEqual(roots(locks), want) {
+			t.Fatalf("ListLocks %q: got %q, %v, want %q", s.prefix, roots(locks), err, want)
+		}
+		locks, err = s.LocksMatching(now, "/")
+		if err != nil || !reflect.DeepEqual(roots(locks), want) {
+			t.Fatalf("LocksMatching %q: got %q, %v, want %q", s.prefix, roots(locks), err, want)
+		}
+		locks, err = s.ExpiringWithin(now, time.Hour)
+		if err != nil || !reflect.DeepEqual(roots(locks), want) {
+			t.Fatalf("ExpiringWithin %q: got %q, %v, want %q", s.prefix, roots(locks), err, want)
+		}
+		seq, iterErr := s.IterLocks(now)
+		locks = nil
+		seq(func(lock LockInfo) bool {
+			locks = append(locks, lock)
+			return true
+		})
+		if err := iterErr(); err != nil || !reflect.DeepEqual(roots(locks), want) {
+			t.Fatalf("IterLocks %q: got %q, %v, want %q", s.prefix, roots(locks), err, want)
+		}
+		if err := s.Check(now); err != nil {
+			t.Fatalf("Check %q: %v", s.prefix, err)
+		}
+		if dangling, err := s.DanglingNodes(now); err != nil || len(dangling) != 0 {
+			t.Fatalf("DanglingNodes %q: got %q, %v", s.prefix, dangling, err)
+		}
+		if stats, err := s.Stats(now); err != nil || stats.Locks != 1 {
+			t.Fatalf("Stats %q: got %+v, %v, want 1 lock", s.prefix, stats, err)
+		}
+	}
+
+	if err := app.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if locks, err := app2.ListLocks(now); err != nil || len(locks) != 1 {
+		t.Fatalf("ListLocks after Flush: got %v, %v, want 1 lock", locks, err)
+	}
+	if err := app2.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func TestRedisLSNamespacePrefixSeparator(t *testing.T) {
+	r := NewTestRedisLS(WithNamespacePrefixSeparator(":"))
+
+	testCases := []struct {
+		prefix string
+		valid  bool
+	}{
+		{"app:", true},
+		{"koofr:webdav:app2:", true},
+		{"app", false},
+		{"app:n:", false},
+		{"app:t:x:", false},
+		{"n:app:", false},
+		{"app:nt:", true},
+	}
+
+	for _, tc := range testCases {
+		func() {
+			defer func() {
+				if p := recover(); (p == nil) != tc.valid {
+					t.Fatalf("Scoped %q: got panic %v, want valid %t", tc.prefix, p, tc.valid)
+				}
+			}()
+			r.Scoped(tc.prefix)
+		}()
+	}
+}
+
+func TestRedisLSCountLocksUnder(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	for _, name := range lockTestNames {
+		_, err := r.Create(now, webdav.LockDetails{
+			Root:      name,
+			Duration:  infiniteTimeout,
+			ZeroDepth: lockTestZeroDepth(name),
+		})
+		if err != nil {
+			t.Fatalf("creating lock for %q: %v", name, err)
+		}
+	}
+
+	for _, root := range []string{"/", "/_", "/_/z", "/_/z/_", "/z", "/z/_/i", "/x", "/_/z/i/x", "/i/"} {
+		want := 0
+		for _, name := range lockTestNames {
+			if name == path.Clean(root) || strings.HasPrefix(name, strings.TrimSuffix(root, "/")+"/") {
+				want++
+			}
+		}
+		got, err := r.CountLocksUnder(now, root)
+		if err != nil || got != want {
+			t.Fatalf("CountLocksUnder %q: got %d, %v, want %d", root, got, err, want)
+		}
+		locks, err := r.ListLocksUnder(now, root, -1)
+		if err != nil || len(locks) != want {
+			t.Fatalf("ListLocksUnder %q: got %d locks, %v, want %d", root, len(locks), err, want)
+		}
+	}
+}
+
+func TestRedisLSTokenCounterLost(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(0, 0)
+		r := NewTestRedisLS(opts...)
+
+		var tokens []string
+		for _, root := range []string{"/a", "/b", "/c"} {
+			token, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute})
+			if err != nil {
+				t.Fatalf("Create %s: %v", root, err)
+			}
+			tokens = append(tokens, token)
+		}
+
+		conn := r.conns.get(context.Background())
+		_, err := conn.Do("DEL", r.prefix+nextTokenKey)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, root := range []string{"/d", "/e"} {
+			token, err := r.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute})
+			if err != nil {
+				t.Fatalf("Create %s: %v", root, err)
+			}
+			if containsString(tokens, token) {
+				t.Fatalf("Create %s: token %s reused", root, token)
+			}
+			tokens = append(tokens, token)
+		}
+
+		for i, root := range []string{"/a", "/b", "/c", "/d", "/e"} {
+			if _, err := r.Confirm(now, root, "", webdav.Condition{Token: tokens[i]}); err != nil {
+				t.Fatalf("Confirm %s: %v", root, err)
+			}
+		}
+		if err := r.Check(now); err != nil && !errors.Is(err, ErrScriptingDisabled) {
+			t.Fatalf("Check: %v", err)
+		}
+	}
+}
+
+func TestRedisLSSetExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewTestRedisLS()
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if at, err := r.PeekExpiry(token); err != nil || !at.Equal(now.Add(time.Minute)) {
+		t.Fatalf("PeekExpiry: got %v, %v, want %v", at, err, now.Add(time.Minute))
+	}
+
+	if err := r.SetExpiry(token, now.Add(time.Hour)); err != nil {
+		t.Fatalf("SetExpiry: %v", err)
+	}
+	if at, err := r.PeekExpiry(token); err != nil || !at.Equal(now.Add(time.Hour)) {
+		t.Fatalf("PeekExpiry: got %v, %v, want %v", at, err, now.Add(time.Hour))
+	}
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if nodes := byExpiryAll(r); len(nodes) != 1 || nodes[0].name != "/a" {
+		t.Fatalf("byExpiryAll: got %v, want /a", nodes)
+	}
+	if _, err := r.Create(now.Add(2*time.Minute), webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != webdav.ErrLocked {
+		t.Fatalf("Create: got %v, want %v", err, webdav.ErrLocked)
+	}
+
+	if err := r.SetExpiry(token, now.Add(-time.Second)); err != nil {
+		t.Fatalf("SetExpiry: %v", err)
+	}
+	if at, err := r.PeekExpiry(token); err != nil || !at.Equal(now.Add(-time.Second)) {
+		t.Fatalf("PeekExpiry: got %v, %v, want %v", at, err, now.Add(-time.Second))
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.PeekExpiry(token); err != webdav.ErrNoSuchLock {
+		t.Fatalf("PeekExpiry: got %v, want %v", err, webdav.ErrNoSuchLock)
+	}
+	if err := r.SetExpiry(token, now); err != webdav.ErrNoSuchLock {
+		t.Fatalf("SetExpiry: got %v, want %v", err, webdav.ErrNoSuchLock)
+	}
+	if _, err := r.PeekExpiry(""); err != webdav.ErrNoSuchLock {
+		t.Fatalf("PeekExpiry(\"\"): got %v, want %v", err, webdav.ErrNoSuchLock)
+	}
+	if err := r.SetExpiry("", now); err != webdav.ErrNoSuchLock {
+		t.Fatalf("SetExpiry(\"\"): got %v, want %v", err, webdav.ErrNoSuchLock)
+	}
+
+	infinite, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: infiniteTimeout})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if at, err := r.PeekExpiry(infinite); err != nil || !at.IsZero() {
+		t.Fatalf("PeekExpiry: got %v, %v, want zero time", at, err)
+	}
+	if err := r.SetExpiry(infinite, now); err != ErrInfiniteLock {
+		t.Fatalf("SetExpiry: got %v, want %v", err, ErrInfiniteLock)
+	}
+
+	held, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	release, err := r.Confirm(now, "/c", "", webdav.Condition{Token: held})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if err := r.SetExpiry(held, now); err != webdav.ErrLocked {
+		t.Fatalf("SetExpiry: got %v, want %v", err, webdav.ErrLocked)
+	}
+	release()
+	if err := r.SetExpiry(held, now); err != nil {
+		t.Fatalf("SetExpiry: %v", err)
+	}
+
+	if err := NewTestRedisLS(WithNoScripting()).SetExpiry(held, now); err != ErrScriptingDisabled {
+		t.Fatalf("SetExpiry: got %v, want %v", err, ErrScriptingDisabled)
+	}
+}
+
+func TestRedisLSTokenURIScheme(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(0, 0)
+		r := NewTestRedisLS(append([]Option{WithTokenURIScheme("urn:uuid")}, opts...)...)
+
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if !strings.HasPrefix(token, "urn:uuid:") {
+			t.Fatalf("Create: got token %q, want urn:uuid: prefix", token)
+		}
+		bare := strings.TrimPrefix(token, "urn:uuid:")
+
+		for _, tok := range []string{token, bare} {
+			release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: tok})
+			if err != nil {
+				t.Fatalf("Confirm %q: %v", tok, err)
+			}
+			release()
+			if _, err := r.Refresh(now, tok, time.Minute); err != nil {
+				t.Fatalf("Refresh %q: %v", tok, err)
+			}
+		}
+		if _, err := r.Confirm(now, "/a", "", webdav.Condition{Token: "urn:uuid:"}); err != webdav.ErrConfirmationFailed {
+			t.Fatalf("Confirm: got %v, want %v", err, webdav.ErrConfirmationFailed)
+		}
+
+		if _, err := r.Create(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute}); err != webdav.ErrLocked {
+			t.Fatalf("Create: got %v, want %v", err, webdav.ErrLocked)
+		}
+		_, _, err = r.CreateDetails(now, webdav.LockDetails{Root: "/a/b", Duration: time.Minute})
+		var lockedErr *LockedError
+		if !errors.Is(err, webdav.ErrLocked) || errors.As(err, &lockedErr) && lockedErr.HolderToken != token {
+			t.Fatalf("CreateDetails: got %v, want holder token %s", err, token)
+		}
+
+		if err := r.Unlock(now, bare); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+		if err := r.Unlock(now, token); err != webdav.ErrNoSuchLock {
+			t.Fatalf("Unlock: got %v, want %v", err, webdav.ErrNoSuchLock)
+		}
+	}
+
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithTokenURIScheme("opaquelocktoken"))
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	info, err := r.GetLock(now, token)
+	if err != nil || info.Token != token {
+		t.Fatalf("GetLock: got %v, %v, want token %s", info, err, token)
+	}
+	locks, err := r.ListLocks(now)
+	if err != nil || len(locks) != 1 || locks[0].Token != token {
+		t.Fatalf("ListLocks: got %v, %v, want token %s", locks, err, token)
+	}
+	stolen, err := r.Steal(now, token, "", time.Minute, StealNewToken)
+	if err != nil || !strings.HasPrefix(stolen, "opaquelocktoken:") || stolen == token {
+		t.Fatalf("Steal: got %q, %v", stolen, err)
+	}
+	if err := r.CreateWithToken(now, "opaquelocktoken:x", webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != nil {
+		t.Fatalf("CreateWithToken: %v", err)
+	}
+	if info, err := r.GetLock(now, "x"); err != nil || info.Token != "opaquelocktoken:x" {
+		t.Fatalf("GetLock: got %v, %v, want token opaquelocktoken:x", info, err)
+	}
+}
+
+func TestRedisLSConfirmManyPartial(t *testing.T) {
+	testRedisLSConfirmManyPartial(t)
+}
+
+func TestRedisLSConfirmManyPartialTransactionalRelease(t *testing.T) {
+	testRedisLSConfirmManyPartial(t, WithTransactionalRelease())
+}
+
+func testRedisLSConfirmManyPartial(t *testing.T, opts ...Option) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(opts...)
+
+	tokenA, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	tokenB, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Minute})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	releaseB, err := r.Confirm(now, "/b", "", webdav.Condition{Token: tokenB})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+
+	names := []string{"/a/x", "/b", "/c", "/a/y", "/d"}
+	held, failed, release, err := r.ConfirmManyPartial(now, names, webdav.Condition{Token: tokenA}, webdav.Condition{Token: tokenB})
+	if err != nil {
+		t.Fatalf("ConfirmManyPartial: %v", err)
+	}
+	if !reflect.DeepEqual(held, []string{"/a/x", "/a/y"}) {
+		t.Fatalf("ConfirmManyPartial: got held %v, want [/a/x /a/y]", held)
+	}
+	if !reflect.DeepEqual(failed, []string{"/b", "/c", "/d"}) {
+		t.Fatalf("ConfirmManyPartial: got failed %v, want [/b /c /d]", failed)
+	}
+	if isHeld, err := r.IsHeld(now, tokenA); err != nil || !isHeld {
+		t.Fatalf("IsHeld: got %v, %v, want true", isHeld, err)
+	}
+
+	release()
+	releaseB()
+	for _, token := range []string{tokenA, tokenB} {
+		if isHeld, err := r.IsHeld(now, token); err != nil || isHeld {
+			t.Fatalf("IsHeld %s: got %v, %v, want false", token, isHeld, err)
+		}
+	}
+
+	held, failed, release, err = r.ConfirmManyPartial(now, []string{"/a", "/b"})
+	if err != nil || len(held) != 0 || !reflect.DeepEqual(failed, []string{"/a", "/b"}) {
+		t.Fatalf("ConfirmManyPartial: got %v, %v, %v", held, failed, err)
+	}
+	release()
+
+	if err := r.Check(now); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+}
+
+func TestRedisLSAuditHook(t *testing.T) {
+	type event struct {
+		caller string
+		op     string
+		args   []interface{}
+		result string
+		err    error
+	}
+	type callerKey struct{}
+
+	var events []event
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS(WithAuditHook(func(ctx context.Context, op string, args []interface{}, result string, err error) {
+		caller, _ := ctx.Value(callerKey{}).(string)
+		events = append(events, event{caller, op, args, result, err})
+	}))
+	view := r.WithContext(context.WithValue(context.Background(), callerKey{}, "alice"))
+
+	ownerXML := "<D:owner><D:href>alice</D:href></D:owner>"
+	token, err := view.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: ownerXML})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != webdav.ErrLocked {
+		t.Fatalf("Create: got %v, want %v", err, webdav.ErrLocked)
+	}
+	if err := view.Unlock(now, token+"0"); err != webdav.ErrNoSuchLock {
+		t.Fatalf("Unlock: got %v, want %v", err, webdav.ErrNoSuchLock)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3: %v", len(events), events)
+	}
+	if e := events[0]; e.caller != "alice" || e.op != "create" || e.result != "ok" || e.err != nil {
+		t.Fatalf("got %+v, want a successful create by alice", e)
+	}
+	for _, arg := range events[0].args {
+		if arg == ownerXML {
+			t.Fatalf("owner XML in audit args: %v", events[0].args)
+		}
+	}
+	if !reflect.DeepEqual(events[0].args[2:5], []interface{}{"/a", int64(60), false}) {
+		t.Fatalf("got args %v", events[0].args)
+	}
+	if e := events[1]; e.caller != "" || e.op != "create" || e.result != errLocked || !errors.Is(e.err, webdav.ErrLocked) {
+		t.Fatalf("got %+v, want a conflicting create", e)
+	}
+	if e := events[2]; e.caller != "alice" || e.op != "unlock" || e.result != errNoSuchLock || e.err != webdav.ErrNoSuchLock {
+		t.Fatalf("got %+v, want a failed unlock by alice", e)
+	}
+
+	r = NewTestRedisLS(WithAuditHook(func(ctx context.Context, op string, args []interface{}, result string, err error) {
+		panic("audit sink down")
+	}))
+	if _, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+}
+
+func TestRedisLSDepthConflicts(t *testing.T) {
+	// RFC 4918 section 9.10: a Depth 0 lock on a collection locks only the
+	// collection and a Depth infinity lock also all of its members. Exclusive
+	// locks conflict where one covers the root of the other.
+	tests := []struct {
+		existing, requested   string
+		existingZero, reqZero bool
+		conflict              bool
+	}{
+		{"/a", "/a", true, true, true},
+		{"/a", "/a", true, false, true},
+		{"/a", "/a", false, true, true},
+		{"/a", "/a", false, false, true},
+
+		{"/a", "/a/b", true, true, false},
+		{"/a", "/a/b", true, false, false},
+		{"/a", "/a/b", false, true, true},
+		{"/a", "/a/b", false, false, true},
+
+		{"/a", "/a/b/c", true, true, false},
+		{"/a", "/a/b/c", true, false, false},
+		{"/a", "/a/b/c", false, true, true},
+		{"/a", "/a/b/c", false, false, true},
+
+		{"/a/b", "/a", true, true, false},
+		{"/a/b", "/a", true, false, true},
+		{"/a/b", "/a", false, true, false},
+		{"/a/b", "/a", false, false, true},
+
+		{"/a/b/c", "/a", true, true, false},
+		{"/a/b/c", "/a", true, false, true},
+		{"/a/b/c", "/a", false, true, false},
+		{"/a/b/c", "/a", false, false, true},
+
+		{"/a/b", "/a/c", false, false, false},
+		{"/a", "/ab", false, false, false},
+		{"/", "/a", true, false, false},
+		{"/a", "/", true, false, true},
+	}
+
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		for _, test := range tests {
+			now := time.Unix(0, 0)
+			r := NewTestRedisLS(opts...)
+
+			if _, err := r.Create(now, webdav.LockDetails{Root: test.existing, Duration: time.Minute, ZeroDepth: test.existingZero}); err != nil {
+				t.Fatalf("Create %s: %v", test.existing, err)
+			}
+			_, err := r.Create(now, webdav.LockDetails{Root: test.requested, Duration: time.Minute, ZeroDepth: test.reqZero})
+			if test.conflict && err != webdav.ErrLocked || !test.conflict && err != nil {
+				t.Errorf("%+v: Create %s: got %v, want conflict %v", test, test.requested, err, test.conflict)
+			}
+		}
+	}
+}
+
+func TestRedisLSZeroDepthCollectionConfirm(t *testing.T) {
+	now := time.Unix(0, 0)
+	r := NewTestRedisLS()
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	// A Depth 0 lock on a collection does not cover its members.
+	if _, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token}); err != webdav.ErrConfirmationFailed {
+		t.Fatalf("Confirm /a/b: got %v, want %v", err, webdav.ErrConfirmationFailed)
+	}
+	if locked, err := r.IsLocked(now, "/a/b"); err != nil || locked {
+		t.Fatalf("IsLocked /a/b: got %v, %v, want false", locked, err)
+	}
+
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm /a: %v", err)
+	}
+	release()
+}
+
+type countConn struct {
+	redis.Conn
+	mu     *sync.Mutex
+	counts map[string]int
+}
+
+func (c countConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	name := commandName
+	if len(args) > 0 {
+		if sub, ok := args[0].(string); ok && commandName == "SCRIPT" {
+			name += "|" + sub
+		}
+	}
+	c.mu.Lock()
+	c.counts[name]++
+	c.mu.Unlock()
+	return c.Conn.Do(commandName, args...)
+}
+
+func TestRedisLSEnsureScripts(t *testing.T) {
+	pool := testPool(NewTestRedisLS())
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	r := NewRedisLSWithConns(func() (redis.Conn, error) {
+		return countConn{pool.Get(), &mu, counts}, nil
+	}, func(conn redis.Conn) {
+		conn.Close()
+	}, "webdavredislstest:")
 
 	conn := pool.Get()
-	defer conn.Close()
+	_, err := conn.Do("SCRIPT", "FLUSH")
+	conn.Close()
+	if err != nil {
+		t.Fatalf("SCRIPT FLUSH: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- r.Scoped(fmt.Sprintf("webdavredislstest:%d:", i)).EnsureScripts(context.Background())
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("EnsureScripts: %v", err)
+		}
+	}
+
+	scripts := r.scripts.all()
+	if counts["SCRIPT|LOAD"] != len(scripts) {
+		t.Fatalf("got %d SCRIPT LOAD, want %d", counts["SCRIPT|LOAD"], len(scripts))
+	}
+
+	args := []interface{}{"EXISTS"}
+	for _, script := range scripts {
+		args = append(args, script.Hash())
+	}
+	conn = pool.Get()
+	exists, err := redis.Ints(conn.Do("SCRIPT", args...))
+	conn.Close()
+	if err != nil {
+		t.Fatalf("SCRIPT EXISTS: %v", err)
+	}
+	for i, e := range exists {
+		if e != 1 {
+			t.Errorf("script %d not loaded by EnsureScripts", i)
+		}
+	}
+
+	if _, err := r.Create(time.Now(), webdav.LockDetails{Root: "/a", Duration: time.Minute}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if counts["EVAL"] != 0 {
+		t.Fatalf("got %d EVAL after EnsureScripts, want 0", counts["EVAL"])
+	}
+
+	r = NewTestRedisLS(WithNoScripting())
+	if err := r.EnsureScripts(context.Background()); err != nil {
+		t.Fatalf("EnsureScripts: %v", err)
+	}
+}
 
-	keys, err := redis.Strings(conn.Do("KEYS", prefix+"*"))
+func TestRedisLSSnapshot(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewTestRedisLS(WithCreationTimestamps())
+
+	var tokens []string
+	for i := 0; i < snapshotLimit+5; i++ {
+		token, err := r.Create(now.Add(time.Duration(i)*time.Second), webdav.LockDetails{
+			Root:     fmt.Sprintf("/%02d", i),
+			Duration: time.Duration(snapshotLimit+5-i) * time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	now = now.Add(time.Minute)
+	release, err := r.Confirm(now, "/03", "", webdav.Condition{Token: tokens[3]})
 	if err != nil {
-		panic(err)
+		t.Fatalf("Confirm: %v", err)
 	}
+	defer release()
 
-	for _, key := range keys {
-		_, err := conn.Do("DEL", key)
-		if err != nil {
-			panic(err)
+	snap, err := r.Snapshot(now)
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if snap.Stats.Locks != snapshotLimit+5 || snap.Stats.Held != 1 || snap.Stats.TokenCounter != snapshotLimit+5 || snap.Truncated {
+		t.Fatalf("Snapshot: got %+v", snap)
+	}
+	if len(snap.Held) != 1 || snap.Held[0].Token != tokens[3] {
+		t.Fatalf("Snapshot: got held %v, want %s", snap.Held, tokens[3])
+	}
+	if len(snap.SoonestExpiring) != snapshotLimit || snap.SoonestExpiring[0].Token != tokens[len(tokens)-1] {
+		t.Fatalf("Snapshot: got soonest expiring %v", snap.SoonestExpiring)
+	}
+	for i := 1; i < len(snap.SoonestExpiring); i++ {
+		if snap.SoonestExpiring[i].Expiry.Before(snap.SoonestExpiring[i-1].Expiry) {
+			t.Fatalf("Snapshot: soonest expiring not sorted: %v", snap.SoonestExpiring)
 		}
 	}
+	if len(snap.Oldest) != snapshotLimit || snap.Oldest[0].Token != tokens[0] || snap.Oldest[snapshotLimit-1].Token != tokens[snapshotLimit-1] {
+		t.Fatalf("Snapshot: got oldest %v", snap.Oldest)
+	}
 
-	return NewRedisLS(pool, prefix)
+	rec := httptest.NewRecorder()
+	DebugHandler(r).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/webdavls", nil))
+	var served Snapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("DebugHandler: got %d, %v: %s", rec.Code, err, rec.Body)
+	}
+	if served.Stats.Locks != snapshotLimit+5 || len(served.Held) != 1 {
+		t.Fatalf("DebugHandler: got %+v", served)
+	}
 }
 
-func TestRedisLSConfirm(t *testing.T) {
-	now := time.Unix(0, 0)
+func TestRedisLSCreateUntil(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(1000, 500*int64(time.Millisecond))
+		deadline := time.Unix(1037, 0)
+		r := NewTestRedisLS(append([]Option{WithExpiryRounding(10 * time.Second), WithExpiryJitter(5 * time.Second), WithMinDuration(time.Minute)}, opts...)...)
+
+		token, err := r.CreateUntil(now, "/a", deadline, false, "")
+		if err != nil {
+			t.Fatalf("CreateUntil: %v", err)
+		}
+		// The helper reads the stored duration in seconds.
+		if n := getByToken(r, token); !n.expiry.Equal(deadline) || n.details.Duration != time.Duration(37) {
+			t.Fatalf("CreateUntil: got expiry %v and duration %v, want %v and 37", n.expiry, n.details.Duration, deadline)
+		}
+		if _, err := r.CreateUntil(now, "/a", deadline, false, ""); err != webdav.ErrLocked {
+			t.Fatalf("CreateUntil: got %v, want %v", err, webdav.ErrLocked)
+		}
+
+		now = now.Add(30 * time.Second)
+		deadline = deadline.Add(time.Hour)
+		res, err := r.RefreshUntil(now, token, deadline)
+		if err != nil {
+			t.Fatalf("RefreshUntil: %v", err)
+		}
+		if !res.Expiry.Equal(deadline) || res.Details.Duration != deadline.Sub(time.Unix(now.Unix(), 0)) {
+			t.Fatalf("RefreshUntil: got %+v, want expiry %v", res, deadline)
+		}
+		if n := getByToken(r, token); !n.expiry.Equal(deadline) {
+			t.Fatalf("RefreshUntil: got expiry %v, want %v", n.expiry, deadline)
+		}
+
+		if _, err := r.CreateUntil(now, "/b", now, false, ""); err != ErrDeadlinePassed {
+			t.Fatalf("CreateUntil: got %v, want %v", err, ErrDeadlinePassed)
+		}
+		if _, err := r.RefreshUntil(now, token, now.Add(-time.Second)); err != ErrDeadlinePassed {
+			t.Fatalf("RefreshUntil: got %v, want %v", err, ErrDeadlinePassed)
+		}
+
+		if err := r.Unlock(deadline.Add(-time.Second), token); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+	}
+}
+
+func TestRedisLSReleaseHistory(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(1000, 0)
+		r := NewTestRedisLS(append([]Option{WithReleaseHistory(3)}, opts...)...)
+
+		a, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		b, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Second})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := r.Unlock(now, a); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+		if _, err := r.Create(now.Add(2*time.Second), webdav.LockDetails{Root: "/b", Duration: time.Minute}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		want := []ReleasedLock{
+			{Root: "/b", Token: b, Reason: ReleaseExpired, Time: now.Add(2 * time.Second)},
+			{Root: "/a", Token: a, Reason: ReleaseUnlocked, Time: now},
+		}
+		if got, err := r.RecentlyReleased(10); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("RecentlyReleased: got %v, %v, want %v", got, err, want)
+		}
+		if got, err := r.RecentlyReleased(1); err != nil || !reflect.DeepEqual(got, want[:1]) {
+			t.Fatalf("RecentlyReleased: got %v, %v, want %v", got, err, want[:1])
+		}
+
+		if r.noScripting {
+			continue
+		}
+
+		c, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: time.Minute})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if _, err := r.MoveLock(now, c, "/b"); err != webdav.ErrLocked {
+			t.Fatalf("MoveLock: got %v, want %v", err, webdav.ErrLocked)
+		}
+		if _, err := r.MoveLock(now, c, "/d"); err != nil {
+			t.Fatalf("MoveLock: %v", err)
+		}
+		if err := r.Unlock(now, c); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+
+		// The failed move is not recorded and the history is trimmed to 3.
+		want = []ReleasedLock{
+			{Root: "/d", Token: c, Reason: ReleaseUnlocked, Time: now},
+			{Root: "/c", Token: c, Reason: ReleaseMoved, Time: now},
+			want[0],
+		}
+		if got, err := r.RecentlyReleased(10); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("RecentlyReleased: got %v, %v, want %v", got, err, want)
+		}
+	}
+
 	r := NewTestRedisLS()
-	alice, err := r.Create(now, webdav.LockDetails{
-		Root:      "/alice",
-		Duration:  infiniteTimeout,
-		ZeroDepth: false,
-	})
-	tweedle, err := r.Create(now, webdav.LockDetails{
-		Root:      "/tweedle",
-		Duration:  infiniteTimeout,
-		ZeroDepth: false,
-	})
+	token, err := r.Create(time.Unix(1000, 0), webdav.LockDetails{Root: "/a", Duration: time.Minute})
 	if err != nil {
 		t.Fatalf("Create: %v", err)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Create: inconsistent state: %v", err)
+	if err := r.Unlock(time.Unix(1000, 0), token); err != nil {
+		t.Fatalf("Unlock: %v", err)
 	}
-
-	// Test a mismatch between name and condition.
-	_, err = r.Confirm(now, "/tweedle/dee", "", webdav.Condition{Token: alice})
-	if err != webdav.ErrConfirmationFailed {
-		t.Fatalf("Confirm (mismatch): got %v, want webdav.ErrConfirmationFailed", err)
+	if got, err := r.RecentlyReleased(10); err != nil || len(got) != 0 {
+		t.Fatalf("RecentlyReleased: got %v, %v, want nothing without WithReleaseHistory", got, err)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Confirm (mismatch): inconsistent state: %v", err)
+}
+
+func TestRedisLSRefreshWithOpts(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithNoScripting()}} {
+		now := time.Unix(1000, 0)
+		r := NewTestRedisLS(opts...)
+
+		token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: "<owner>alice</owner>", ZeroDepth: true})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		res, err := r.RefreshWithOpts(now, token, 2*time.Minute, RefreshOpts{})
+		if err != nil || res.Details.OwnerXML != "<owner>alice</owner>" || res.Details.Duration != 2*time.Minute {
+			t.Fatalf("RefreshWithOpts: got %+v, %v", res, err)
+		}
+
+		ownerXML := "<owner>bob</owner>"
+		zeroDepth := true
+		res, err = r.RefreshWithOpts(now, token, 3*time.Minute, RefreshOpts{OwnerXML: &ownerXML, ZeroDepth: &zeroDepth})
+		if err != nil {
+			t.Fatalf("RefreshWithOpts: %v", err)
+		}
+		if want := (webdav.LockDetails{Root: "/a", Duration: 3 * time.Minute, OwnerXML: ownerXML, ZeroDepth: true}); res.Details != want || !res.Expiry.Equal(now.Add(3*time.Minute)) {
+			t.Fatalf("RefreshWithOpts: got %+v, want %+v", res, want)
+		}
+		if n := getByToken(r, token); n.details.OwnerXML != ownerXML {
+			t.Fatalf("RefreshWithOpts: stored owner %q, want %q", n.details.OwnerXML, ownerXML)
+		}
+
+		// Refresh keeps the owner.
+		if details, err := r.Refresh(now, token, time.Minute); err != nil || details.OwnerXML != ownerXML {
+			t.Fatalf("Refresh: got %+v, %v", details, err)
+		}
+
+		// A depth change fails the whole refresh.
+		carol := "<owner>carol</owner>"
+		zeroDepth = false
+		if _, err := r.RefreshWithOpts(now, token, time.Hour, RefreshOpts{OwnerXML: &carol, ZeroDepth: &zeroDepth}); err != ErrDepthImmutable {
+			t.Fatalf("RefreshWithOpts: got %v, want %v", err, ErrDepthImmutable)
+		}
+		if n := getByToken(r, token); n.details.OwnerXML != ownerXML || n.details.Duration != time.Duration(60) {
+			t.Fatalf("RefreshWithOpts: got %+v, want it unchanged", n.details)
+		}
+
+		if _, err := r.RefreshWithOpts(now, "missing", time.Minute, RefreshOpts{OwnerXML: &carol}); err != webdav.ErrNoSuchLock {
+			t.Fatalf("RefreshWithOpts: got %v, want %v", err, webdav.ErrNoSuchLock)
+		}
 	}
+}
 
-	// Test two names (that fall under the same lock) in the one Confirm call.
-	release, err := r.Confirm(now, "/tweedle/dee", "/tweedle/dum", webdav.Condition{Token: tweedle})
+func TestRedisLSRefreshWithOptsOwnerStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := &memOwnerStore{docs: map[string]string{}}
+	r := NewTestRedisLS(WithOwnerStore(store))
+
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute, OwnerXML: "<owner>alice</owner>"})
 	if err != nil {
-		t.Fatalf("Confirm (twins): %v", err)
-	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Confirm (twins): inconsistent state: %v", err)
-	}
-	release()
-	if err := r.consistent(); err != nil {
-		t.Fatalf("release (twins): inconsistent state: %v", err)
+		t.Fatalf("Create: %v", err)
 	}
 
-	// Test the same two names in overlapping Confirm / release calls.
-	releaseDee, err := r.Confirm(now, "/tweedle/dee", "", webdav.Condition{Token: tweedle})
-	if err != nil {
-		t.Fatalf("Confirm (sequence #0): %v", err)
+	ownerXML := "<owner>bob</owner>"
+	res, err := r.RefreshWithOpts(now, token, time.Minute, RefreshOpts{OwnerXML: &ownerXML})
+	if err != nil || res.Details.OwnerXML != ownerXML {
+		t.Fatalf("RefreshWithOpts: got %+v, %v", res, err)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Confirm (sequence #0): inconsistent state: %v", err)
+	if want := map[string]string{"ref2": ownerXML}; !reflect.DeepEqual(store.docs, want) {
+		t.Fatalf("RefreshWithOpts: got documents %v, want %v", store.docs, want)
 	}
 
-	_, err = r.Confirm(now, "/tweedle/dum", "", webdav.Condition{Token: tweedle})
-	if err != webdav.ErrConfirmationFailed {
-		t.Fatalf("Confirm (sequence #1): got %v, want webdav.ErrConfirmationFailed", err)
+	zeroDepth := true
+	if _, err := r.RefreshWithOpts(now, token, time.Minute, RefreshOpts{OwnerXML: &ownerXML, ZeroDepth: &zeroDepth}); err != ErrDepthImmutable {
+		t.Fatalf("RefreshWithOpts: got %v, want %v", err, ErrDepthImmutable)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Confirm (sequence #1): inconsistent state: %v", err)
+	if want := map[string]string{"ref2": ownerXML}; !reflect.DeepEqual(store.docs, want) {
+		t.Fatalf("RefreshWithOpts: got documents %v, want %v", store.docs, want)
 	}
+}
 
-	releaseDee()
-	if err := r.consistent(); err != nil {
-		t.Fatalf("release (sequence #2): inconsistent state: %v", err)
-	}
+func TestRedisLSValidateToken(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewTestRedisLS()
 
-	releaseDum, err := r.Confirm(now, "/tweedle/dum", "", webdav.Condition{Token: tweedle})
+	token, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
 	if err != nil {
-		t.Fatalf("Confirm (sequence #3): %v", err)
+		t.Fatalf("Create: %v", err)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Confirm (sequence #3): inconsistent state: %v", err)
+	infinite, err := r.Create(now, webdav.LockDetails{Root: "/b", Duration: infiniteTimeout})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
 	}
 
-	// Test that you can't unlock a held lock.
-	err = r.Unlock(now, tweedle)
-	if err != webdav.ErrLocked {
-		t.Fatalf("Unlock (sequence #4): got %v, want ErrLocked", err)
+	check := func(when time.Time, token string, wantExists, wantHeld bool) {
+		t.Helper()
+		exists, held, err := r.ValidateToken(when, token)
+		if err != nil || exists != wantExists || held != wantHeld {
+			t.Fatalf("ValidateToken(%q): got %t, %t, %v, want %t, %t", token, exists, held, err, wantExists, wantHeld)
+		}
 	}
 
-	releaseDum()
-	if err := r.consistent(); err != nil {
-		t.Fatalf("release (sequence #5): inconsistent state: %v", err)
-	}
+	check(now, token, true, false)
+	check(now.Add(time.Hour), infinite, true, false)
+	check(now, "missing", false, false)
+	check(now, "", false, false)
 
-	err = r.Unlock(now, tweedle)
+	release, err := r.Confirm(now, "/a", "", webdav.Condition{Token: token})
 	if err != nil {
-		t.Fatalf("Unlock (sequence #6): %v", err)
+		t.Fatalf("Confirm: %v", err)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Unlock (sequence #6): inconsistent state: %v", err)
+	check(now, token, true, true)
+	release()
+	check(now, token, true, false)
+
+	// An expired lock does not exist, but is not collected either.
+	check(now.Add(time.Minute), token, false, false)
+	if nodes := byExpiryAll(r); len(nodes) != 1 || nodes[0].name != "/a" {
+		t.Fatalf("byExpiryAll: got %v, want /a", nodes)
+	}
+	if err := r.Unlock(now.Add(time.Minute), token); err != webdav.ErrNoSuchLock {
+		t.Fatalf("Unlock: got %v, want %v", err, webdav.ErrNoSuchLock)
 	}
 }
 
-func TestRedisLSNonCanonicalRoot(t *testing.T) {
-	now := time.Unix(0, 0)
-	r := NewTestRedisLS()
-	token, err := r.Create(now, webdav.LockDetails{
-		Root:     "/foo/./bar//",
-		Duration: 1 * time.Second,
-	})
+func TestRedisLSRequiredTokens(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewTestRedisLS(WithTokenURIScheme("urn:uuid"))
+
+	a, err := r.Create(now, webdav.LockDetails{Root: "/a", Duration: time.Minute})
 	if err != nil {
 		t.Fatalf("Create: %v", err)
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Create: inconsistent state: %v", err)
+	c, err := r.Create(now, webdav.LockDetails{Root: "/c", Duration: time.Hour, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
 	}
-	if err := r.Unlock(now, token); err != nil {
-		t.Fatalf("Unlock: %v", err)
+
+	for _, tc := range []struct {
+		name string
+		want []string
+	}{
+		{"/a", []string{a}},
+		{"/a/b/", []string{a}},
+		{"/c", []string{c}},
+		{"/c/d", []string{}},
+		{"/", []string{}},
+	} {
+		if got, err := r.RequiredTokens(now, tc.name); err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("RequiredTokens(%q): got %v, %v, want %v", tc.name, got, err, tc.want)
+		}
 	}
-	if err := r.consistent(); err != nil {
-		t.Fatalf("Unlock: inconsistent state: %v", err)
+
+	// A token RequiredTokens returns satisfies Lookup.
+	tokens, _ := r.RequiredTokens(now, "/a/b")
+	if info, err := r.Lookup(now, "/a/b", webdav.Condition{Token: tokens[0]}); err != nil || info.Token != a {
+		t.Fatalf("Lookup: got %v, %v, want %s", info, err, a)
+	}
+
+	release, err := r.Confirm(now, "/c", "", webdav.Condition{Token: c})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	if got, err := r.RequiredTokens(now, "/c"); err != nil || len(got) != 0 {
+		t.Fatalf("RequiredTokens (held): got %v, %v, want none", got, err)
+	}
+	release()
+
+	if got, err := r.RequiredTokens(now.Add(time.Minute), "/a"); err != nil || len(got) != 0 {
+		t.Fatalf("RequiredTokens (expired): got %v, %v, want none", got, err)
 	}
 }
 
 func TestRedisLSExpiry(t *testing.T) {
 	r := NewTestRedisLS()
 
-	conn := r.pool.Get()
+	conn := r.conns.get(context.Background())
 	defer conn.Close()
 
 	testCases := []string{
@@ -530,6 +5155,7 @@ func TestRedisLSExpiry(t *testing.T) {
 			collectExpiredNodesScript := redis.NewScript(0,
 				GetParentPathFunc+
 					RemoveFunc+
+					ReconcileFunc+
 					CollectExpiredNodesFunc+
 					`return collect_expired_nodes(ARGV[1], tonumber(ARGV[2]))`,
 			)
@@ -560,8 +5186,19 @@ func TestRedisLSExpiry(t *testing.T) {
 }
 
 func TestRedisLS(t *testing.T) {
-	now := time.Unix(0, 0)
 	r := NewTestRedisLS()
+	testRedisLS(t, r, r)
+}
+
+func TestRedisLSNoScripting(t *testing.T) {
+	r := NewTestRedisLS(WithNoScripting())
+	testRedisLS(t, r, NewRedisLS(testPool(r), r.prefix))
+}
+
+// testRedisLS runs random operations on r and checks the state after each one
+// with checker, which shares its prefix.
+func testRedisLS(t *testing.T, r *RedisLS, checker *RedisLS) {
+	now := time.Unix(0, 0)
 	rng := rand.New(rand.NewSource(0))
 	tokens := map[string]string{}
 	nConfirm, nCreate, nRefresh, nUnlock := 0, 0, 0, 0
@@ -629,6 +5266,9 @@ func TestRedisLS(t *testing.T) {
 		if err := r.consistent(); err != nil {
 			t.Fatalf("iteration #%d: inconsistent state: %v", i, err)
 		}
+		if err := checker.Check(now); err != nil {
+			t.Fatalf("iteration #%d: Check: %v", i, err)
+		}
 	}
 
 	if nConfirm < N/10 {
@@ -645,6 +5285,239 @@ func TestRedisLS(t *testing.T) {
 	}
 }
 
+type lockTestOpKind int
+
+const (
+	lockTestCreate lockTestOpKind = iota
+	lockTestRefresh
+	lockTestUnlock
+	lockTestConfirm
+	lockTestRelease
+	lockTestAdvance
+)
+
+func (k lockTestOpKind) String() string {
+	return [...]string{"Create", "Refresh", "Unlock", "Confirm", "Release", "Advance"}[k]
+}
+
+// lockTestOp is an operation run by lockTestDriver.
+type lockTestOp struct {
+	kind lockTestOpKind
+	// name is the root for Create and name0 for Confirm.
+	name string
+	// name1 is name1 for Confirm.
+	name1 string
+	// duration is the duration for Create and Refresh, and how far the clock
+	// moves for Advance.
+	duration  time.Duration
+	zeroDepth bool
+	// lock is the index of the created lock whose token is used by Refresh,
+	// Unlock and Confirm. Confirm passes no condition if it is -1.
+	lock int
+	// hold keeps a confirmed lock held until a Release of its index in the
+	// pending releases. Otherwise Confirm releases it right away.
+	hold    bool
+	release int
+}
+
+// lockTestDriver runs operations on a RedisLS and on webdav.NewMemLS(), which
+// serves as an oracle: each operation must have the same result on both, and
+// the Redis state must be consistent after it.
+type lockTestDriver struct {
+	r       *RedisLS
+	checker *RedisLS
+	oracle  webdav.LockSystem
+	now     time.Time
+	// tokens are the Redis and oracle tokens of every lock created so far.
+	tokens [][2]string
+	// releases are the pending releases of held confirmations.
+	releases [][2]func()
+}
+
+func newLockTestDriver(r *RedisLS, checker *RedisLS) *lockTestDriver {
+	return &lockTestDriver{
+		r:       r,
+		checker: checker,
+		oracle:  webdav.NewMemLS(),
+		now:     time.Unix(0, 0),
+	}
+}
+
+// step runs op and returns its error on r in opErr. err is not nil if the
+// result differs from the oracle or the state is inconsistent.
+func (d *lockTestDriver) step(op lockTestOp) (opErr error, err error) {
+	var oracleErr error
+	var token, oracleToken string
+	if op.lock >= 0 {
+		token, oracleToken = d.tokens[op.lock][0], d.tokens[op.lock][1]
+	}
+
+	switch op.kind {
+	case lockTestCreate:
+		details := webdav.LockDetails{
+			Root:      op.name,
+			Duration:  op.duration,
+			ZeroDepth: op.zeroDepth,
+		}
+		token, opErr = d.r.Create(d.now, details)
+		oracleToken, oracleErr = d.oracle.Create(d.now, details)
+		if opErr == nil && oracleErr == nil {
+			d.tokens = append(d.tokens, [2]string{token, oracleToken})
+		}
+
+	case lockTestRefresh:
+		var details, oracleDetails webdav.LockDetails
+		details, opErr = d.r.Refresh(d.now, token, op.duration)
+		oracleDetails, oracleErr = d.oracle.Refresh(d.now, oracleToken, op.duration)
+		if details != oracleDetails {
+			return opErr, fmt.Errorf("Refresh %q: got %#v, oracle got %#v", op.name, details, oracleDetails)
+		}
+
+	case lockTestUnlock:
+		opErr = d.r.Unlock(d.now, token)
+		oracleErr = d.oracle.Unlock(d.now, oracleToken)
+
+	case lockTestConfirm:
+		var conditions, oracleConditions []webdav.Condition
+		if op.lock >= 0 {
+			conditions = []webdav.Condition{{Token: token}}
+			oracleConditions = []webdav.Condition{{Token: oracleToken}}
+		}
+		var release, oracleRelease func()
+		release, opErr = d.r.Confirm(d.now, op.name, op.name1, conditions...)
+		oracleRelease, oracleErr = d.oracle.Confirm(d.now, op.name, op.name1, oracleConditions...)
+		if opErr == nil && oracleErr == nil {
+			if op.hold {
+				d.releases = append(d.releases, [2]func(){release, oracleRelease})
+				break
+			}
+			if err := d.check(); err != nil {
+				return opErr, fmt.Errorf("while held: %v", err)
+			}
+			release()
+			oracleRelease()
+		} else {
+			// Release whichever side succeeded, the mismatch is reported below.
+			if release != nil {
+				release()
+			}
+			if oracleRelease != nil {
+				oracleRelease()
+			}
+		}
+
+	case lockTestRelease:
+		releases := d.releases[op.release]
+		d.releases = append(d.releases[:op.release], d.releases[op.release+1:]...)
+		releases[0]()
+		releases[1]()
+
+	case lockTestAdvance:
+		d.now = d.now.Add(op.duration)
+	}
+
+	if opErr != oracleErr {
+		return opErr, fmt.Errorf("%v %q: got %v, oracle got %v", op.kind, op.name, opErr, oracleErr)
+	}
+
+	return opErr, d.check()
+}
+
+func (d *lockTestDriver) check() error {
+	if err := d.r.consistent(); err != nil {
+		return fmt.Errorf("inconsistent state: %v", err)
+	}
+	if err := d.checker.Check(d.now); err != nil {
+		return fmt.Errorf("Check: %v", err)
+	}
+	return nil
+}
+
+var lockFuzzSegments = []string{"a", "b", "ab", "a b"}
+
+// lockFuzzPath returns one of the 85 paths up to three segments deep built
+// from lockFuzzSegments. The segments share prefixes, so that siblings such as
+// "/a" and "/ab" are covered.
+func lockFuzzPath(b byte) string {
+	p := ""
+	for i, depth := 0, int(b%4); i < depth; i++ {
+		b >>= 2
+		p += "/" + lockFuzzSegments[b%4]
+	}
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+var lockFuzzDurations = []time.Duration{
+	infiniteTimeout,
+	0,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// FuzzRedisLS decodes operations from groups of four bytes and runs them with
+// lockTestDriver.
+func FuzzRedisLS(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 0, 3, 5, 0, 4, 1, 0, 2, 0, 2, 0, 0, 0})
+	f.Add([]byte{0, 9, 0, 1, 0, 1, 3, 0, 3, 1, 0, 9, 5, 0, 2, 0, 4, 0, 0, 0})
+	f.Add([]byte{0, 0, 2, 0, 0, 4, 2, 1, 3, 4, 4, 1, 5, 0, 2, 0, 4, 0, 0, 0, 5, 0, 3, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		const maxOps = 64
+
+		r := NewTestRedisLS()
+		d := newLockTestDriver(r, r)
+
+		for i := 0; i+4 <= len(data) && i/4 < maxOps; i += 4 {
+			a, b, c := data[i+1], data[i+2], data[i+3]
+
+			op := lockTestOp{
+				kind:      lockTestOpKind(data[i] % 6),
+				name:      lockFuzzPath(a),
+				duration:  lockFuzzDurations[int(b)%len(lockFuzzDurations)],
+				zeroDepth: c&1 != 0,
+				lock:      -1,
+			}
+
+			switch op.kind {
+			case lockTestRefresh, lockTestUnlock:
+				if len(d.tokens) == 0 {
+					continue
+				}
+				op.lock = int(a) % len(d.tokens)
+			case lockTestConfirm:
+				if c&2 != 0 {
+					op.name1 = lockFuzzPath(b)
+				}
+				if len(d.tokens) > 0 && c&4 != 0 {
+					op.lock = int(c>>3) % len(d.tokens)
+				}
+				op.hold = c&1 != 0
+			case lockTestRelease:
+				if len(d.releases) == 0 {
+					continue
+				}
+				op.release = int(a) % len(d.releases)
+			case lockTestAdvance:
+				op.duration = time.Duration(b%4) * time.Second
+			}
+
+			if _, err := d.step(op); err != nil {
+				t.Fatalf("op #%d %+v: %v", i/4, op, err)
+			}
+		}
+
+		for len(d.releases) > 0 {
+			if _, err := d.step(lockTestOp{kind: lockTestRelease, lock: -1}); err != nil {
+				t.Fatalf("final release: %v", err)
+			}
+		}
+	})
+}
+
 func (r *RedisLS) consistent() error {
 	r.redisLog("consistent start")
 	defer r.redisLog("consistent end")
@@ -684,11 +5557,10 @@ func (r *RedisLS) consistent() error {
 		// are locked (i.e. have a non-empty token).
 		var list []string
 		for name0, n0 := range byNameAll(r) {
-			// All of lockTestNames' name fragments are one byte long: '_', 'i' or 'z',
-			// so strings.HasPrefix is equivalent to self-or-descendent name match.
-			// We don't have to worry about "/foo/bar" being a false positive match
-			// for "/foo/b".
-			if strings.HasPrefix(name0, name) && n0.token != "" {
+			// Match on whole segments, so that "/foo/bar" is not a false
+			// positive match for "/foo/b".
+			selfOrDescendant := name == "/" || name0 == name || strings.HasPrefix(name0, name+"/")
+			if selfOrDescendant && n0.token != "" {
 				list = append(list, name0)
 			}
 		}
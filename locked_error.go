@@ -0,0 +1,68 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+	webdav "github.com/koofr/go-webdav"
+)
+
+// LockedError is returned by CreateDetails, CreateRootLock, CreateIdempotent
+// and CreateWithMeta when the requested lock conflicts with an existing lock,
+// to tell which lock is in the way. It matches webdav.ErrLocked with
+// errors.Is. Create still returns webdav.ErrLocked itself, as webdav.Handler
+// compares errors with ==; use WithConflictHandler to observe its conflicts.
+type LockedError struct {
+	// Root is the root of the requested lock.
+	Root string
+	// HolderRoot is the root of the conflicting lock.
+	HolderRoot string
+	// HolderToken is the token of the conflicting lock. It is empty if the
+	// requested lock has infinite depth and conflicts with one of the locks
+	// below HolderRoot.
+	HolderToken string
+}
+
+func (e *LockedError) Error() string {
+	if e.HolderToken == "" {
+		return fmt.Sprintf("%v: %s is blocked by a lock below %s", webdav.ErrLocked, e.Root, e.HolderRoot)
+	}
+	return fmt.Sprintf("%v: %s is blocked by the lock on %s (token %s)", webdav.ErrLocked, e.Root, e.HolderRoot, e.HolderToken)
+}
+
+func (e *LockedError) Unwrap() error {
+	return webdav.ErrLocked
+}
+
+// lockedError parses the value of an ERR_LOCKED reply with a holder, see
+// lockedReplyMacro. The root is filled in by conflict.
+func lockedError(values []interface{}) error {
+	var code string
+	lockedErr := &LockedError{}
+	if _, err := redis.Scan(values, &code, &lockedErr.HolderRoot, &lockedErr.HolderToken); err != nil {
+		return err
+	}
+	return lockedErr
+}
+
+// conflict fills in the root of a LockedError returned for a lock on root and
+// passes it to the handler set with WithConflictHandler. Other errors are
+// returned unchanged.
+func (r *RedisLS) conflict(root string, err error) error {
+	lockedErr, ok := err.(*LockedError)
+	if !ok {
+		return err
+	}
+	lockedErr.Root = root
+	if lockedErr.HolderToken != "" {
+		lockedErr.HolderToken = r.tokenURI(lockedErr.HolderToken)
+	}
+	if r.conflictHandler != nil {
+		r.conflictHandler(lockedErr)
+	}
+	return lockedErr
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrMaintenance is returned by Create, CreateIdempotent and the functions
+// built on them while maintenance mode is enabled.
+var ErrMaintenance = errors.New("webdavredisls: lock system in maintenance mode")
+
+// SetMaintenance enables or disables maintenance mode. In maintenance mode no
+// new locks are granted, but existing locks can still be refreshed, confirmed,
+// stolen and unlocked, so the lock tree drains, e.g. before migrating Redis.
+//
+// The mode is stored in Redis under the prefix and checked by the create
+// script, so it applies atomically to every RedisLS sharing the prefix.
+func (r *RedisLS) SetMaintenance(enabled bool) error {
+	ctx := r.context()
+	conn := r.conn(ctx)
+	defer r.conns.release(conn)
+
+	var err error
+	if enabled {
+		_, err = doContext(ctx, conn, "SET", r.prefix+maintenanceKey, trueValue)
+	} else {
+		_, err = doContext(ctx, conn, "DEL", r.prefix+maintenanceKey)
+	}
+	return err
+}
+
+// InMaintenance reports whether maintenance mode is enabled.
+func (r *RedisLS) InMaintenance() (bool, error) {
+	ctx := r.context()
+	conn := r.conn(ctx)
+	defer r.conns.release(conn)
+
+	return redis.Bool(doContext(ctx, conn, "EXISTS", r.prefix+maintenanceKey))
+}
@@ -0,0 +1,922 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// noScriptMaxAttempts is the number of times an operation is attempted with
+// WithNoScripting before giving up with ErrTxConflict.
+const noScriptMaxAttempts = 16
+
+// ErrScriptingDisabled is returned by operations that are only implemented
+// with Lua scripts when scripting is disabled with WithNoScripting.
+var ErrScriptingDisabled = errors.New("webdavredisls: operation not supported without scripting")
+
+// ErrTxConflict is returned with WithNoScripting when an operation's
+// transaction was aborted by concurrent changes too many times in a row.
+var ErrTxConflict = errors.New("webdavredisls: too many transaction conflicts")
+
+// txFunc is the Go implementation of a script for WithNoScripting. It reads
+// through tx and returns the same reply as the script would, while its writes
+// are queued in tx until the transaction is executed.
+type txFunc func(tx *txn, args []interface{}) (status string, value interface{}, err error)
+
+// txFuncs returns the Go implementations of the scripts supported by
+// WithNoScripting, keyed by script.
+func (r *RedisLS) txFuncs() map[*redis.Script]txFunc {
+	return map[*redis.Script]txFunc{
+		r.scripts.create:       txCreate,
+		r.scripts.createFenced: txCreateFenced,
+		r.scripts.refresh:      txRefresh,
+		r.scripts.unlock:       txUnlock,
+		r.scripts.confirm:      txConfirm,
+		r.scripts.release:      txRelease,
+	}
+}
+
+// runTx runs the Go implementation of a script in an optimistic transaction:
+// every key is WATCHed before it is read and all writes are sent in a single
+// MULTI/EXEC, which is retried from scratch if a watched key changed. The
+// reply has the same shape as the script's.
+func (r *RedisLS) runTx(conn redis.Conn, script *redis.Script, keysAndArgs ...interface{}) ([]interface{}, error) {
+	fn, ok := r.txFuncs()[script]
+	if !ok {
+		return nil, ErrScriptingDisabled
+	}
+	withCollected := script != r.scripts.release
+
+	for attempt := 0; attempt < noScriptMaxAttempts; attempt++ {
+		tx := &txn{
+			r:      r,
+			conn:   conn,
+			prefix: txArgString(keysAndArgs[0]),
+			nodes:  map[string]map[string]string{},
+			dirty:  map[string]bool{},
+			strs:   map[string]*string{},
+		}
+
+		status, value, err := fn(tx, keysAndArgs)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return nil, err
+		}
+
+		committed, err := tx.exec()
+		if err != nil {
+			return nil, err
+		}
+		if !committed {
+			continue
+		}
+
+		values := []interface{}{status, value}
+		if withCollected {
+			values = append(values, tx.collected)
+		}
+		return values, nil
+	}
+
+	return nil, ErrTxConflict
+}
+
+// txn caches the keys read in a transaction and queues its writes. Nodes and
+// string keys are written back whole when the transaction is executed.
+type txn struct {
+	r      *RedisLS
+	conn   redis.Conn
+	prefix string
+
+	// nodes are the node hashes read or written, by key. A nil hash is a
+	// missing node.
+	nodes map[string]map[string]string
+	dirty map[string]bool
+	// strs are the string keys read or written. A nil value is a missing key.
+	strs      map[string]*string
+	dirtyStrs []string
+	// cmds are the other commands to run on EXEC, e.g. for the expiry zset.
+	cmds [][]interface{}
+	// expiryAtSec is the exact expiry passed by CreateUntil and RefreshUntil,
+	// or 0.
+	expiryAtSec int64
+
+	collected []interface{}
+}
+
+func (tx *txn) nameKey(name string) string {
+	return tx.prefix + tx.r.lua.namePrefix + name
+}
+
+func (tx *txn) tokenKey(token string) string {
+	return tx.prefix + tx.r.lua.tokenPrefix + token
+}
+
+// expiryZSetKey returns the key of the expiry zset shard for a name, like
+// expiryZSetKeyMacro.
+func (tx *txn) expiryZSetKey(name string) string {
+	shards := tx.r.lua.expiryShards
+	if shards <= 1 {
+		return tx.prefix + expiryZSetKey
+	}
+	var h int64
+	for i := 0; i < len(name); i++ {
+		h = (h*31 + int64(name[i])) % 2147483647
+	}
+	return tx.prefix + tx.r.lua.expiryShardPrefix + strconv.FormatInt(h%int64(shards), 10)
+}
+
+// expiryZSetKeys returns the keys of all expiry zset shards.
+func (tx *txn) expiryZSetKeys() []string {
+	shards := tx.r.lua.expiryShards
+	if shards <= 1 {
+		return []string{tx.prefix + expiryZSetKey}
+	}
+	keys := make([]string, shards)
+	for shard := range keys {
+		keys[shard] = tx.prefix + tx.r.lua.expiryShardPrefix + strconv.Itoa(shard)
+	}
+	return keys
+}
+
+// node returns the node hash for a name, which the caller may modify and pass
+// to setNode. It returns nil if the node does not exist.
+func (tx *txn) node(name string) (map[string]string, error) {
+	key := tx.nameKey(name)
+	if m, ok := tx.nodes[key]; ok {
+		return m, nil
+	}
+
+	if _, err := tx.conn.Do("WATCH", key); err != nil {
+		return nil, err
+	}
+	m, err := redis.StringMap(tx.conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		m = nil
+	}
+	tx.nodes[key] = m
+	return m, nil
+}
+
+// setNode replaces the node hash for a name. A nil hash deletes the node.
+func (tx *txn) setNode(name string, m map[string]string) {
+	key := tx.nameKey(name)
+	tx.nodes[key] = m
+	tx.dirty[key] = true
+}
+
+// str returns the value of a string key and whether it exists.
+func (tx *txn) str(key string) (string, bool, error) {
+	if v, ok := tx.strs[key]; ok {
+		if v == nil {
+			return "", false, nil
+		}
+		return *v, true, nil
+	}
+
+	if _, err := tx.conn.Do("WATCH", key); err != nil {
+		return "", false, err
+	}
+	v, err := redis.String(tx.conn.Do("GET", key))
+	if err == redis.ErrNil {
+		tx.strs[key] = nil
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	tx.strs[key] = &v
+	return v, true, nil
+}
+
+// setStr sets a string key. A nil value deletes the key.
+func (tx *txn) setStr(key string, v *string) {
+	tx.strs[key] = v
+	tx.dirtyStrs = append(tx.dirtyStrs, key)
+}
+
+func (tx *txn) queue(args ...interface{}) {
+	tx.cmds = append(tx.cmds, args)
+}
+
+// exec writes the queued changes in a MULTI/EXEC and reports whether it was
+// committed, i.e. none of the watched keys changed.
+func (tx *txn) exec() (bool, error) {
+	if err := tx.conn.Send("MULTI"); err != nil {
+		return false, err
+	}
+
+	for key := range tx.dirty {
+		tx.conn.Send("DEL", key)
+		if m := tx.nodes[key]; m != nil {
+			args := redis.Args{}.Add(key)
+			for field, value := range m {
+				args = args.Add(field, value)
+			}
+			tx.conn.Send("HSET", args...)
+		}
+	}
+
+	written := map[string]bool{}
+	for _, key := range tx.dirtyStrs {
+		if written[key] {
+			continue
+		}
+		written[key] = true
+		if v := tx.strs[key]; v != nil {
+			tx.conn.Send("SET", key, *v)
+		} else {
+			tx.conn.Send("DEL", key)
+		}
+	}
+
+	for _, cmd := range tx.cmds {
+		tx.conn.Send(cmd[0].(string), cmd[1:]...)
+	}
+
+	reply, err := tx.conn.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// collectExpiredNodes is collect_expired_nodes. Unlike the script it does not
+// reconcile the refcounts on the paths of the removed locks.
+func (tx *txn) collectExpiredNodes(nowSec int64) (int, error) {
+	collected := 0
+	budget := tx.r.lua.collectLimit
+
+	for _, zsetKey := range tx.expiryZSetKeys() {
+		if _, err := tx.conn.Do("WATCH", zsetKey); err != nil {
+			return 0, err
+		}
+		args := redis.Args{}.Add(zsetKey, "-inf", nowSec)
+		if tx.r.lua.collectLimit > 0 {
+			if budget <= 0 {
+				break
+			}
+			args = args.Add("LIMIT", 0, budget)
+		}
+		names, err := redis.Strings(tx.conn.Do("ZRANGEBYSCORE", args...))
+		if err != nil {
+			return 0, err
+		}
+		budget -= len(names)
+
+		for _, name := range names {
+			m, err := tx.node(name)
+			if err != nil {
+				return 0, err
+			}
+			if m == nil || m[tokenKey] == "" {
+				tx.queue("ZREM", zsetKey, name)
+				continue
+			}
+
+			node := []interface{}{
+				[]byte(tokenKey), []byte(m[tokenKey]),
+				[]byte(rootKey), []byte(m[rootKey]),
+				[]byte(durationKey), []byte(m[durationKey]),
+				[]byte(ownerXMLKey), []byte(m[ownerXMLKey]),
+				[]byte(zeroDepthKey), []byte(m[zeroDepthKey]),
+				[]byte(expiryKey), []byte(m[expiryKey]),
+			}
+
+			root, token := m[rootKey], m[tokenKey]
+			durationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+			if err := tx.remove(name, root, token, durationSec); err != nil {
+				return 0, err
+			}
+			tx.recordRelease(nowSec, root, token, string(ReleaseExpired))
+
+			tx.collected = append(tx.collected, node)
+			collected++
+		}
+	}
+
+	return collected, nil
+}
+
+// recordRelease is the release history part of recordReleaseMacro.
+func (tx *txn) recordRelease(nowSec int64, root, token, reason string) {
+	size := tx.r.lua.releaseHistorySize
+	if size == 0 {
+		return
+	}
+	key := tx.prefix + releaseHistoryKey
+	tx.queue("LPUSH", key, strconv.FormatInt(nowSec, 10)+"\t"+reason+"\t"+token+"\t"+root)
+	tx.queue("LTRIM", key, 0, size-1)
+}
+
+// remove deletes the lock token and its metadata from the named node, drops
+// the node from its expiry set and decrements the ref counts from root up to
+// "/", deleting nodes that are no longer referenced.
+func (tx *txn) remove(name, root, token string, durationSec int64) error {
+	tx.setStr(tx.tokenKey(token), nil)
+
+	m, err := tx.node(name)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		delete(m, tokenKey)
+		delete(m, createdAtKey)
+		for field := range m {
+			if strings.HasPrefix(field, metaKeyPrefix) {
+				delete(m, field)
+			}
+		}
+		tx.setNode(name, m)
+	}
+
+	if durationSec >= 0 {
+		tx.queue("ZREM", tx.expiryZSetKey(name), name)
+	}
+
+	path := root
+	for {
+		m, err := tx.node(path)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			refCount, _ := strconv.Atoi(m[refCountKey])
+			refCount--
+			if refCount <= 0 {
+				tx.setNode(path, nil)
+			} else {
+				m[refCountKey] = strconv.Itoa(refCount)
+				tx.setNode(path, m)
+			}
+		}
+
+		if path == "/" {
+			break
+		}
+		path = parentPath(path)
+	}
+
+	return nil
+}
+
+// canCreate is can_create.
+func (tx *txn) canCreate(name string, zeroDepth bool) (can bool, corrupt bool, err error) {
+	path := name
+	first := true
+
+	for {
+		m, err := tx.node(path)
+		if err != nil {
+			return false, false, err
+		}
+
+		if m != nil {
+			_, hasRoot := m[rootKey]
+			_, hasToken := m[tokenKey]
+			nodeZeroDepth := m[zeroDepthKey]
+
+			if !hasRoot {
+				// The node exists but can't be told apart from a missing one.
+				return false, true, nil
+			}
+			if !first && hasToken && nodeZeroDepth != trueValue && nodeZeroDepth != falseValue {
+				// The depth of an ancestor lock is unknown.
+				return false, true, nil
+			}
+
+			if first {
+				if hasToken || !zeroDepth {
+					return false, false, nil
+				}
+			} else if hasToken && nodeZeroDepth != trueValue {
+				return false, false, nil
+			}
+		}
+
+		if path == "/" {
+			break
+		}
+		path = parentPath(path)
+		first = false
+	}
+
+	return true, false, nil
+}
+
+// nextToken is next_token. The token counter is incremented right away,
+// outside of the transaction, so retries skip token numbers.
+func (tx *txn) nextToken() (string, error) {
+	step := int64(1)
+	for i := 0; i < nextTokenMaxAttempts; i++ {
+		n, err := redis.Int64(tx.conn.Do("INCRBY", tx.prefix+nextTokenKey, step))
+		if err != nil {
+			return "", err
+		}
+		token := strconv.FormatInt(n, 10)
+		_, ok, err := tx.str(tx.tokenKey(token))
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return token, nil
+		}
+		step *= 2
+	}
+	return "", ErrTokenCollision
+}
+
+// createToken is create_token.
+func (tx *txn) createToken(nowSec int64, root string, durationSec int64, zeroDepth bool, ownerXML string, jitterSec int64) (string, error) {
+	token, err := tx.nextToken()
+	if err != nil {
+		return "", err
+	}
+
+	path := root
+	first := true
+
+	for {
+		m, err := tx.node(path)
+		if err != nil {
+			return "", err
+		}
+		if m == nil {
+			m = map[string]string{
+				nameKey: path,
+				rootKey: path,
+				heldKey: falseValue,
+			}
+		}
+		refCount, _ := strconv.Atoi(m[refCountKey])
+		m[refCountKey] = strconv.Itoa(refCount + 1)
+
+		if first {
+			var expirySec int64
+			if durationSec >= 0 {
+				expirySec = tx.expiry(nowSec, durationSec, jitterSec)
+			}
+
+			zeroDepthValue := falseValue
+			if zeroDepth {
+				zeroDepthValue = trueValue
+			}
+
+			m[tokenKey] = token
+			m[durationKey] = strconv.FormatInt(durationSec, 10)
+			m[ownerXMLKey] = ownerXML
+			m[zeroDepthKey] = zeroDepthValue
+			m[expiryKey] = strconv.FormatInt(expirySec, 10)
+			if tx.r.lua.creationTimestamps {
+				m[createdAtKey] = strconv.FormatInt(nowSec, 10)
+			}
+
+			name := path
+			tx.setStr(tx.tokenKey(token), &name)
+
+			if durationSec >= 0 {
+				tx.queue("ZADD", tx.expiryZSetKey(path), expirySec, path)
+			}
+		}
+		tx.setNode(path, m)
+
+		if path == "/" {
+			break
+		}
+		path = parentPath(path)
+		first = false
+	}
+
+	return token, nil
+}
+
+// expiry is get_expiry.
+func (tx *txn) expiry(nowSec, durationSec, jitterSec int64) int64 {
+	if tx.expiryAtSec != 0 {
+		return tx.expiryAtSec
+	}
+	if durationSec > 0 {
+		expirySec := nowSec + durationSec + jitterSec
+		if rounding := tx.r.lua.expiryRoundingSec; rounding > 1 && expirySec%rounding != 0 {
+			expirySec += rounding - expirySec%rounding
+		}
+		return expirySec
+	}
+	return nowSec + durationSec
+}
+
+// txCreate is create. Arguments are as for the create script.
+func txCreate(tx *txn, args []interface{}) (string, interface{}, error) {
+	nowSec := txArgInt(args[1])
+	root := txArgString(args[2])
+	durationSec := txArgInt(args[3])
+	zeroDepth := txArgString(args[4]) == "1"
+	ownerXML := txArgString(args[5])
+	jitterSec := txArgInt(args[6])
+	inlineCollect := txArgString(args[7]) != "0"
+	if len(args) > 8 {
+		tx.expiryAtSec = txArgInt(args[8])
+	}
+
+	if root != "/" && (!strings.HasPrefix(root, "/") || path.Clean(root) != root) {
+		return replyErr, errInvalidPath, nil
+	}
+
+	if _, maintenance, err := tx.str(tx.prefix + maintenanceKey); err != nil {
+		return "", nil, err
+	} else if maintenance {
+		return replyErr, errMaintenance, nil
+	}
+
+	if inlineCollect {
+		if _, err := tx.collectExpiredNodes(nowSec); err != nil {
+			return "", nil, err
+		}
+	}
+
+	can, corrupt, err := tx.canCreate(root, zeroDepth)
+	if err != nil {
+		return "", nil, err
+	}
+	if !can && !corrupt && !inlineCollect {
+		collected, err := tx.collectExpiredNodes(nowSec)
+		if err != nil {
+			return "", nil, err
+		}
+		if collected > 0 {
+			if can, corrupt, err = tx.canCreate(root, zeroDepth); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if corrupt {
+		return replyErr, errCorruptState, nil
+	}
+	if !can {
+		return replyErr, errLocked, nil
+	}
+
+	token, err := tx.createToken(nowSec, root, durationSec, zeroDepth, ownerXML, jitterSec)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return replyOK, token, nil
+}
+
+// txCreateFenced is create_fenced. Arguments are as for the createFenced
+// script.
+func txCreateFenced(tx *txn, args []interface{}) (string, interface{}, error) {
+	status, token, err := txCreate(tx, args)
+	if err != nil || status != replyOK {
+		return status, token, err
+	}
+
+	key := tx.prefix + fenceCounterKey
+	v, _, err := tx.str(key)
+	if err != nil {
+		return "", nil, err
+	}
+	fence, _ := strconv.ParseInt(v, 10, 64)
+	fence++
+	next := strconv.FormatInt(fence, 10)
+	tx.setStr(key, &next)
+
+	return replyOK, []interface{}{token, fence}, nil
+}
+
+// txRefresh is refresh. Arguments are as for the refresh script.
+func txRefresh(tx *txn, args []interface{}) (string, interface{}, error) {
+	nowSec := txArgInt(args[1])
+	token := txArgString(args[2])
+	newDurationSec := txArgInt(args[3])
+	jitterSec := int64(0)
+	if len(args) > 4 {
+		jitterSec = txArgInt(args[4])
+	}
+	if len(args) > 5 {
+		tx.expiryAtSec = txArgInt(args[5])
+	}
+
+	if _, err := tx.collectExpiredNodes(nowSec); err != nil {
+		return "", nil, err
+	}
+
+	name, ok, err := tx.str(tx.tokenKey(token))
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return replyErr, errNoSuchLock, nil
+	}
+
+	m, err := tx.node(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if m == nil {
+		return replyErr, errNoSuchLock, nil
+	}
+	if m[heldKey] == trueValue {
+		return replyErr, errLocked, nil
+	}
+	if len(args) > 9 && txArgString(args[8]) == "1" && (txArgString(args[9]) == "1") != (m[zeroDepthKey] == trueValue) {
+		return replyErr, errDepthImmutable, nil
+	}
+
+	zsetKey := tx.expiryZSetKey(name)
+	oldDurationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+	if oldDurationSec >= 0 {
+		tx.queue("ZREM", zsetKey, name)
+	}
+
+	var newExpirySec int64
+	if newDurationSec >= 0 {
+		newExpirySec = tx.expiry(nowSec, newDurationSec, jitterSec)
+		tx.queue("ZADD", zsetKey, newExpirySec, name)
+	}
+
+	previousOwnerXML := m[ownerXMLKey]
+	replaceOwner := len(args) > 7 && txArgString(args[6]) == "1"
+	if replaceOwner {
+		m[ownerXMLKey] = txArgString(args[7])
+	}
+
+	m[durationKey] = strconv.FormatInt(newDurationSec, 10)
+	m[expiryKey] = strconv.FormatInt(newExpirySec, 10)
+	tx.setNode(name, m)
+
+	details := []interface{}{
+		[]byte(rootKey), []byte(m[rootKey]),
+		[]byte(durationKey), []byte(m[durationKey]),
+		[]byte(ownerXMLKey), []byte(m[ownerXMLKey]),
+		[]byte(zeroDepthKey), []byte(m[zeroDepthKey]),
+		[]byte(expiryKey), []byte(m[expiryKey]),
+	}
+	if replaceOwner {
+		details = append(details, []byte(previousOwnerXMLKey), []byte(previousOwnerXML))
+	}
+
+	return replyOK, details, nil
+}
+
+// txUnlock is unlock. Arguments are as for the unlock script.
+func txUnlock(tx *txn, args []interface{}) (string, interface{}, error) {
+	nowSec := txArgInt(args[1])
+	token := txArgString(args[2])
+
+	if _, err := tx.collectExpiredNodes(nowSec); err != nil {
+		return "", nil, err
+	}
+
+	name, ok, err := tx.str(tx.tokenKey(token))
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return replyErr, errNoSuchLock, nil
+	}
+
+	m, err := tx.node(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if m == nil {
+		return replyErr, errNoSuchLock, nil
+	}
+	if m[heldKey] == trueValue {
+		return replyErr, errLocked, nil
+	}
+
+	ownerXML := m[ownerXMLKey]
+	durationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+	if err := tx.remove(name, m[rootKey], token, durationSec); err != nil {
+		return "", nil, err
+	}
+	tx.recordRelease(nowSec, m[rootKey], token, string(ReleaseUnlocked))
+
+	return replyOK, ownerXML, nil
+}
+
+// lookup is lookup. It returns the name and duration of the first unheld lock
+// identified by one of tokens that covers name.
+func (tx *txn) lookup(name string, tokens []string) (string, int64, bool, error) {
+	for _, token := range tokens {
+		lockName, ok, err := tx.str(tx.tokenKey(token))
+		if err != nil {
+			return "", 0, false, err
+		}
+		if !ok {
+			continue
+		}
+
+		m, err := tx.node(lockName)
+		if err != nil {
+			return "", 0, false, err
+		}
+		if m == nil || m[heldKey] == trueValue {
+			continue
+		}
+
+		root := m[rootKey]
+		if lockCovers(root, m[zeroDepthKey] == trueValue, name) {
+			durationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+			return root, durationSec, true, nil
+		}
+	}
+
+	return "", 0, false, nil
+}
+
+// lockCovers is lock_covers.
+func lockCovers(root string, zeroDepth bool, name string) bool {
+	if name == root {
+		return true
+	}
+	if zeroDepth {
+		return false
+	}
+	return root == "/" || (len(name) > len(root) && name[:len(root)+1] == root+"/")
+}
+
+// hold is hold.
+func (tx *txn) hold(name string, durationSec int64, nowSec int64) error {
+	m, err := tx.node(name)
+	if err != nil {
+		return err
+	}
+	if m == nil || m[tokenKey] == "" {
+		return fmt.Errorf("%w: %s: %s", ErrCorruptState, missingLockMessage, name)
+	}
+	if m[heldKey] == trueValue {
+		return errors.New("webdavredisls: inconsistent held state")
+	}
+	m[heldKey] = trueValue
+	m[heldSinceKey] = strconv.FormatInt(nowSec, 10)
+	tx.setNode(name, m)
+
+	if err := tx.addHeldCount(1); err != nil {
+		return err
+	}
+
+	if durationSec >= 0 {
+		tx.queue("ZREM", tx.expiryZSetKey(name), name)
+	}
+	return nil
+}
+
+// unhold is unhold.
+func (tx *txn) unhold(name string) error {
+	m, err := tx.node(name)
+	if err != nil {
+		return err
+	}
+	if m == nil || m[heldKey] != trueValue {
+		// The error reply the release script fails with, so that
+		// scriptError handles both alike.
+		return redis.Error(inconsistentHeldStateMessage)
+	}
+	m[heldKey] = falseValue
+	delete(m, heldSinceKey)
+	tx.setNode(name, m)
+
+	if err := tx.addHeldCount(-1); err != nil {
+		return err
+	}
+
+	durationSec, _ := strconv.ParseInt(m[durationKey], 10, 64)
+	if durationSec >= 0 {
+		expirySec, _ := strconv.ParseInt(m[expiryKey], 10, 64)
+		tx.queue("ZADD", tx.expiryZSetKey(name), expirySec, name)
+	}
+	return nil
+}
+
+// addHeldCount adds delta to the held count, deleting it when it drops to 0.
+func (tx *txn) addHeldCount(delta int64) error {
+	key := tx.prefix + heldCountKey
+	v, _, err := tx.str(key)
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.ParseInt(v, 10, 64)
+	n += delta
+	if n <= 0 {
+		tx.setStr(key, nil)
+	} else {
+		s := strconv.FormatInt(n, 10)
+		tx.setStr(key, &s)
+	}
+	return nil
+}
+
+// txConfirm is confirm. Arguments are as for the confirm script.
+func txConfirm(tx *txn, args []interface{}) (string, interface{}, error) {
+	nowSec := txArgInt(args[1])
+	names := []string{txArgString(args[2]), txArgString(args[3])}
+	count := int(txArgInt(args[4]))
+	tokens := make([]string, 0, count)
+	for _, arg := range args[5 : 5+count] {
+		tokens = append(tokens, txArgString(arg))
+	}
+
+	if _, err := tx.collectExpiredNodes(nowSec); err != nil {
+		return "", nil, err
+	}
+
+	type found struct {
+		root        string
+		durationSec int64
+	}
+	var held []found
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		root, durationSec, ok, err := tx.lookup(name, tokens)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			return replyErr, errConfirmationFailed, nil
+		}
+		// Don't hold the same node twice.
+		if len(held) > 0 && held[0].root == root {
+			continue
+		}
+		held = append(held, found{root, durationSec})
+	}
+
+	res := make([]interface{}, 0, len(held))
+	for _, f := range held {
+		if err := tx.hold(f.root, f.durationSec, nowSec); err != nil {
+			return "", nil, err
+		}
+		res = append(res, []byte(f.root))
+	}
+
+	return replyOK, res, nil
+}
+
+// txRelease is release. Arguments are as for the release script.
+func txRelease(tx *txn, args []interface{}) (string, interface{}, error) {
+	released := map[string]bool{}
+
+	for _, arg := range args[1:] {
+		name := txArgString(arg)
+		if name == "" || released[name] {
+			continue
+		}
+		released[name] = true
+
+		if err := tx.unhold(name); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return replyOK, int64(1), nil
+}
+
+// parentPath is get_parent_path.
+func parentPath(p string) string {
+	for i := len(p) - 1; i > 0; i-- {
+		if p[i] == '/' {
+			return p[:i]
+		}
+	}
+	return "/"
+}
+
+// txArgString converts a script argument to the string Redis would see.
+func txArgString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func txArgInt(v interface{}) int64 {
+	n, _ := strconv.ParseInt(txArgString(v), 10, 64)
+	return n
+}
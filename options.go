@@ -0,0 +1,441 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Option configures a RedisLS.
+type Option func(*RedisLS)
+
+// WithExpiryHandler sets a function that is called for every lock removed by
+// expired-node collection, e.g. to abort an upload tied to that lock.
+//
+// The handler is called synchronously by the operation that triggered the
+// collection, after its Redis connection has been released. Slow work should
+// be handed off to another goroutine.
+func WithExpiryHandler(handler func(LockInfo)) Option {
+	return func(r *RedisLS) {
+		r.expiryHandler = handler
+	}
+}
+
+// WithMaxOwnerXMLBytes limits the size of the owner XML accepted by Create and
+// UpdateOwner. Larger values are rejected with ErrOwnerXMLTooLarge. A limit of
+// 0 (the default) disables the check.
+func WithMaxOwnerXMLBytes(n int) Option {
+	return func(r *RedisLS) {
+		r.maxOwnerXMLBytes = n
+	}
+}
+
+// WithOwnerValidator sets a function that checks the owner XML accepted by
+// Create, UpdateOwner and Steal before it is stored, so that malformed owners
+// can't break lockdiscovery responses later. If it returns an error, the
+// operation fails with an error that wraps ErrInvalidOwner. An empty owner is
+// always allowed. WellFormedOwnerXML can be used as the validator.
+func WithOwnerValidator(validator func(ownerXML string) error) Option {
+	return func(r *RedisLS) {
+		r.ownerValidator = validator
+	}
+}
+
+// WithRetry makes operations retry up to attempts times in total when running
+// a script fails with a connection-level error, such as a network blip.
+// Every attempt uses a fresh connection and the delay between attempts
+// starts at backoff and doubles each time. Error replies from Redis and
+// definitive results such as webdav.ErrLocked are never retried.
+//
+// Scripts re-read all state, so retrying Refresh, Unlock and Confirm is safe.
+// Retrying Create is not entirely: if a Create succeeded in Redis but its
+// reply was lost, the retry fails with webdav.ErrLocked and the first token
+// leaks until the lock expires.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(r *RedisLS) {
+		r.retryAttempts = attempts
+		r.retryBackoff = backoff
+	}
+}
+
+// WithIdempotencyWindow sets how long CreateIdempotent remembers idempotency
+// keys. The default is one minute.
+func WithIdempotencyWindow(d time.Duration) Option {
+	return func(r *RedisLS) {
+		r.idempotencyWindow = d
+	}
+}
+
+// WithKeySeparator sets the separator between a key type and the rest of the
+// key, e.g. "/" gives keys like prefix + "n/" + name instead of the default
+// prefix + "n:" + name. The expiry zset and token counter keys have no type
+// and keep their names. NewRedisLS panics if the separator is empty or makes
+// two key types ambiguous.
+func WithKeySeparator(separator string) Option {
+	return func(r *RedisLS) {
+		r.keySeparator = separator
+	}
+}
+
+// WithExpiryJitter spreads lock expiries by adding a random delay of up to max,
+// rounded down to whole seconds, to the expiry of every lock created or
+// refreshed. Without it, a burst of locks created in the same second with the
+// same duration expires at once and the next operation pays for collecting the
+// whole cohort. This trades a little expiry precision for smoother collection
+// cost: a lock may live up to max longer than its duration, but never shorter.
+// Zero-duration locks still expire immediately.
+func WithExpiryJitter(max time.Duration) Option {
+	return func(r *RedisLS) {
+		r.expiryJitter = max
+	}
+}
+
+// WithStrictConditions makes Confirm and Lookup fail with
+// webdav.ErrConfirmationFailed when a condition has Not set or an ETag, which
+// are not supported yet. By default such conditions are treated as bare token
+// matches, so e.g. "If: (Not <token>)" is granted as if it were "(<token>)".
+func WithStrictConditions() Option {
+	return func(r *RedisLS) {
+		r.strictConditions = true
+	}
+}
+
+// WithInlineCollect sets whether Create collects expired locks before granting
+// a new one. It is enabled by default. When disabled, Create only collects if
+// the new lock conflicts with an existing one, so expired locks never block a
+// grant but the common case skips the collection entirely. This is useful for
+// benchmarking the raw grant cost and for deployments that rely on other
+// operations to collect. All other operations still collect expired locks.
+func WithInlineCollect(enabled bool) Option {
+	return func(r *RedisLS) {
+		r.inlineCollect = enabled
+	}
+}
+
+// RootLockPolicy controls the creation of infinite-depth locks at "/", which
+// conflict with every other lock. Zero-depth locks at "/" are always allowed.
+type RootLockPolicy int
+
+const (
+	// RootLockAllowed allows infinite-depth locks at "/". It is the default.
+	RootLockAllowed RootLockPolicy = iota
+	// RootLockDenied rejects infinite-depth locks at "/" with
+	// ErrRootLockForbidden.
+	RootLockDenied
+	// RootLockExplicit only allows infinite-depth locks at "/" created with
+	// CreateRootLock and rejects the others with ErrRootLockForbidden.
+	RootLockExplicit
+)
+
+// WithRootLockPolicy sets the policy for infinite-depth locks at "/", e.g. to
+// stop a buggy client from locking the whole namespace. The policy applies to
+// the path after normalization, so a root of "" or "/a/.." counts as "/".
+func WithRootLockPolicy(policy RootLockPolicy) Option {
+	return func(r *RedisLS) {
+		r.rootLockPolicy = policy
+	}
+}
+
+// WithAlwaysEval makes every script run with EVAL and its full body instead of
+// EVALSHA. This is for Redis deployments that disable EVALSHA or flush the
+// script cache so often that most calls hit NOSCRIPT and pay for a second round
+// trip anyway. The cost is bandwidth: the script bodies are between roughly
+// 0.7 KB (Stats) and 8 KB (Check), about 6 KB for Create and 4.5 KB for
+// Confirm, against the 40 byte SHA1 sent by EVALSHA. It takes precedence over
+// WithScriptCacheCheck.
+func WithAlwaysEval() Option {
+	return func(r *RedisLS) {
+		r.alwaysEval = true
+	}
+}
+
+// WithScriptCacheCheck makes the lock system check with SCRIPT EXISTS at most
+// once per interval whether its scripts are still cached, and load the missing
+// ones with SCRIPT LOAD. Scripts that are not cached still work without it,
+// each call just falls back to EVAL after a NOSCRIPT reply, so the check only
+// saves the extra round trip and the body transfer after the script cache has
+// been flushed. Failed checks are ignored and retried after the next interval.
+func WithScriptCacheCheck(interval time.Duration) Option {
+	return func(r *RedisLS) {
+		r.scriptCacheCheck = interval
+	}
+}
+
+// WithPathNormalizer sets a function that is applied to every lock path before
+// it is cleaned, so that Create, Confirm, Lookup and the other operations all
+// canonicalize paths identically. Stored roots are in the normalized form. See
+// NormalizeNFC.
+func WithPathNormalizer(normalizer func(string) string) Option {
+	return func(r *RedisLS) {
+		r.pathNormalizer = normalizer
+	}
+}
+
+// WithCaseFold makes lock paths case-insensitive by lowercasing them, for
+// backing stores that are case-insensitive. This changes the lock-conflict
+// semantics: a lock on /Foo/Bar conflicts with a lock on /foo/bar and covers
+// it in Confirm and Lookup. Stored roots are in the lowercased form, so
+// ListLocks reports e.g. /foo/bar for a lock created on /Foo/Bar.
+func WithCaseFold() Option {
+	return func(r *RedisLS) {
+		r.caseFold = true
+	}
+}
+
+// WithOwnerStore keeps owner XML documents in store instead of Redis, which
+// only keeps the reference returned by OwnerStore.Put. This keeps large owner
+// documents out of Redis memory. Create stores the document once the token is
+// known, so it takes an extra round trip, and the lock is removed again if
+// Put fails. Documents are deleted when their lock is unlocked, collected or
+// given a new owner. Read operations resolve the references with
+// OwnerStore.Get.
+func WithOwnerStore(store OwnerStore) Option {
+	return func(r *RedisLS) {
+		r.ownerStore = store
+	}
+}
+
+// WithExpiryShards splits the expiry zset into n shards keyed by a hash of the
+// lock path, named prefix + "e:" + shard with the default key separator. The
+// default of 1 keeps the single prefix + "e" zset. The scripts do not declare
+// their keys, so they can't run on Redis Cluster yet and every operation still
+// collects expired locks from all shards; sharding only bounds the size of
+// each zset. Changing the number of shards orphans the locks in the old
+// shards, so it must only be done on an empty lock system. NewRedisLS panics
+// if n is less than 1.
+func WithExpiryShards(n int) Option {
+	return func(r *RedisLS) {
+		r.expiryShards = n
+	}
+}
+
+// WithExpiryRounding rounds the expiry of locks with a positive duration up
+// to the next multiple of d after adding any jitter, e.g. to 10 seconds so that
+// locks expiring close to each other are collected together. Rounding up
+// never makes a lock shorter than its duration, but it may live up to d
+// longer. d is truncated to whole seconds; the default of 0, like anything
+// up to a second, keeps the expiry at second precision. NewRedisLS panics if d
+// is negative.
+func WithExpiryRounding(d time.Duration) Option {
+	return func(r *RedisLS) {
+		r.expiryRounding = d
+	}
+}
+
+// WithConflictHandler calls fn with every LockedError, i.e. whenever a lock
+// can't be created because it conflicts with an existing lock, e.g. to log
+// which lock blocked it. This includes the conflicts of Create, which only
+// returns webdav.ErrLocked. fn is called synchronously before the error is
+// returned, so it must not block.
+func WithConflictHandler(fn func(err *LockedError)) Option {
+	return func(r *RedisLS) {
+		r.conflictHandler = fn
+	}
+}
+
+// WithConnTimeout limits how long an operation waits for a connection from a
+// pool that is configured to wait for one, e.g. while all connections are in
+// use. If no connection can be obtained in time the operation fails with
+// ErrPoolTimeout. The timeout does not apply to the getConn function passed
+// to NewRedisLSWithConns, which can't be interrupted.
+func WithConnTimeout(d time.Duration) Option {
+	return func(r *RedisLS) {
+		r.connTimeout = d
+	}
+}
+
+// WithCommandTimeout limits how long each Redis command waits for its reply,
+// so that a half-open connection or a stuck Redis fails the operation with an
+// error wrapping ErrCommandTimeout instead of hanging until the operating
+// system gives up. Such errors are not retried. It is separate from
+// WithConnTimeout, which only covers getting a connection, and overrides the
+// read timeout the connections were dialed with. Connections passed to
+// NewRedisLSWithConns that don't implement redis.ConnWithTimeout are not
+// limited.
+func WithCommandTimeout(d time.Duration) Option {
+	return func(r *RedisLS) {
+		r.commandTimeout = d
+	}
+}
+
+// WithStatsInterval starts a goroutine that calls Stats every interval and
+// passes the result to fn, e.g. to export the number of locks, held locks and
+// locks waiting to be collected as gauges. If Stats fails, fn is not called
+// and the interval doubles up to 32 times the configured one until it
+// succeeds again. The goroutine runs until Close is called. NewRedisLS panics
+// if interval is not positive.
+func WithStatsInterval(interval time.Duration, fn func(LockStats)) Option {
+	return func(r *RedisLS) {
+		r.statsExporter = &statsExporter{
+			interval: interval,
+			fn:       fn,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// WithMinDuration bumps the duration of locks requested by Create, Refresh and
+// Steal up to d. By default a zero duration, e.g. from "Timeout: Second-0",
+// gives a lock that expires immediately, which is effectively the same as not
+// locking at all. Infinite durations are left alone.
+func WithMinDuration(d time.Duration) Option {
+	return func(r *RedisLS) {
+		r.minDuration = d
+	}
+}
+
+// WithRejectZeroDuration makes Create, Refresh and Steal fail with
+// ErrZeroDuration when the requested duration is less than a second, instead
+// of creating a lock that expires immediately. It takes precedence over
+// WithMinDuration.
+func WithRejectZeroDuration() Option {
+	return func(r *RedisLS) {
+		r.rejectZero = true
+	}
+}
+
+// WithNoScripting runs Create, CreateFenced, Refresh, Unlock and Confirm as
+// optimistic MULTI/EXEC transactions from Go instead of Lua scripts, for Redis
+// deployments where EVAL is forbidden, e.g. by an ACL. Every key is WATCHed
+// before it is read and the transaction is retried from scratch when another
+// client changes one of them, up to 16 times before failing with
+// ErrTxConflict. This takes a round trip per key read, so it is much slower
+// than the scripts, especially under contention on the same paths.
+//
+// Collection does not reconcile the refcounts on the paths of removed locks.
+// All other operations, and options that need them such as WithOwnerStore,
+// fail with ErrScriptingDisabled.
+func WithNoScripting() Option {
+	return func(r *RedisLS) {
+		r.noScripting = true
+	}
+}
+
+// WithHeldConfirmRetry makes Confirm wait up to maxWait for a lock that
+// matches its conditions but is held by another Confirm call, e.g. during a
+// MOVE, instead of failing right away with webdav.ErrConfirmationFailed.
+// Retries poll like CreateWait and stop early when the context of the view
+// returned by WithContext is done. Conditions that don't match any lock still
+// fail right away, at the cost of a read per condition token. It is off by
+// default, as webdav.Handler does not expect Confirm to block.
+func WithHeldConfirmRetry(maxWait time.Duration) Option {
+	return func(r *RedisLS) {
+		r.heldConfirmRetry = maxWait
+	}
+}
+
+// WithTransactionalRelease makes the release functions returned by Confirm,
+// ConfirmRoots and ConfirmManyPartial unhold the nodes with the optimistic
+// MULTI/EXEC transaction of WithNoScripting instead of the release script,
+// for Redis deployments that throttle EVAL but allow transactions. The result
+// is the same, but it takes a round trip per held node, and under contention
+// the release may fail with ErrTxConflict. The other operations still run as
+// scripts.
+func WithTransactionalRelease() Option {
+	return func(r *RedisLS) {
+		r.txRelease = true
+	}
+}
+
+// WithNamespacePrefixSeparator makes NewRedisLS and Scoped panic for a prefix
+// that does not end with sep, e.g. ":", or that contains sep followed by one
+// of the key prefixes the lock system uses, such as "n:". Lock systems on the
+// same Redis whose prefixes pass the check can't see each other's keys, even
+// if one prefix starts with the other. Without it, prefixes like "app" and
+// "app2" are fine too, but "app" and "appn:" are not.
+func WithNamespacePrefixSeparator(sep string) Option {
+	return func(r *RedisLS) {
+		r.namespaceSeparator = sep
+	}
+}
+
+// WithScriptBudget bounds the work a single script does, so that no operation
+// can run long enough to trip lua-time-limit and block Redis for other clients.
+// Every script that collects expired locks handles at most maxCollect expiry
+// zset entries, oldest first, and leaves the rest to later calls; until an
+// expired lock is collected it still conflicts with new locks. Locks can't be
+// created at roots with more than maxDepth path segments, which bounds the
+// ancestor walks; such requests fail with ErrPathTooDeep. A limit of 0 (the
+// default) disables it.
+//
+// A script that does exceed lua-time-limit makes operations fail with an error
+// wrapping ErrScriptBusy.
+func WithScriptBudget(maxCollect int, maxDepth int) Option {
+	return func(r *RedisLS) {
+		r.collectLimit = maxCollect
+		r.maxPathDepth = maxDepth
+	}
+}
+
+// WithCreationTimestamps makes Create and the other operations that create
+// locks record when each lock was created, e.g. to compute the age of locks
+// that have been refreshed for a long time. It is reported as
+// LockInfo.CreatedAt. It is off by default to save a field per lock.
+func WithCreationTimestamps() Option {
+	return func(r *RedisLS) {
+		r.creationTimestamps = true
+	}
+}
+
+// WithReleaseHistory makes the lock system keep the last size locks that were
+// unlocked, collected after expiring or moved by MoveLock, for RecentlyReleased,
+// e.g. to answer "who had this locked a minute ago" when debugging a client.
+// The history is a single list that is trimmed to size on every push, so it
+// costs two commands per release and at most size entries. It is off by
+// default.
+func WithReleaseHistory(size int) Option {
+	return func(r *RedisLS) {
+		r.releaseHistorySize = size
+	}
+}
+
+// WithDebugAssertions compiles extra invariant checks into the scripts, e.g.
+// that refcounts never go negative, that a removed lock's token key points to
+// its node and that held locks are never in the expiry zset. A violated check
+// fails the script with an "assertion failed" error, so that corruption shows
+// up where it happens rather than later. The checks cost extra commands per
+// operation and are meant for development and staging. They have no effect
+// with WithNoScripting.
+func WithDebugAssertions() Option {
+	return func(r *RedisLS) {
+		r.debugAssertions = true
+	}
+}
+
+// WithTokenURIScheme makes the lock system hand out tokens as URIs with the
+// given scheme, e.g. "urn:uuid" or "opaquelocktoken", as expected in the
+// Lock-Token header by some WebDAV clients: token "5" becomes "urn:uuid:5".
+// The scheme is only added and stripped at the API, Redis keeps storing bare
+// tokens, so it can be turned on and off for an existing lock system. Methods
+// taking a token accept it both with and without the scheme. The tokens are
+// still numbers, not UUIDs; clients that validate the syntax of the URI need
+// tokens created with CreateWithToken.
+func WithTokenURIScheme(scheme string) Option {
+	return func(r *RedisLS) {
+		r.tokenURIScheme = scheme
+	}
+}
+
+// WithAuditHook calls hook after every script run, which covers every lock
+// mutation and lookup, e.g. to feed an audit trail. Unlike the counters of
+// ScriptErrors it is called once per operation, on failures too, with the
+// context of the view returned by WithContext, so that the identity of the
+// caller can be recorded. hook is called synchronously, so it must not block.
+// A panic in hook is logged and otherwise ignored.
+func WithAuditHook(hook AuditHook) Option {
+	return func(r *RedisLS) {
+		r.auditHook = hook
+	}
+}
+
+// NormalizeNFC returns name in Unicode Normalization Form C. Used with
+// WithPathNormalizer it makes a path with decomposed characters, as sent by
+// e.g. macOS clients, match the same path with composed characters.
+func NormalizeNFC(name string) string {
+	return norm.NFC.String(name)
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	webdav "github.com/koofr/go-webdav"
+)
+
+// OwnerStore keeps owner XML documents outside of Redis, see WithOwnerStore.
+type OwnerStore interface {
+	// Put stores the owner XML of the lock identified by token and returns a
+	// reference to it.
+	Put(token, ownerXML string) (ref string, err error)
+	// Get returns the owner XML for a reference returned by Put.
+	Get(ref string) (ownerXML string, err error)
+	// Delete removes the owner XML for a reference returned by Put. Errors
+	// are ignored, so stores that must not leak should also expire
+	// unreferenced documents on their own.
+	Delete(ref string) error
+}
+
+// inlineOwnerXML returns the owner XML to store in Redis when a lock is
+// created. With an OwnerStore nothing is stored until the token is known.
+func (r *RedisLS) inlineOwnerXML(ownerXML string) string {
+	if r.ownerStore != nil {
+		return ""
+	}
+	return ownerXML
+}
+
+// finishCreate puts the owner XML of a lock created with inlineOwnerXML into
+// the OwnerStore. If that fails, the lock is removed again.
+func (r *RedisLS) finishCreate(now time.Time, token string, ownerXML string, err error) (string, error) {
+	if err != nil || r.ownerStore == nil || ownerXML == "" {
+		return token, err
+	}
+
+	if _, err := r.storeOwner(now, token, ownerXML, false); err != nil {
+		if err == webdav.ErrNoSuchLock {
+			// The lock has already expired.
+			return token, nil
+		}
+		r.Unlock(now, token)
+		return "", err
+	}
+
+	return token, nil
+}
+
+// storeOwner puts ownerXML into the OwnerStore and replaces the reference
+// stored in the lock identified by token, deleting the previous document. With
+// force set the reference is replaced even if the lock is held.
+func (r *RedisLS) storeOwner(now time.Time, token string, ownerXML string, force bool) (webdav.LockDetails, error) {
+	ref, err := r.ownerStore.Put(token, ownerXML)
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	m, err := redis.StringMap(r.do(
+		r.scripts.updateOwner,
+		r.prefix,
+		now.Unix(),
+		token,
+		ref,
+		force,
+	))
+	if err != nil {
+		r.ownerStore.Delete(ref)
+		return webdav.LockDetails{}, err
+	}
+
+	if previous := m[previousOwnerXMLKey]; previous != ref {
+		r.deleteOwner(previous)
+	}
+
+	details := lockDetailsFromMap(m)
+	details.OwnerXML = ownerXML
+
+	return details, nil
+}
+
+// resolveOwner replaces the owner reference in details with the owner XML
+// from the OwnerStore.
+func (r *RedisLS) resolveOwner(details *webdav.LockDetails) error {
+	if r.ownerStore == nil || details.OwnerXML == "" {
+		return nil
+	}
+
+	ownerXML, err := r.ownerStore.Get(details.OwnerXML)
+	if err != nil {
+		return err
+	}
+	details.OwnerXML = ownerXML
+
+	return nil
+}
+
+// deleteOwner deletes the owner XML for ref from the OwnerStore.
+func (r *RedisLS) deleteOwner(ref string) {
+	if r.ownerStore == nil || ref == "" {
+		return
+	}
+	r.ownerStore.Delete(ref)
+}
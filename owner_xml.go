@@ -0,0 +1,33 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrInvalidOwner is wrapped by the error returned when the owner XML is
+// rejected by the validator set with WithOwnerValidator.
+var ErrInvalidOwner = errors.New("webdavredisls: invalid owner XML")
+
+// WellFormedOwnerXML returns an error if ownerXML is not a well-formed XML
+// fragment, e.g. if it has unbalanced or mismatched tags. The fragment may
+// have several top-level elements and character data, like the content of a
+// DAV:owner element.
+func WellFormedOwnerXML(ownerXML string) error {
+	d := xml.NewDecoder(strings.NewReader(ownerXML))
+	for {
+		_, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
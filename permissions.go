@@ -0,0 +1,160 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrCommandsDenied is wrapped by the error returned by CheckPermissions when
+// Redis denies some of the required commands.
+var ErrCommandsDenied = errors.New("webdavredisls: redis commands denied")
+
+// Redis commands issued by the package, in ACL notation. TestRequiredCommands
+// checks them against the sources.
+var (
+	// goCommands are issued from Go regardless of the configuration.
+	goCommands = []string{"DEL", "EXISTS", "GET", "INCRBY", "SCAN", "SET", "UNLINK"}
+	// releaseHistoryCommands are issued from Go with WithReleaseHistory.
+	releaseHistoryCommands = []string{"LRANGE"}
+	// luaCommands are issued by the scripts.
+	luaCommands = []string{
+		"DECR", "DEL", "EXISTS", "GET", "HDEL", "HGET", "HGETALL", "HINCRBY",
+		"HKEYS", "HMGET", "HSET", "INCR", "INCRBY", "LPUSH", "LTRIM", "SCAN", "SET",
+		"ZADD", "ZCOUNT", "ZRANGEBYSCORE", "ZREM", "ZSCAN", "ZSCORE",
+	}
+	// txCommands are issued by the Go implementation of the scripts used with
+	// WithNoScripting.
+	txCommands = []string{
+		"DEL", "EXEC", "GET", "HGETALL", "HSET", "INCRBY", "LPUSH", "LTRIM", "MULTI",
+		"SET", "UNWATCH", "WATCH", "ZADD", "ZRANGEBYSCORE", "ZREM",
+	}
+)
+
+// RequiredCommands returns the sorted set of Redis commands the lock system
+// issues with its configuration, in the notation of Redis ACLs, e.g. to
+// review the ACL of its Redis user. Commands run by the scripts are included,
+// as Redis checks them against the ACL too.
+func (r *RedisLS) RequiredCommands() []string {
+	commands := append([]string{}, goCommands...)
+	if r.lua.releaseHistorySize > 0 {
+		commands = append(commands, releaseHistoryCommands...)
+	}
+	if r.noScripting {
+		commands = append(commands, txCommands...)
+	} else {
+		commands = append(commands, "EVAL", "EVALSHA")
+		commands = append(commands, luaCommands...)
+		if r.scriptCacheCheck > 0 {
+			commands = append(commands, "SCRIPT|EXISTS", "SCRIPT|LOAD")
+		}
+		if r.txRelease {
+			commands = append(commands, txCommands...)
+		}
+	}
+
+	sort.Strings(commands)
+	unique := commands[:0]
+	for i, command := range commands {
+		if i == 0 || command != commands[i-1] {
+			unique = append(unique, command)
+		}
+	}
+	return unique
+}
+
+// CheckPermissions runs every command returned by RequiredCommands once
+// against a probe key under the prefix and returns an error wrapping
+// ErrCommandsDenied that lists the commands Redis rejected with NOPERM, e.g.
+// to validate the ACL at startup. Redis checks the ACL before running a
+// command, so the probes don't need valid data and their other errors are
+// ignored. Permitted writes to the probe key are undone at the end.
+func (r *RedisLS) CheckPermissions(ctx context.Context) error {
+	conn := r.conn(ctx)
+	defer r.conns.release(conn)
+
+	key := r.prefix + "permissions-probe"
+
+	var denied []string
+	probe := func(command string, args ...interface{}) bool {
+		name := strings.SplitN(command, "|", 2)
+		if len(name) == 2 {
+			args = append([]interface{}{name[1]}, args...)
+		}
+		_, err := conn.Do(name[0], args...)
+		if redisErr, ok := err.(redis.Error); ok && strings.HasPrefix(string(redisErr), "NOPERM") {
+			denied = append(denied, command)
+			return false
+		}
+		return true
+	}
+
+	const sha = "0000000000000000000000000000000000000000"
+
+	for _, command := range r.RequiredCommands() {
+		switch command {
+		case "EVAL":
+			probe(command, "return 0", 0)
+		case "EVALSHA":
+			probe(command, sha, 0)
+		case "SCRIPT|EXISTS":
+			probe(command, sha)
+		case "SCRIPT|LOAD":
+			probe(command, "return 0")
+		case "SCAN":
+			probe(command, 0, "MATCH", key, "COUNT", 1)
+		case "ZSCAN":
+			probe(command, key, 0)
+		case "HDEL", "HGET", "HMGET":
+			probe(command, key, "f")
+		case "HSET":
+			probe(command, key, "f", "v")
+		case "HINCRBY":
+			probe(command, key, "f", 0)
+		case "INCRBY":
+			probe(command, key, 0)
+		case "LPUSH":
+			probe(command, key, "v")
+		case "LRANGE", "LTRIM":
+			probe(command, key, 0, 0)
+		case "SET":
+			probe(command, key, "v")
+		case "ZADD":
+			probe(command, key, 0, "m")
+		case "ZCOUNT", "ZRANGEBYSCORE":
+			probe(command, key, 0, 0)
+		case "ZREM", "ZSCORE":
+			probe(command, key, "m")
+		case "EXEC", "UNWATCH":
+			// Outside of MULTI and WATCH these are no-ops or error replies.
+			probe(command)
+		case "MULTI":
+			if probe(command) {
+				if _, err := conn.Do("DISCARD"); err != nil {
+					conn.Do("EXEC")
+				}
+			}
+		default:
+			probe(command, key)
+		}
+	}
+
+	if r.noScripting {
+		// WATCH is probed after UNWATCH.
+		conn.Do("UNWATCH")
+	}
+	conn.Do("DEL", key)
+
+	if len(denied) > 0 {
+		return fmt.Errorf("%w: %s", ErrCommandsDenied, strings.Join(denied, ", "))
+	}
+	return nil
+}
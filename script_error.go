@@ -0,0 +1,135 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ErrInconsistentHeldState is wrapped by the error returned when a script
+// finds a node whose held flag contradicts the operation, e.g. holding a node
+// that is already held. It means an invariant of the lock tree is violated;
+// Check describes the state in more detail.
+var ErrInconsistentHeldState = errors.New("webdavredisls: inconsistent held state")
+
+// ErrTokenCollision is wrapped by the error returned when no unused token
+// could be taken from the token counter. Every token is checked against the
+// existing locks, so a lost counter, e.g. evicted by an allkeys eviction
+// policy, only costs skipping the tokens in use; this error means that the
+// token keys themselves are inconsistent. Redis should use a noeviction or
+// volatile eviction policy, as the lock system sets no TTLs.
+var ErrTokenCollision = errors.New("webdavredisls: token collision")
+
+// tokenCollisionMessage is the message of the Lua error raised by next_token.
+const tokenCollisionMessage = "token collision"
+
+// ErrScriptBusy is wrapped by the error returned when Redis is busy running a
+// script that exceeded lua-time-limit (BUSY) or when the script was killed with
+// SCRIPT KILL. The operation did not run, or was rolled back to the point where
+// it was killed; WithScriptBudget bounds the work a single script does.
+var ErrScriptBusy = errors.New("webdavredisls: redis busy running a script")
+
+// scriptKilledMessage is part of the error reply of a script that was killed
+// with SCRIPT KILL.
+const scriptKilledMessage = "Script killed by user"
+
+// inconsistentHeldStateMessage is the message of the Lua error raised by hold
+// and unhold.
+const inconsistentHeldStateMessage = "inconsistent held state"
+
+// missingLockMessage is the message of the Lua error raised by hold for a
+// node that is not locked.
+const missingLockMessage = "holding a missing lock"
+
+// ScriptError is returned when Redis fails a script with an error reply, such
+// as a Lua runtime error. Definitive results like webdav.ErrLocked and
+// connection-level errors are returned as they are.
+type ScriptError struct {
+	// Script is the name of the script, e.g. "create" or "confirm".
+	Script string
+	// Err is the error reply, or an error wrapping it such as
+	// ErrInconsistentHeldState, ErrScriptBusy or ErrRedisOutOfMemory.
+	Err error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("webdavredisls: script %s: %v", e.Script, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// scriptErrorCounts counts the failures of every script. It is shared with
+// the views returned by Scoped.
+type scriptErrorCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// ScriptErrors returns the number of script runs that failed with a
+// ScriptError since r was created, by script name, e.g. to export as a
+// metric.
+func (r *RedisLS) ScriptErrors() map[string]uint64 {
+	r.scriptErrors.mu.Lock()
+	defer r.scriptErrors.mu.Unlock()
+
+	counts := make(map[string]uint64, len(r.scriptErrors.counts))
+	for name, n := range r.scriptErrors.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// scriptError turns an error reply of script into a *ScriptError and counts
+// it. Other errors are returned unchanged.
+func (r *RedisLS) scriptError(script *redis.Script, err error) error {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return err
+	}
+
+	name := r.scripts.name(script)
+
+	r.scriptErrors.mu.Lock()
+	if r.scriptErrors.counts == nil {
+		r.scriptErrors.counts = map[string]uint64{}
+	}
+	r.scriptErrors.counts[name]++
+	r.scriptErrors.mu.Unlock()
+
+	msg := string(redisErr)
+	switch {
+	case strings.Contains(msg, inconsistentHeldStateMessage):
+		err = fmt.Errorf("%w: %s", ErrInconsistentHeldState, redisErr)
+	case strings.Contains(msg, missingLockMessage):
+		err = fmt.Errorf("%w: %s", ErrCorruptState, redisErr)
+	case strings.Contains(msg, tokenCollisionMessage):
+		err = fmt.Errorf("%w: %s", ErrTokenCollision, redisErr)
+	case strings.HasPrefix(msg, "BUSY ") || strings.Contains(msg, scriptKilledMessage):
+		err = fmt.Errorf("%w: %s", ErrScriptBusy, redisErr)
+	default:
+		err = writeRejectedError(redisErr)
+	}
+
+	return &ScriptError{Script: name, Err: err}
+}
+
+// name returns the name of the field of s that holds script.
+func (s *scriptSet) name(script *redis.Script) string {
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Pointer() == reflect.ValueOf(script).Pointer() {
+			return v.Type().Field(i).Name
+		}
+	}
+	return "unknown"
+}
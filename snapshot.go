@@ -0,0 +1,121 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// snapshotLimit is the number of locks in each list of a Snapshot.
+const snapshotLimit = 10
+
+// snapshotScanBudget is the number of name keys Snapshot scans at most for
+// held and old locks, so that a debug endpoint can't block Redis for long.
+const snapshotScanBudget = 10000
+
+// Snapshot is a summary of the lock system for humans, e.g. served as JSON
+// from a debug endpoint by DebugHandler.
+type Snapshot struct {
+	// Time is the time the snapshot was taken at.
+	Time time.Time
+	// Stats are the counters returned by Stats, including the token counter.
+	Stats LockStats
+	// SoonestExpiring are the unheld locks that expire next, sorted by
+	// expiry.
+	SoonestExpiring []LockInfo
+	// Held are locks held by a Confirm call that has not been released yet,
+	// in no particular order.
+	Held []LockInfo
+	// Oldest are the locks with the earliest CreatedAt, sorted by it. It is
+	// empty unless WithCreationTimestamps is set.
+	Oldest []LockInfo
+	// Truncated is set if Held and Oldest come from a partial scan of the
+	// locks, as there were too many to scan them all.
+	Truncated bool
+}
+
+// Snapshot returns a summary of the lock system in a single script run: the
+// counters of Stats, the locks expiring soonest, held locks and the oldest
+// locks, with at most 10 locks in each list. Held and oldest locks are found
+// by scanning up to 10000 locks, so the snapshot is bounded in cost but may be
+// partial, see Snapshot.Truncated. It is meant for debugging rather than
+// monitoring, where Stats is much cheaper. Like GetLock it never writes to
+// Redis.
+func (r *RedisLS) Snapshot(now time.Time) (Snapshot, error) {
+	values, err := redis.Values(r.do(
+		r.scripts.snapshot,
+		r.prefix,
+		now.Unix(),
+		now.Add(statsExpiringSoonWindow).Unix(),
+		snapshotLimit,
+		snapshotScanBudget,
+	))
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(values) != 5 {
+		return Snapshot{}, fmt.Errorf("unexpected script reply length: %d", len(values))
+	}
+
+	counters, err := redis.Int64s(values[0], nil)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if len(counters) != 5 {
+		return Snapshot{}, fmt.Errorf("unexpected script reply length: %d", len(counters))
+	}
+
+	snap := Snapshot{
+		Time: now,
+		Stats: LockStats{
+			Locks:        counters[0],
+			Held:         counters[1],
+			ExpiringSoon: counters[2],
+			Collectable:  counters[3],
+			TokenCounter: counters[4],
+		},
+	}
+
+	for i, list := range []*[]LockInfo{&snap.SoonestExpiring, &snap.Held, &snap.Oldest} {
+		replies, err := redis.Values(values[1+i], nil)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		if *list, err = r.lockInfos(replies); err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	truncated, err := redis.Int(values[4], nil)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snap.Truncated = truncated == 1
+
+	return snap, nil
+}
+
+// DebugHandler returns an http.Handler that serves a Snapshot of ls as JSON,
+// e.g. mounted at /debug/webdavls. The snapshot includes tokens and owner XML,
+// so the handler must not be reachable by clients.
+func DebugHandler(ls *RedisLS) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		snap, err := ls.Snapshot(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(snap)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// statsExpiringSoonWindow is the window for LockStats.ExpiringSoon.
+const statsExpiringSoonWindow = time.Minute
+
+// statsMaxBackoff is how many intervals the stats exporter waits at most
+// after Stats failed repeatedly.
+const statsMaxBackoff = 32
+
+// LockStats are aggregate counters describing the lock system.
+type LockStats struct {
+	// Locks is the number of stored locks, including expired locks that
+	// have not been collected yet.
+	Locks int64
+	// Held is the number of locks held by a Confirm call that has not been
+	// released yet.
+	Held int64
+	// ExpiringSoon is the number of unheld locks expiring within the next
+	// minute.
+	ExpiringSoon int64
+	// Collectable is the number of expired locks waiting to be collected.
+	Collectable int64
+	// TokenCounter is the last token number handed out.
+	TokenCounter int64
+}
+
+// Stats returns aggregate counters for monitoring. It reads a few counters and
+// the expiry zset instead of scanning the keyspace, so it is much cheaper than
+// ListLocks. Like GetLock it never writes to Redis.
+func (r *RedisLS) Stats(now time.Time) (LockStats, error) {
+	values, err := redis.Int64s(r.do(
+		r.scripts.stats,
+		r.prefix,
+		now.Unix(),
+		now.Add(statsExpiringSoonWindow).Unix(),
+	))
+	if err != nil {
+		return LockStats{}, err
+	}
+	if len(values) != 5 {
+		return LockStats{}, fmt.Errorf("unexpected script reply length: %d", len(values))
+	}
+
+	return LockStats{
+		Locks:        values[0],
+		Held:         values[1],
+		ExpiringSoon: values[2],
+		Collectable:  values[3],
+		TokenCounter: values[4],
+	}, nil
+}
+
+// CountLocksUnder returns the number of locks at or below root, e.g. for
+// per-tenant quotas. It reads the refcount every node keeps, so unlike
+// ListLocksUnder it takes constant time. Like LockStats.Locks it includes
+// expired locks that have not been collected yet. Like GetLock it never writes
+// to Redis.
+func (r *RedisLS) CountLocksUnder(now time.Time, root string) (int, error) {
+	return redis.Int(r.do(r.scripts.countLocksUnder, r.prefix, r.cleanPath(root)))
+}
+
+// DeepestLock returns the root of the unexpired lock with the most path
+// segments and its depth, where "/" has depth 0 and "/a/b" depth 2, e.g. to
+// find pathological trees created by clients. Ties are broken by the smallest
+// root. If there are no locks, path is empty and depth is -1. Unlike Stats it
+// visits every key under the prefix, so it should be called sparingly; it
+// never writes to Redis.
+func (r *RedisLS) DeepestLock(now time.Time) (path string, depth int, err error) {
+	values, err := redis.Values(r.do(r.scripts.deepestLock, r.prefix, now.Unix()))
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := redis.Scan(values, &path, &depth); err != nil {
+		return "", 0, err
+	}
+	return path, depth, nil
+}
+
+// statsExporter is the goroutine started by WithStatsInterval.
+type statsExporter struct {
+	interval time.Duration
+	fn       func(LockStats)
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// run calls fn with the stats every interval until stop is closed. While
+// Stats fails the interval doubles, up to statsMaxBackoff intervals, so that
+// an unavailable Redis is not polled at full rate.
+func (e *statsExporter) run(r *RedisLS) {
+	defer close(e.done)
+
+	delay := e.interval
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-timer.C:
+		}
+
+		stats, err := r.Stats(time.Now())
+		if err != nil {
+			if delay < statsMaxBackoff*e.interval {
+				delay *= 2
+			}
+		} else {
+			delay = e.interval
+			e.fn(stats)
+		}
+
+		timer.Reset(delay)
+	}
+}
+
+// Close stops the stats exporter started with WithStatsInterval and waits for
+// it to exit. It does not close the pool. Close is safe to call more than
+// once and on views returned by Scoped, which share the exporter.
+func (r *RedisLS) Close() error {
+	if e := r.statsExporter; e != nil {
+		e.stopOnce.Do(func() { close(e.stop) })
+		<-e.done
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webdavredisls
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	webdav "github.com/koofr/go-webdav"
+)
+
+// ErrTokenExists is returned by CreateWithToken if the token is already used
+// by another lock.
+var ErrTokenExists = errors.New("webdavredisls: token already exists")
+
+// ErrInvalidToken is returned by CreateWithToken for a token that can't be
+// used, see CreateWithToken.
+var ErrInvalidToken = errors.New("webdavredisls: invalid token")
+
+// TokenCounter returns the last token number handed out, or 0 if no token
+// has been created yet. Tokens are the decimal form of these numbers. It is
+// meant for diagnostics and admin tooling.
+func (r *RedisLS) TokenCounter() (int64, error) {
+	ctx := r.context()
+	conn := r.conn(ctx)
+	defer r.conns.release(conn)
+
+	n, err := redis.Int64(doContext(ctx, conn, "GET", r.prefix+nextTokenKey))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// ReserveTokens advances the token counter by n and returns the first of the
+// n reserved token numbers. Create never hands out reserved numbers, so admin
+// tooling that bulk-imports locks can assign them without collisions. It is
+// not meant for the request path.
+func (r *RedisLS) ReserveTokens(n int) (first int64, err error) {
+	if n <= 0 {
+		return 0, errors.New("webdavredisls: number of reserved tokens must be positive")
+	}
+
+	ctx := r.context()
+	conn := r.conn(ctx)
+	defer r.conns.release(conn)
+
+	last, err := redis.Int64(doContext(ctx, conn, "INCRBY", r.prefix+nextTokenKey, n))
+	if err != nil {
+		return 0, err
+	}
+	return last - int64(n) + 1, nil
+}
+
+// CreateFenced is like Create, but also returns a fencing token for the lock:
+// the next number from a fence counter that is taken in the same script run
+// that creates the lock. Fences strictly increase across all locks created
+// with CreateFenced under the prefix, also by other instances, so a resource
+// guarded by the lock can reject writes that carry a lower fence than one it
+// has already seen, e.g. from a holder that was paused until its lock expired
+// and was taken by someone else.
+//
+// The fence counter is separate from the token counter, which restarts low if
+// it is lost, and Flush keeps it. Fences only go back if the counter key
+// itself is lost, e.g. evicted or deleted by hand, so it should live in a
+// Redis that does not evict keys.
+//
+// The token and the fence are separate values: compare fences, and treat the
+// token as opaque, as it is also rewritten by WithTokenURIScheme. The fence
+// stays the same when the lock is refreshed. Locks created otherwise have no
+// fence.
+func (r *RedisLS) CreateFenced(now time.Time, details webdav.LockDetails) (token string, fence int64, err error) {
+	if err := r.checkOwnerXML(details.OwnerXML); err != nil {
+		return "", 0, err
+	}
+	duration, err := r.lockDuration(details.Duration)
+	if err != nil {
+		return "", 0, err
+	}
+	root := r.cleanPath(details.Root)
+	if err := r.checkRootLock(root, details.ZeroDepth, false); err != nil {
+		return "", 0, err
+	}
+
+	values, err := redis.Values(r.do(
+		r.scripts.createFenced,
+		r.prefix,
+		now.Unix(),
+		root,
+		durationToSec(duration),
+		details.ZeroDepth,
+		r.inlineOwnerXML(details.OwnerXML),
+		r.expiryJitterSec(),
+		r.inlineCollect,
+	))
+	if err == nil {
+		_, err = redis.Scan(values, &token, &fence)
+	}
+
+	token, err = r.finishCreate(now, token, details.OwnerXML, r.conflict(root, err))
+	if errors.Is(err, webdav.ErrLocked) {
+		return "", 0, webdav.ErrLocked
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return r.tokenURI(token), fence, nil
+}
+
+// CreateWithToken is like Create, but the lock gets token instead of the next
+// number from the token counter, e.g. so that it matches the record of an
+// external coordinator. It returns ErrTokenExists if token is already used by
+// another lock.
+//
+// The token must not be empty, contain the key separator, spaces, control
+// characters or angle brackets, which would break the Lock-Token header, or
+// start with "ERR_" or the "fallback:" prefix of FallbackLS. A decimal token
+// must not be greater than the token counter, so that Create never hands it
+// out again; reserve such tokens with ReserveTokens first. Invalid tokens are
+// rejected with ErrInvalidToken.
+func (r *RedisLS) CreateWithToken(now time.Time, token string, details webdav.LockDetails) error {
+	token = r.storedToken(token)
+	if err := r.validateToken(token); err != nil {
+		return err
+	}
+	if err := r.checkOwnerXML(details.OwnerXML); err != nil {
+		return err
+	}
+	duration, err := r.lockDuration(details.Duration)
+	if err != nil {
+		return err
+	}
+	root := r.cleanPath(details.Root)
+	if err := r.checkRootLock(root, details.ZeroDepth, false); err != nil {
+		return err
+	}
+
+	_, err = redis.String(r.do(
+		r.scripts.createWithToken,
+		r.prefix,
+		now.Unix(),
+		root,
+		durationToSec(duration),
+		details.ZeroDepth,
+		r.inlineOwnerXML(details.OwnerXML),
+		r.expiryJitterSec(),
+		r.inlineCollect,
+		token,
+	))
+
+	_, err = r.finishCreate(now, token, details.OwnerXML, r.conflict(root, err))
+	return err
+}
+
+// tokenURI returns the token of a lock as it is handed out, with the scheme
+// set with WithTokenURIScheme.
+func (r *RedisLS) tokenURI(token string) string {
+	if r.tokenURIScheme == "" || token == "" {
+		return token
+	}
+	return r.tokenURIScheme + ":" + token
+}
+
+// storedToken returns the token of a lock as it is stored, without the scheme
+// set with WithTokenURIScheme. Bare tokens are returned unchanged. The scheme
+// alone is not stripped, as the empty token would match the ancestor nodes.
+func (r *RedisLS) storedToken(token string) string {
+	if r.tokenURIScheme == "" {
+		return token
+	}
+	if stored := strings.TrimPrefix(token, r.tokenURIScheme+":"); stored != "" {
+		return stored
+	}
+	return token
+}
+
+// validateToken checks a token passed to CreateWithToken.
+func (r *RedisLS) validateToken(token string) error {
+	if token == "" ||
+		strings.Contains(token, r.keySeparator) ||
+		strings.HasPrefix(token, "ERR_") ||
+		strings.HasPrefix(token, fallbackTokenPrefix) {
+		return ErrInvalidToken
+	}
+	for _, c := range token {
+		if c <= ' ' || c == 0x7f || c == '<' || c == '>' {
+			return ErrInvalidToken
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Koofr. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package webdavredislstest provides helpers for testing code that uses
+// webdavredisls without a Redis server. The lock system runs against an
+// in-process miniredis server, which supports all the commands and Lua
+// features used by the scripts.
+package webdavredislstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	webdavredisls "github.com/koofr/go-webdav-redis-ls"
+)
+
+// Prefix is the key prefix used by NewRedisLS.
+const Prefix = "webdavredislstest:"
+
+// NewPool returns a redis.Pool connected to a new miniredis server. The
+// server is closed when the test finishes.
+func NewPool(tb testing.TB) (*redis.Pool, *miniredis.Miniredis) {
+	server := miniredis.RunT(tb)
+
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	tb.Cleanup(func() {
+		pool.Close()
+	})
+
+	return pool, server
+}
+
+// NewRedisLS returns a RedisLS backed by a new miniredis server, along with
+// the server so that tests can inspect keys or fast-forward key TTLs. The
+// server is closed when the test finishes.
+func NewRedisLS(tb testing.TB, opts ...webdavredisls.Option) (*webdavredisls.RedisLS, *miniredis.Miniredis) {
+	pool, server := NewPool(tb)
+
+	return webdavredisls.NewRedisLS(pool, Prefix, opts...), server
+}
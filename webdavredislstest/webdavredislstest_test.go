@@ -0,0 +1,62 @@
+package webdavredislstest
+
+import (
+	"testing"
+	"time"
+
+	webdav "github.com/koofr/go-webdav"
+)
+
+func TestNewRedisLS(t *testing.T) {
+	now := time.Unix(0, 0)
+	r, server := NewRedisLS(t)
+
+	token, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a/b",
+		Duration: 10 * time.Second,
+		OwnerXML: "<owner />",
+	})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !server.Exists(Prefix + "t:" + token) {
+		t.Fatalf("Create: token key does not exist")
+	}
+
+	if _, err := r.Create(now, webdav.LockDetails{
+		Root:     "/a",
+		Duration: 10 * time.Second,
+	}); err != webdav.ErrLocked {
+		t.Fatalf("Create (conflict): got %v, want webdav.ErrLocked", err)
+	}
+
+	release, err := r.Confirm(now, "/a/b", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm: %v", err)
+	}
+	release()
+
+	details, err := r.Refresh(now, token, 20*time.Second)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if details.Duration != 20*time.Second {
+		t.Fatalf("Refresh: got duration %v, want 20s", details.Duration)
+	}
+
+	locks, err := r.ListLocks(now)
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Token != token {
+		t.Fatalf("ListLocks: got %v, want the lock with token %q", locks, token)
+	}
+
+	// Expired locks are collected by the next operation.
+	if err := r.Unlock(now.Add(20*time.Second), token); err != webdav.ErrNoSuchLock {
+		t.Fatalf("Unlock (expired): got %v, want webdav.ErrNoSuchLock", err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != Prefix+"nt" {
+		t.Fatalf("Unlock (expired): got keys %q, want only the token counter", keys)
+	}
+}